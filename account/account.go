@@ -0,0 +1,64 @@
+package account
+
+import (
+	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/tctl"
+)
+
+// Manager creates and deletes teleport users. The roles of a new user are
+// set on its signup token afterwards.
+type Manager interface {
+	// AddUser creates a signup token for name, out is what to show the
+	// operator about it
+	AddUser(name string) (out, token string, err error)
+	DeleteUser(name string) error
+}
+
+var manager Manager = Tctl{}
+
+// Init calls the auth server API when the config has an auth server and
+// an identity, and runs tctl otherwise.
+func Init(conf config.Config) error {
+	opts, err := tctl.NewOptions(conf.Teleport)
+	if err != nil {
+		return err
+	}
+	if conf.Teleport.AuthServer == "" || conf.Teleport.Identity == "" {
+		manager = Tctl{Options: opts}
+		return nil
+	}
+
+	api, err := NewAPI(conf.Teleport.AuthServer, conf.Teleport.Identity, conf.ProxyHost, opts.Timeout)
+	if err != nil {
+		return err
+	}
+	manager = api
+	return nil
+}
+
+func Set(m Manager) {
+	manager = m
+}
+
+func AddUser(name string) (string, string, error) {
+	return manager.AddUser(name)
+}
+
+func DeleteUser(name string) error {
+	return manager.DeleteUser(name)
+}
+
+// Tctl runs the tctl binary, the fallback when tero has no identity to
+// call the auth server with.
+type Tctl struct {
+	Options tctl.Options
+}
+
+func (t Tctl) AddUser(name string) (string, string, error) {
+	return tctl.CmdAddUser(t.Options, name, "")
+}
+
+func (t Tctl) DeleteUser(name string) error {
+	_, err := tctl.CmdDeleteUser(t.Options, name)
+	return err
+}
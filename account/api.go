@@ -0,0 +1,162 @@
+package account
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// apiDomain is the name the auth server has in its TLS certificate,
+// whatever address it is reached at.
+const apiDomain = "teleport.cluster.local"
+
+// SignupTTL is how long a signup token of the API is valid, as with tctl.
+const SignupTTL = time.Hour
+
+// API calls the HTTP API of the teleport auth server with the TLS
+// certificate of an identity file.
+type API struct {
+	// URL of the auth server. Ex: https://auth.example.com:3025
+	URL       string
+	Client    *http.Client
+	ProxyHost string
+}
+
+// NewAPI reads the key, the TLS certificate and the CA certificates of the
+// identity file, the ssh certificate in it is skipped. Every call gives up
+// after timeout.
+func NewAPI(authServer, identityFile, proxyHost string, timeout time.Duration) (*API, error) {
+	raw, err := ioutil.ReadFile(identityFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyPEM, certPEM []byte
+	pool := x509.NewCertPool()
+	for {
+		var block *pem.Block
+		block, raw = pem.Decode(raw)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE" && certPEM == nil:
+			certPEM = pem.EncodeToMemory(block)
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid CA certificate in %s: %s", identityFile, err)
+			}
+			pool.AddCert(cert)
+		case block.Type == "RSA PRIVATE KEY" || block.Type == "PRIVATE KEY" || block.Type == "EC PRIVATE KEY":
+			keyPEM = pem.EncodeToMemory(block)
+		}
+	}
+	if keyPEM == nil || certPEM == nil {
+		return nil, fmt.Errorf("Identity file %s has no TLS certificate, make it with `tctl auth sign --format=file`", identityFile)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid identity file %s: %s", identityFile, err)
+	}
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   apiDomain,
+	}}
+	return &API{
+		URL:       "https://" + authServer,
+		Client:    &http.Client{Transport: transport, Timeout: timeout},
+		ProxyHost: proxyHost,
+	}, nil
+}
+
+func (api *API) AddUser(name string) (string, string, error) {
+	body := map[string]interface{}{
+		"user": map[string]interface{}{"name": name, "allowed_logins": []string{}},
+		"ttl":  SignupTTL,
+	}
+	var token string
+	if err := api.call(http.MethodPost, "/v2/signuptokens", body, &token); err != nil {
+		return "", "", fmt.Errorf("Failed to add user `%s`: %s", name, err)
+	}
+	if token == "" {
+		return "", "", fmt.Errorf("Failed to add user `%s`: the auth server returned no signup token", name)
+	}
+
+	out := fmt.Sprintf("Signup token has been created and is valid for %d hours. Share this URL with the user:\nhttps://%s/web/newuser/%s\n", int(SignupTTL.Hours()), api.ProxyHost, token)
+	return out, token, nil
+}
+
+func (api *API) DeleteUser(name string) error {
+	if err := api.call(http.MethodDelete, "/v2/users/"+url.PathEscape(name), nil, nil); err != nil {
+		return fmt.Errorf("Failed to delete user `%s`: %s", name, err)
+	}
+	return nil
+}
+
+// call sends body as json and decodes the answer into out, the error of
+// the auth server is returned as it is.
+func (api *API) call(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequest(method, api.URL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := api.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(apiError(resp.Status, raw))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// apiError takes the message out of a teleport error, ex:
+// {"error": {"message": "user bob not found"}}
+func apiError(status string, raw []byte) string {
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(raw, &e) == nil {
+		if e.Error.Message != "" {
+			return e.Error.Message
+		}
+		if e.Message != "" {
+			return e.Message
+		}
+	}
+	return status
+}
@@ -0,0 +1,80 @@
+package account_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bentol/tero/account"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPI_shouldAddAndDeleteUsers(t *testing.T) {
+	var added map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v2/signuptokens":
+			json.NewDecoder(r.Body).Decode(&added)
+			w.Write([]byte(`"0123456789abcdef0123456789abcdef"`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/v2/users/thor":
+			w.Write([]byte(`{"message":"ok"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"message":"user loki is not found"}}`))
+		}
+	}))
+	defer ts.Close()
+	api := &account.API{URL: ts.URL, Client: ts.Client(), ProxyHost: "proxy.example.com:3080"}
+
+	out, token, err := api.AddUser("thor")
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789abcdef0123456789abcdef", token)
+	assert.Contains(t, out, "https://proxy.example.com:3080/web/newuser/0123456789abcdef0123456789abcdef")
+	assert.Equal(t, "thor", added["user"].(map[string]interface{})["name"])
+
+	assert.Nil(t, api.DeleteUser("thor"))
+	err = api.DeleteUser("loki")
+	assert.Equal(t, "Failed to delete user `loki`: user loki is not found", err.Error())
+}
+
+func TestNewAPI_shouldReadIdentityFile(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tero"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	rawCert, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	rawKey, _ := x509.MarshalECPrivateKey(key)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rawCert})
+
+	dir, _ := ioutil.TempDir("", "tero-identity")
+	defer os.RemoveAll(dir)
+	identity := filepath.Join(dir, "identity")
+	content := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey})) +
+		"ecdsa-sha2-nistp256-cert-v01@openssh.com AAAA tero\n" +
+		string(certPEM) + string(certPEM)
+	ioutil.WriteFile(identity, []byte(content), 0600)
+
+	api, err := account.NewAPI("auth.example.com:3025", identity, "proxy.example.com:3080", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://auth.example.com:3025", api.URL)
+	assert.Equal(t, time.Minute, api.Client.Timeout)
+
+	ioutil.WriteFile(identity, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0600)
+	_, err = account.NewAPI("auth.example.com:3025", identity, "", time.Minute)
+	assert.Contains(t, err.Error(), "has no TLS certificate")
+}
@@ -0,0 +1,118 @@
+package account_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bentol/tero/account"
+	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/tctl"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTctl answers like tctl, `users add broken` fails, `users add
+// silent` prints no signup token and `users add slow` hangs. It writes its
+// arguments to args.
+const fakeTctl = `#!/bin/sh
+echo "$@" > "$(dirname "$0")/args"
+while [ "${1#--}" != "$1" ]; do
+	shift 2
+done
+case "$1 $2 $3" in
+"users add slow")
+	exec sleep 5;;
+"users add broken"|"users rm broken")
+	echo "error: auth server unreachable" >&2
+	exit 1;;
+"users add silent")
+	echo "Signup token has been created";;
+"users add "*)
+	echo "Signup token has been created and is valid for 1 hours. Share this URL with the user:"
+	echo "https://proxy.example.com:3080/web/newuser/0123456789abcdef0123456789abcdef";;
+"users rm "*)
+	echo "User $3 has been deleted";;
+esac
+`
+
+func setupTctl(t *testing.T) (account.Tctl, string) {
+	dir, err := ioutil.TempDir("", "tero-tctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "tctl")
+	if err := ioutil.WriteFile(path, []byte(fakeTctl), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return account.Tctl{Options: tctl.Options{Path: path}}, dir
+}
+
+func TestTctl_shouldAddUser(t *testing.T) {
+	fake, dir := setupTctl(t)
+
+	out, token, err := fake.AddUser("thor")
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789abcdef0123456789abcdef", token)
+	assert.Contains(t, out, "Share this URL with the user")
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	assert.Equal(t, "users add thor\n", string(args))
+}
+
+func TestTctl_shouldReportFailures(t *testing.T) {
+	fake, _ := setupTctl(t)
+
+	_, _, err := fake.AddUser("broken")
+	assert.Equal(t, "tctl users add failed: exit status 1: error: auth server unreachable", err.Error())
+	_, _, err = fake.AddUser("silent")
+	assert.Equal(t, "tctl users add printed no signup token: Signup token has been created", err.Error())
+
+	assert.Nil(t, fake.DeleteUser("thor"))
+	err = fake.DeleteUser("broken")
+	assert.Equal(t, "tctl users rm failed: exit status 1: error: auth server unreachable", err.Error())
+
+	fake.Options.Path = "/nonexistent/tctl"
+	_, _, err = fake.AddUser("thor")
+	assert.Contains(t, err.Error(), "no such file or directory")
+}
+
+func TestTctl_shouldPassTheClusterOptions(t *testing.T) {
+	fake, dir := setupTctl(t)
+	fake.Options.Config = "/etc/teleport.yaml"
+	fake.Options.AuthServer = "auth.example.com:3025"
+	fake.Options.Identity = "/etc/tero/identity"
+
+	_, _, err := fake.AddUser("thor")
+	assert.Nil(t, err)
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	assert.Equal(t, "--config /etc/teleport.yaml --auth-server auth.example.com:3025 --identity /etc/tero/identity users add thor\n", string(args))
+}
+
+func TestTctl_shouldTimeOut(t *testing.T) {
+	fake, _ := setupTctl(t)
+	fake.Options.AuthServer = "auth.example.com:3025"
+	fake.Options.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, _, err := fake.AddUser("slow")
+	assert.Equal(t, "tctl users add timed out after 100ms, check the auth server auth.example.com:3025 is reachable", err.Error())
+	assert.True(t, time.Since(start) < 2*time.Second)
+}
+
+func TestNewOptions_shouldReadTheTeleportConfig(t *testing.T) {
+	opts, err := tctl.NewOptions(config.TeleportConfig{AuthServer: "auth.example.com:3025", TctlPath: "/opt/tctl", Timeout: "1m"})
+	assert.Nil(t, err)
+	assert.Equal(t, tctl.Options{Path: "/opt/tctl", AuthServer: "auth.example.com:3025", Timeout: time.Minute}, opts)
+
+	opts, err = tctl.NewOptions(config.TeleportConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, tctl.DefaultTimeout, opts.Timeout)
+
+	_, err = tctl.NewOptions(config.TeleportConfig{Timeout: "soon"})
+	assert.Equal(t, "Invalid teleport timeout `soon`, use a duration. Ex: 1m", err.Error())
+	assert.Equal(t, err, account.Init(config.Config{Teleport: config.TeleportConfig{Timeout: "soon"}}))
+}
@@ -1,22 +1,42 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/user"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/bentol/tero/account"
+	"github.com/bentol/tero/audit"
+	"github.com/bentol/tero/auth"
 	"github.com/bentol/tero/backend"
 	"github.com/bentol/tero/client"
 	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/output"
+	"github.com/bentol/tero/review"
+	"github.com/bentol/tero/server"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
-const configfile = "/etc/tero.toml"
+const (
+	configfile        = "/etc/tero.toml"
+	defaultPolicyFile = "/etc/tero-policy.toml"
+)
 
 var (
 	app = kingpin.New("Tele", "Roles management for teleport.")
 
+	format = kingpin.Flag("format", "Output format").Default("table").Enum(output.Names()...)
+	force  = kingpin.Flag("force", "Write to the dir storage without a pid_file, only once the auth server is stopped").Bool()
+
 	users = kingpin.Command("users", "Manage users")
 
 	addUser        = users.Command("add", "Add user")
@@ -24,6 +44,11 @@ var (
 	addUserRoles   = addUser.Flag("roles", "The name roles of this user allowed to use. Ex: intern,dba").Required().String()
 	addUserEmailTo = addUser.Flag("email", "Send registration token to, default: <username>@tokopedia.com").String()
 
+	importUsers         = users.Command("import", "Add the users of a file, every row is checked first")
+	importUsersFile     = importUsers.Flag("file", "CSV file with the columns name,roles,email or YAML file with a users list. Ex: hires.csv").Short('f').Required().ExistingFile()
+	importUsersParallel = importUsers.Flag("parallel", "How many users are added at a time").Default("4").Int()
+	importUsersDryRun   = importUsers.Flag("dry-run", "Only check the rows").Bool()
+
 	listUsers = users.Command("ls", "List user")
 
 	lockUser     = users.Command("lock", "Lock user")
@@ -35,6 +60,13 @@ var (
 	deleteUser     = users.Command("delete", "Delete user")
 	deleteUserName = deleteUser.Arg("name", "User name").Required().String()
 
+	offboardUser          = users.Command("offboard", "Lock users that left, detach their roles and revoke their signup token")
+	offboardUserName      = offboardUser.Arg("name", "User name").String()
+	offboardUserFile      = offboardUser.Flag("file", "File with a user name per line, to offboard many users").Short('f').ExistingFile()
+	offboardUserReason    = offboardUser.Flag("reason", "Why the users are offboarded. Ex: left the company").Required().String()
+	offboardUserRequester = offboardUser.Flag("requester", "Mail the summary to this user or address").String()
+	offboardUserDelete    = offboardUser.Flag("delete-after", "Delete the accounts with `tero reap` after this grace period. Ex: 720h").Duration()
+
 	resetUser        = users.Command("reset", "Reset user (delete it, then send registration link again)")
 	resetUserName    = resetUser.Arg("name", "User name").Required().String()
 	resetUserEmailTo = resetUser.Flag("email", "Send registration token to, default: <username>@tokopedia.com").String()
@@ -42,41 +74,139 @@ var (
 	showUser     = users.Command("show", "Show user info")
 	showUserName = showUser.Arg("name", "User name").Required().String()
 
+	explainUser     = users.Command("explain", "Show the effective access of a user")
+	explainUserName = explainUser.Arg("name", "User name").Required().String()
+
 	roles = kingpin.Command("roles", "Manage roles")
 
 	showRole     = roles.Command("show", "Show role info")
 	showRoleName = showRole.Arg("name", "Role name").Required().String()
 
-	addRole     = roles.Command("add", "Add role")
-	addRoleName = addRole.Arg("name", "Role name").Required().String()
-	rolesUsers  = addRole.Flag("logins", "The name of user this roles allowed to use. Ex: root,ubuntu").Required().String()
-	rolesNodes  = addRole.Flag("nodes", "Node pattern this roles can login to. Ex: env:staging,app:postgres").Required().String()
+	addRole      = roles.Command("add", "Add role")
+	addRoleName  = addRole.Arg("name", "Role name").Required().String()
+	rolesUsers   = addRole.Flag("logins", "The name of user this roles allowed to use. Ex: root,ubuntu").Required().String()
+	rolesNodes   = addRole.Flag("nodes", "Node pattern this roles can login to. Ex: env:staging,app:postgres").Required().String()
+	addRoleFlags = roleFlags(addRole)
 
-	updateRole       = roles.Command("update", "Update role")
+	updateRole       = roles.Command("update", "Update role, only the given flags are changed")
 	updateRoleName   = updateRole.Arg("name", "Role name").Required().String()
-	updateRolesUsers = updateRole.Flag("logins", "The name of user this roles allowed to use. Ex: root,ubuntu").Required().String()
-	updateRolesNodes = updateRole.Flag("nodes", "Node pattern this roles can login to. Ex: env:staging,app:postgres").Required().String()
+	updateRolesUsers = updateRole.Flag("logins", "The name of user this roles allowed to use. Ex: root,ubuntu").String()
+	updateRolesNodes = updateRole.Flag("nodes", "Node pattern this roles can login to. Ex: env:staging,app:postgres").String()
+	updateRoleFlags  = roleFlags(updateRole)
 
-	deleteRole      = roles.Command("delete", "Delete role")
-	deletedRoleName = deleteRole.Arg("role", "Role to be deleted").Required().String()
+	deleteRole         = roles.Command("delete", "Delete role")
+	deletedRoleName    = deleteRole.Arg("role", "Role to be deleted").Required().String()
+	deleteRoleCascade  = deleteRole.Flag("cascade", "Detach the role from the users holding it first").Bool()
+	deleteRoleReassign = deleteRole.Flag("reassign", "Move the users holding the role to this role. Ex: developer").String()
 
 	attachRole      = kingpin.Command("attach", "Attach role to user(s)")
 	attachRoleName  = attachRole.Arg("role", "Role name to be attached").Required().String()
 	attachRoleUsers = attachRole.Flag("users", "User to be attached. If more than user use comma separated. Ex: adi,budi").Required().String()
+	attachRoleFor   = attachRole.Flag("for", "Detach the role again after this long. Ex: 4h").Duration()
+	attachRoleUntil = attachRole.Flag("until", "Detach the role again at this time. Ex: 2020-01-02T15:04:05+07:00").String()
 
 	detachRole       = kingpin.Command("detach", "Detach role from user(s)")
 	dettachRoleName  = detachRole.Arg("role", "Role name to be detached").Required().String()
 	dettachRoleUsers = detachRole.Flag("users", "User to be detached. If more than user use comma separated. Ex: adi,budi").Required().String()
 
 	listRole = roles.Command("ls", "List all role")
+
+	requestAccess       = kingpin.Command("request", "Request a role for a limited time")
+	requestAccessRole   = requestAccess.Arg("role", "Role name to be requested").Required().String()
+	requestAccessReason = requestAccess.Flag("reason", "Why the role is needed. Ex: INC-123").Required().String()
+	requestAccessFor    = requestAccess.Flag("for", "How long the role is needed. Ex: 2h").Required().Duration()
+
+	requests = kingpin.Command("requests", "Manage access requests")
+
+	listRequests    = requests.Command("ls", "List pending access requests")
+	listRequestsAll = listRequests.Flag("all", "Also list approved and denied requests").Bool()
+
+	approveRequest   = requests.Command("approve", "Approve access request, the role is attached until the request expires")
+	approveRequestID = approveRequest.Arg("id", "Request id").Required().String()
+
+	denyRequest       = requests.Command("deny", "Deny access request")
+	denyRequestID     = denyRequest.Arg("id", "Request id").Required().String()
+	denyRequestReason = denyRequest.Flag("reason", "Why the request is denied").String()
+
+	serve         = kingpin.Command("serve", "Serve the JSON REST API")
+	serveListen   = serve.Flag("listen", "Address to listen on").Default(":8080").String()
+	serveTLSCert  = serve.Flag("tls-cert", "Serve HTTPS with this certificate file").ExistingFile()
+	serveTLSKey   = serve.Flag("tls-key", "Private key of --tls-cert").ExistingFile()
+	serveClientCA = serve.Flag("client-ca", "Accept client certificates signed by this CA as operator identity").ExistingFile()
+
+	invites             = kingpin.Command("invites", "Manage the invites of users that did not sign up yet")
+	listInvites         = invites.Command("ls", "List invites")
+	listInvitesUser     = listInvites.Flag("user", "Only invites of users matching this glob. Ex: intern-*").String()
+	listInvitesState    = listInvites.Flag("state", "Only pending or expired invites").Enum("pending", "expired")
+	revokeInvite        = invites.Command("revoke", "Revoke the invite of a user")
+	revokeInviteUser    = revokeInvite.Arg("user", "User name").Required().String()
+	resendInvite        = invites.Command("resend", "Replace the invite of a user with a fresh one and mail it again")
+	resendInviteUser    = resendInvite.Arg("user", "User name").Required().String()
+	resendInviteEmailTo = resendInvite.Flag("email", "Send registration token to, default: <username>@tokopedia.com").String()
+
+	reapGrants      = kingpin.Command("reap", "Detach roles whose time-boxed grant expired and delete offboarded users after their grace period")
+	reapGrantsEvery = reapGrants.Flag("every", "Keep running and reap at this interval. Ex: 1m").Duration()
+
+	access            = kingpin.Command("access", "Query who can access nodes")
+	checkAccess       = access.Command("check", "List the roles and users that can login to nodes with the given labels")
+	checkAccessLabels = checkAccess.Flag("labels", "Labels of the nodes. Ex: env:production,app:postgres").Required().String()
+	checkAccessLogin  = checkAccess.Flag("login", "Only this login. Ex: root").String()
+
+	reviews           = kingpin.Command("review", "Review the roles of users")
+	startReview       = reviews.Command("start", "Start a review of the roles a team owns")
+	startReviewOwner  = startReview.Flag("owner", "Team of the reviews config. Ex: sre").Required().String()
+	listReviews       = reviews.Command("ls", "List open reviews")
+	listReviewsAll    = listReviews.Flag("all", "Also list closed reviews").Bool()
+	showReview        = reviews.Command("show", "Show every role of a review")
+	showReviewID      = showReview.Arg("id", "Review id").Required().String()
+	keepReview        = reviews.Command("keep", "Keep the roles of a user")
+	keepReviewID      = keepReview.Arg("id", "Review id").Required().String()
+	keepReviewUser    = keepReview.Arg("user", "User name").Required().String()
+	keepReviewRole    = keepReview.Arg("role", "Role name, every role of the user when not given").String()
+	revokeReview      = reviews.Command("revoke", "Revoke the roles of a user when the review is closed")
+	revokeReviewID    = revokeReview.Arg("id", "Review id").Required().String()
+	revokeReviewUser  = revokeReview.Arg("user", "User name").Required().String()
+	revokeReviewRole  = revokeReview.Arg("role", "Role name, every role of the user when not given").String()
+	closeReview       = reviews.Command("close", "Detach the revoked roles and write the signed report")
+	closeReviewID     = closeReview.Arg("id", "Review id").Required().String()
+	closeReviewReport = closeReview.Flag("report", "Report file, default: review-<id>.json").String()
+	remindReview      = reviews.Command("remind", "Mail the reviewers with roles left to review")
+	remindReviewID    = remindReview.Arg("id", "Review id, every open review when not given").String()
+	verifyReview      = reviews.Command("verify", "Check the signature of a review report")
+	verifyReviewFile  = verifyReview.Flag("report", "Report file").Required().ExistingFile()
+	verifyReviewKey   = verifyReview.Flag("key", "Public key of the signing key").Required().ExistingFile()
+
+	auditCmd       = kingpin.Command("audit", "Query the audit log of changes made through tero")
+	listAudit      = auditCmd.Command("ls", "List audit events")
+	listAuditUser  = listAudit.Flag("user", "Only events made by or about this user").String()
+	listAuditSince = listAudit.Flag("since", "Only events since this long ago or this time. Ex: 7d, 12h, 2020-01-02T15:04:05+07:00").String()
+
+	planState     = kingpin.Command("plan", "Show the changes needed to reach the state file")
+	planStateFile = planState.Flag("file", "State file with roles, users and their roles. Ex: access.yaml").Short('f').Required().ExistingFile()
+
+	applyState     = kingpin.Command("apply", "Apply the changes needed to reach the state file")
+	applyStateFile = applyState.Flag("file", "State file with roles, users and their roles. Ex: access.yaml").Short('f').Required().ExistingFile()
+
+	fsck    = kingpin.Command("fsck", "Check every role, user and add user token record")
+	fsckFix = fsck.Flag("fix", "Repair the problems found, after confirmation").Bool()
 )
 
+func roleFlags(cmd *kingpin.CmdClause) *client.RoleFlags {
+	flags := &client.RoleFlags{}
+	cmd.Flag("deny-logins", "Logins this role is denied. Ex: root").StringVar(&flags.DenyLogins)
+	cmd.Flag("deny-nodes", "Node pattern this role is denied. Ex: env:production").StringVar(&flags.DenyNodes)
+	cmd.Flag("allow-rule", "Allowed resource rule as resources:verbs[:where], can be repeated. Ex: session:list,read").StringsVar(&flags.AllowRules)
+	cmd.Flag("deny-rule", "Denied resource rule as resources:verbs[:where], can be repeated. Ex: role:create,update,delete").StringsVar(&flags.DenyRules)
+	cmd.Flag("max-session-ttl", "Max session TTL. Ex: 8h").StringVar(&flags.MaxSessionTTL)
+	cmd.Flag("forward-agent", "Allow SSH agent forwarding").EnumVar(&flags.ForwardAgent, "true", "false")
+	cmd.Flag("port-forwarding", "Allow port forwarding").EnumVar(&flags.PortForwarding, "true", "false")
+	cmd.Flag("cert-format", "Certificate format").EnumVar(&flags.CertFormat, "standard", "oldssh")
+	return flags
+}
+
 func init() {
 	kingpin.Version("0.0.1")
 
-	selectedStorage := "dynamodb"
-	backend.InitBackend(selectedStorage)
-
 	// read config
 	_, err := os.Stat(configfile)
 	if err != nil {
@@ -91,117 +221,448 @@ func init() {
 	config.Set(conf)
 }
 
+// setup connects the storage, audit log and account manager, it runs
+// after the flags are parsed as --force changes how the storage writes.
+func setup() {
+	conf := config.Get()
+	conf.Dir.Force = *force
+	config.Set(conf)
+
+	selectedStorage := conf.Storage
+	if selectedStorage == "" {
+		selectedStorage = "dynamodb"
+	}
+	if err := backend.InitBackend(selectedStorage, conf); err != nil {
+		log.Fatal(err)
+	}
+	if err := audit.Init(conf.Audit); err != nil {
+		log.Fatal(err)
+	}
+	if err := account.Init(conf); err != nil {
+		log.Fatal(err)
+	}
+}
+
+var errAborted = errors.New("Aborted")
+
 func main() {
-	switch kingpin.Parse() {
+	command := kingpin.Parse()
+	setup()
+	op, err := authorize(command)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	// changes are recorded in the audit log as made by the operator of
+	// the policy, never by the bare unix user
+	result, err := run(command, op, op.Name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	err = output.Write(os.Stdout, *format, result)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// run executes command and returns what should be printed. Commands that
+// only change something report it with an output.Message.
+func run(command string, op *auth.Operator, operator string) (interface{}, error) {
+	switch command {
 	case "roles add":
-		out, err := client.NewRole(*addRoleName, *rolesUsers, *rolesNodes)
-		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			return
-		}
-		fmt.Printf(out + "\n")
+		return message(client.NewRoleWithFlags(operator, *addRoleName, *rolesUsers, *rolesNodes, *addRoleFlags))
 	case "roles update":
-		out, err := client.UpdateRole(*updateRoleName, *updateRolesUsers, *updateRolesNodes)
-		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			return
-		}
-		fmt.Printf(out + "\n")
+		return message(client.UpdateRoleWithFlags(operator, *updateRoleName, *updateRolesUsers, *updateRolesNodes, *updateRoleFlags))
 	case "roles ls":
-		out, err := client.ListRoles()
-		if err != nil {
-			panic("Failed to get roles")
-		}
-		fmt.Printf(out)
+		return client.ListRoles()
 	case "roles delete":
-		out, err := client.DeleteRole(*deletedRoleName)
+		flags := client.DeleteRoleFlags{Cascade: *deleteRoleCascade, Reassign: *deleteRoleReassign}
+		holders, err := client.RoleHolders(*deletedRoleName)
 		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			return
+			return nil, err
+		}
+		if len(holders) != 0 && (flags.Cascade || flags.Reassign != "") {
+			question := fmt.Sprintf("Role `%s` will be detached from %s.\nAre you sure ? ", *deletedRoleName, strings.Join(holders, ","))
+			if flags.Reassign != "" {
+				question = fmt.Sprintf("%s will be moved from role `%s` to `%s`.\nAre you sure ? ", strings.Join(holders, ","), *deletedRoleName, flags.Reassign)
+			}
+			if !confirm(question) {
+				return nil, errAborted
+			}
 		}
-		fmt.Printf(out + "\n")
+		return message(client.DeleteRoleWithFlags(operator, *deletedRoleName, flags))
 	case "attach":
-		out, err := client.AttachRole(*attachRoleName, *attachRoleUsers)
+		expires, err := client.ParseExpiry(*attachRoleFor, *attachRoleUntil, time.Now())
 		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			return
+			return nil, err
 		}
-		fmt.Printf(out + "\n")
-	case "detach":
-		out, err := client.DetachRole(*dettachRoleName, *dettachRoleUsers)
-		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			return
+		if expires.IsZero() {
+			return message(client.AttachRole(operator, *attachRoleName, *attachRoleUsers))
 		}
-		fmt.Printf(out + "\n")
-	case "roles show":
-		out, err := client.ShowRole(*showRoleName)
+		return message(client.AttachRoleUntil(operator, *attachRoleName, *attachRoleUsers, expires))
+	case "request":
+		return message(client.RequestAccess(operator, *requestAccessRole, *requestAccessReason, *requestAccessFor))
+	case "requests ls":
+		return client.ListRequests(*listRequestsAll)
+	case "requests approve":
+		return message(client.ApproveRequest(operator, *approveRequestID))
+	case "requests deny":
+		return message(client.DenyRequest(operator, *denyRequestID, *denyRequestReason))
+	case "serve":
+		policy, err := auth.LoadPolicy(policyFile())
 		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			return
+			return nil, err
 		}
-		fmt.Printf(out + "\n")
-	case "users show":
-		out, err := client.ShowUser(*showUserName)
-		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			return
+		srv := &http.Server{
+			Addr:         *serveListen,
+			Handler:      server.New(policy),
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 2 * time.Minute,
 		}
-		fmt.Printf(out + "\n")
-	case "users ls":
-		out, err := client.ListUser()
-		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			return
+		if *serveTLSCert == "" {
+			if *serveClientCA != "" {
+				return nil, errors.New("--client-ca needs --tls-cert and --tls-key")
+			}
+			log.Printf("Serving tero API on %s", *serveListen)
+			return nil, srv.ListenAndServe()
+		}
+
+		if *serveClientCA != "" {
+			pem, err := ioutil.ReadFile(*serveClientCA)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("No certificate found in %s", *serveClientCA)
+			}
+			srv.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+		}
+		log.Printf("Serving tero API on %s with TLS", *serveListen)
+		return nil, srv.ListenAndServeTLS(*serveTLSCert, *serveTLSKey)
+	case "users explain":
+		return client.ExplainUser(*explainUserName)
+	case "access check":
+		return client.CheckAccess(*checkAccessLabels, *checkAccessLogin)
+	case "review start":
+		return message(client.StartReview(operator, *startReviewOwner))
+	case "review ls":
+		return client.ListReviews(*listReviewsAll)
+	case "review show":
+		return client.ShowReview(*showReviewID)
+	case "review keep":
+		return message(client.DecideReview(operator, *keepReviewID, *keepReviewUser, *keepReviewRole, review.Keep))
+	case "review revoke":
+		return message(client.DecideReview(operator, *revokeReviewID, *revokeReviewUser, *revokeReviewRole, review.Revoke))
+	case "review close":
+		if err := client.AuthorizeReview(op, *closeReviewID); err != nil {
+			return nil, err
+		}
+		reportFile := *closeReviewReport
+		if reportFile == "" {
+			reportFile = "review-" + *closeReviewID + ".json"
 		}
-		fmt.Printf(out + "\n")
+		return message(client.CloseReview(operator, *closeReviewID, reportFile))
+	case "review remind":
+		return message(client.RemindReviewers(*remindReviewID))
+	case "review verify":
+		return client.VerifyReviewReport(*verifyReviewFile, *verifyReviewKey)
+	case "invites ls":
+		return client.ListInvites(*listInvitesUser, *listInvitesState, time.Now())
+	case "invites revoke":
+		return message(client.RevokeInvite(operator, *revokeInviteUser))
+	case "invites resend":
+		return message(client.ResendInvite(operator, *resendInviteUser, *resendInviteEmailTo))
+	case "audit ls":
+		return client.ListAuditEvents(*listAuditUser, *listAuditSince)
+	case "reap":
+		if *reapGrantsEvery <= 0 {
+			if _, err := client.ReapOffboardings(operator); err != nil {
+				return nil, err
+			}
+			return client.ReapGrants(operator)
+		}
+		for {
+			// a failed round is logged and tried again at the next tick
+			if _, err := client.ReapOffboardings(operator); err != nil {
+				log.Printf("Error: %s", err.Error())
+			}
+			if _, err := client.ReapGrants(operator); err != nil {
+				log.Printf("Error: %s", err.Error())
+			}
+			time.Sleep(*reapGrantsEvery)
+		}
+	case "detach":
+		return message(client.DetachRole(operator, *dettachRoleName, *dettachRoleUsers))
+	case "roles show":
+		return client.ShowRole(*showRoleName)
+	case "users show":
+		return client.ShowUser(*showUserName)
+	case "users ls":
+		return client.ListUser()
 	case "users add":
-		out, err := client.AddUser(*addUserName, *addUserRoles, *addUserEmailTo)
+		return message(client.AddUser(operator, *addUserName, *addUserRoles, *addUserEmailTo))
+	case "users import":
+		rows, err := client.LoadImport(*importUsersFile)
 		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			return
+			return nil, err
 		}
-		fmt.Printf(out + "\n")
-	case "users lock":
-		out, err := client.LockUser(*lockUserName)
-		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			return
+		if err := client.AuthorizeImport(op, rows); err != nil {
+			return nil, err
 		}
-		fmt.Printf(out + "\n")
+		results, err := client.ImportUsers(operator, rows, *importUsersParallel, *importUsersDryRun)
+		if err != nil && results != nil {
+			// the rows go to stderr so the error is not lost in between
+			output.Write(os.Stderr, "table", results)
+		}
+		return results, err
+	case "users lock":
+		return message(client.LockUser(operator, *lockUserName))
 	case "users unlock":
-		out, err := client.UnlockUser(*unlockUserName)
+		return message(client.UnlockUser(operator, *unlockUserName))
+	case "users offboard":
+		names, err := offboardNames()
 		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			return
+			return nil, err
 		}
-		fmt.Printf(out + "\n")
+		if err := client.AuthorizeOffboarding(op, names); err != nil {
+			return nil, err
+		}
+		if !confirm(fmt.Sprintf("%s will be locked and lose every role.\nAre you sure ? ", strings.Join(names, ","))) {
+			return nil, errAborted
+		}
+		results, err := client.OffboardUsers(operator, names, *offboardUserReason, *offboardUserRequester, *offboardUserDelete)
+		if err != nil && results != nil {
+			output.Write(os.Stderr, "table", results)
+		}
+		return results, err
 	case "users delete":
-		fmt.Print("This command will delete user.\nAre you sure ? ")
-		if askForConfirmation() != true {
-			return
+		if !confirm("This command will delete user.\nAre you sure ? ") {
+			return nil, errAborted
 		}
-		out, err := client.DeleteUser(*deleteUserName)
+		return message(client.DeleteUser(operator, *deleteUserName))
+	case "users reset":
+		if !confirm("This command will reset user.\nAre you sure ? ") {
+			return nil, errAborted
+		}
+		return message(client.ResetUser(operator, *resetUserName, *resetUserEmailTo))
+	case "plan":
+		state, err := client.LoadState(*planStateFile)
 		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			return
+			return nil, err
 		}
-		fmt.Printf(out + "\n")
-	case "users reset":
-		fmt.Print("This command will reset user.\nAre you sure ? ")
-		if askForConfirmation() != true {
-			return
+		return client.PlanState(state)
+	case "apply":
+		state, err := client.LoadState(*applyStateFile)
+		if err != nil {
+			return nil, err
+		}
+		changes, err := client.PlanState(state)
+		if err != nil {
+			return nil, err
 		}
-		out, err := client.ResetUser(*resetUserName, *resetUserEmailTo)
+		if len(changes) == 0 {
+			return output.Message{Message: "No changes, backend matches the state file."}, nil
+		}
+		if err := client.AuthorizeChanges(op, changes); err != nil {
+			return nil, err
+		}
+		// the plan goes to stderr so stdout only has the result
+		output.Write(os.Stderr, "table", changes)
+		if !confirm("These changes will be applied.\nAre you sure ? ") {
+			return nil, errAborted
+		}
+		return message(client.ApplyChanges(operator, changes))
+	case "fsck":
+		problems, err := client.Fsck(time.Now())
 		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			return
+			return nil, err
+		}
+		if len(problems) == 0 {
+			return output.Message{Message: "No problems found."}, nil
+		}
+		if !*fsckFix {
+			return problems, nil
 		}
-		fmt.Printf(out + "\n")
+		if problems.Fixable() == 0 {
+			output.Write(os.Stderr, "table", problems)
+			return nil, errors.New("None of the problems can be repaired, fix them by hand")
+		}
+		if err := client.AuthorizeRepairs(op, problems); err != nil {
+			return nil, err
+		}
+		output.Write(os.Stderr, "table", problems)
+		if !confirm(fmt.Sprintf("%d of these problems will be repaired.\nAre you sure ? ", problems.Fixable())) {
+			return nil, errAborted
+		}
+		return message(client.RepairProblems(operator, problems))
 	default:
-		fmt.Printf("Error: Unreconized command\n")
-		return
+		return nil, fmt.Errorf("Unreconized command `%s`", command)
+	}
+}
+
+// offboardNames returns the user of `users offboard` or the users of its
+// list file.
+func offboardNames() ([]string, error) {
+	if (*offboardUserName == "") == (*offboardUserFile == "") {
+		return nil, errors.New("Give either a user name or --file")
+	}
+	if *offboardUserName != "" {
+		return []string{*offboardUserName}, nil
+	}
+	return client.LoadOffboardList(*offboardUserFile)
+}
+
+func policyFile() string {
+	if path := config.Get().PolicyFile; path != "" {
+		return path
+	}
+	return defaultPolicyFile
+}
+
+// authorize finds the operator running tero in the policy and checks it
+// may run command, before anything is read from or written to the
+// backend. Access requests are governed by the approvers in the config,
+// so anyone may ask for a role.
+func authorize(command string) (*auth.Operator, error) {
+	policy, err := auth.LoadPolicy(policyFile())
+	if err != nil {
+		return nil, err
 	}
+	name, err := currentOperator()
+	if err != nil {
+		return nil, err
+	}
+	op, err := policy.ByOSUser(name)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := make([]error, 0)
+	switch command {
+	case "roles add":
+		checks = append(checks, op.CanManageRole(*addRoleName), canUseNodes(op, *rolesNodes), canUseLogins(op, *rolesUsers), canUseRules(op, addRoleFlags))
+	case "roles update":
+		checks = append(checks, op.CanManageRole(*updateRoleName), canUseRules(op, updateRoleFlags))
+		if *updateRolesNodes != "" {
+			checks = append(checks, canUseNodes(op, *updateRolesNodes))
+		}
+		if *updateRolesUsers != "" {
+			checks = append(checks, canUseLogins(op, *updateRolesUsers))
+		}
+	case "roles delete":
+		checks = append(checks, op.CanManageRole(*deletedRoleName))
+		if *deleteRoleCascade || *deleteRoleReassign != "" {
+			holders, err := client.RoleHolders(*deletedRoleName)
+			checks = append(checks, err)
+			for _, u := range holders {
+				checks = append(checks, op.CanManageUser(u))
+			}
+		}
+		if *deleteRoleReassign != "" {
+			checks = append(checks, op.CanManageRole(*deleteRoleReassign))
+		}
+	case "attach":
+		checks = append(checks, op.CanManageRole(*attachRoleName), canManageUsers(op, *attachRoleUsers))
+	case "detach":
+		checks = append(checks, op.CanManageRole(*dettachRoleName), canManageUsers(op, *dettachRoleUsers))
+	case "users add":
+		checks = append(checks, op.CanManageUser(*addUserName))
+		for _, r := range strings.Split(*addUserRoles, ",") {
+			checks = append(checks, op.CanManageRole(r))
+		}
+	case "users lock":
+		checks = append(checks, op.CanManageUser(*lockUserName))
+	case "users unlock":
+		checks = append(checks, op.CanManageUser(*unlockUserName))
+	case "users delete":
+		checks = append(checks, op.CanManageUser(*deleteUserName))
+	case "users reset":
+		checks = append(checks, op.CanManageUser(*resetUserName))
+	case "invites revoke":
+		checks = append(checks, client.AuthorizeInvite(op, *revokeInviteUser))
+	case "invites resend":
+		checks = append(checks, client.AuthorizeInvite(op, *resendInviteUser))
+	case "reap":
+		checks = append(checks, op.CanManageAll())
+	case "review start":
+		checks = append(checks, client.AuthorizeStartReview(op, *startReviewOwner))
+	case "review remind":
+		checks = append(checks, client.AuthorizeRemind(op, *remindReviewID))
+	}
+	// the other commands only read, apply, users import, users offboard
+	// and fsck --fix authorize each change they make, the requests and
+	// reviews config decide who may request, approve and review
+
+	for _, err := range checks {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return op, nil
+}
+
+func canUseNodes(op *auth.Operator, rawNodePatterns string) error {
+	nodePatterns, err := backend.ParseNodePatterns(rawNodePatterns)
+	if err != nil {
+		return err
+	}
+	return op.CanUseLabels(nodePatterns)
+}
+
+func canUseLogins(op *auth.Operator, rawAllowedLogins string) error {
+	logins, err := backend.ParseAllowedLogins(rawAllowedLogins)
+	if err != nil {
+		return err
+	}
+	return op.CanUseLogins(logins)
+}
+
+// canUseRules checks the allow and deny rules given as flags, the rules a
+// role already has are left as they are.
+func canUseRules(op *auth.Operator, flags *client.RoleFlags) error {
+	rules, err := backend.ParseRules(append(append([]string(nil), flags.AllowRules...), flags.DenyRules...))
+	if err != nil {
+		return err
+	}
+	return op.CanUseRules(rules)
+}
+
+func canManageUsers(op *auth.Operator, rawUsers string) error {
+	for _, u := range strings.Split(rawUsers, ",") {
+		if err := op.CanManageUser(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentOperator is the teleport user running tero, its unix account
+// name is expected to match.
+func currentOperator() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("Cannot tell who is running tero: %s", err)
+	}
+	return u.Username, nil
+}
+
+func message(out string, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	return output.Message{Message: out}, nil
+}
+
+// confirm asks on stderr, so prompts do not end up in machine readable
+// output.
+func confirm(question string) bool {
+	fmt.Fprint(os.Stderr, question)
+	return askForConfirmation()
 }
 
 func askForConfirmation() bool {
@@ -217,7 +678,7 @@ func askForConfirmation() bool {
 	} else if containsString(nokayResponses, response) {
 		return false
 	} else {
-		fmt.Println("Please type yes or no and then press enter:")
+		fmt.Fprintln(os.Stderr, "Please type yes or no and then press enter:")
 		return askForConfirmation()
 	}
 }
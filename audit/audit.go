@@ -0,0 +1,184 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bentol/tero/config"
+)
+
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+)
+
+// Event is one change made through tero.
+type Event struct {
+	Time     time.Time `json:"time" yaml:"time"`
+	Operator string    `json:"operator" yaml:"operator"`
+	// Action is <kind>.<verb>, ex: role.create, user.lock
+	Action string `json:"action" yaml:"action"`
+	Role   string `json:"role,omitempty" yaml:"role,omitempty"`
+	// Users are the users the change is about
+	Users  []string          `json:"users,omitempty" yaml:"users,omitempty"`
+	Args   map[string]string `json:"args,omitempty" yaml:"args,omitempty"`
+	Before *State            `json:"before,omitempty" yaml:"before,omitempty"`
+	After  *State            `json:"after,omitempty" yaml:"after,omitempty"`
+	Result string            `json:"result" yaml:"result"`
+	Error  string            `json:"error,omitempty" yaml:"error,omitempty"`
+	// PrevHash and Hash chain the events of the backend and file sinks,
+	// see Seal
+	PrevHash string `json:"prev_hash,omitempty" yaml:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty" yaml:"hash,omitempty"`
+}
+
+// State holds the teleport records of the role and users of an event as
+// they were stored.
+type State struct {
+	Role  interface{}            `json:"role,omitempty" yaml:"role,omitempty"`
+	Users map[string]interface{} `json:"users,omitempty" yaml:"users,omitempty"`
+}
+
+type Filter struct {
+	// User matches events made by or about this user
+	User  string
+	Since time.Time
+}
+
+func (f Filter) Match(e Event) bool {
+	if e.Time.Before(f.Since) {
+		return false
+	}
+	return f.User == "" || e.Operator == f.User || containsString(e.Users, f.User)
+}
+
+type Sink interface {
+	Write(e Event) error
+	// Query returns the events matching f, oldest first
+	Query(f Filter) ([]Event, error)
+}
+
+var sink Sink
+
+// Init selects the sink events are written to, the backend storage must
+// be initialized first.
+func Init(conf config.AuditConfig) error {
+	switch conf.Sink {
+	case "", "backend":
+		sink = &BackendSink{}
+	case "file":
+		path := conf.File
+		if path == "" {
+			path = "/var/log/tero/audit.jsonl"
+		}
+		f, err := NewFileSink(path)
+		if err != nil {
+			return err
+		}
+		sink = f
+	case "syslog":
+		s, err := NewSyslogSink(conf.SyslogTag)
+		if err != nil {
+			return err
+		}
+		sink = s
+	default:
+		return fmt.Errorf("Unknown audit sink `%s`", conf.Sink)
+	}
+	return nil
+}
+
+func SetSink(s Sink) {
+	sink = s
+}
+
+// Record writes e to the sink, it does nothing when no sink is selected.
+func Record(e Event) error {
+	if sink == nil {
+		return nil
+	}
+	return sink.Write(e)
+}
+
+func Query(f Filter) ([]Event, error) {
+	if sink == nil {
+		return nil, errors.New("Audit log is not configured")
+	}
+	return sink.Query(f)
+}
+
+// Seal chains e to the event before it, so changing or removing an event
+// breaks the hash of every event after it.
+func Seal(e Event, prevHash string) (Event, error) {
+	e.PrevHash = prevHash
+	e.Hash = ""
+	hash, err := hashOf(e)
+	if err != nil {
+		return e, err
+	}
+	e.Hash = hash
+	return e, nil
+}
+
+// Head is the last event of a chain. The sinks keep it apart from the
+// events, so events removed from the end are noticed as well.
+type Head struct {
+	Count int64  `json:"count"`
+	Hash  string `json:"hash"`
+}
+
+// verifier checks events are chained in the order they are read.
+type verifier struct {
+	Head
+}
+
+// next fails when e was changed, or events were added or removed before
+// it.
+func (v *verifier) next(e Event) error {
+	hash, err := hashOf(e)
+	if err != nil {
+		return err
+	}
+	if e.PrevHash != v.Hash || e.Hash != hash {
+		return errTampered
+	}
+	v.Count++
+	v.Hash = e.Hash
+	return nil
+}
+
+// end fails when the chain does not end at h.
+func (v *verifier) end(h Head) error {
+	if v.Count != h.Count {
+		return fmt.Errorf("it ends at event %d but %d were written", v.Count, h.Count)
+	}
+	if v.Hash != h.Hash {
+		return errors.New("its last event was replaced")
+	}
+	return nil
+}
+
+var errTampered = errors.New("it was tampered with")
+
+func hashOf(e Event) (string, error) {
+	e.Hash = ""
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func containsString(slice []string, element string) bool {
+	for _, elem := range slice {
+		if elem == element {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package audit_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bentol/tero/audit"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFileSink(t *testing.T) (*audit.FileSink, string) {
+	dir, err := ioutil.TempDir("", "tero-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "audit.jsonl")
+	sink, err := audit.NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink, path
+}
+
+func event(operator, action string, users []string, at time.Time) audit.Event {
+	return audit.Event{Time: at, Operator: operator, Action: action, Users: users, Result: audit.ResultOK}
+}
+
+func TestFileSink_shouldChainEvents(t *testing.T) {
+	sink, _ := newFileSink(t)
+	now := time.Now().UTC()
+
+	assert.Nil(t, sink.Write(event("hulk", "user.lock", []string{"beni"}, now.Add(-48*time.Hour))))
+	assert.Nil(t, sink.Write(event("hulk", "role.attach", []string{"thor"}, now.Add(-time.Hour))))
+	assert.Nil(t, sink.Write(event("beni", "role.create", nil, now)))
+
+	events, err := sink.Query(audit.Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, "", events[0].PrevHash)
+	assert.Equal(t, events[0].Hash, events[1].PrevHash)
+	assert.Equal(t, events[1].Hash, events[2].PrevHash)
+
+	events, err = sink.Query(audit.Filter{User: "beni"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user.lock", "role.create"}, []string{events[0].Action, events[1].Action})
+
+	events, err = sink.Query(audit.Filter{User: "hulk", Since: now.Add(-24 * time.Hour)})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "role.attach", events[0].Action)
+}
+
+func TestFileSink_shouldDetectTampering(t *testing.T) {
+	sink, path := newFileSink(t)
+	now := time.Now().UTC()
+	assert.Nil(t, sink.Write(event("hulk", "user.lock", []string{"beni"}, now)))
+	assert.Nil(t, sink.Write(event("hulk", "user.delete", []string{"beni"}, now)))
+
+	raw, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	tampered := strings.Replace(string(raw), `"operator":"hulk"`, `"operator":"thor"`, 1)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(tampered), 0600))
+
+	_, err = sink.Query(audit.Filter{})
+	assert.EqualError(t, err, "Audit log "+path+" was tampered with at line 1")
+
+	// dropping the first event breaks the chain too
+	lines := strings.SplitN(string(raw), "\n", 2)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(lines[1]), 0600))
+	_, err = sink.Query(audit.Filter{})
+	assert.EqualError(t, err, "Audit log "+path+" was tampered with at line 1")
+}
+
+func TestFileSink_shouldDetectTruncation(t *testing.T) {
+	sink, path := newFileSink(t)
+	now := time.Now().UTC()
+	assert.Nil(t, sink.Write(event("hulk", "user.lock", []string{"beni"}, now)))
+	assert.Nil(t, sink.Write(event("hulk", "user.delete", []string{"beni"}, now)))
+
+	raw, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	lines := strings.SplitAfterN(string(raw), "\n", 2)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(lines[0]), 0600))
+
+	_, err = sink.Query(audit.Filter{})
+	assert.EqualError(t, err, "Audit log "+path+" was tampered with, it ends at event 1 but 2 were written")
+}
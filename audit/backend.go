@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bentol/tero/backend"
+)
+
+const (
+	Prefix = "teleport/tero/audit/"
+	// HeadPath holds the Head of the chain, it is outside of Prefix so
+	// listing the events leaves it out
+	HeadPath = "teleport/tero/audit-head"
+)
+
+// BackendSink stores events next to the teleport records, so every tero
+// sharing the storage sees them. Events are chained like the ones of the
+// file sink and numbered by the head, which is moved with a version
+// checked write so concurrent writers never fork the chain.
+type BackendSink struct{}
+
+func (s *BackendSink) Write(e Event) error {
+	storage := backend.GetStorage()
+	items, err := storage.GetItems(HeadPath)
+	if err != nil {
+		return err
+	}
+	if _, ok := items[HeadPath]; !ok {
+		err := storage.CreateItem(HeadPath, `{"count":0,"hash":""}`)
+		if err != nil && err != backend.ErrExists {
+			return err
+		}
+	}
+
+	// the head moves first, an event lost after that is reported by
+	// Query as a gap instead of going unnoticed
+	var sealed Event
+	var count int64
+	err = storage.UpdateItem(HeadPath, func(old string) (string, error) {
+		head := Head{}
+		if err := json.Unmarshal([]byte(old), &head); err != nil {
+			return "", fmt.Errorf("Invalid audit head %s: %s", HeadPath, err)
+		}
+		next, err := Seal(e, head.Hash)
+		if err != nil {
+			return "", err
+		}
+		sealed = next
+		count = head.Count + 1
+		raw, err := json.Marshal(Head{Count: count, Hash: sealed.Hash})
+		return string(raw), err
+	})
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+	return storage.CreateItem(eventPath(count), string(raw))
+}
+
+// Query verifies the whole chain, an event that was changed, added or
+// removed makes it fail.
+func (s *BackendSink) Query(f Filter) ([]Event, error) {
+	storage := backend.GetStorage()
+	items, err := storage.GetItems(Prefix)
+	if err != nil {
+		return nil, err
+	}
+	heads, err := storage.GetItems(HeadPath)
+	if err != nil {
+		return nil, err
+	}
+	head := Head{}
+	if raw, ok := heads[HeadPath]; ok {
+		if err := json.Unmarshal([]byte(raw), &head); err != nil {
+			return nil, fmt.Errorf("Invalid audit head %s: %s", HeadPath, err)
+		}
+	}
+
+	paths := make([]string, 0, len(items))
+	for path := range items {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	result := make([]Event, 0)
+	chain := verifier{}
+	for _, path := range paths {
+		e := Event{}
+		if err := json.Unmarshal([]byte(items[path]), &e); err != nil {
+			return nil, fmt.Errorf("Invalid audit event %s: %s", path, err)
+		}
+		count, err := strconv.ParseInt(strings.TrimPrefix(path, Prefix), 10, 64)
+		if err != nil || count != chain.Count+1 || chain.next(e) != nil {
+			return nil, fmt.Errorf("Audit log was tampered with at event %s", path)
+		}
+
+		if f.Match(e) {
+			result = append(result, e)
+		}
+	}
+	if err := chain.end(head); err != nil {
+		return nil, fmt.Errorf("Audit log was tampered with, %s", err)
+	}
+	return result, nil
+}
+
+func eventPath(count int64) string {
+	return fmt.Sprintf("%s%020d", Prefix, count)
+}
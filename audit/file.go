@@ -0,0 +1,153 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gofrs/flock"
+)
+
+// FileSink appends events as JSON lines, each event carries the hash of
+// the one before it. The head of the chain is kept in <path>.head, so
+// cutting events from the end of the log is noticed too.
+type FileSink struct {
+	path string
+	// mu serializes writes inside this process, lock guards against
+	// other tero processes
+	mu   sync.Mutex
+	lock *flock.Flock
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open audit log: %s", err)
+	}
+	f.Close()
+	return &FileSink{path: path, lock: flock.New(path + ".lock")}, nil
+}
+
+func (s *FileSink) Write(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.lock.Lock(); err != nil {
+		return err
+	}
+	defer s.lock.Unlock()
+
+	head, err := s.head()
+	if err != nil {
+		return err
+	}
+	sealed, err := Seal(e, head.Hash)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(raw, '\n')); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	return s.writeHead(Head{Count: head.Count + 1, Hash: sealed.Hash})
+}
+
+// Query verifies the whole chain while reading it, an event that was
+// changed, added or removed makes it fail.
+func (s *FileSink) Query(filter Filter) ([]Event, error) {
+	if err := s.lock.RLock(); err != nil {
+		return nil, err
+	}
+	defer s.lock.Unlock()
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := make([]Event, 0)
+	chain := verifier{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		e := Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("Audit log %s is broken at line %d: %s", s.path, line, err)
+		}
+		if err := chain.next(e); err != nil {
+			return nil, fmt.Errorf("Audit log %s was tampered with at line %d", s.path, line)
+		}
+
+		if filter.Match(e) {
+			result = append(result, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	head, err := s.head()
+	if err != nil {
+		return nil, err
+	}
+	if err := chain.end(head); err != nil {
+		return nil, fmt.Errorf("Audit log %s was tampered with, %s", s.path, err)
+	}
+	return result, nil
+}
+
+// head returns an empty Head for a log nothing was written to yet.
+func (s *FileSink) head() (Head, error) {
+	head := Head{}
+	raw, err := ioutil.ReadFile(s.path + ".head")
+	if os.IsNotExist(err) {
+		return head, nil
+	}
+	if err != nil {
+		return head, err
+	}
+	if err := json.Unmarshal(raw, &head); err != nil {
+		return head, fmt.Errorf("Invalid audit log head %s.head: %s", s.path, err)
+	}
+	return head, nil
+}
+
+// writeHead replaces the head file in one rename, so it is never half
+// written.
+func (s *FileSink) writeHead(head Head) error {
+	raw, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".head.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path+".head")
+}
@@ -0,0 +1,38 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"log/syslog"
+)
+
+// SyslogSink sends every event as one JSON message to the local syslog.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	if tag == "" {
+		tag = "tero"
+	}
+	w, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{writer: w}, nil
+}
+
+func (s *SyslogSink) Write(e Event) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if e.Result == ResultError {
+		return s.writer.Warning(string(raw))
+	}
+	return s.writer.Notice(string(raw))
+}
+
+func (s *SyslogSink) Query(f Filter) ([]Event, error) {
+	return nil, errors.New("Audit events sent to syslog cannot be listed by tero, search them in syslog")
+}
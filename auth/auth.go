@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bentol/tero/role"
+)
+
+// Policy says who may run tero and what each operator may manage, ex:
+//
+//	[operators.alice]
+//	os_users = ["alice"]
+//	token_hashes = ["<sha256 hex of the api token>"]
+//	cert_names = ["alice.ops"]
+//	roles = ["dba", "dev-*"]
+//	users = ["*"]
+//	labels = ["env:staging", "app:*"]
+//	logins = ["ubuntu", "{{internal.logins}}"]
+//	rules = ["session:list", "session:read"]
+//
+// roles, users, labels, logins and rules are glob patterns. Labels, logins
+// and rules (as resource:verb) limit what the roles an operator creates or
+// changes may hold, so nobody can grant themselves more than the policy
+// gives them.
+type Policy struct {
+	Operators map[string]*Operator `toml:"operators"`
+}
+
+type Operator struct {
+	Name        string   `toml:"-"`
+	OSUsers     []string `toml:"os_users"`
+	TokenHashes []string `toml:"token_hashes"`
+	CertNames   []string `toml:"cert_names"`
+	Roles       []string `toml:"roles"`
+	Users       []string `toml:"users"`
+	Labels      []string `toml:"labels"`
+	Logins      []string `toml:"logins"`
+	Rules       []string `toml:"rules"`
+}
+
+// DeniedError is returned when an operator is not known or not allowed to
+// do something.
+type DeniedError struct {
+	// Unknown is set when the caller could not be identified at all
+	Unknown bool
+	Message string
+}
+
+func (e *DeniedError) Error() string {
+	return e.Message
+}
+
+func LoadPolicy(policyFile string) (*Policy, error) {
+	if _, err := os.Stat(policyFile); err != nil {
+		return nil, fmt.Errorf("Policy file is missing: %s, every operator is denied", policyFile)
+	}
+
+	p := &Policy{}
+	if _, err := toml.DecodeFile(policyFile, p); err != nil {
+		return nil, fmt.Errorf("Invalid policy file %s: %s", policyFile, err)
+	}
+	for name, o := range p.Operators {
+		o.Name = name
+	}
+	return p, nil
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *Policy) ByOSUser(name string) (*Operator, error) {
+	return p.find("unix user `"+name+"`", func(o *Operator) bool {
+		return containsString(o.OSUsers, name)
+	})
+}
+
+func (p *Policy) ByToken(token string) (*Operator, error) {
+	hash := []byte(HashToken(token))
+	return p.find("api token", func(o *Operator) bool {
+		for _, h := range o.TokenHashes {
+			if subtle.ConstantTimeCompare([]byte(strings.ToLower(h)), hash) == 1 {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (p *Policy) ByCert(commonName string) (*Operator, error) {
+	return p.find("client certificate `"+commonName+"`", func(o *Operator) bool {
+		return containsString(o.CertNames, commonName)
+	})
+}
+
+// find goes through the operators sorted by name, so an identity listed
+// twice always resolves to the same operator.
+func (p *Policy) find(identity string, match func(o *Operator) bool) (*Operator, error) {
+	names := make([]string, 0, len(p.Operators))
+	for name := range p.Operators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if match(p.Operators[name]) {
+			return p.Operators[name], nil
+		}
+	}
+	return nil, &DeniedError{Unknown: true, Message: fmt.Sprintf("No operator in the policy for %s", identity)}
+}
+
+func (o *Operator) CanManageRole(name string) error {
+	if !matchAny(o.Roles, name) {
+		return o.deny("role `%s`", name)
+	}
+	return nil
+}
+
+func (o *Operator) CanManageUser(name string) error {
+	if !matchAny(o.Users, name) {
+		return o.deny("user `%s`", name)
+	}
+	return nil
+}
+
+// CanManageAll checks the operator manages every role and user, for
+// commands like reap that act on whatever falls due.
+func (o *Operator) CanManageAll() error {
+	if !containsString(o.Roles, "*") {
+		return o.deny("every role")
+	}
+	if !containsString(o.Users, "*") {
+		return o.deny("every user")
+	}
+	return nil
+}
+
+// CanUseLabels checks every node label of a role is inside the label
+// scope of the operator.
+func (o *Operator) CanUseLabels(labels map[string]string) error {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		allowed := false
+		for _, scope := range o.Labels {
+			s := strings.SplitN(scope, ":", 2)
+			if len(s) == 2 && match(s[0], k) && match(s[1], labels[k]) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return o.deny("nodes `%s:%s`", k, labels[k])
+		}
+	}
+	return nil
+}
+
+func (o *Operator) CanUseLogins(logins []string) error {
+	for _, login := range logins {
+		if !matchAny(o.Logins, login) {
+			return o.deny("login `%s`", login)
+		}
+	}
+	return nil
+}
+
+// CanUseRules checks every resource and verb of the rules is inside the
+// rule scope of the operator, the where clause is not looked at.
+func (o *Operator) CanUseRules(rules []role.Rule) error {
+	for _, rule := range rules {
+		for _, resource := range rule.Resources {
+			for _, verb := range rule.Verbs {
+				allowed := false
+				for _, scope := range o.Rules {
+					s := strings.SplitN(scope, ":", 2)
+					if len(s) == 2 && match(s[0], resource) && match(s[1], verb) {
+						allowed = true
+						break
+					}
+				}
+				if !allowed {
+					return o.deny("rule `%s:%s`", resource, verb)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (o *Operator) deny(format string, a ...interface{}) error {
+	return &DeniedError{Message: fmt.Sprintf("Operator `%s` is not allowed to manage "+format, append([]interface{}{o.Name}, a...)...)}
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if match(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func match(pattern, name string) bool {
+	ok, err := path.Match(pattern, name)
+	return err == nil && ok
+}
+
+func containsString(slice []string, element string) bool {
+	for _, elem := range slice {
+		if elem == element {
+			return true
+		}
+	}
+	return false
+}
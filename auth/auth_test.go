@@ -0,0 +1,108 @@
+package auth_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bentol/tero/auth"
+	"github.com/bentol/tero/role"
+	"github.com/stretchr/testify/assert"
+)
+
+const policyToml = `
+[operators.alice]
+os_users = ["alice"]
+token_hashes = ["%s"]
+roles = ["dev-*"]
+users = ["*"]
+labels = ["env:staging", "app:*"]
+logins = ["ubuntu", "dev-*"]
+rules = ["session:*", "event:list"]
+
+[operators.bob]
+os_users = ["bob"]
+cert_names = ["bob.ops"]
+roles = ["*"]
+users = ["intern-*"]
+`
+
+func loadPolicy(t *testing.T) *auth.Policy {
+	dir, err := ioutil.TempDir("", "tero-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "policy.toml")
+	content := []byte(fmt.Sprintf(policyToml, auth.HashToken("alice-secret")))
+	if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := auth.LoadPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadPolicy_shouldDenyWhenMissing(t *testing.T) {
+	_, err := auth.LoadPolicy("/nonexistent/tero-policy.toml")
+	assert.EqualError(t, err, "Policy file is missing: /nonexistent/tero-policy.toml, every operator is denied")
+}
+
+func TestPolicy_shouldFindOperatorByIdentity(t *testing.T) {
+	p := loadPolicy(t)
+
+	op, err := p.ByOSUser("bob")
+	assert.Nil(t, err)
+	assert.Equal(t, "bob", op.Name)
+
+	op, err = p.ByCert("bob.ops")
+	assert.Nil(t, err)
+	assert.Equal(t, "bob", op.Name)
+
+	op, err = p.ByToken("alice-secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", op.Name)
+
+	_, err = p.ByToken("wrong")
+	denied, ok := err.(*auth.DeniedError)
+	assert.True(t, ok)
+	assert.True(t, denied.Unknown)
+
+	_, err = p.ByOSUser("mallory")
+	assert.EqualError(t, err, "No operator in the policy for unix user `mallory`")
+}
+
+func TestOperator_shouldOnlyManageItsScope(t *testing.T) {
+	p := loadPolicy(t)
+	alice, _ := p.ByOSUser("alice")
+	bob, _ := p.ByOSUser("bob")
+
+	assert.Nil(t, alice.CanManageRole("dev-db"))
+	assert.EqualError(t, alice.CanManageRole("admin"), "Operator `alice` is not allowed to manage role `admin`")
+	assert.Nil(t, bob.CanManageRole("admin"))
+
+	assert.Nil(t, bob.CanManageUser("intern-budi"))
+	assert.EqualError(t, bob.CanManageUser("beni"), "Operator `bob` is not allowed to manage user `beni`")
+
+	assert.Nil(t, alice.CanUseLabels(map[string]string{"env": "staging", "app": "postgres"}))
+	assert.EqualError(t, alice.CanUseLabels(map[string]string{"env": "production"}), "Operator `alice` is not allowed to manage nodes `env:production`")
+	assert.NotNil(t, bob.CanUseLabels(map[string]string{"env": "staging"}))
+	assert.Nil(t, bob.CanUseLabels(map[string]string{}))
+
+	assert.Nil(t, alice.CanUseLogins([]string{"ubuntu", "dev-app"}))
+	assert.EqualError(t, alice.CanUseLogins([]string{"ubuntu", "root"}), "Operator `alice` is not allowed to manage login `root`")
+	assert.NotNil(t, bob.CanUseLogins([]string{"ubuntu"}))
+
+	assert.Nil(t, alice.CanUseRules([]role.Rule{{Resources: []string{"session"}, Verbs: []string{"list", "read"}}, {Resources: []string{"event"}, Verbs: []string{"list"}}}))
+	assert.EqualError(t, alice.CanUseRules([]role.Rule{{Resources: []string{"session", "role"}, Verbs: []string{"list"}}}), "Operator `alice` is not allowed to manage rule `role:list`")
+	assert.EqualError(t, alice.CanUseRules([]role.Rule{{Resources: []string{"*"}, Verbs: []string{"list"}}}), "Operator `alice` is not allowed to manage rule `*:list`")
+	assert.Nil(t, bob.CanUseRules(nil))
+
+	assert.EqualError(t, alice.CanManageAll(), "Operator `alice` is not allowed to manage every role")
+	assert.EqualError(t, bob.CanManageAll(), "Operator `bob` is not allowed to manage every user")
+}
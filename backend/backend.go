@@ -1,12 +1,20 @@
 package backend
 
 import (
-	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/bentol/tero/backend/boltdb"
+	"github.com/bentol/tero/backend/dir"
 	"github.com/bentol/tero/backend/dynamo"
+	"github.com/bentol/tero/backend/errs"
+	"github.com/bentol/tero/backend/etcd"
+	"github.com/bentol/tero/backend/memory"
+	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/grant"
 	"github.com/bentol/tero/role"
 	"github.com/bentol/tero/token"
 	"github.com/bentol/tero/user"
@@ -14,14 +22,53 @@ import (
 
 var (
 	storage Storage
+
+	// ErrConflict is returned when a record is changed by someone else
+	// while tero is updating it
+	ErrConflict = errs.ErrConflict
+
+	// ErrExists is returned when a new record would replace a stored one
+	ErrExists = errs.ErrExists
 )
 
+// InvalidError is returned when tero refuses the input of a change before
+// anything is changed.
+type InvalidError struct {
+	Message string
+}
+
+func (e *InvalidError) Error() string {
+	return e.Message
+}
+
+// Invalid returns an InvalidError formatted as fmt.Sprintf does.
+func Invalid(format string, a ...interface{}) error {
+	return &InvalidError{Message: fmt.Sprintf(format, a...)}
+}
+
+// NotFoundError is returned when a role, a user or a record a command
+// works on is not stored.
+type NotFoundError struct {
+	Message string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Message
+}
+
+// NotFound returns a NotFoundError formatted as fmt.Sprintf does.
+func NotFound(format string, a ...interface{}) error {
+	return &NotFoundError{Message: fmt.Sprintf(format, a...)}
+}
+
 type Storage interface {
 	GetRoles() ([]role.Role, error)
 	GetRoleByName(name string) (*role.Role, error)
 	DeleteRole(name string) error
-	CreateRole(name string, allowedLogins []string, nodePatterns map[string]string) (*role.Role, error)
-	UpdateRole(name string, allowedLogins []string, nodePatterns map[string]string) (*role.Role, error)
+	CreateRole(newRole role.Role) (*role.Role, error)
+	// UpdateRole passes a fresh copy of the role to change, then writes
+	// it back
+	UpdateRole(name string, change func(r *role.Role)) (*role.Role, error)
 	AttachRole(selectedRole *role.Role, users []user.User) ([]user.User, error)
 	DetachRole(selectedRole *role.Role, users []user.User) ([]user.User, error)
 	GetUsers() (map[string]user.User, error)
@@ -31,15 +78,57 @@ type Storage interface {
 	GetAddUserToken(token string) (*token.AddUserToken, error)
 	GetAddUserTokenByUserName(userName string) (*token.AddUserToken, error)
 	InsertItem(path, value string, ttl int64) error
+	// CreateItem is InsertItem for a record that must be new, it returns
+	// ErrExists when path is already stored
+	CreateItem(path, value string) error
+	// GetItem returns the value of the record at exactly path, false
+	// when there is none
+	GetItem(path string) (string, bool, error)
+	// GetItems returns the value of every record under prefix, keyed by
+	// its path
+	GetItems(prefix string) (map[string]string, error)
+	DeleteItem(path string) error
+	// UpdateItem writes what change returns for the value at path, only
+	// if the record was not modified in between. It starts over on a
+	// conflicting write and gives up with ErrConflict.
+	UpdateItem(path string, change func(old string) (string, error)) error
 	UpdateAddUserToken(token *token.AddUserToken) error
 	SetUserLockedStatus(username string, status bool) error
 }
 
-func InitBackend(selectedStorage string) {
+func InitBackend(selectedStorage string, conf config.Config) error {
 	switch selectedStorage {
 	case "dynamodb":
-		storage = dynamo.New()
+		dyn, err := dynamo.New(conf.DynamoDB)
+		if err != nil {
+			return err
+		}
+		storage = dyn
+	case "etcd":
+		e, err := etcd.New(conf.Etcd)
+		if err != nil {
+			return err
+		}
+		storage = e
+	case "dir":
+		d, err := dir.New(conf.Dir)
+		if err != nil {
+			return err
+		}
+		storage = d
+	case "boltdb":
+		b, err := boltdb.New(conf.BoltDB)
+		if err != nil {
+			return err
+		}
+		storage = b
+	case "memory":
+		storage = memory.New()
+	default:
+		return fmt.Errorf("Unknown storage `%s`", selectedStorage)
 	}
+
+	return nil
 }
 
 func checkStorage() {
@@ -73,66 +162,261 @@ func GetUsersByNames(names []string) ([]user.User, error) {
 	return storage.GetUsersByNames(names)
 }
 
-func CreateRole(name string, allowedLogins []string, nodePatterns map[string]string) (*role.Role, error) {
+func CreateRole(newRole role.Role) (*role.Role, error) {
 	checkStorage()
+	if err := CheckName("role", newRole.Name); err != nil {
+		return nil, err
+	}
 
 	// make sure role not exists
-	existedRole, _ := storage.GetRoleByName(name)
+	existedRole, _ := storage.GetRoleByName(newRole.Name)
 	if existedRole != nil {
-		return nil, fmt.Errorf("Role `%s` already exists", name)
+		return nil, fmt.Errorf("Role `%s` already exists", newRole.Name)
 	}
 
-	return storage.CreateRole(name, allowedLogins, nodePatterns)
+	return storage.CreateRole(newRole)
 }
 
-func UpdateRole(name string, allowedLogins []string, nodePatterns map[string]string) (*role.Role, error) {
+func UpdateRole(name string, change func(r *role.Role)) (*role.Role, error) {
 	checkStorage()
 
 	// make sure role exists
 	existedRole, _ := storage.GetRoleByName(name)
 	if existedRole == nil {
-		return nil, fmt.Errorf("Role `%s` doesn't exists", name)
+		return nil, NotFound("Role `%s` doesn't exists", name)
 	}
 
-	return storage.UpdateRole(name, allowedLogins, nodePatterns)
+	return storage.UpdateRole(name, change)
 }
 
+// AttachRole attaches the role for good, users holding it until some
+// time keep it without expiry.
 func AttachRole(name string, users []string) ([]user.User, error) {
 	checkStorage()
 
-	role, err := storage.GetRoleByName(name)
+	role, listUsers, err := getRoleAndUsers(name, users)
 	if err != nil {
 		return nil, err
 	}
-	if role == nil {
-		return nil, fmt.Errorf("Role `%s` does not exist", name)
+
+	err = deleteGrants(name, users)
+	if err != nil {
+		return nil, err
 	}
 
-	listUsers, err := storage.GetUsersByNames(users)
-	if len(users) != len(listUsers) {
-		return nil, errors.New("One or more user does not exist")
+	toAttach := usersWithoutRole(listUsers, name)
+	if len(toAttach) == 0 {
+		return listUsers, nil
+	}
+	return storage.AttachRole(role, toAttach)
+}
+
+// AttachRoleUntil attaches the role and records when ReapGrants has to
+// detach it again. Users holding the role until some time get the new
+// expiry.
+func AttachRoleUntil(name string, users []string, expires time.Time) ([]user.User, error) {
+	checkStorage()
+
+	now := time.Now()
+	if !expires.After(now) {
+		return nil, Invalid("Expiry must be in the future")
+	}
+
+	role, listUsers, err := getRoleAndUsers(name, users)
+	if err != nil {
+		return nil, err
 	}
 
-	return storage.AttachRole(role, listUsers)
+	grants, err := storage.GetItems(grant.Prefix + name + "/")
+	if err != nil {
+		return nil, err
+	}
+	toAttach := usersWithoutRole(listUsers, name)
+	for _, u := range listUsers {
+		_, timeBoxed := grants[grant.Path(name, u.Name)]
+		if containsString(u.RoleNames(), name) && !timeBoxed {
+			return nil, Invalid("User `%s` already has role `%s` without expiry", u.Name, name)
+		}
+	}
+
+	// record the grants first, a failure after this leaves a grant for a
+	// role that is not attached instead of an attached role nobody reaps
+	for _, u := range listUsers {
+		g := grant.Grant{Role: name, User: u.Name, Expires: expires, GrantedAt: now}
+		err = storage.InsertItem(g.Path(), g.GetJSON(), 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(toAttach) == 0 {
+		return listUsers, nil
+	}
+	return storage.AttachRole(role, toAttach)
 }
 
 func DettachRole(name string, users []string) ([]user.User, error) {
 	checkStorage()
 
-	role, err := storage.GetRoleByName(name)
+	role, listUsers, err := getRoleAndUsers(name, users)
+	if err != nil {
+		return nil, err
+	}
+
+	detached, err := storage.DetachRole(role, listUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	return detached, deleteGrants(name, users)
+}
+
+// DetachRoleByName is DettachRole for a role that may no longer exist,
+// users keep its name until it is detached.
+func DetachRoleByName(name string, users []string) ([]user.User, error) {
+	checkStorage()
+
+	listUsers, err := storage.GetUsersByNames(users)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) != len(listUsers) {
+		return nil, NotFound("One or more user does not exist")
+	}
+
+	detached, err := storage.DetachRole(&role.Role{Name: name}, listUsers)
 	if err != nil {
 		return nil, err
 	}
+
+	return detached, deleteGrants(name, users)
+}
+
+func getRoleAndUsers(name string, users []string) (*role.Role, []user.User, error) {
+	role, err := storage.GetRoleByName(name)
+	if err != nil {
+		return nil, nil, err
+	}
 	if role == nil {
-		return nil, fmt.Errorf("Role `%s` does not exist", name)
+		return nil, nil, NotFound("Role `%s` does not exist", name)
 	}
 
 	listUsers, err := storage.GetUsersByNames(users)
+	if err != nil {
+		return nil, nil, err
+	}
 	if len(users) != len(listUsers) {
-		return nil, errors.New("One or more user does not exist")
+		return nil, nil, NotFound("One or more user does not exist")
+	}
+
+	return role, listUsers, nil
+}
+
+func usersWithoutRole(users []user.User, name string) []user.User {
+	result := make([]user.User, 0)
+	for _, u := range users {
+		if !containsString(u.RoleNames(), name) {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+func deleteGrants(name string, users []string) error {
+	grants, err := storage.GetItems(grant.Prefix + name + "/")
+	if err != nil {
+		return err
 	}
 
-	return storage.DetachRole(role, listUsers)
+	for _, userName := range users {
+		path := grant.Path(name, userName)
+		if _, ok := grants[path]; !ok {
+			continue
+		}
+		if err := storage.DeleteItem(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetGrants returns every time-boxed grant, the first to expire first.
+func GetGrants() ([]grant.Grant, error) {
+	checkStorage()
+
+	items, err := storage.GetItems(grant.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := make([]grant.Grant, 0, len(items))
+	for path, value := range items {
+		g, err := grant.FromJSON([]byte(value))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid grant record `%s`: %s", path, err)
+		}
+		grants = append(grants, g)
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Expires.Equal(grants[j].Expires) {
+			return grants[i].Path() < grants[j].Path()
+		}
+		return grants[i].Expires.Before(grants[j].Expires)
+	})
+	return grants, nil
+}
+
+func GetGrantsByUser(name string) ([]grant.Grant, error) {
+	grants, err := GetGrants()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]grant.Grant, 0)
+	for _, g := range grants {
+		if g.User == name {
+			result = append(result, g)
+		}
+	}
+	return result, nil
+}
+
+// ReapGrants detaches every grant that expired at now and returns them.
+// Grants whose role or user is gone are only removed.
+func ReapGrants(now time.Time) ([]grant.Grant, error) {
+	grants, err := GetGrants()
+	if err != nil {
+		return nil, err
+	}
+
+	reaped := make([]grant.Grant, 0)
+	for _, g := range grants {
+		if !g.Expired(now) {
+			continue
+		}
+
+		role, err := storage.GetRoleByName(g.Role)
+		if err != nil {
+			return reaped, err
+		}
+		users, err := storage.GetUsersByNames([]string{g.User})
+		if err != nil {
+			return reaped, err
+		}
+		if role != nil && len(users) != 0 {
+			_, err = storage.DetachRole(role, users)
+			if err != nil {
+				return reaped, err
+			}
+		}
+
+		err = storage.DeleteItem(g.Path())
+		if err != nil {
+			return reaped, err
+		}
+		reaped = append(reaped, g)
+	}
+	return reaped, nil
 }
 
 func GetUsers() (map[string]user.User, error) {
@@ -145,11 +429,55 @@ func GetUsersByRole(name string) ([]user.User, error) {
 	return storage.GetUsersByRole(name)
 }
 
+// GetAddUserTokens returns every signup token that is stored.
+func GetAddUserTokens() ([]token.AddUserToken, error) {
+	checkStorage()
+
+	items, err := storage.GetItems("teleport/addusertokens/")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]token.AddUserToken, 0, len(items))
+	for path, value := range items {
+		result = append(result, token.AddUserToken{Token: strings.TrimPrefix(path, "teleport/addusertokens/"), JSON: []byte(value)})
+	}
+	return result, nil
+}
+
+// RevokeAddUserToken deletes the signup tokens of the user, it reports
+// whether there was one.
+func RevokeAddUserToken(userName string) (bool, error) {
+	tokens, err := GetAddUserTokens()
+	if err != nil {
+		return false, err
+	}
+
+	revoked := false
+	for _, t := range tokens {
+		if t.UserName() != userName {
+			continue
+		}
+		err = DeleteAddUserToken(t.Token)
+		if err != nil {
+			return revoked, err
+		}
+		revoked = true
+	}
+	return revoked, nil
+}
+
+// DeleteAddUserToken deletes a single signup token.
+func DeleteAddUserToken(token string) error {
+	checkStorage()
+	return storage.DeleteItem("teleport/addusertokens/" + token)
+}
+
 func ConfigureNewUserToken(token string, roles []string) error {
 	checkStorage()
 	addUserToken, err := storage.GetAddUserToken(token)
 	if addUserToken == nil {
-		return errors.New("Add user token not found")
+		return NotFound("Add user token not found")
 	}
 
 	addUserToken.SetRoles(roles)
@@ -167,7 +495,7 @@ func ParseNodePatterns(rawPatterns string) (map[string]string, error) {
 	splitResult := strings.Split(rawPatterns, ",")
 	for _, line := range splitResult {
 		if strings.Count(line, ":") != 1 {
-			return nil, errors.New("Invalid node patterns")
+			return nil, Invalid("Invalid node patterns")
 		}
 
 		s := strings.SplitN(line, ":", 2)
@@ -177,10 +505,42 @@ func ParseNodePatterns(rawPatterns string) (map[string]string, error) {
 	return result, nil
 }
 
+// ParseRules parses rules written as resources:verbs[:where], ex:
+// session,role:list,read
+func ParseRules(rawRules []string) ([]role.Rule, error) {
+	rules := make([]role.Rule, 0, len(rawRules))
+	for _, rawRule := range rawRules {
+		s := strings.SplitN(rawRule, ":", 3)
+		if len(s) < 2 || s[0] == "" || s[1] == "" {
+			return nil, Invalid("Invalid rule `%s`, use resources:verbs[:where]", rawRule)
+		}
+
+		rule := role.Rule{
+			Resources: strings.Split(s[0], ","),
+			Verbs:     strings.Split(s[1], ","),
+		}
+		if len(s) == 3 {
+			rule.Where = s[2]
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// CheckName refuses names that cannot be a single segment of a record
+// path, ex: ../../etc would escape the dir backend.
+func CheckName(kind, name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return Invalid("Invalid %s name `%s`, it must not contain / or \\ or be . or ..", kind, name)
+	}
+	return nil
+}
+
 func ParseAllowedLogins(rawAllowedLogins string) ([]string, error) {
 	ret := strings.Split(rawAllowedLogins, ",")
 	if len(ret) == 0 {
-		return nil, errors.New("Allowed logins must not empty")
+		return nil, Invalid("Allowed logins must not empty")
 	}
 
 	return ret, nil
@@ -193,3 +553,12 @@ func UnlockUser(username string) error {
 func LockUser(username string) error {
 	return storage.SetUserLockedStatus(username, true)
 }
+
+func containsString(slice []string, element string) bool {
+	for _, elem := range slice {
+		if elem == element {
+			return true
+		}
+	}
+	return false
+}
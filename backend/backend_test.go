@@ -1,4 +1,4 @@
-package backend
+package backend_test
 
 import (
 	"fmt"
@@ -6,9 +6,16 @@ import (
 	"math/rand"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/Jeffail/gabs"
 	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/backend/memory"
 	"github.com/bentol/tero/client"
+	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/request"
+	"github.com/bentol/tero/review"
+	"github.com/bentol/tero/role"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,7 +24,14 @@ func init() {
 }
 
 func setup() {
-	backend.InitBackend("dynamodb")
+	err := backend.InitBackend("memory", config.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = backend.GetStorage().(*memory.MemoryStorage).LoadFixtures("../testdata")
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 func CreateDummyNewUserToken() (string, string) {
@@ -100,9 +114,19 @@ func TestParseAllowedLogins(t *testing.T) {
 	}
 }
 
+func TestCreateRole_shouldRefuseNamesThatAreNotAPathSegment(t *testing.T) {
+	setup()
+	for _, name := range []string{"", "..", "../../x", "dev/db", `dev\db`} {
+		_, err := backend.CreateRole(role.Role{Name: name, AllowedLogins: []string{"ubuntu"}, NodePatterns: map[string]string{"env": "dev"}})
+		assert.NotNil(t, err, name)
+	}
+	_, err := backend.CreateRole(role.Role{Name: "../x"})
+	assert.EqualError(t, err, "Invalid role name `../x`, it must not contain / or \\ or be . or ..")
+}
+
 func TestGetUsersByRole_shouldReturnItsUser(t *testing.T) {
 	roleName := "test-role-" + strconv.Itoa(rand.Int())
-	_, _ = client.NewRole(roleName, "ubuntu", "env:production")
+	_, _ = client.NewRole("hulk", roleName, "ubuntu", "env:production")
 
 	users, _ := backend.GetUsersByRole(roleName)
 	assert.Equal(t, len(users), 0)
@@ -144,3 +168,146 @@ func TestGetAddUserTokenByUserName_shouldReturnAppropriateItem(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, token, addUserToken.Token)
 }
+
+func TestUserUpdates_shouldKeepFieldsTeroDoesNotManage(t *testing.T) {
+	userName := "test-user-" + strconv.Itoa(rand.Int())
+	path := fmt.Sprintf("teleport/web/users/%s/params", userName)
+	rawUser := fmt.Sprintf(`{"kind":"user","version":"v2","metadata":{"name":"%s"},"spec":{"roles":[],"traits":{"logins":["deploy"]},"oidc_identities":[{"connector_id":"google","username":"someone@example.com"}],"status":{"is_locked":false},"expires":"2030-01-01T00:00:00Z","created_by":{"time":"2018-01-01T00:00:00Z","user":{"name":"admin"}}}}`, userName)
+	backend.GetStorage().InsertItem(path, rawUser, 0)
+
+	roleName := "test-role-" + strconv.Itoa(rand.Int())
+	_, _ = client.NewRole("hulk", roleName, "ubuntu", "env:production")
+
+	_, err := backend.AttachRole(roleName, []string{userName})
+	assert.Nil(t, err)
+	_, err = backend.DettachRole(roleName, []string{userName})
+	assert.Nil(t, err)
+	assert.Nil(t, backend.LockUser(userName))
+	assert.Nil(t, backend.UnlockUser(userName))
+
+	item, _ := backend.GetStorage().(*memory.MemoryStorage).Get(path)
+	json, _ := gabs.ParseJSON(item.Value)
+	assert.Equal(t, []interface{}{"deploy"}, json.Path("spec.traits.logins").Data())
+	assert.Equal(t, "someone@example.com", json.Path("spec.oidc_identities").Index(0).Path("username").Data())
+	assert.Equal(t, "2030-01-01T00:00:00Z", json.Path("spec.expires").Data())
+	assert.Equal(t, "admin", json.Path("spec.created_by.user.name").Data())
+	assert.Equal(t, false, json.Path("spec.status.is_locked").Data())
+	assert.Equal(t, []interface{}{}, json.Path("spec.roles").Data())
+}
+
+func TestAttachRoleUntil_shouldBeReapedAfterExpiry(t *testing.T) {
+	setup()
+	_, err := backend.CreateRole(role.Role{Name: "oncall", AllowedLogins: []string{"ubuntu"}, NodePatterns: map[string]string{"env": "production"}})
+	assert.Nil(t, err)
+
+	expires := time.Now().Add(4 * time.Hour)
+	_, err = backend.AttachRoleUntil("oncall", []string{"beni"}, expires)
+	assert.Nil(t, err)
+
+	grants, err := backend.GetGrantsByUser("beni")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(grants))
+	assert.Equal(t, "oncall", grants[0].Role)
+	assert.True(t, expires.Equal(grants[0].Expires))
+
+	reaped, err := backend.ReapGrants(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(reaped))
+
+	reaped, err = backend.ReapGrants(expires)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reaped))
+
+	beni, _ := backend.GetStorage().GetUserByName("beni")
+	assert.Equal(t, []string{"admin"}, beni.RoleNames())
+	grants, _ = backend.GetGrants()
+	assert.Equal(t, 0, len(grants))
+}
+
+func TestAttachRoleUntil_shouldNotShortenPermanentRole(t *testing.T) {
+	setup()
+	_, err := backend.AttachRoleUntil("admin", []string{"beni"}, time.Now().Add(time.Hour))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "without expiry")
+
+	_, err = backend.AttachRoleUntil("admin", []string{"beni"}, time.Now().Add(-time.Hour))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "future")
+}
+
+func TestAttachAndDetach_shouldRemoveGrant(t *testing.T) {
+	setup()
+	_, _ = backend.CreateRole(role.Role{Name: "oncall", AllowedLogins: []string{"ubuntu"}, NodePatterns: map[string]string{"env": "production"}})
+
+	_, err := backend.AttachRoleUntil("oncall", []string{"beni", "hulk"}, time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+
+	// attaching again for good keeps the role, only once
+	_, err = backend.AttachRole("oncall", []string{"beni"})
+	assert.Nil(t, err)
+	beni, _ := backend.GetStorage().GetUserByName("beni")
+	assert.Equal(t, []string{"admin", "oncall"}, beni.RoleNames())
+
+	_, err = backend.DettachRole("oncall", []string{"hulk"})
+	assert.Nil(t, err)
+
+	grants, _ := backend.GetGrants()
+	assert.Equal(t, 0, len(grants))
+}
+
+func TestUpdateCampaign_shouldRunChangeAgainOnAConcurrentSave(t *testing.T) {
+	setup()
+	c := review.New("sre", "hulk", []review.Item{{User: "beni", Role: "admin", Reviewer: "hulk", Decision: review.Pending}}, time.Now().UTC())
+	assert.Nil(t, backend.SaveCampaign(&c))
+
+	calls := 0
+	_, err := backend.UpdateCampaign(c.ID, func(fresh *review.Campaign) error {
+		calls++
+		if fresh.State != review.Open {
+			return fmt.Errorf("Review %s is already %s", fresh.ID, fresh.State)
+		}
+		if calls == 1 {
+			closed := *fresh
+			closed.State = review.Closed
+			assert.Nil(t, backend.GetStorage().InsertItem(closed.Path(), closed.GetJSON(), 0))
+		}
+		fresh.Items[0].Decision = review.Keep
+		return nil
+	})
+	assert.EqualError(t, err, fmt.Sprintf("Review %s is already closed", c.ID))
+	assert.Equal(t, 2, calls)
+
+	stored, err := backend.GetCampaign(c.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, review.Pending, stored.Items[0].Decision)
+}
+
+func TestSaveCampaign_shouldNeverReplaceAStoredCampaign(t *testing.T) {
+	setup()
+	c := review.New("sre", "hulk", nil, time.Now().UTC())
+	assert.Nil(t, backend.SaveCampaign(&c))
+	assert.Equal(t, 32, len(c.ID))
+
+	err := backend.GetStorage().CreateItem(c.Path(), "{}")
+	assert.Equal(t, backend.ErrExists, err)
+	stored, _ := backend.GetCampaign(c.ID)
+	assert.Equal(t, "sre", stored.Owner)
+
+	other := review.New("dba", "hulk", nil, time.Now().UTC())
+	assert.Nil(t, backend.SaveCampaign(&other))
+	assert.NotEqual(t, c.ID, other.ID)
+}
+
+func TestGetRequest_shouldOnlyReturnTheRequestOfThatExactID(t *testing.T) {
+	setup()
+	r := request.New("admin", "beni", "incident", time.Hour, time.Now().UTC())
+	assert.Nil(t, backend.SaveRequest(&r))
+
+	stored, err := backend.GetRequest(r.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "beni", stored.User)
+
+	stored, err = backend.GetRequest(r.ID[:2])
+	assert.Nil(t, err)
+	assert.Nil(t, stored)
+}
@@ -0,0 +1,310 @@
+package boltdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bentol/tero/backend/errs"
+	"github.com/bentol/tero/backend/kv"
+	"github.com/bentol/tero/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStorage reads and writes teleport records in a bolt file, where
+// every path segment but the last one is a nested bucket:
+// teleport/roles/admin/params is key "params" in bucket roles -> admin.
+// Values are wrapped in the record teleport's bolt backend uses, an
+// expired record reads as missing.
+//
+// The file is opened for every operation and closed right after, bolt's
+// own file lock keeps tero and a running auth server from writing at the
+// same time.
+type BoltStorage struct {
+	kv.Storage
+	path        string
+	mu          sync.Mutex
+	lockTimeout time.Duration
+}
+
+// record is how teleport's bolt backend stores a value
+type record struct {
+	Created time.Time     `json:"created"`
+	TTL     time.Duration `json:"ttl"`
+	Value   []byte        `json:"val"`
+}
+
+func (r record) expired(now time.Time) bool {
+	return r.TTL != 0 && now.Sub(r.Created) > r.TTL
+}
+
+func New(conf config.BoltDBConfig) (*BoltStorage, error) {
+	lockTimeout := time.Duration(conf.LockTimeout) * time.Second
+	if lockTimeout == 0 {
+		lockTimeout = 5 * time.Second
+	}
+
+	b := &BoltStorage{
+		path:        conf.Path,
+		lockTimeout: lockTimeout,
+	}
+	b.Storage = kv.Storage{Store: b}
+
+	// make sure the file is usable before any command runs
+	err := b.view(func(tx *bolt.Tx) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *BoltStorage) Get(path string) (*kv.Item, error) {
+	var item *kv.Item
+	err := b.view(func(tx *bolt.Tx) error {
+		buckets, key := splitPath(path)
+		bucket := getBucket(tx, buckets)
+		if bucket == nil {
+			return nil
+		}
+
+		r, err := readRecord(path, bucket.Get([]byte(key)))
+		if err != nil || r == nil {
+			return err
+		}
+		item = &kv.Item{
+			Path:  path,
+			Value: r.Value,
+		}
+		return nil
+	})
+	return item, err
+}
+
+func (b *BoltStorage) List(prefix string) ([]kv.Item, error) {
+	result := make([]kv.Item, 0)
+	err := b.view(func(tx *bolt.Tx) error {
+		// only walk the deepest bucket the prefix fully names
+		buckets, _ := splitPath(prefix)
+		collect := func(path string, value []byte) error {
+			if !strings.HasPrefix(path, prefix) {
+				return nil
+			}
+			r, err := readRecord(path, value)
+			if err != nil || r == nil {
+				return err
+			}
+			result = append(result, kv.Item{
+				Path:  path,
+				Value: r.Value,
+			})
+			return nil
+		}
+
+		if len(buckets) == 0 {
+			return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+				return walkBucket(bucket, "teleport/"+string(name)+"/", collect)
+			})
+		}
+
+		bucket := getBucket(tx, buckets)
+		if bucket == nil {
+			return nil
+		}
+		return walkBucket(bucket, "teleport/"+strings.Join(buckets, "/")+"/", collect)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result, nil
+}
+
+func (b *BoltStorage) Put(path string, value []byte, ttl int64) error {
+	return b.update(func(tx *bolt.Tx) error {
+		bucket, key, err := createBuckets(tx, path)
+		if err != nil {
+			return err
+		}
+		return putRecord(bucket, key, record{
+			Created: time.Now().UTC(),
+			TTL:     time.Duration(ttl) * time.Second,
+			Value:   value,
+		})
+	})
+}
+
+func (b *BoltStorage) Create(path string, value []byte) error {
+	return b.update(func(tx *bolt.Tx) error {
+		bucket, key, err := createBuckets(tx, path)
+		if err != nil {
+			return err
+		}
+		existing, err := readRecord(path, bucket.Get([]byte(key)))
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return errs.ErrExists
+		}
+		return putRecord(bucket, key, record{
+			Created: time.Now().UTC(),
+			Value:   value,
+		})
+	})
+}
+
+func (b *BoltStorage) CompareAndSwap(path string, old, value []byte) error {
+	return b.update(func(tx *bolt.Tx) error {
+		buckets, key := splitPath(path)
+		bucket := getBucket(tx, buckets)
+		if bucket == nil {
+			return errs.ErrConflict
+		}
+		r, err := readRecord(path, bucket.Get([]byte(key)))
+		if err != nil {
+			return err
+		}
+		if r == nil || !bytes.Equal(r.Value, old) {
+			return errs.ErrConflict
+		}
+
+		// created and ttl stay, so the record expires when it would have
+		r.Value = value
+		return putRecord(bucket, key, *r)
+	})
+}
+
+func (b *BoltStorage) Delete(path string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		buckets, key := splitPath(path)
+		bucket := getBucket(tx, buckets)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func (b *BoltStorage) view(fn func(tx *bolt.Tx) error) error {
+	db, err := b.open(true)
+	if err != nil {
+		return err
+	}
+	defer b.close(db)
+
+	return db.View(fn)
+}
+
+func (b *BoltStorage) update(fn func(tx *bolt.Tx) error) error {
+	db, err := b.open(false)
+	if err != nil {
+		return err
+	}
+	defer b.close(db)
+
+	return db.Update(fn)
+}
+
+func (b *BoltStorage) open(readOnly bool) (*bolt.DB, error) {
+	b.mu.Lock()
+	db, err := bolt.Open(b.path, 0600, &bolt.Options{
+		Timeout:  b.lockTimeout,
+		ReadOnly: readOnly,
+	})
+	if err == bolt.ErrTimeout {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("Cannot lock bolt file `%s`, is the auth server running?", b.path)
+	}
+	if err != nil {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("Cannot open bolt file `%s`: %s", b.path, err)
+	}
+	return db, nil
+}
+
+func (b *BoltStorage) close(db *bolt.DB) {
+	db.Close()
+	b.mu.Unlock()
+}
+
+// splitPath turns teleport/roles/admin/params into [roles admin], params
+func splitPath(path string) ([]string, string) {
+	segments := strings.Split(strings.TrimPrefix(path, "teleport/"), "/")
+	return segments[:len(segments)-1], segments[len(segments)-1]
+}
+
+// createBuckets returns the bucket of path and the key in it, creating the
+// buckets that are missing.
+func createBuckets(tx *bolt.Tx, path string) (*bolt.Bucket, string, error) {
+	buckets, key := splitPath(path)
+	if len(buckets) == 0 {
+		return nil, "", fmt.Errorf("Invalid path `%s`", path)
+	}
+
+	bucket, err := tx.CreateBucketIfNotExists([]byte(buckets[0]))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, name := range buckets[1:] {
+		bucket, err = bucket.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return bucket, key, nil
+}
+
+func getBucket(tx *bolt.Tx, buckets []string) *bolt.Bucket {
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	bucket := tx.Bucket([]byte(buckets[0]))
+	for _, name := range buckets[1:] {
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket([]byte(name))
+	}
+	return bucket
+}
+
+func walkBucket(bucket *bolt.Bucket, prefix string, fn func(path string, value []byte) error) error {
+	return bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return walkBucket(bucket.Bucket(k), prefix+string(k)+"/", fn)
+		}
+		return fn(prefix+string(k), v)
+	})
+}
+
+// readRecord returns nil when there is no value or it expired
+func readRecord(path string, value []byte) (*record, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	var r record
+	if err := json.Unmarshal(value, &r); err != nil {
+		return nil, fmt.Errorf("Record `%s` is not in teleport's bolt format: %s", path, err)
+	}
+	if r.expired(time.Now().UTC()) {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+func putRecord(bucket *bolt.Bucket, key string, r record) error {
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), value)
+}
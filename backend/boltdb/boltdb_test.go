@@ -0,0 +1,187 @@
+package boltdb_test
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bentol/tero/backend/boltdb"
+	"github.com/bentol/tero/backend/errs"
+	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/role"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newBoltFile(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "teleport.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	return path
+}
+
+func newStorage(t *testing.T) (*boltdb.BoltStorage, string) {
+	path := newBoltFile(t)
+	storage, err := boltdb.New(config.BoltDBConfig{Path: path, LockTimeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, path
+}
+
+func TestNew_shouldFailIfFileMissing(t *testing.T) {
+	_, err := boltdb.New(config.BoltDBConfig{Path: filepath.Join(t.TempDir(), "missing.db")})
+	assert.NotNil(t, err)
+}
+
+func TestCreateRole_shouldUseNestedBuckets(t *testing.T) {
+	storage, path := newStorage(t)
+
+	_, err := storage.CreateRole(role.Role{Name: "dev", AllowedLogins: []string{"ubuntu"}, NodePatterns: map[string]string{"env": "staging"}})
+	assert.Nil(t, err)
+
+	db, _ := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte("roles")).Bucket([]byte("dev")).Get([]byte("params"))
+		var record struct {
+			Val []byte `json:"val"`
+		}
+		assert.Nil(t, json.Unmarshal(value, &record))
+		assert.Contains(t, string(record.Val), `"name":"dev"`)
+		return nil
+	})
+	db.Close()
+
+	roles, err := storage.GetRoles()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(roles))
+
+	assert.Nil(t, storage.DeleteRole("dev"))
+	r, err := storage.GetRoleByName("dev")
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+}
+
+func TestSetUserLockedStatus_shouldLockUser(t *testing.T) {
+	storage, _ := newStorage(t)
+	value := `{"kind":"user","version":"v2","metadata":{"name":"beni"},"spec":{"roles":[],"status":{"is_locked":false}}}`
+	assert.Nil(t, storage.InsertItem("teleport/web/users/beni/params", value, 0))
+
+	assert.Nil(t, storage.SetUserLockedStatus("beni", true))
+	u, _ := storage.GetUserByName("beni")
+	assert.True(t, u.IsLocked)
+}
+
+func TestPut_shouldFailWhileAuthServerHoldsTheFile(t *testing.T) {
+	storage, path := newStorage(t)
+
+	db, err := bolt.Open(path, 0600, nil)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	err = storage.InsertItem("teleport/roles/dev/params", "{}", 0)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "is the auth server running?")
+}
+
+// records as teleport's bolt backend writes them: the json value base64
+// encoded in val, next to when it was created and its ttl in nanoseconds
+const (
+	teleportRole  = `{"created":"2019-11-05T08:12:41.713254127Z","ttl":0,"val":"eyJraW5kIjoicm9sZSIsInZlcnNpb24iOiJ2MyIsIm1ldGFkYXRhIjp7Im5hbWUiOiJvcHMiLCJuYW1lc3BhY2UiOiJkZWZhdWx0In0sInNwZWMiOnsib3B0aW9ucyI6eyJmb3J3YXJkX2FnZW50IjpmYWxzZSwibWF4X3Nlc3Npb25fdHRsIjoiMzBoMG0wcyJ9LCJhbGxvdyI6eyJsb2dpbnMiOlsicm9vdCJdLCJub2RlX2xhYmVscyI6eyJlbnYiOiJwcm9kdWN0aW9uIn19LCJkZW55Ijp7fX19"}`
+	expiredToken  = `{"created":"2019-11-05T08:12:41.713254127Z","ttl":3600000000000,"val":"eyJ0b2tlbiI6ImFiYyIsInVzZXIiOnsibmFtZSI6ImJ1ZGkiLCJyb2xlcyI6bnVsbH19"}`
+	teleportToken = `{"created":"2019-11-05T08:12:41.713254127Z","ttl":0,"val":"eyJ0b2tlbiI6ImFiYyIsInVzZXIiOnsibmFtZSI6ImJ1ZGkiLCJyb2xlcyI6bnVsbH19"}`
+)
+
+func putRaw(t *testing.T, path string, buckets []string, key, value string) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(buckets[0]))
+		if err != nil {
+			return err
+		}
+		for _, name := range buckets[1:] {
+			if bucket, err = bucket.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte(key), []byte(value))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetRoleByName_shouldReadRecordsWrittenByTeleport(t *testing.T) {
+	storage, path := newStorage(t)
+	putRaw(t, path, []string{"roles", "ops"}, "params", teleportRole)
+
+	r, err := storage.GetRoleByName("ops")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"root"}, r.AllowedLogins)
+	assert.Equal(t, "production", r.NodePatterns["env"])
+
+	roles, err := storage.GetRoles()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(roles))
+}
+
+func TestGetAddUserToken_shouldSkipExpiredRecords(t *testing.T) {
+	storage, path := newStorage(t)
+	putRaw(t, path, []string{"addusertokens"}, "abc", expiredToken)
+
+	addUserToken, err := storage.GetAddUserToken("abc")
+	assert.Nil(t, err)
+	assert.Nil(t, addUserToken)
+
+	addUserToken, err = storage.GetAddUserTokenByUserName("budi")
+	assert.Nil(t, err)
+	assert.Nil(t, addUserToken)
+}
+
+func TestUpdateAddUserToken_shouldKeepTheRecordTTL(t *testing.T) {
+	storage, path := newStorage(t)
+	putRaw(t, path, []string{"addusertokens"}, "abc", teleportToken)
+	assert.Nil(t, storage.InsertItem("teleport/addusertokens/def", `{"token":"def","user":{"name":"loki","roles":null}}`, 3600))
+
+	for _, name := range []string{"abc", "def"} {
+		addUserToken, _ := storage.GetAddUserToken(name)
+		addUserToken.SetRoles([]string{"dev"})
+		assert.Nil(t, storage.UpdateAddUserToken(addUserToken))
+	}
+
+	db, _ := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	defer db.Close()
+	db.View(func(tx *bolt.Tx) error {
+		var record struct {
+			Created time.Time     `json:"created"`
+			TTL     time.Duration `json:"ttl"`
+		}
+		bucket := tx.Bucket([]byte("addusertokens"))
+		assert.Nil(t, json.Unmarshal(bucket.Get([]byte("abc")), &record))
+		assert.Equal(t, time.Duration(0), record.TTL)
+		assert.Equal(t, 2019, record.Created.Year())
+
+		assert.Nil(t, json.Unmarshal(bucket.Get([]byte("def")), &record))
+		assert.Equal(t, time.Hour, record.TTL)
+		return nil
+	})
+}
+
+func TestCreateItem_shouldRefuseExistingRecords(t *testing.T) {
+	storage, _ := newStorage(t)
+	assert.Nil(t, storage.CreateItem("teleport/tero/requests/abc", `{"id":"abc"}`))
+	assert.Equal(t, errs.ErrExists, storage.CreateItem("teleport/tero/requests/abc", `{"id":"other"}`))
+
+	items, err := storage.GetItems("teleport/tero/requests/abc")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"id":"abc"}`, items["teleport/tero/requests/abc"])
+}
@@ -0,0 +1,381 @@
+package dir
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bentol/tero/backend/errs"
+	"github.com/bentol/tero/backend/kv"
+	"github.com/bentol/tero/config"
+	"github.com/gofrs/flock"
+)
+
+const lockFileName = ".tero.lock"
+
+// DirStorage reads and writes teleport records stored as plain files, the
+// way teleport's "dir" backend does: teleport/roles/admin/params lives in
+// <path>/roles/admin/params, and its expiry, if it has one, in
+// <path>/roles/admin/.params.ttl
+//
+// The lock file only keeps tero processes apart, teleport never takes it.
+// The auth server has to be stopped while tero writes: writes are refused
+// as long as the process in pidFile runs, and without a pidFile unless
+// force is set.
+type DirStorage struct {
+	kv.Storage
+	path    string
+	pidFile string
+	force   bool
+	// mu serializes access inside this process, lock guards against
+	// other tero processes
+	mu          sync.Mutex
+	lock        *flock.Flock
+	lockTimeout time.Duration
+}
+
+func New(conf config.DirConfig) (*DirStorage, error) {
+	info, err := os.Stat(conf.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open teleport data directory `%s`: %s", conf.Path, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("Teleport data directory `%s` is not a directory", conf.Path)
+	}
+
+	lockTimeout := time.Duration(conf.LockTimeout) * time.Second
+	if lockTimeout == 0 {
+		lockTimeout = 5 * time.Second
+	}
+
+	d := &DirStorage{
+		path:        conf.Path,
+		pidFile:     conf.PidFile,
+		force:       conf.Force,
+		lock:        flock.New(filepath.Join(conf.Path, lockFileName)),
+		lockTimeout: lockTimeout,
+	}
+	d.Storage = kv.Storage{Store: d}
+	return d, nil
+}
+
+func (d *DirStorage) Get(path string) (*kv.Item, error) {
+	unlock, err := d.acquire(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	file, err := d.file(path)
+	if err != nil {
+		return nil, err
+	}
+	value, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	expired, err := isExpired(file)
+	if expired || err != nil {
+		return nil, err
+	}
+
+	return &kv.Item{
+		Path:  path,
+		Value: value,
+	}, nil
+}
+
+func (d *DirStorage) List(prefix string) ([]kv.Item, error) {
+	unlock, err := d.acquire(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// only walk the deepest directory the prefix fully names
+	root, err := d.file(prefix[:strings.LastIndex(prefix, "/")+1])
+	if err != nil {
+		return nil, err
+	}
+	result := make([]kv.Item, 0)
+	err = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+
+		path := d.itemPath(file)
+		if !strings.HasPrefix(path, prefix) {
+			return nil
+		}
+		expired, err := isExpired(file)
+		if expired || err != nil {
+			return err
+		}
+		value, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		result = append(result, kv.Item{
+			Path:  path,
+			Value: value,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result, nil
+}
+
+func (d *DirStorage) Put(path string, value []byte, ttl int64) error {
+	unlock, err := d.acquire(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := d.file(path)
+	if err != nil {
+		return err
+	}
+	return d.put(file, value, ttl)
+}
+
+func (d *DirStorage) Create(path string, value []byte) error {
+	unlock, err := d.acquire(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := d.file(path)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		expired, err := isExpired(file)
+		if err != nil {
+			return err
+		}
+		if !expired {
+			return errs.ErrExists
+		}
+	}
+	return d.put(file, value, 0)
+}
+
+func (d *DirStorage) CompareAndSwap(path string, old, value []byte) error {
+	unlock, err := d.acquire(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := d.file(path)
+	if err != nil {
+		return err
+	}
+	current, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return errs.ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	expired, err := isExpired(file)
+	if err != nil {
+		return err
+	}
+	if expired || !bytes.Equal(current, old) {
+		return errs.ErrConflict
+	}
+
+	// the ttl file stays, so the record expires when it would have
+	return d.write(file, value)
+}
+
+func (d *DirStorage) Delete(path string) error {
+	unlock, err := d.acquire(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := d.file(path)
+	if err != nil {
+		return err
+	}
+	for _, f := range []string{file, ttlFile(file)} {
+		err = os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// put writes the record and its ttl file, it expects the caller to hold
+// the exclusive lock
+func (d *DirStorage) put(file string, value []byte, ttl int64) error {
+	if err := d.write(file, value); err != nil {
+		return err
+	}
+
+	if ttl <= 0 {
+		err := os.Remove(ttlFile(file))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	expires, err := time.Now().UTC().Add(time.Duration(ttl) * time.Second).MarshalText()
+	if err != nil {
+		return err
+	}
+	return d.write(ttlFile(file), expires)
+}
+
+// write expects the caller to hold the exclusive lock
+func (d *DirStorage) write(file string, value []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	// write to a temp file first so readers never see a half written record
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func (d *DirStorage) acquire(exclusive bool) (func(), error) {
+	if exclusive {
+		if err := d.checkAuthServer(); err != nil {
+			return nil, err
+		}
+	}
+
+	d.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), d.lockTimeout)
+	defer cancel()
+
+	var locked bool
+	var err error
+	if exclusive {
+		locked, err = d.lock.TryLockContext(ctx, 50*time.Millisecond)
+	} else {
+		locked, err = d.lock.TryRLockContext(ctx, 50*time.Millisecond)
+	}
+	if err != nil || !locked {
+		d.mu.Unlock()
+		return nil, fmt.Errorf("Cannot lock teleport data directory `%s`, is another process holding it?", d.path)
+	}
+
+	return func() {
+		d.lock.Unlock()
+		d.mu.Unlock()
+	}, nil
+}
+
+// checkAuthServer fails when the pid file names a running process, or
+// when there is no pid file to check and force is not set.
+func (d *DirStorage) checkAuthServer() error {
+	if d.pidFile == "" {
+		if d.force {
+			return nil
+		}
+		return fmt.Errorf("Cannot tell whether teleport is running on `%s`, set pid_file in [dir] or stop the auth server and pass --force", d.path)
+	}
+	raw, err := ioutil.ReadFile(d.pidFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("Invalid pid file %s", d.pidFile)
+	}
+
+	if syscall.Kill(pid, 0) == syscall.ESRCH {
+		return nil
+	}
+	return fmt.Errorf("Teleport is running with pid %d (%s), stop the auth server before changing teleport data directory `%s`", pid, d.pidFile, d.path)
+}
+
+// file maps a record path to its file, paths with segments that could
+// leave the data directory or clash with ttl and lock files are refused.
+func (d *DirStorage) file(path string) (string, error) {
+	rel := strings.TrimPrefix(path, "teleport/")
+	segments := strings.Split(strings.TrimSuffix(rel, "/"), "/")
+	for _, segment := range segments {
+		if strings.HasPrefix(segment, ".") || strings.ContainsRune(segment, '\\') || strings.ContainsRune(segment, filepath.Separator) {
+			return "", fmt.Errorf("Invalid record path `%s`", path)
+		}
+	}
+	return filepath.Join(d.path, filepath.FromSlash(rel)), nil
+}
+
+func (d *DirStorage) itemPath(file string) string {
+	relPath, _ := filepath.Rel(d.path, file)
+	return "teleport/" + filepath.ToSlash(relPath)
+}
+
+// ttlFile is where teleport keeps the expiry of the record in file
+func ttlFile(file string) string {
+	return filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".ttl")
+}
+
+// isExpired reports whether the ttl file of file holds a time in the past
+func isExpired(file string) (bool, error) {
+	raw, err := ioutil.ReadFile(ttlFile(file))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var expires time.Time
+	if err := expires.UnmarshalText(raw); err != nil {
+		return false, fmt.Errorf("Invalid ttl file %s: %s", ttlFile(file), err)
+	}
+	return time.Now().After(expires), nil
+}
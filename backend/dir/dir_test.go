@@ -0,0 +1,176 @@
+package dir_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bentol/tero/backend/dir"
+	"github.com/bentol/tero/backend/errs"
+	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/role"
+	"github.com/gofrs/flock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newStorage(t *testing.T) (*dir.DirStorage, string) {
+	path := t.TempDir()
+	storage, err := dir.New(config.DirConfig{Path: path, LockTimeout: 1, Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, path
+}
+
+func TestNew_shouldFailIfDirectoryMissing(t *testing.T) {
+	_, err := dir.New(config.DirConfig{Path: filepath.Join(t.TempDir(), "missing")})
+	assert.NotNil(t, err)
+}
+
+func TestCreateRole_shouldWriteTeleportLayout(t *testing.T) {
+	storage, path := newStorage(t)
+
+	_, err := storage.CreateRole(role.Role{Name: "dev", AllowedLogins: []string{"ubuntu"}, NodePatterns: map[string]string{"env": "staging"}})
+	assert.Nil(t, err)
+
+	raw, err := ioutil.ReadFile(filepath.Join(path, "roles", "dev", "params"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(raw), `"name":"dev"`)
+
+	roles, err := storage.GetRoles()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(roles))
+	assert.Equal(t, "staging", roles[0].NodePatterns["env"])
+
+	assert.Nil(t, storage.DeleteRole("dev"))
+	r, err := storage.GetRoleByName("dev")
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+}
+
+func TestAttachRole_shouldUpdateUsers(t *testing.T) {
+	storage, _ := newStorage(t)
+	for _, name := range []string{"beni", "hulk"} {
+		value := `{"kind":"user","version":"v2","metadata":{"name":"` + name + `"},"spec":{"roles":[],"status":{"is_locked":false}}}`
+		assert.Nil(t, storage.InsertItem("teleport/web/users/"+name+"/params", value, 0))
+	}
+
+	r, _ := storage.CreateRole(role.Role{Name: "dev", AllowedLogins: []string{"ubuntu"}, NodePatterns: map[string]string{"env": "staging"}})
+	users, _ := storage.GetUsersByNames([]string{"beni", "hulk"})
+	_, err := storage.AttachRole(r, users)
+	assert.Nil(t, err)
+
+	users, _ = storage.GetUsersByRole("dev")
+	assert.Equal(t, 2, len(users))
+}
+
+func TestPut_shouldFailWhenDirectoryIsLocked(t *testing.T) {
+	storage, path := newStorage(t)
+
+	lock := flock.New(filepath.Join(path, ".tero.lock"))
+	locked, err := lock.TryLock()
+	assert.True(t, locked)
+	assert.Nil(t, err)
+	defer lock.Unlock()
+
+	err = storage.InsertItem("teleport/roles/dev/params", "{}", 0)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Cannot lock")
+}
+
+func TestPut_shouldRefusePathsLeavingTheDirectory(t *testing.T) {
+	storage, path := newStorage(t)
+
+	err := storage.InsertItem("teleport/roles/../../x/params", "{}", 0)
+	assert.EqualError(t, err, "Invalid record path `teleport/roles/../../x/params`")
+	_, err = storage.GetItems("teleport/../")
+	assert.NotNil(t, err)
+
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	for _, f := range files {
+		assert.NotEqual(t, "x", f.Name())
+	}
+}
+
+func TestPut_shouldRefuseWritesWhileTeleportRuns(t *testing.T) {
+	path := t.TempDir()
+	pidFile := filepath.Join(path, "teleport.pid")
+	storage, err := dir.New(config.DirConfig{Path: path, LockTimeout: 1, PidFile: pidFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, storage.InsertItem("teleport/roles/dev/params", "{}", 0))
+
+	ioutil.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600)
+	err = storage.InsertItem("teleport/roles/dev/params", "{}", 0)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "stop the auth server")
+	_, err = storage.GetItems("teleport/roles/")
+	assert.Nil(t, err)
+}
+
+func TestPut_shouldRefuseWritesWithoutPidFileUnlessForced(t *testing.T) {
+	path := t.TempDir()
+	storage, err := dir.New(config.DirConfig{Path: path, LockTimeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.InsertItem("teleport/roles/dev/params", "{}", 0)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "--force")
+	_, err = storage.GetItems("teleport/roles/")
+	assert.Nil(t, err)
+}
+
+func TestPut_shouldWriteTheTTLFileTeleportReads(t *testing.T) {
+	storage, path := newStorage(t)
+	value := `{"token":"abc","user":{"name":"budi","roles":null}}`
+	assert.Nil(t, storage.InsertItem("teleport/addusertokens/abc", value, 3600))
+
+	raw, err := ioutil.ReadFile(filepath.Join(path, "addusertokens", ".abc.ttl"))
+	assert.Nil(t, err)
+	var expires time.Time
+	assert.Nil(t, expires.UnmarshalText(raw))
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expires, time.Minute)
+
+	addUserToken, _ := storage.GetAddUserToken("abc")
+	addUserToken.SetRoles([]string{"dev"})
+	assert.Nil(t, storage.UpdateAddUserToken(addUserToken))
+	kept, _ := ioutil.ReadFile(filepath.Join(path, "addusertokens", ".abc.ttl"))
+	assert.Equal(t, raw, kept)
+
+	assert.Nil(t, storage.DeleteItem("teleport/addusertokens/abc"))
+	_, err = os.Stat(filepath.Join(path, "addusertokens", ".abc.ttl"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGet_shouldSkipExpiredRecords(t *testing.T) {
+	storage, path := newStorage(t)
+	// written by teleport: the value and its expiry next to it
+	tokens := filepath.Join(path, "addusertokens")
+	os.MkdirAll(tokens, 0700)
+	ioutil.WriteFile(filepath.Join(tokens, "abc"), []byte(`{"token":"abc","user":{"name":"budi","roles":null}}`), 0600)
+	ioutil.WriteFile(filepath.Join(tokens, ".abc.ttl"), []byte("2019-11-05T08:12:41.713254127Z"), 0600)
+
+	addUserToken, err := storage.GetAddUserToken("abc")
+	assert.Nil(t, err)
+	assert.Nil(t, addUserToken)
+	addUserToken, err = storage.GetAddUserTokenByUserName("budi")
+	assert.Nil(t, err)
+	assert.Nil(t, addUserToken)
+}
+
+func TestCreateItem_shouldRefuseExistingRecords(t *testing.T) {
+	storage, _ := newStorage(t)
+	assert.Nil(t, storage.CreateItem("teleport/tero/requests/abc", `{"id":"abc"}`))
+	assert.Equal(t, errs.ErrExists, storage.CreateItem("teleport/tero/requests/abc", `{"id":"other"}`))
+
+	items, err := storage.GetItems("teleport/tero/requests/abc")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"id":"abc"}`, items["teleport/tero/requests/abc"])
+}
@@ -3,16 +3,20 @@ package dynamo
 import (
 	"errors"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
 	"github.com/Jeffail/gabs"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/bentol/tero/backend/errs"
+	"github.com/bentol/tero/config"
 	"github.com/bentol/tero/role"
 	"github.com/bentol/tero/token"
 	"github.com/bentol/tero/user"
@@ -20,10 +24,15 @@ import (
 
 var (
 	tableName *string
+
+	// throttled requests are retried maxRetries times, waiting
+	// retryBaseDelay, then twice as long after every attempt
+	maxRetries     = 5
+	retryBaseDelay = 100 * time.Millisecond
 )
 
 type DynamoStorage struct {
-	Svc *dynamodb.DynamoDB
+	Svc dynamodbiface.DynamoDBAPI
 }
 
 type DynamoRow struct {
@@ -34,30 +43,87 @@ type DynamoRow struct {
 	Timestamp int64
 }
 
-func New() DynamoStorage {
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String("localhost")},
-	)
-	sess.Config.Endpoint = aws.String("http://localhost:4567")
-	sess.Config.DisableSSL = aws.Bool(true)
-	creds := credentials.NewStaticCredentials("access_key", "secret_key", "")
-	sess.Config.Credentials = creds
+func New(conf config.DynamoDBConfig) (DynamoStorage, error) {
+	awsConfig := &aws.Config{
+		Region:     aws.String(conf.Region),
+		DisableSSL: aws.Bool(conf.DisableSSL),
+	}
+	if conf.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(conf.Endpoint)
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return DynamoStorage{}, err
+	}
 
+	creds, err := newCredentials(sess, conf)
 	if err != nil {
-		log.Fatal(err)
+		return DynamoStorage{}, err
+	}
+	if creds != nil {
+		sess.Config.Credentials = creds
 	}
 
 	// Create DynamoDB client
 	svc := dynamodb.New(sess)
-	tableName = aws.String("teleport.state")
+	tableName = aws.String(conf.TableName)
+	if conf.TableName == "" {
+		tableName = aws.String("teleport.state")
+	}
 
-	return DynamoStorage{
+	dyn := DynamoStorage{
 		svc,
 	}
+	if err := dyn.checkTable(); err != nil {
+		return DynamoStorage{}, err
+	}
+
+	return dyn, nil
+}
+
+func newCredentials(sess *session.Session, conf config.DynamoDBConfig) (*credentials.Credentials, error) {
+	switch conf.Credentials {
+	case "":
+		return nil, nil
+	case "static":
+		return credentials.NewStaticCredentials(conf.AccessKey, conf.SecretKey, ""), nil
+	case "env":
+		return credentials.NewEnvCredentials(), nil
+	case "shared":
+		return credentials.NewSharedCredentials("", conf.Profile), nil
+	case "instance":
+		return ec2rolecreds.NewCredentials(sess), nil
+	}
+
+	return nil, fmt.Errorf("Unknown dynamodb credentials `%s`, use one of: static, env, shared, instance", conf.Credentials)
 }
 
-func (dyn DynamoStorage) GetRoles() ([]role.Role, error) {
-	result := make([]role.Role, 0)
+// checkTable makes sure the table is reachable and uses the key schema
+// teleport creates (HashKey as partition key, FullPath as sort key).
+func (dyn DynamoStorage) checkTable() error {
+	resp, err := dyn.Svc.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: tableName,
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot reach dynamodb table `%s`: %s", *tableName, err)
+	}
+
+	keys := make(map[string]string)
+	for _, k := range resp.Table.KeySchema {
+		keys[aws.StringValue(k.AttributeName)] = aws.StringValue(k.KeyType)
+	}
+	if len(keys) != 2 || keys["HashKey"] != dynamodb.KeyTypeHash || keys["FullPath"] != dynamodb.KeyTypeRange {
+		return fmt.Errorf("Dynamodb table `%s` has unexpected key schema, expected HashKey (HASH) and FullPath (RANGE)", *tableName)
+	}
+
+	return nil
+}
+
+// queryPrefix returns every item under the teleport hash key whose
+// FullPath starts with prefix, following LastEvaluatedKey until the whole
+// result set is read.
+func (dyn DynamoStorage) queryPrefix(prefix string) ([]map[string]*dynamodb.AttributeValue, error) {
 	queryParams := &dynamodb.QueryInput{
 		TableName: tableName,
 		KeyConditions: map[string]*dynamodb.Condition{
@@ -73,37 +139,100 @@ func (dyn DynamoStorage) GetRoles() ([]role.Role, error) {
 				ComparisonOperator: aws.String("BEGINS_WITH"),
 				AttributeValueList: []*dynamodb.AttributeValue{
 					{
-						S: aws.String("teleport/roles"),
+						S: aws.String(prefix),
 					},
 				},
 			},
 		},
 	}
 
-	resp, err := dyn.Svc.Query(queryParams)
+	items := make([]map[string]*dynamodb.AttributeValue, 0)
+	for {
+		var resp *dynamodb.QueryOutput
+		err := withRetry(func() error {
+			var err error
+			resp, err = dyn.Svc.Query(queryParams)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, resp.Items...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			return items, nil
+		}
+		queryParams.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+func (dyn DynamoStorage) getItem(params *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	var resp *dynamodb.GetItemOutput
+	err := withRetry(func() error {
+		var err error
+		resp, err = dyn.Svc.GetItem(params)
+		return err
+	})
+	return resp, err
+}
+
+// withRetry runs fn again with exponential backoff as long as dynamodb
+// reports the table is throttled.
+func withRetry(fn func() error) error {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if !isThrottled(err) {
+			return err
+		}
+		if attempt == maxRetries {
+			return fmt.Errorf("Dynamodb is still throttling after %d retries: %s", maxRetries, err)
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func isThrottled(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+
+	switch aerr.Code() {
+	case dynamodb.ErrCodeProvisionedThroughputExceededException, dynamodb.ErrCodeRequestLimitExceeded, "ThrottlingException":
+		return true
+	}
+	return false
+}
+
+func (dyn DynamoStorage) GetRoles() ([]role.Role, error) {
+	result := make([]role.Role, 0)
+	items, err := dyn.queryPrefix("teleport/roles")
 	if err != nil {
 		return nil, err
 	}
 
-	for _, item := range resp.Items {
-		result = append(result, dynItemToRole(item))
+	for _, item := range items {
+		r := dynItemToRole(item)
+		// a record that does not parse has no name, fsck reports it
+		if r.Name == "" {
+			continue
+		}
+		result = append(result, r)
 	}
 	return result, nil
 }
 
-func (dyn DynamoStorage) CreateRole(name string, allowedLogins []string, nodePatterns map[string]string) (*role.Role, error) {
+func (dyn DynamoStorage) CreateRole(newRole role.Role) (*role.Role, error) {
 	svc := dyn.Svc
 
-	jsonTemplate, _ := gabs.ParseJSON([]byte(role.RoleJsonTemplate))
-	jsonTemplate.SetP(name, "metadata.name")
-	jsonTemplate.SetP(allowedLogins, "spec.allow.logins")
-	jsonTemplate.SetP(nodePatterns, "spec.allow.node_labels")
-
 	row := DynamoRow{
 		0,
 		"teleport",
-		[]byte(jsonTemplate.String()),
-		fmt.Sprintf("teleport/roles/%s/params", name),
+		[]byte(newRole.GetJSON()),
+		fmt.Sprintf("teleport/roles/%s/params", newRole.Name),
 		time.Now().UnixNano() / int64(time.Second),
 	}
 
@@ -121,7 +250,7 @@ func (dyn DynamoStorage) CreateRole(name string, allowedLogins []string, nodePat
 		return nil, err
 	}
 
-	return dyn.GetRoleByName(name)
+	return dyn.GetRoleByName(newRole.Name)
 }
 
 func (dyn DynamoStorage) DeleteRole(name string) error {
@@ -146,8 +275,6 @@ func (dyn DynamoStorage) DeleteRole(name string) error {
 }
 
 func (dyn DynamoStorage) GetRoleByName(name string) (*role.Role, error) {
-	svc := dyn.Svc
-
 	params_get := &dynamodb.GetItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
 			"FullPath": {
@@ -159,7 +286,7 @@ func (dyn DynamoStorage) GetRoleByName(name string) (*role.Role, error) {
 		},
 		TableName: tableName,
 	}
-	resp, err := svc.GetItem(params_get)
+	resp, err := dyn.getItem(params_get)
 	if err != nil {
 		return nil, err
 	}
@@ -172,174 +299,90 @@ func (dyn DynamoStorage) GetRoleByName(name string) (*role.Role, error) {
 	return &r, nil
 }
 
-func (dyn DynamoStorage) UpdateRole(name string, allowedLogins []string, nodePatterns map[string]string) (*role.Role, error) {
-	oldRole, _ := dyn.GetRoleByName(name)
-	oldRole.AllowedLogins = allowedLogins
-	oldRole.NodePatterns = nodePatterns
-
-	paramsUpdate := &dynamodb.UpdateItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"FullPath": {
-				S: aws.String(fmt.Sprintf("teleport/roles/%s/params", name)),
-			},
-			"HashKey": {
-				S: aws.String("teleport"),
-			},
-		},
-		TableName: tableName,
-		ExpressionAttributeNames: map[string]*string{
-			"#Value": aws.String("Value"),
-		},
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":v": {
-				B: []byte(oldRole.GetJSON()),
-			},
-		},
-		UpdateExpression: aws.String("SET #Value = :v"),
-		ReturnValues:     aws.String("ALL_NEW"),
-	}
-
-	resp, err := dyn.Svc.UpdateItem(paramsUpdate)
+func (dyn DynamoStorage) UpdateRole(name string, change func(r *role.Role)) (*role.Role, error) {
+	path := fmt.Sprintf("teleport/roles/%s/params", name)
+	item, err := dyn.updateValue(path, func(old []byte) ([]byte, error) {
+		oldRole, err := role.FromJSON(old)
+		if err != nil {
+			return nil, err
+		}
+		change(&oldRole)
+		return []byte(oldRole.GetJSON()), nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	updatedRole := dynItemToRole(resp.Attributes)
+	updatedRole := dynItemToRole(item)
 	return &updatedRole, nil
 }
 
 func (dyn DynamoStorage) DetachRole(selectedRole *role.Role, users []user.User) ([]user.User, error) {
-	updatedUserRow := make([]map[string]*dynamodb.AttributeValue, 0)
-
-	for _, user := range users {
+	return dyn.updateUsers(users, func(u *user.User) {
 		updatedRoles := make([]role.Role, 0)
-		for _, r := range user.Roles {
+		for _, r := range u.Roles {
 			if r.Name != selectedRole.Name {
 				updatedRoles = append(updatedRoles, r)
 			}
 		}
-		user.Roles = updatedRoles
-
-		paramsUpdate := &dynamodb.UpdateItemInput{
-			Key: map[string]*dynamodb.AttributeValue{
-				"FullPath": {
-					S: aws.String(fmt.Sprintf("teleport/web/users/%s/params", user.Name)),
-				},
-				"HashKey": {
-					S: aws.String("teleport"),
-				},
-			},
-			TableName: tableName,
-			ExpressionAttributeNames: map[string]*string{
-				"#Value": aws.String("Value"),
-			},
-			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-				":v": {
-					B: []byte(user.GetJSON()),
-				},
-			},
-			UpdateExpression: aws.String("SET #Value = :v"),
-			ReturnValues:     aws.String("ALL_NEW"),
-		}
+		u.Roles = updatedRoles
+	})
+}
 
-		resp, err := dyn.Svc.UpdateItem(paramsUpdate)
-		if err != nil {
-			return nil, err
-		}
+func (dyn DynamoStorage) AttachRole(selectedRole *role.Role, users []user.User) ([]user.User, error) {
+	return dyn.updateUsers(users, func(u *user.User) {
+		u.Roles = append(u.Roles, *selectedRole)
+	})
+}
 
-		updatedUserRow = append(updatedUserRow, resp.Attributes)
+func (dyn DynamoStorage) updateUsers(users []user.User, change func(u *user.User)) ([]user.User, error) {
+	allRoles, err := dyn.GetRoles()
+	if err != nil {
+		return nil, err
 	}
-
-	allRoles, _ := dyn.GetRoles()
-	mappedUsers := dynItemsToUsers(updatedUserRow, allRoles)
-	result := make([]user.User, 0, len(mappedUsers))
-	for _, u := range mappedUsers {
-		result = append(result, u)
+	mappedRoles := make(map[string]role.Role)
+	for _, r := range allRoles {
+		mappedRoles[r.Name] = r
 	}
-	return result, nil
-}
 
-func (dyn DynamoStorage) AttachRole(selectedRole *role.Role, users []user.User) ([]user.User, error) {
 	updatedUserRow := make([]map[string]*dynamodb.AttributeValue, 0)
-
-	for _, user := range users {
-		user.Roles = append(user.Roles, *selectedRole)
-
-		paramsUpdate := &dynamodb.UpdateItemInput{
-			Key: map[string]*dynamodb.AttributeValue{
-				"FullPath": {
-					S: aws.String(fmt.Sprintf("teleport/web/users/%s/params", user.Name)),
-				},
-				"HashKey": {
-					S: aws.String("teleport"),
-				},
-			},
-			TableName: tableName,
-			ExpressionAttributeNames: map[string]*string{
-				"#Value": aws.String("Value"),
-			},
-			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-				":v": {
-					B: []byte(user.GetJSON()),
-				},
-			},
-			UpdateExpression: aws.String("SET #Value = :v"),
-			ReturnValues:     aws.String("ALL_NEW"),
-		}
-
-		resp, err := dyn.Svc.UpdateItem(paramsUpdate)
+	for _, u := range users {
+		path := fmt.Sprintf("teleport/web/users/%s/params", u.Name)
+		item, err := dyn.updateValue(path, func(old []byte) ([]byte, error) {
+			freshUser, err := user.FromJSON(old, mappedRoles)
+			if err != nil {
+				return nil, err
+			}
+			change(&freshUser)
+			return []byte(freshUser.GetJSON()), nil
+		})
 		if err != nil {
 			return nil, err
 		}
 
-		updatedUserRow = append(updatedUserRow, resp.Attributes)
+		updatedUserRow = append(updatedUserRow, item)
 	}
 
-	allRoles, _ := dyn.GetRoles()
-	mappedUsers := dynItemsToUsers(updatedUserRow, allRoles)
-	result := make([]user.User, 0, len(mappedUsers))
-	for _, u := range mappedUsers {
-		result = append(result, u)
-	}
-	return result, nil
+	return dynItemsToUsersAsArray(updatedUserRow, allRoles), nil
 }
 
 func (dyn DynamoStorage) GetAllUsers() ([]user.User, error) {
-	queryParams := &dynamodb.QueryInput{
-		TableName: tableName,
-		KeyConditions: map[string]*dynamodb.Condition{
-			"HashKey": {
-				ComparisonOperator: aws.String("EQ"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String("teleport"),
-					},
-				},
-			},
-			"FullPath": {
-				ComparisonOperator: aws.String("BEGINS_WITH"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String("teleport/web/users"),
-					},
-				},
-			},
-		},
-	}
-
-	resp, err := dyn.Svc.Query(queryParams)
+	items, err := dyn.queryPrefix("teleport/web/users")
 	if err != nil {
 		return nil, err
 	}
 	cleanUsers := make([]map[string]*dynamodb.AttributeValue, 0)
-	for _, v := range resp.Items {
+	for _, v := range items {
 		path := *v["FullPath"].S
 		if strings.HasSuffix(path, "params") {
 			cleanUsers = append(cleanUsers, v)
 		}
 	}
 
-	allRoles, _ := dyn.GetRoles()
+	allRoles, err := dyn.GetRoles()
+	if err != nil {
+		return nil, err
+	}
 	allUsers := dynItemsToUsersAsArray(cleanUsers, allRoles)
 	return allUsers, nil
 }
@@ -364,40 +407,21 @@ func (dyn DynamoStorage) GetUsersByRole(roleName string) ([]user.User, error) {
 }
 
 func (dyn DynamoStorage) GetUsers() (map[string]user.User, error) {
-	queryParams := &dynamodb.QueryInput{
-		TableName: tableName,
-		KeyConditions: map[string]*dynamodb.Condition{
-			"HashKey": {
-				ComparisonOperator: aws.String("EQ"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String("teleport"),
-					},
-				},
-			},
-			"FullPath": {
-				ComparisonOperator: aws.String("BEGINS_WITH"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String("teleport/web/users"),
-					},
-				},
-			},
-		},
-	}
-
-	resp, err := dyn.Svc.Query(queryParams)
+	items, err := dyn.queryPrefix("teleport/web/users")
 	if err != nil {
 		return nil, err
 	}
 	cleanUsers := make([]map[string]*dynamodb.AttributeValue, 0)
-	for _, v := range resp.Items {
+	for _, v := range items {
 		path := *v["FullPath"].S
 		if strings.HasSuffix(path, "params") {
 			cleanUsers = append(cleanUsers, v)
 		}
 	}
-	allRoles, _ := dyn.GetRoles()
+	allRoles, err := dyn.GetRoles()
+	if err != nil {
+		return nil, err
+	}
 	allUsers := dynItemsToUsers(cleanUsers, allRoles)
 	return allUsers, nil
 }
@@ -425,8 +449,6 @@ func (dyn DynamoStorage) GetUsersByNames(names []string) ([]user.User, error) {
 }
 
 func (dyn DynamoStorage) GetUserByName(username string) (*user.User, error) {
-	svc := dyn.Svc
-
 	params_get := &dynamodb.GetItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
 			"FullPath": {
@@ -438,7 +460,7 @@ func (dyn DynamoStorage) GetUserByName(username string) (*user.User, error) {
 		},
 		TableName: tableName,
 	}
-	resp, err := svc.GetItem(params_get)
+	resp, err := dyn.getItem(params_get)
 	if err != nil {
 		return nil, err
 	}
@@ -447,7 +469,10 @@ func (dyn DynamoStorage) GetUserByName(username string) (*user.User, error) {
 		return nil, nil
 	}
 
-	allRoles, _ := dyn.GetRoles()
+	allRoles, err := dyn.GetRoles()
+	if err != nil {
+		return nil, err
+	}
 	mappedRoles := make(map[string]role.Role)
 	for _, r := range allRoles {
 		mappedRoles[r.Name] = r
@@ -468,7 +493,7 @@ func (dyn DynamoStorage) GetAddUserToken(userToken string) (*token.AddUserToken,
 		},
 		TableName: tableName,
 	}
-	resp, err := dyn.Svc.GetItem(params_get)
+	resp, err := dyn.getItem(params_get)
 	if err != nil {
 		return nil, err
 	}
@@ -478,51 +503,30 @@ func (dyn DynamoStorage) GetAddUserToken(userToken string) (*token.AddUserToken,
 	}
 
 	addUserToken := token.AddUserToken{
-		userToken,
-		resp.Item["Value"].B,
+		Token: userToken,
+		JSON:  resp.Item["Value"].B,
 	}
 	return &addUserToken, nil
 }
 
 func (dyn DynamoStorage) GetAddUserTokenByUserName(searchedUserName string) (*token.AddUserToken, error) {
 	// todo: move filtering in database side
-	queryParams := &dynamodb.QueryInput{
-		TableName: tableName,
-		KeyConditions: map[string]*dynamodb.Condition{
-			"HashKey": {
-				ComparisonOperator: aws.String("EQ"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String("teleport"),
-					},
-				},
-			},
-			"FullPath": {
-				ComparisonOperator: aws.String("BEGINS_WITH"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String("teleport/addusertokens"),
-					},
-				},
-			},
-		},
-	}
-
-	resp, err := dyn.Svc.Query(queryParams)
+	items, err := dyn.queryPrefix("teleport/addusertokens")
 	if err != nil {
 		return nil, err
 	}
 
-	for _, v := range resp.Items {
+	// a malformed token is skipped, `tero fsck` reports it
+	for _, v := range items {
 		json, err := gabs.ParseJSON(v["Value"].B)
 		if err != nil {
-			return nil, err
+			continue
 		}
-		userName := json.Path("user.name").Data().(string)
+		userName, _ := json.Path("user.name").Data().(string)
 		if searchedUserName == userName {
 			addUsertoken := token.AddUserToken{
-				json.Path("token").Data().(string),
-				v["Value"].B,
+				Token: strings.TrimPrefix(*v["FullPath"].S, "teleport/addusertokens/"),
+				JSON:  v["Value"].B,
 			}
 			return &addUsertoken, nil
 		}
@@ -538,7 +542,7 @@ func (dyn DynamoStorage) InsertItem(path, value string, ttl int64) error {
 		ttl,
 		"teleport",
 		[]byte(value),
-		fmt.Sprintf(path),
+		path,
 		time.Now().UnixNano() / int64(time.Second),
 	}
 
@@ -555,6 +559,87 @@ func (dyn DynamoStorage) InsertItem(path, value string, ttl int64) error {
 	return err
 }
 
+// CreateItem is InsertItem with a condition that FullPath is not stored
+// yet.
+func (dyn DynamoStorage) CreateItem(path, value string) error {
+	row := DynamoRow{
+		0,
+		"teleport",
+		[]byte(value),
+		path,
+		time.Now().UnixNano() / int64(time.Second),
+	}
+
+	av, err := dynamodbattribute.MarshalMap(row)
+	if err != nil {
+		return err
+	}
+
+	_, err = dyn.Svc.PutItem(&dynamodb.PutItemInput{
+		TableName:           tableName,
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(FullPath)"),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return errs.ErrExists
+	}
+	return err
+}
+
+func (dyn DynamoStorage) GetItem(path string) (string, bool, error) {
+	resp, err := dyn.getItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"FullPath": {
+				S: aws.String(path),
+			},
+			"HashKey": {
+				S: aws.String("teleport"),
+			},
+		},
+		TableName: tableName,
+	})
+	if err != nil || len(resp.Item) == 0 {
+		return "", false, err
+	}
+	return string(resp.Item["Value"].B), true, nil
+}
+
+func (dyn DynamoStorage) GetItems(prefix string) (map[string]string, error) {
+	items, err := dyn.queryPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(items))
+	for _, v := range items {
+		result[*v["FullPath"].S] = string(v["Value"].B)
+	}
+	return result, nil
+}
+
+func (dyn DynamoStorage) UpdateItem(path string, change func(old string) (string, error)) error {
+	_, err := dyn.updateValue(path, func(old []byte) ([]byte, error) {
+		value, err := change(string(old))
+		return []byte(value), err
+	})
+	return err
+}
+
+func (dyn DynamoStorage) DeleteItem(path string) error {
+	_, err := dyn.Svc.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"FullPath": {
+				S: aws.String(path),
+			},
+			"HashKey": {
+				S: aws.String("teleport"),
+			},
+		},
+		TableName: tableName,
+	})
+	return err
+}
+
 func (dyn DynamoStorage) UpdateAddUserToken(token *token.AddUserToken) error {
 	path := fmt.Sprintf("teleport/addusertokens/%s", token.Token)
 	return dyn.UpdateValue(path, token.JSON)
@@ -587,6 +672,67 @@ func (dyn DynamoStorage) UpdateValue(path string, value []byte) error {
 	return err
 }
 
+// updateValue is kv.Storage.update with a conditional UpdateItem.
+func (dyn DynamoStorage) updateValue(path string, change func(old []byte) ([]byte, error)) (map[string]*dynamodb.AttributeValue, error) {
+	key := map[string]*dynamodb.AttributeValue{
+		"FullPath": {
+			S: aws.String(path),
+		},
+		"HashKey": {
+			S: aws.String("teleport"),
+		},
+	}
+
+	for attempt := 0; attempt < errs.MaxConflictRetries; attempt++ {
+		resp, err := dyn.getItem(&dynamodb.GetItemInput{
+			Key:       key,
+			TableName: tableName,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Item) == 0 {
+			return nil, fmt.Errorf("Record `%s` does not exist", path)
+		}
+
+		old := resp.Item["Value"].B
+		value, err := change(old)
+		if err != nil {
+			return nil, err
+		}
+
+		paramsUpdate := &dynamodb.UpdateItemInput{
+			Key:       key,
+			TableName: tableName,
+			ExpressionAttributeNames: map[string]*string{
+				"#Value": aws.String("Value"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":v": {
+					B: value,
+				},
+				":old": {
+					B: old,
+				},
+			},
+			UpdateExpression:    aws.String("SET #Value = :v"),
+			ConditionExpression: aws.String("#Value = :old"),
+			ReturnValues:        aws.String("ALL_NEW"),
+		}
+
+		updated, err := dyn.Svc.UpdateItem(paramsUpdate)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return updated.Attributes, nil
+	}
+
+	return nil, errs.ErrConflict
+}
+
 func (dyn DynamoStorage) SetUserLockedStatus(username string, lockedStatus bool) error {
 	userObj, err := dyn.GetUserByName(username)
 	if err != nil {
@@ -596,33 +742,16 @@ func (dyn DynamoStorage) SetUserLockedStatus(username string, lockedStatus bool)
 		return errors.New("User not exists")
 	}
 
-	userObj.IsLocked = lockedStatus
-	path := fmt.Sprintf("teleport/web/users/%s/params", username)
-	return dyn.UpdateValue(path, []byte(userObj.GetJSON()))
+	_, err = dyn.updateUsers([]user.User{*userObj}, func(u *user.User) {
+		u.IsLocked = lockedStatus
+	})
+	return err
 }
 
 func dynItemToRole(item map[string]*dynamodb.AttributeValue) role.Role {
 	obj := DynamoRow{}
 	dynamodbattribute.UnmarshalMap(item, &obj)
-	rawRole, _ := gabs.ParseJSON(obj.Value)
-	rawNodePatterns := rawRole.Path("spec.allow.node_labels").Data().(map[string]interface{})
-	rawLogins := rawRole.Path("spec.allow.logins").Data().([]interface{})
-
-	nodePatterns := make(map[string]string)
-	for k, v := range rawNodePatterns {
-		nodePatterns[k] = v.(string)
-	}
-
-	logins := make([]string, 0)
-	for _, v := range rawLogins {
-		logins = append(logins, v.(string))
-	}
-
-	r := role.Role{
-		rawRole.Path("metadata.name").Data().(string),
-		nodePatterns,
-		logins,
-	}
+	r, _ := role.FromJSON(obj.Value)
 	return r
 }
 
@@ -643,26 +772,15 @@ func dynItemsToUsers(items []map[string]*dynamodb.AttributeValue, roles []role.R
 	result := make(map[string]user.User, 0)
 	for _, item := range items {
 		u := dynItemToUser(item, mappedRoles)
+		if u.Name == "" {
+			continue
+		}
 		result[u.Name] = u
 	}
 	return result
 }
 
 func dynItemToUser(item map[string]*dynamodb.AttributeValue, mappedRoles map[string]role.Role) user.User {
-	rawUser, _ := gabs.ParseJSON(item["Value"].B)
-	rawRoles := rawUser.Path("spec.roles").Data()
-
-	roles := make([]role.Role, 0)
-	if rawRoles != nil {
-		for _, role := range rawRoles.([]interface{}) {
-			roles = append(roles, mappedRoles[role.(string)])
-		}
-	}
-
-	u := user.User{
-		Name:     rawUser.Path("metadata.name").Data().(string),
-		Roles:    roles,
-		IsLocked: rawUser.Path("spec.status.is_locked").Data().(bool),
-	}
+	u, _ := user.FromJSON(item["Value"].B, mappedRoles)
 	return u
 }
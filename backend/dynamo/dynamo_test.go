@@ -0,0 +1,178 @@
+package dynamo
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/bentol/tero/backend/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDynamo serves role items pageSize at a time and fails the first
+// throttles calls with ProvisionedThroughputExceeded.
+type fakeDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	items     []map[string]*dynamodb.AttributeValue
+	pageSize  int
+	throttles int
+	calls     int
+}
+
+func (f *fakeDynamo) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	f.calls++
+	if f.throttles > 0 {
+		f.throttles--
+		return nil, awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+	}
+
+	start := 0
+	if input.ExclusiveStartKey != nil {
+		fmt.Sscanf(*input.ExclusiveStartKey["FullPath"].S, "teleport/roles/role-%d/params", &start)
+		start++
+	}
+	end := start + f.pageSize
+	if end >= len(f.items) {
+		return &dynamodb.QueryOutput{Items: f.items[start:]}, nil
+	}
+
+	return &dynamodb.QueryOutput{
+		Items:            f.items[start:end],
+		LastEvaluatedKey: f.items[end-1],
+	}, nil
+}
+
+func newFakeDynamo(total, pageSize int) *fakeDynamo {
+	items := make([]map[string]*dynamodb.AttributeValue, 0)
+	for i := 0; i < total; i++ {
+		name := fmt.Sprintf("role-%d", i)
+		items = append(items, map[string]*dynamodb.AttributeValue{
+			"HashKey":  {S: aws.String("teleport")},
+			"FullPath": {S: aws.String(fmt.Sprintf("teleport/roles/%s/params", name))},
+			"Value": {B: []byte(fmt.Sprintf(
+				`{"kind":"role","metadata":{"name":"%s"},"spec":{"allow":{"logins":["ubuntu"],"node_labels":{"env":"staging"}}}}`,
+				name,
+			))},
+		})
+	}
+	return &fakeDynamo{items: items, pageSize: pageSize}
+}
+
+func init() {
+	tableName = aws.String("teleport.state")
+	retryBaseDelay = time.Millisecond
+}
+
+func TestGetRoles_shouldReadEveryPage(t *testing.T) {
+	fake := newFakeDynamo(25, 10)
+	roles, err := DynamoStorage{fake}.GetRoles()
+	assert.Nil(t, err)
+	assert.Equal(t, 25, len(roles))
+	assert.Equal(t, 3, fake.calls)
+}
+
+func TestGetRoles_shouldRetryThrottledQuery(t *testing.T) {
+	fake := newFakeDynamo(5, 10)
+	fake.throttles = 2
+	roles, err := DynamoStorage{fake}.GetRoles()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(roles))
+	assert.Equal(t, 3, fake.calls)
+}
+
+func TestGetRoles_shouldErrorWhenRetriesRunOut(t *testing.T) {
+	fake := newFakeDynamo(5, 10)
+	fake.throttles = maxRetries + 1
+	roles, err := DynamoStorage{fake}.GetRoles()
+	assert.Nil(t, roles)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "throttling")
+}
+
+// fakeConflictDynamo holds one user record and rejects the first
+// conflicts conditional updates as if someone else wrote in between.
+type fakeConflictDynamo struct {
+	fakeDynamo
+	value     []byte
+	conflicts int
+	reads     int
+}
+
+func (f *fakeConflictDynamo) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	f.reads++
+	return &dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{
+			"FullPath": input.Key["FullPath"],
+			"Value":    {B: f.value},
+		},
+	}, nil
+}
+
+func (f *fakeConflictDynamo) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if f.conflicts > 0 {
+		f.conflicts--
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "conflict", nil)
+	}
+	if string(input.ExpressionAttributeValues[":old"].B) != string(f.value) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "conflict", nil)
+	}
+
+	f.value = input.ExpressionAttributeValues[":v"].B
+	return &dynamodb.UpdateItemOutput{
+		Attributes: map[string]*dynamodb.AttributeValue{
+			"Value": {B: f.value},
+		},
+	}, nil
+}
+
+func newFakeConflictDynamo(conflicts int) *fakeConflictDynamo {
+	return &fakeConflictDynamo{
+		fakeDynamo: *newFakeDynamo(1, 10),
+		value:      []byte(`{"kind":"user","version":"v2","metadata":{"name":"beni"},"spec":{"roles":[],"status":{"is_locked":false}}}`),
+		conflicts:  conflicts,
+	}
+}
+
+func TestSetUserLockedStatus_shouldRetryWithFreshReadOnConflict(t *testing.T) {
+	fake := newFakeConflictDynamo(1)
+	err := DynamoStorage{fake}.SetUserLockedStatus("beni", true)
+	assert.Nil(t, err)
+	assert.Contains(t, string(fake.value), `"is_locked":true`)
+	// one read in SetUserLockedStatus, two in updateValue
+	assert.Equal(t, 3, fake.reads)
+}
+
+func TestSetUserLockedStatus_shouldReturnErrConflictWhenRetriesRunOut(t *testing.T) {
+	fake := newFakeConflictDynamo(errs.MaxConflictRetries)
+	err := DynamoStorage{fake}.SetUserLockedStatus("beni", true)
+	assert.Equal(t, errs.ErrConflict, err)
+	assert.Contains(t, string(fake.value), `"is_locked":false`)
+}
+
+func TestGetAddUserTokenByUserName_shouldSkipMalformedTokens(t *testing.T) {
+	item := func(token, value string) map[string]*dynamodb.AttributeValue {
+		return map[string]*dynamodb.AttributeValue{
+			"HashKey":  {S: aws.String("teleport")},
+			"FullPath": {S: aws.String("teleport/addusertokens/" + token)},
+			"Value":    {B: []byte(value)},
+		}
+	}
+	fake := &fakeDynamo{pageSize: 10, items: []map[string]*dynamodb.AttributeValue{
+		item("broken", `{"token":`),
+		item("nameless", `{"token":"nameless","user":{"name":42}}`),
+		item("tokenless", `{"user":{"name":"odin"}}`),
+		item("thor-token", `{"token":"thor-token","user":{"name":"thor"}}`),
+	}}
+
+	tok, err := DynamoStorage{fake}.GetAddUserTokenByUserName("thor")
+	assert.Nil(t, err)
+	assert.Equal(t, "thor-token", tok.Token)
+
+	tok, err = DynamoStorage{fake}.GetAddUserTokenByUserName("odin")
+	assert.Nil(t, err)
+	assert.Equal(t, "tokenless", tok.Token)
+}
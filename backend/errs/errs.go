@@ -0,0 +1,16 @@
+package errs
+
+import "errors"
+
+// ErrConflict is returned when a record keeps changing between the read
+// and the write of a read-modify-write update, even after retrying.
+var ErrConflict = errors.New("Record was changed by someone else at the same time, please try again")
+
+// ErrExists is returned when a record that should be new is already
+// stored.
+var ErrExists = errors.New("Record already exists")
+
+// MaxConflictRetries is how many times a read-modify-write update starts
+// over with a fresh read after a conflicting write, before the backends
+// give up with ErrConflict.
+const MaxConflictRetries = 3
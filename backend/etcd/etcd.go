@@ -0,0 +1,218 @@
+package etcd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bentol/tero/backend/errs"
+	"github.com/bentol/tero/backend/kv"
+	"github.com/bentol/tero/config"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const requestTimeout = 5 * time.Second
+
+// EtcdStorage stores teleport records the same way teleport's etcd
+// backend does: teleport/roles/admin/params lives under the key
+// <prefix>/roles/admin/params with its value base64 encoded, and a record
+// with a ttl is bound to an etcd lease.
+//
+// Teleport keeps its records through the etcd v3 API since 3.0, records
+// an older auth server wrote with the v2 API are not visible here.
+type EtcdStorage struct {
+	kv.Storage
+	Client *clientv3.Client
+	prefix string
+}
+
+func New(conf config.EtcdConfig) (*EtcdStorage, error) {
+	var tlsConfig *tls.Config
+	if conf.TLSCertFile != "" || conf.TLSCAFile != "" {
+		tlsInfo := transport.TLSInfo{
+			CertFile:      conf.TLSCertFile,
+			KeyFile:       conf.TLSKeyFile,
+			TrustedCAFile: conf.TLSCAFile,
+		}
+		var err error
+		tlsConfig, err = tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dialTimeout := time.Duration(conf.DialTimeout) * time.Second
+	if dialTimeout == 0 {
+		dialTimeout = requestTimeout
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   conf.Peers,
+		DialTimeout: dialTimeout,
+		TLS:         tlsConfig,
+		Username:    conf.Username,
+		Password:    conf.Password,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.TrimSuffix(conf.Prefix, "/")
+	if prefix == "" {
+		prefix = "/teleport"
+	}
+
+	e := &EtcdStorage{
+		Client: client,
+		prefix: prefix,
+	}
+	e.Storage = kv.Storage{Store: e}
+
+	// make sure the cluster is reachable before any command runs
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	if _, err := client.Get(ctx, prefix, clientv3.WithCountOnly()); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("Cannot reach etcd %v: %s", conf.Peers, err)
+	}
+
+	return e, nil
+}
+
+func (e *EtcdStorage) Get(path string) (*kv.Item, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := e.Client.Get(ctx, e.key(path))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	value, err := decode(path, resp.Kvs[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	return &kv.Item{
+		Path:  path,
+		Value: value,
+	}, nil
+}
+
+func (e *EtcdStorage) List(prefix string) ([]kv.Item, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := e.Client.Get(ctx, e.key(prefix),
+		clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]kv.Item, 0, len(resp.Kvs))
+	for _, v := range resp.Kvs {
+		path := e.path(string(v.Key))
+		value, err := decode(path, v.Value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, kv.Item{
+			Path:  path,
+			Value: value,
+		})
+	}
+	return result, nil
+}
+
+func (e *EtcdStorage) Put(path string, value []byte, ttl int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	var opts []clientv3.OpOption
+	if ttl > 0 {
+		lease, err := e.Client.Grant(ctx, ttl)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, clientv3.WithLease(lease.ID))
+	}
+
+	_, err := e.Client.Put(ctx, e.key(path), encode(value), opts...)
+	return err
+}
+
+func (e *EtcdStorage) CompareAndSwap(path string, old, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	key := e.key(path)
+	resp, err := e.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", encode(old))).
+		Then(clientv3.OpPut(key, encode(value), clientv3.WithIgnoreLease())).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return errs.ErrConflict
+	}
+	return nil
+}
+
+func (e *EtcdStorage) Create(path string, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	key := e.key(path)
+	resp, err := e.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, encode(value))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return errs.ErrExists
+	}
+	return nil
+}
+
+func (e *EtcdStorage) Delete(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := e.Client.Delete(ctx, e.key(path))
+	return err
+}
+
+func (e *EtcdStorage) Close() error {
+	return e.Client.Close()
+}
+
+func (e *EtcdStorage) key(path string) string {
+	return e.prefix + "/" + strings.TrimPrefix(path, "teleport/")
+}
+
+func (e *EtcdStorage) path(key string) string {
+	return "teleport/" + strings.TrimPrefix(key, e.prefix+"/")
+}
+
+func encode(value []byte) string {
+	return base64.StdEncoding.EncodeToString(value)
+}
+
+func decode(path string, value []byte) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(string(value))
+	if err != nil {
+		return nil, fmt.Errorf("Record `%s` is not base64 encoded as teleport writes it: %s", path, err)
+	}
+	return decoded, nil
+}
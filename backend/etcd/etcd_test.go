@@ -0,0 +1,225 @@
+package etcd_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bentol/tero/backend/errs"
+	"github.com/bentol/tero/backend/etcd"
+	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/role"
+	"github.com/bentol/tero/user"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	u, _ := url.Parse("http://" + l.Addr().String())
+	return *u
+}
+
+func startEtcd(t *testing.T) *etcd.EtcdStorage {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL := freeURL(t)
+	peerURL := freeURL(t)
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = fmt.Sprintf("%s=%s", cfg.Name, peerURL.String())
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("embedded etcd took too long to start")
+	}
+
+	storage, err := etcd.New(config.EtcdConfig{
+		Peers: []string{clientURL.String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func insertUser(t *testing.T, storage *etcd.EtcdStorage, name string) {
+	value := fmt.Sprintf(`{"kind":"user","version":"v2","metadata":{"name":"%s"},"spec":{"roles":[],"status":{"is_locked":false}}}`, name)
+	err := storage.InsertItem(fmt.Sprintf("teleport/web/users/%s/params", name), value, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNew_shouldFailIfEtcdUnreachable(t *testing.T) {
+	unreachable := freeURL(t)
+	_, err := etcd.New(config.EtcdConfig{
+		Peers:       []string{unreachable.String()},
+		DialTimeout: 1,
+	})
+	assert.NotNil(t, err)
+}
+
+func TestCreateRole_shouldUseTeleportKeyLayout(t *testing.T) {
+	storage := startEtcd(t)
+
+	_, err := storage.CreateRole(role.Role{Name: "dev", AllowedLogins: []string{"ubuntu"}, NodePatterns: map[string]string{"env": "staging"}})
+	assert.Nil(t, err)
+
+	resp, err := storage.Client.Get(context.Background(), "/teleport/roles/dev/params")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Kvs))
+	raw, err := base64.StdEncoding.DecodeString(string(resp.Kvs[0].Value))
+	assert.Nil(t, err)
+	assert.Contains(t, string(raw), `"name":"dev"`)
+
+	r, err := storage.GetRoleByName("dev")
+	assert.Nil(t, err)
+	assert.Equal(t, "staging", r.NodePatterns["env"])
+	assert.Equal(t, []string{"ubuntu"}, r.AllowedLogins)
+
+	roles, err := storage.GetRoles()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(roles))
+
+	assert.Nil(t, storage.DeleteRole("dev"))
+	r, err = storage.GetRoleByName("dev")
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+}
+
+func TestAttachRole_shouldUpdateUsers(t *testing.T) {
+	storage := startEtcd(t)
+	insertUser(t, storage, "beni")
+	insertUser(t, storage, "hulk")
+
+	r, _ := storage.CreateRole(role.Role{Name: "dev", AllowedLogins: []string{"ubuntu"}, NodePatterns: map[string]string{"env": "staging"}})
+	users, _ := storage.GetUsersByNames([]string{"beni", "hulk"})
+	_, err := storage.AttachRole(r, users)
+	assert.Nil(t, err)
+
+	users, _ = storage.GetUsersByRole("dev")
+	assert.Equal(t, 2, len(users))
+
+	hulk, _ := storage.GetUserByName("hulk")
+	_, err = storage.DetachRole(r, []user.User{*hulk})
+	assert.Nil(t, err)
+
+	users, _ = storage.GetUsersByRole("dev")
+	assert.Equal(t, 1, len(users))
+	assert.Equal(t, "beni", users[0].Name)
+}
+
+func TestSetUserLockedStatus_shouldLockUser(t *testing.T) {
+	storage := startEtcd(t)
+	insertUser(t, storage, "beni")
+
+	assert.Nil(t, storage.SetUserLockedStatus("beni", true))
+	u, _ := storage.GetUserByName("beni")
+	assert.True(t, u.IsLocked)
+
+	assert.NotNil(t, storage.SetUserLockedStatus("imaginary_user", true))
+}
+
+func TestGetAddUserTokenByUserName_shouldReturnAppropriateItem(t *testing.T) {
+	storage := startEtcd(t)
+	value := `{"token":"abc","user":{"name":"budi","roles":null}}`
+	assert.Nil(t, storage.InsertItem("teleport/addusertokens/abc", value, 0))
+
+	addUserToken, err := storage.GetAddUserTokenByUserName("budi")
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", addUserToken.Token)
+
+	addUserToken.SetRoles([]string{"dev"})
+	assert.Nil(t, storage.UpdateAddUserToken(addUserToken))
+
+	addUserToken, _ = storage.GetAddUserToken("abc")
+	assert.Equal(t, []string{"dev"}, addUserToken.GetStringRoles())
+}
+
+func TestGetRoleByName_shouldReadRecordsWrittenByTeleport(t *testing.T) {
+	storage := startEtcd(t)
+	// the auth server writes the json base64 encoded
+	teleportRole := `{"kind":"role","version":"v3","metadata":{"name":"ops","namespace":"default"},"spec":{"options":{"forward_agent":false,"max_session_ttl":"30h0m0s","port_forwarding":true,"cert_format":"standard"},"allow":{"logins":["root"],"node_labels":{"env":"production"},"rules":[{"resources":["session"],"verbs":["list","read"]}]},"deny":{}}}`
+	teleportUser := `{"kind":"user","version":"v2","metadata":{"name":"beni","namespace":"default"},"spec":{"roles":["ops"],"traits":{"logins":["beni"]},"status":{"is_locked":false,"locked_time":"0001-01-01T00:00:00Z","lock_expires":"0001-01-01T00:00:00Z"},"expires":"0001-01-01T00:00:00Z","created_by":{"time":"0001-01-01T00:00:00Z","user":{"name":""}}}}`
+	ctx := context.Background()
+	_, err := storage.Client.Put(ctx, "/teleport/roles/ops/params", base64.StdEncoding.EncodeToString([]byte(teleportRole)))
+	assert.Nil(t, err)
+	_, err = storage.Client.Put(ctx, "/teleport/web/users/beni/params", base64.StdEncoding.EncodeToString([]byte(teleportUser)))
+	assert.Nil(t, err)
+
+	r, err := storage.GetRoleByName("ops")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"root"}, r.AllowedLogins)
+	assert.Equal(t, "production", r.NodePatterns["env"])
+
+	users, err := storage.GetUsersByRole("ops")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(users))
+	assert.Equal(t, "beni", users[0].Name)
+}
+
+func TestGet_shouldRefuseValuesTeleportCannotRead(t *testing.T) {
+	storage := startEtcd(t)
+	_, err := storage.Client.Put(context.Background(), "/teleport/roles/raw/params", `{"kind":"role"}`)
+	assert.Nil(t, err)
+
+	_, err = storage.GetRoleByName("raw")
+	assert.NotNil(t, err)
+}
+
+func TestPut_shouldKeepTheLeaseOnUpdates(t *testing.T) {
+	storage := startEtcd(t)
+	value := `{"token":"abc","user":{"name":"budi","roles":null}}`
+	assert.Nil(t, storage.InsertItem("teleport/addusertokens/abc", value, 3600))
+
+	lease := func() int64 {
+		resp, err := storage.Client.Get(context.Background(), "/teleport/addusertokens/abc")
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(resp.Kvs))
+		return resp.Kvs[0].Lease
+	}
+	leaseID := lease()
+	assert.NotEqual(t, int64(0), leaseID)
+
+	addUserToken, _ := storage.GetAddUserToken("abc")
+	addUserToken.SetRoles([]string{"dev"})
+	assert.Nil(t, storage.UpdateAddUserToken(addUserToken))
+	assert.Equal(t, leaseID, lease())
+
+	err := storage.UpdateItem("teleport/addusertokens/abc", func(old string) (string, error) {
+		return old, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, leaseID, lease())
+}
+
+func TestCreateItem_shouldRefuseExistingRecords(t *testing.T) {
+	storage := startEtcd(t)
+	assert.Nil(t, storage.CreateItem("teleport/tero/requests/abc", `{"id":"abc"}`))
+	assert.Equal(t, errs.ErrExists, storage.CreateItem("teleport/tero/requests/abc", `{"id":"other"}`))
+
+	items, err := storage.GetItems("teleport/tero/requests/abc")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"id":"abc"}`, items["teleport/tero/requests/abc"])
+}
@@ -0,0 +1,399 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Jeffail/gabs"
+	"github.com/bentol/tero/backend/errs"
+	"github.com/bentol/tero/role"
+	"github.com/bentol/tero/token"
+	"github.com/bentol/tero/user"
+)
+
+// Item is a single teleport record. Path uses the same layout as the
+// dynamodb FullPath column, ex: teleport/web/users/beni/params
+type Item struct {
+	Path  string
+	Value []byte
+	TTL   int64
+}
+
+// Store is the minimal set of operations a key-value backend has to
+// provide, Storage builds the role/user/token logic on top of it.
+type Store interface {
+	// Get returns nil when path does not exist
+	Get(path string) (*Item, error)
+	// List returns every item whose path starts with prefix, sorted by path
+	List(prefix string) ([]Item, error)
+	// Put writes value at path, a ttl above 0 makes the record expire
+	// after ttl seconds the way teleport expires it in the same backend
+	Put(path string, value []byte, ttl int64) error
+	// CompareAndSwap replaces the value at path only if it still equals
+	// old, otherwise it returns errs.ErrConflict. The record keeps its
+	// expiry.
+	CompareAndSwap(path string, old, value []byte) error
+	// Create writes value at path only if there is no record there yet,
+	// otherwise it returns errs.ErrExists
+	Create(path string, value []byte) error
+	Delete(path string) error
+}
+
+type Storage struct {
+	Store Store
+}
+
+func (s Storage) GetRoles() ([]role.Role, error) {
+	items, err := s.Store.List("teleport/roles/")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]role.Role, 0)
+	for _, item := range items {
+		if !strings.HasSuffix(item.Path, "/params") {
+			continue
+		}
+		r, err := role.FromJSON(item.Value)
+		if err != nil {
+			continue
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func (s Storage) CreateRole(newRole role.Role) (*role.Role, error) {
+	err := s.Store.Put(RolePath(newRole.Name), []byte(newRole.GetJSON()), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetRoleByName(newRole.Name)
+}
+
+func (s Storage) DeleteRole(name string) error {
+	return s.Store.Delete(RolePath(name))
+}
+
+func (s Storage) GetRoleByName(name string) (*role.Role, error) {
+	item, err := s.Store.Get(RolePath(name))
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, nil
+	}
+
+	r, err := role.FromJSON(item.Value)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s Storage) UpdateRole(name string, change func(r *role.Role)) (*role.Role, error) {
+	err := s.update(RolePath(name), func(old []byte) ([]byte, error) {
+		oldRole, err := role.FromJSON(old)
+		if err != nil {
+			return nil, err
+		}
+		change(&oldRole)
+		return []byte(oldRole.GetJSON()), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetRoleByName(name)
+}
+
+func (s Storage) AttachRole(selectedRole *role.Role, users []user.User) ([]user.User, error) {
+	return s.updateUsers(users, func(u *user.User) {
+		u.Roles = append(u.Roles, *selectedRole)
+	})
+}
+
+func (s Storage) DetachRole(selectedRole *role.Role, users []user.User) ([]user.User, error) {
+	return s.updateUsers(users, func(u *user.User) {
+		updatedRoles := make([]role.Role, 0)
+		for _, r := range u.Roles {
+			if r.Name != selectedRole.Name {
+				updatedRoles = append(updatedRoles, r)
+			}
+		}
+		u.Roles = updatedRoles
+	})
+}
+
+// updateUsers applies change to a fresh copy of every user record and
+// writes it back with update.
+func (s Storage) updateUsers(users []user.User, change func(u *user.User)) ([]user.User, error) {
+	mappedRoles, err := s.mappedRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range users {
+		err := s.update(UserPath(u.Name), func(old []byte) ([]byte, error) {
+			freshUser, err := user.FromJSON(old, mappedRoles)
+			if err != nil {
+				return nil, err
+			}
+			change(&freshUser)
+			return []byte(freshUser.GetJSON()), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s.GetUsersByNames(userNames(users))
+}
+
+func (s Storage) GetUsers() (map[string]user.User, error) {
+	mappedRoles, err := s.mappedRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := s.Store.List("teleport/web/users/")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]user.User)
+	for _, item := range items {
+		if !strings.HasSuffix(item.Path, "/params") {
+			continue
+		}
+		u, err := user.FromJSON(item.Value, mappedRoles)
+		if err != nil {
+			continue
+		}
+		result[u.Name] = u
+	}
+	return result, nil
+}
+
+func (s Storage) GetUserByName(name string) (*user.User, error) {
+	item, err := s.Store.Get(UserPath(name))
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, nil
+	}
+
+	mappedRoles, err := s.mappedRoles()
+	if err != nil {
+		return nil, err
+	}
+	u, err := user.FromJSON(item.Value, mappedRoles)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s Storage) GetUsersByNames(names []string) ([]user.User, error) {
+	allUsers, err := s.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	filteredUsers := make([]user.User, 0)
+	for _, name := range names {
+		if u, ok := allUsers[name]; ok {
+			filteredUsers = append(filteredUsers, u)
+		}
+	}
+	return filteredUsers, nil
+}
+
+func (s Storage) GetUsersByRole(roleName string) ([]user.User, error) {
+	allUsers, err := s.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	filteredUsers := make([]user.User, 0)
+	for _, u := range allUsers {
+		for _, r := range u.Roles {
+			if r.Name == roleName {
+				filteredUsers = append(filteredUsers, u)
+				break
+			}
+		}
+	}
+	return filteredUsers, nil
+}
+
+func (s Storage) GetAddUserToken(userToken string) (*token.AddUserToken, error) {
+	item, err := s.Store.Get(TokenPath(userToken))
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, nil
+	}
+
+	return &token.AddUserToken{
+		Token: userToken,
+		JSON:  item.Value,
+	}, nil
+}
+
+func (s Storage) GetAddUserTokenByUserName(searchedUserName string) (*token.AddUserToken, error) {
+	items, err := s.Store.List("teleport/addusertokens/")
+	if err != nil {
+		return nil, err
+	}
+
+	// a malformed token is skipped, `tero fsck` reports it
+	for _, item := range items {
+		json, err := gabs.ParseJSON(item.Value)
+		if err != nil {
+			continue
+		}
+		userName, _ := json.Path("user.name").Data().(string)
+		if searchedUserName == userName {
+			return &token.AddUserToken{
+				Token: strings.TrimPrefix(item.Path, "teleport/addusertokens/"),
+				JSON:  item.Value,
+			}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s Storage) InsertItem(path, value string, ttl int64) error {
+	return s.Store.Put(path, []byte(value), ttl)
+}
+
+func (s Storage) CreateItem(path, value string) error {
+	return s.Store.Create(path, []byte(value))
+}
+
+func (s Storage) GetItem(path string) (string, bool, error) {
+	item, err := s.Store.Get(path)
+	if err != nil || item == nil {
+		return "", false, err
+	}
+	return string(item.Value), true, nil
+}
+
+func (s Storage) GetItems(prefix string) (map[string]string, error) {
+	items, err := s.Store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(items))
+	for _, item := range items {
+		result[item.Path] = string(item.Value)
+	}
+	return result, nil
+}
+
+func (s Storage) UpdateItem(path string, change func(old string) (string, error)) error {
+	return s.update(path, func(old []byte) ([]byte, error) {
+		value, err := change(string(old))
+		return []byte(value), err
+	})
+}
+
+func (s Storage) DeleteItem(path string) error {
+	return s.Store.Delete(path)
+}
+
+func (s Storage) UpdateAddUserToken(addUserToken *token.AddUserToken) error {
+	path := TokenPath(addUserToken.Token)
+	item, err := s.Store.Get(path)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return errors.New("Add user token not found")
+	}
+
+	// a swap keeps the expiry teleport gave the token
+	return s.Store.CompareAndSwap(path, item.Value, addUserToken.JSON)
+}
+
+func (s Storage) SetUserLockedStatus(username string, lockedStatus bool) error {
+	userObj, err := s.GetUserByName(username)
+	if err != nil {
+		return err
+	}
+	if userObj == nil {
+		return errors.New("User not exists")
+	}
+
+	_, err = s.updateUsers([]user.User{*userObj}, func(u *user.User) {
+		u.IsLocked = lockedStatus
+	})
+	return err
+}
+
+// update reads the record at path, passes its value to change and writes
+// the result back only if the record was not modified in between.
+func (s Storage) update(path string, change func(old []byte) ([]byte, error)) error {
+	for attempt := 0; attempt < errs.MaxConflictRetries; attempt++ {
+		item, err := s.Store.Get(path)
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			return fmt.Errorf("Record `%s` does not exist", path)
+		}
+
+		value, err := change(item.Value)
+		if err != nil {
+			return err
+		}
+
+		err = s.Store.CompareAndSwap(path, item.Value, value)
+		if err == errs.ErrConflict {
+			continue
+		}
+		return err
+	}
+
+	return errs.ErrConflict
+}
+
+func (s Storage) mappedRoles() (map[string]role.Role, error) {
+	roles, err := s.GetRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	mappedRoles := make(map[string]role.Role)
+	for _, r := range roles {
+		mappedRoles[r.Name] = r
+	}
+	return mappedRoles, nil
+}
+
+func userNames(users []user.User) []string {
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		names = append(names, u.Name)
+	}
+	return names
+}
+
+func RolePath(name string) string {
+	return fmt.Sprintf("teleport/roles/%s/params", name)
+}
+
+func UserPath(name string) string {
+	return fmt.Sprintf("teleport/web/users/%s/params", name)
+}
+
+func TokenPath(userToken string) string {
+	return fmt.Sprintf("teleport/addusertokens/%s", userToken)
+}
@@ -0,0 +1,52 @@
+package kv_test
+
+import (
+	"testing"
+
+	"github.com/bentol/tero/backend/errs"
+	"github.com/bentol/tero/backend/kv"
+	"github.com/bentol/tero/backend/memory"
+	"github.com/bentol/tero/role"
+	"github.com/stretchr/testify/assert"
+)
+
+// racingStore changes the record right before each of the first races
+// CompareAndSwap calls, like a concurrent writer would.
+type racingStore struct {
+	*memory.MemoryStorage
+	races int
+}
+
+func (r *racingStore) CompareAndSwap(path string, old, value []byte) error {
+	if r.races > 0 {
+		r.races--
+		item, _ := r.Get(path)
+		r.Put(path, append([]byte(" "), item.Value...), 0)
+	}
+	return r.MemoryStorage.CompareAndSwap(path, old, value)
+}
+
+func newStorage(races int) kv.Storage {
+	store := &racingStore{memory.New(), races}
+	store.Put(kv.RolePath("dev"), []byte(`{"kind":"role","metadata":{"name":"dev"},"spec":{"allow":{"logins":["ubuntu"],"node_labels":{"env":"staging"}}}}`), 0)
+	store.Put(kv.UserPath("beni"), []byte(`{"kind":"user","metadata":{"name":"beni"},"spec":{"roles":[],"status":{"is_locked":false}}}`), 0)
+	return kv.Storage{Store: store}
+}
+
+func TestAttachRole_shouldRetryOnConflict(t *testing.T) {
+	storage := newStorage(2)
+	users, _ := storage.GetUsersByNames([]string{"beni"})
+	r, _ := storage.GetRoleByName("dev")
+
+	updated, err := storage.AttachRole(r, users)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dev"}, updated[0].RoleNames())
+}
+
+func TestAttachRole_shouldReturnErrConflictWhenRetriesRunOut(t *testing.T) {
+	storage := newStorage(10)
+	users, _ := storage.GetUsersByNames([]string{"beni"})
+
+	_, err := storage.AttachRole(&role.Role{Name: "dev"}, users)
+	assert.Equal(t, errs.ErrConflict, err)
+}
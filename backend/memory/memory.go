@@ -0,0 +1,130 @@
+package memory
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bentol/tero/backend/errs"
+	"github.com/bentol/tero/backend/kv"
+)
+
+// MemoryStorage keeps teleport records in a map keyed by their full path
+// (ex: teleport/roles/admin/params), so it can stand in for a real
+// backend in tests and dry runs.
+type MemoryStorage struct {
+	kv.Storage
+	mu    sync.RWMutex
+	items map[string]kv.Item
+}
+
+func New() *MemoryStorage {
+	mem := &MemoryStorage{
+		items: make(map[string]kv.Item),
+	}
+	mem.Storage = kv.Storage{Store: mem}
+	return mem
+}
+
+// LoadFixtures inserts every file under dir as a record, using the file
+// path relative to dir as the record path.
+func (mem *MemoryStorage) LoadFixtures(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		return mem.Put(filepath.ToSlash(relPath), value, 0)
+	})
+}
+
+func (mem *MemoryStorage) Get(path string) (*kv.Item, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	item, ok := mem.items[path]
+	if !ok {
+		return nil, nil
+	}
+	return &item, nil
+}
+
+func (mem *MemoryStorage) List(prefix string) ([]kv.Item, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	result := make([]kv.Item, 0)
+	for path, item := range mem.items {
+		if strings.HasPrefix(path, prefix) {
+			result = append(result, item)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result, nil
+}
+
+func (mem *MemoryStorage) Put(path string, value []byte, ttl int64) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	mem.items[path] = kv.Item{
+		Path:  path,
+		Value: value,
+		TTL:   ttl,
+	}
+	return nil
+}
+
+func (mem *MemoryStorage) CompareAndSwap(path string, old, value []byte) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	item, ok := mem.items[path]
+	if !ok || !bytes.Equal(item.Value, old) {
+		return errs.ErrConflict
+	}
+
+	item.Value = value
+	mem.items[path] = item
+	return nil
+}
+
+func (mem *MemoryStorage) Create(path string, value []byte) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	if _, ok := mem.items[path]; ok {
+		return errs.ErrExists
+	}
+	mem.items[path] = kv.Item{
+		Path:  path,
+		Value: value,
+	}
+	return nil
+}
+
+func (mem *MemoryStorage) Delete(path string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	delete(mem.items, path)
+	return nil
+}
@@ -0,0 +1,63 @@
+package backend
+
+import (
+	"sort"
+
+	"github.com/bentol/tero/offboard"
+	"github.com/bentol/tero/role"
+	"github.com/bentol/tero/user"
+)
+
+// SaveOffboarding creates or overwrites the offboarding of a user.
+func SaveOffboarding(o offboard.Offboarding) error {
+	checkStorage()
+	return storage.InsertItem(o.Path(), o.GetJSON(), 0)
+}
+
+// GetOffboardings returns every offboarding, the oldest first.
+func GetOffboardings() ([]offboard.Offboarding, error) {
+	result := make([]offboard.Offboarding, 0)
+	if err := getRecords("offboarding", offboard.Prefix, &result); err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].At.Before(result[j].At)
+	})
+	return result, nil
+}
+
+// GetOffboarding returns nil when the user was never offboarded.
+func GetOffboarding(userName string) (*offboard.Offboarding, error) {
+	var o offboard.Offboarding
+	ok, err := getRecord("offboarding", offboard.Path(userName), &o)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// DetachAllRoles detaches every role of the user, the ones that no longer
+// exist too, and forgets its grants. It returns the detached roles.
+func DetachAllRoles(u user.User) ([]string, error) {
+	checkStorage()
+
+	names := u.RoleNames()
+	for _, name := range names {
+		_, err := storage.DetachRole(&role.Role{Name: name}, []user.User{u})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	grants, err := GetGrantsByUser(u.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range grants {
+		err = storage.DeleteItem(g.Path())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
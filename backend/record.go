@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// The records tero keeps next to teleport's are stored as JSON, each at
+// its own path.
+
+// createRecord gives a new record a random id, then stores v at path(id).
+// It never replaces a stored record and returns ErrExists instead.
+func createRecord(id *string, path func(id string) string, v interface{}) error {
+	checkStorage()
+
+	newID, err := newID()
+	if err != nil {
+		return err
+	}
+	*id = newID
+
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return storage.CreateItem(path(*id), string(value))
+}
+
+// getRecord decodes the record at path into v, it returns false when
+// there is none.
+func getRecord(kind, path string, v interface{}) (bool, error) {
+	checkStorage()
+
+	value, ok, err := storage.GetItem(path)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, decodeRecord(kind, path, value, v)
+}
+
+// getRecords appends every record under prefix to the slice list points
+// to, in no particular order.
+func getRecords(kind, prefix string, list interface{}) error {
+	checkStorage()
+
+	items, err := storage.GetItems(prefix)
+	if err != nil {
+		return err
+	}
+
+	slice := reflect.ValueOf(list).Elem()
+	for path, value := range items {
+		v := reflect.New(slice.Type().Elem())
+		if err := decodeRecord(kind, path, value, v.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, v.Elem()))
+	}
+	return nil
+}
+
+// updateRecord decodes a fresh copy of the record at path into v, lets
+// change modify it and writes it back only if nobody saved the record in
+// between. change is run again on the new copy otherwise, an error of
+// change is returned as is.
+func updateRecord(kind, path string, v interface{}, change func() error) error {
+	checkStorage()
+
+	return storage.UpdateItem(path, func(old string) (string, error) {
+		if err := decodeRecord(kind, path, old, v); err != nil {
+			return "", err
+		}
+		if err := change(); err != nil {
+			return "", err
+		}
+		value, err := json.Marshal(v)
+		return string(value), err
+	})
+}
+
+// decodeRecord resets v first, so nothing is left over from a previous
+// attempt of updateRecord.
+func decodeRecord(kind, path, value string, v interface{}) error {
+	elem := reflect.ValueOf(v).Elem()
+	elem.Set(reflect.Zero(elem.Type()))
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return fmt.Errorf("Invalid %s record `%s`: %s", kind, path, err)
+	}
+	return nil
+}
+
+// newID returns a random 128 bit id for a tero record.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Cannot generate an id: %s", err)
+	}
+	return hex.EncodeToString(b), nil
+}
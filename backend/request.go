@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"sort"
+
+	"github.com/bentol/tero/request"
+)
+
+// SaveRequest gives a new access request its ID and stores it, it never
+// replaces a stored request. Decisions go through UpdateRequest.
+func SaveRequest(r *request.Request) error {
+	return createRecord(&r.ID, request.Path, r)
+}
+
+// UpdateRequest lets change decide a fresh copy of the request, as
+// updateRecord does.
+func UpdateRequest(id string, change func(r *request.Request) error) (*request.Request, error) {
+	var r request.Request
+	err := updateRecord("request", request.Path(id), &r, func() error {
+		return change(&r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// GetRequests returns every access request, the oldest first.
+func GetRequests() ([]request.Request, error) {
+	requests := make([]request.Request, 0)
+	if err := getRecords("request", request.Prefix, &requests); err != nil {
+		return nil, err
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Created.Before(requests[j].Created)
+	})
+	return requests, nil
+}
+
+// GetRequest returns nil when there is no request with that id.
+func GetRequest(id string) (*request.Request, error) {
+	var r request.Request
+	ok, err := getRecord("request", request.Path(id), &r)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &r, nil
+}
@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"sort"
+
+	"github.com/bentol/tero/review"
+)
+
+// SaveCampaign gives a new review campaign its ID and stores it, it never
+// replaces a stored campaign. Changes go through UpdateCampaign.
+func SaveCampaign(c *review.Campaign) error {
+	return createRecord(&c.ID, review.Path, c)
+}
+
+// UpdateCampaign records the decisions change makes on the campaign, a
+// conflicting save reruns change.
+func UpdateCampaign(id string, change func(c *review.Campaign) error) (*review.Campaign, error) {
+	var c review.Campaign
+	err := updateRecord("review", review.Path(id), &c, func() error {
+		return change(&c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetCampaigns returns every review campaign, the oldest first.
+func GetCampaigns() ([]review.Campaign, error) {
+	campaigns := make([]review.Campaign, 0)
+	if err := getRecords("review", review.Prefix, &campaigns); err != nil {
+		return nil, err
+	}
+	sort.Slice(campaigns, func(i, j int) bool {
+		return campaigns[i].Created.Before(campaigns[j].Created)
+	})
+	return campaigns, nil
+}
+
+// GetCampaign returns nil when there is no campaign with that id.
+func GetCampaign(id string) (*review.Campaign, error) {
+	var c review.Campaign
+	ok, err := getRecord("review", review.Path(id), &c)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &c, nil
+}
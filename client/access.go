@@ -0,0 +1,95 @@
+package client
+
+import (
+	"sort"
+
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/role"
+)
+
+// CheckAccess finds the roles that select nodes with the given labels and
+// the logins every user gets on them through those roles. A user with a
+// role denying the nodes gets no login at all. When login is given only
+// that login is reported.
+func CheckAccess(rawLabels, login string) (*AccessReport, error) {
+	labels, err := backend.ParseNodePatterns(rawLabels)
+	if err != nil {
+		return nil, backend.Invalid("Invalid labels `%s`, use key:value. Ex: env:production,app:postgres", rawLabels)
+	}
+
+	roles, err := backend.GetRoles()
+	if err != nil {
+		return nil, err
+	}
+	users, err := backend.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AccessReport{Labels: labels, Login: login, Roles: make(RoleList, 0), Users: make([]AccessGrant, 0)}
+	for _, r := range roles {
+		if r.AllowsNode(labels) && (login == "" || mayAllowLogin(r.AllowedLogins, login)) {
+			report.Roles = append(report.Roles, newRoleInfo(r))
+		}
+	}
+
+	for _, u := range users {
+		denied := false
+		deniedLogins := make([]string, 0)
+		for _, r := range u.Roles {
+			denied = denied || r.DeniesNode(labels)
+			deniedLogins = append(deniedLogins, role.ExpandLogins(r.Deny.Logins, u.Traits)...)
+		}
+		if denied {
+			continue
+		}
+
+		for _, r := range u.Roles {
+			if !r.AllowsNode(labels) {
+				continue
+			}
+			for _, l := range role.ExpandLogins(r.AllowedLogins, u.Traits) {
+				if (login != "" && l != login) || hasLogin(deniedLogins, l) {
+					continue
+				}
+				report.Users = append(report.Users, AccessGrant{User: u.Name, Login: l, Role: r.Name, Locked: u.IsLocked})
+			}
+		}
+	}
+
+	sort.Slice(report.Users, func(i, j int) bool {
+		a, b := report.Users[i], report.Users[j]
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		if a.Login != b.Login {
+			return a.Login < b.Login
+		}
+		return a.Role < b.Role
+	})
+	return report, nil
+}
+
+// mayAllowLogin reports whether the logins of a role, before the traits
+// of any user are expanded, may give login: a login taken from a user
+// trait may be anything.
+func mayAllowLogin(logins []string, login string) bool {
+	for _, l := range logins {
+		if l == login || l == role.Wildcard || role.IsTrait(l) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasLogin reports whether logins, expanded with the traits of a user,
+// has login or the wildcard. A trait left unexpanded matches nothing, or
+// a deny of a trait the user lacks would deny every login.
+func hasLogin(logins []string, login string) bool {
+	for _, l := range logins {
+		if !role.IsTrait(l) && (l == login || l == role.Wildcard) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package client_test
+
+import (
+	"testing"
+
+	"github.com/bentol/tero/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckAccess_shouldListRolesAndLoginsOfUsers(t *testing.T) {
+	setup()
+	_, err := client.NewRoleWithFlags("hulk", "dba", "postgres,{{internal.logins}}", "env:production,app:postgres-*", client.RoleFlags{})
+	assert.Nil(t, err)
+	_, err = client.NewRoleWithFlags("hulk", "intern", "ubuntu", "env:staging", client.RoleFlags{DenyNodes: "env:production"})
+	assert.Nil(t, err)
+	_, err = client.AttachRole("hulk", "dba", "beni")
+	assert.Nil(t, err)
+	_, err = client.AttachRole("hulk", "intern", "hulk")
+	assert.Nil(t, err)
+
+	// hulk has admin too, but intern denies every production node
+	report, err := client.CheckAccess("env:production,app:postgres-main", "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"admin", "dba"}, []string{report.Roles[0].Name, report.Roles[1].Name})
+	assert.Equal(t, []client.AccessGrant{
+		{User: "beni", Login: "postgres", Role: "dba"},
+		{User: "beni", Login: "root", Role: "admin"},
+		{User: "beni", Login: "ubuntu", Role: "dba"},
+	}, report.Users)
+
+	report, err = client.CheckAccess("env:production,app:postgres-main", "root")
+	assert.Nil(t, err)
+	// dba stays listed, a login from a user trait may be root
+	assert.Equal(t, 2, len(report.Roles))
+	assert.Equal(t, []client.AccessGrant{{User: "beni", Login: "root", Role: "admin"}}, report.Users)
+
+	_, err = client.CheckAccess("production", "")
+	assert.NotNil(t, err)
+}
+
+func TestCheckAccess_shouldOnlyDenyTheLoginsTraitsResolveTo(t *testing.T) {
+	setup()
+	_, err := client.NewRoleWithFlags("hulk", "no-github", "ubuntu", "env:staging", client.RoleFlags{DenyLogins: "{{external.github_logins}}"})
+	assert.Nil(t, err)
+	_, err = client.NewRoleWithFlags("hulk", "no-own", "root", "env:staging", client.RoleFlags{DenyLogins: "{{internal.logins}}"})
+	assert.Nil(t, err)
+	_, err = client.AttachRole("hulk", "no-github", "beni")
+	assert.Nil(t, err)
+	_, err = client.AttachRole("hulk", "no-own", "hulk")
+	assert.Nil(t, err)
+
+	// beni has no github_logins trait, hulk loses ubuntu from its logins
+	// trait but keeps root
+	report, err := client.CheckAccess("env:staging", "")
+	assert.Nil(t, err)
+	assert.Equal(t, []client.AccessGrant{
+		{User: "beni", Login: "root", Role: "admin"},
+		{User: "beni", Login: "ubuntu", Role: "no-github"},
+		{User: "hulk", Login: "root", Role: "admin"},
+		{User: "hulk", Login: "root", Role: "no-own"},
+	}, report.Users)
+
+	report, err = client.CheckAccess("env:staging", "ubuntu")
+	assert.Nil(t, err)
+	assert.Equal(t, []client.AccessGrant{{User: "beni", Login: "ubuntu", Role: "no-github"}}, report.Users)
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bentol/tero/audit"
+	"github.com/bentol/tero/backend"
+)
+
+// audited runs change and writes an audit event, made by operator, with
+// the records of roleName and userNames as they were before and after it.
+// A failure to write the event fails the command, the change is already
+// made by then so the error says so.
+func audited(operator, action, roleName string, userNames []string, args map[string]string, change func() (string, error)) (string, error) {
+	before := snapshot(roleName, userNames)
+	out, err := change()
+
+	e := audit.Event{
+		Time:     time.Now().UTC(),
+		Operator: operator,
+		Action:   action,
+		Role:     roleName,
+		Users:    userNames,
+		Args:     args,
+		Before:   before,
+		After:    snapshot(roleName, userNames),
+		Result:   audit.ResultOK,
+	}
+	if err != nil {
+		e.Result = audit.ResultError
+		e.Error = err.Error()
+	}
+	if recordErr := record(e); recordErr != nil {
+		return "", recordErr
+	}
+	return out, err
+}
+
+func record(e audit.Event) error {
+	if err := audit.Record(e); err != nil {
+		if e.Result == audit.ResultError {
+			return fmt.Errorf("%s failed with `%s` and could not be recorded in the audit log: %s", e.Action, e.Error, err)
+		}
+		return fmt.Errorf("%s was made but could not be recorded in the audit log: %s", e.Action, err)
+	}
+	return nil
+}
+
+// snapshot returns the stored records of the role and users, the ones that
+// do not exist are left out.
+func snapshot(roleName string, userNames []string) *audit.State {
+	state := &audit.State{}
+	if roleName != "" {
+		r, err := backend.GetRoleByName(roleName)
+		if err == nil && r != nil {
+			state.Role = rawRecord(r.Raw)
+		}
+	}
+	if len(userNames) != 0 {
+		users, err := backend.GetUsersByNames(userNames)
+		if err == nil && len(users) != 0 {
+			state.Users = make(map[string]interface{})
+			for _, u := range users {
+				state.Users[u.Name] = rawRecord(u.Raw)
+			}
+		}
+	}
+	if state.Role == nil && state.Users == nil {
+		return nil
+	}
+	return state
+}
+
+func rawRecord(raw []byte) interface{} {
+	var record interface{}
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return string(raw)
+	}
+	return record
+}
+
+// ListAuditEvents returns the events made by or about user since the
+// given time, see ParseSince.
+func ListAuditEvents(user, since string) (AuditEvents, error) {
+	filter := audit.Filter{User: user}
+	if since != "" {
+		t, err := ParseSince(since, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		filter.Since = t
+	}
+
+	events, err := audit.Query(filter)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// ParseSince accepts a number of days (ex: 7d), a duration (ex: 12h) or a
+// RFC3339 timestamp.
+func ParseSince(since string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(since, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(since, "d"))
+		if err == nil && days >= 0 {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(since); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	return time.Time{}, backend.Invalid("Invalid since `%s`, use days, a duration or RFC3339. Ex: 7d, 12h", since)
+}
@@ -0,0 +1,116 @@
+package client_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bentol/tero/audit"
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAudit_shouldRecordChangesWithState(t *testing.T) {
+	setup()
+	audit.SetSink(&audit.BackendSink{})
+	t.Cleanup(func() { audit.SetSink(nil) })
+
+	_, err := client.NewRole("hulk", "oncall", "ubuntu", "env:production")
+	assert.Nil(t, err)
+	_, err = client.AttachRole("hulk", "oncall", "beni")
+	assert.Nil(t, err)
+	_, err = client.LockUser("hulk", "thanos")
+	assert.NotNil(t, err)
+
+	events, err := client.ListAuditEvents("", "1h")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(events))
+
+	created := events[0]
+	assert.Equal(t, "hulk", created.Operator)
+	assert.Equal(t, "role.create", created.Action)
+	assert.Equal(t, map[string]string{"logins": "ubuntu", "nodes": "env:production"}, created.Args)
+	assert.Nil(t, created.Before)
+	assert.NotNil(t, created.After.Role)
+
+	attached := events[1]
+	assert.Equal(t, []string{"beni"}, attached.Users)
+	assert.NotEqual(t, attached.Before.Users["beni"], attached.After.Users["beni"])
+
+	failed := events[2]
+	assert.Equal(t, audit.ResultError, failed.Result)
+	assert.NotEmpty(t, failed.Error)
+
+	events, err = client.ListAuditEvents("beni", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+}
+
+func TestAudit_shouldDetectChangedAndMissingBackendEvents(t *testing.T) {
+	setup()
+	audit.SetSink(&audit.BackendSink{})
+	t.Cleanup(func() { audit.SetSink(nil) })
+	storage := backend.GetStorage()
+
+	_, err := client.LockUser("hulk", "beni")
+	assert.Nil(t, err)
+	_, err = client.UnlockUser("hulk", "beni")
+	assert.Nil(t, err)
+	events, err := client.ListAuditEvents("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, events[0].Hash, events[1].PrevHash)
+
+	items, _ := storage.GetItems(audit.Prefix)
+	first := audit.Prefix + "00000000000000000001"
+	last := audit.Prefix + "00000000000000000002"
+
+	storage.InsertItem(first, strings.Replace(items[first], `"operator":"hulk"`, `"operator":"thor"`, 1), 0)
+	_, err = client.ListAuditEvents("", "")
+	assert.EqualError(t, err, "Audit log was tampered with at event "+first)
+
+	storage.InsertItem(first, items[first], 0)
+	storage.DeleteItem(last)
+	_, err = client.ListAuditEvents("", "")
+	assert.EqualError(t, err, "Audit log was tampered with, it ends at event 1 but 2 were written")
+}
+
+// failingSink cannot write, like a full disk or an unreachable backend.
+type failingSink struct{}
+
+func (failingSink) Write(e audit.Event) error {
+	return errors.New("disk full")
+}
+
+func (failingSink) Query(f audit.Filter) ([]audit.Event, error) {
+	return nil, nil
+}
+
+func TestAudit_shouldFailTheCommandWhenTheEventIsNotRecorded(t *testing.T) {
+	setup()
+	audit.SetSink(failingSink{})
+	t.Cleanup(func() { audit.SetSink(nil) })
+
+	_, err := client.LockUser("hulk", "beni")
+	assert.EqualError(t, err, "user.lock was made but could not be recorded in the audit log: disk full")
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2020, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	since, err := client.ParseSince("7d", now)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2020, 1, 3, 12, 0, 0, 0, time.UTC), since)
+
+	since, err = client.ParseSince("90m", now)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(-90*time.Minute), since)
+
+	since, err = client.ParseSince("2020-01-01T00:00:00Z", now)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), since)
+
+	_, err = client.ParseSince("last week", now)
+	assert.NotNil(t, err)
+}
@@ -1,19 +1,47 @@
 package client
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/bentol/tero/account"
+	"github.com/bentol/tero/audit"
 	"github.com/bentol/tero/backend"
 	"github.com/bentol/tero/config"
 	"github.com/bentol/tero/notif"
-	"github.com/bentol/tero/tctl"
-	"github.com/olekukonko/tablewriter"
+	"github.com/bentol/tero/role"
 )
 
-func NewRole(name, rawAllowedLogins, rawNodePatterns string) (string, error) {
+// RoleFlags holds the optional role settings given on the command line.
+// Empty fields are left as they are.
+type RoleFlags struct {
+	DenyLogins     string
+	DenyNodes      string
+	AllowRules     []string
+	DenyRules      []string
+	MaxSessionTTL  string
+	ForwardAgent   string
+	PortForwarding string
+	CertFormat     string
+}
+
+func NewRole(operator, name, rawAllowedLogins, rawNodePatterns string) (string, error) {
+	return NewRoleWithFlags(operator, name, rawAllowedLogins, rawNodePatterns, RoleFlags{})
+}
+
+func NewRoleWithFlags(operator, name, rawAllowedLogins, rawNodePatterns string, flags RoleFlags) (string, error) {
+	args := roleArgs(rawAllowedLogins, rawNodePatterns, flags)
+	return audited(operator, "role.create", name, nil, args, func() (string, error) {
+		return createRole(name, rawAllowedLogins, rawNodePatterns, flags)
+	})
+}
+
+func createRole(name, rawAllowedLogins, rawNodePatterns string, flags RoleFlags) (string, error) {
 	nodePatterns, err := backend.ParseNodePatterns(rawNodePatterns)
 	if err != nil {
 		return "", err
@@ -23,137 +51,532 @@ func NewRole(name, rawAllowedLogins, rawNodePatterns string) (string, error) {
 		return "", err
 	}
 
-	role, err := backend.CreateRole(name, allowedLogins, nodePatterns)
+	newRole := role.Role{
+		Name:          name,
+		NodePatterns:  nodePatterns,
+		AllowedLogins: allowedLogins,
+	}
+	err = applyRoleFlags(&newRole, flags)
 	if err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("Role `%s` successfully created!", role.Name), nil
+	created, err := backend.CreateRole(newRole)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Role `%s` successfully created!", created.Name), nil
 }
 
-func ListRoles() (string, error) {
-	result := new(bytes.Buffer)
+func ListRoles() (RoleList, error) {
+	roles, err := backend.GetRoles()
+	if err != nil {
+		return nil, err
+	}
 
-	roles, _ := backend.GetRoles()
+	result := make(RoleList, 0, len(roles))
+	for _, r := range roles {
+		result = append(result, newRoleInfo(r))
+	}
+	return result, nil
+}
 
-	data := make([][]string, 0)
+// DeleteRoleFlags say what happens to the users holding the role, without
+// either of them a role that is still attached is not deleted.
+type DeleteRoleFlags struct {
+	// Cascade detaches the role from its holders first
+	Cascade bool
+	// Reassign attaches this role to the holders in place of the deleted
+	// one, for as long as they held it
+	Reassign string
+}
 
-	for _, role := range roles {
-		data = append(data, []string{role.Name, role.StringAllowedLogins(), role.StringNodePatterns()})
+func DeleteRole(operator, name string) (string, error) {
+	return DeleteRoleWithFlags(operator, name, DeleteRoleFlags{})
+}
+
+func DeleteRoleWithFlags(operator, name string, flags DeleteRoleFlags) (string, error) {
+	if flags.Cascade && flags.Reassign != "" {
+		return "", backend.Invalid("Use either --cascade or --reassign, not both")
+	}
+	if flags.Reassign == name {
+		return "", backend.Invalid("Cannot reassign role `%s` to itself", name)
 	}
 
-	table := tablewriter.NewWriter(result)
-	table.SetHeader([]string{"Role", "Allowed Logins", "Node"})
+	holders, err := RoleHolders(name)
+	if err != nil {
+		return "", err
+	}
+	args := make(map[string]string)
+	if flags.Cascade {
+		args["cascade"] = "true"
+	}
+	if flags.Reassign != "" {
+		args["reassign"] = flags.Reassign
+	}
+	return audited(operator, "role.delete", name, holders, args, func() (string, error) {
+		return deleteRole(name, flags)
+	})
+}
 
-	for _, v := range data {
-		table.Append(v)
+// RoleHolders returns the names of the users the role is attached to.
+func RoleHolders(name string) ([]string, error) {
+	users, err := backend.GetUsersByRole(name)
+	if err != nil {
+		return nil, err
 	}
-	table.Render()
-	return result.String(), nil
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		names = append(names, u.Name)
+	}
+	sort.Strings(names)
+	return names, nil
 }
 
-func DeleteRole(name string) (string, error) {
-	role, _ := backend.GetRoleByName(name)
+func deleteRole(name string, flags DeleteRoleFlags) (string, error) {
+	role, err := backend.GetRoleByName(name)
+	if err != nil {
+		return "", err
+	}
 	if role == nil {
-		return "Role doesn't exists", nil
+		return "", backend.NotFound("Role `%s` does not exist", name)
+	}
+	if flags.Reassign != "" {
+		target, err := backend.GetRoleByName(flags.Reassign)
+		if err != nil {
+			return "", err
+		}
+		if target == nil {
+			return "", backend.NotFound("Role `%s` does not exist", flags.Reassign)
+		}
+	}
+
+	holders, err := RoleHolders(name)
+	if err != nil {
+		return "", err
+	}
+	if len(holders) != 0 {
+		if !flags.Cascade && flags.Reassign == "" {
+			return "", fmt.Errorf("Role `%s` is still attached to %s, use --cascade to detach it or --reassign to move them to another role", name, strings.Join(holders, ","))
+		}
+		if flags.Reassign != "" {
+			if err := reassignRole(name, flags.Reassign, holders); err != nil {
+				return "", fmt.Errorf("Failed to reassign to role `%s`: %s", flags.Reassign, err)
+			}
+		}
+		if _, err := backend.DettachRole(name, holders); err != nil {
+			return "", fmt.Errorf("Failed to detach role: %s", err)
+		}
+	}
+
+	err = backend.DeleteRole(name)
+	if err != nil {
+		return "", fmt.Errorf("Failed to delete role: %s", err)
 	}
 
-	err := backend.DeleteRole(name)
-	if err == nil {
+	switch {
+	case len(holders) == 0:
 		return fmt.Sprintf("Role `%s` deleted!", name), nil
+	case flags.Reassign != "":
+		return fmt.Sprintf("Role `%s` deleted, [%s] moved to role `%s`!", name, strings.Join(holders, ","), flags.Reassign), nil
+	default:
+		return fmt.Sprintf("Role `%s` deleted and detached from [%s]!", name, strings.Join(holders, ",")), nil
 	}
-	return fmt.Sprintf("Failed to delete role: %s", err), nil
 }
 
-func UpdateRole(name, rawAllowedLogins, rawNodePatterns string) (string, error) {
-	nodePatterns, err := backend.ParseNodePatterns(rawNodePatterns)
+// reassignRole attaches role to to the users, until the expiry of their
+// grant of role from when it is time-boxed. Users that already have role
+// to keep it as it is, unless they held role from for good.
+func reassignRole(from, to string, users []string) error {
+	grants, err := backend.GetGrants()
 	if err != nil {
-		return "", err
+		return err
 	}
-	allowedLogins, err := backend.ParseAllowedLogins(rawAllowedLogins)
+	expires := make(map[string]time.Time)
+	for _, g := range grants {
+		if g.Role == from {
+			expires[g.User] = g.Expires
+		}
+	}
+	holders, err := RoleHolders(to)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	_, err = backend.UpdateRole(name, allowedLogins, nodePatterns)
-	if err != nil {
-		return "", err
+	forGood := make([]string, 0)
+	now := time.Now()
+	for _, u := range users {
+		until, timeBoxed := expires[u]
+		switch {
+		case !timeBoxed:
+			forGood = append(forGood, u)
+		case containsString(holders, u) || !until.After(now):
+			// already has it, or the grant expired and is left to reap
+		default:
+			if _, err := backend.AttachRoleUntil(to, []string{u}, until); err != nil {
+				return err
+			}
+		}
+	}
+	if len(forGood) == 0 {
+		return nil
 	}
+	_, err = backend.AttachRole(to, forGood)
+	return err
+}
 
-	return fmt.Sprintf("Role `%s` successfully updated!", name), nil
+func UpdateRole(operator, name, rawAllowedLogins, rawNodePatterns string) (string, error) {
+	return UpdateRoleWithFlags(operator, name, rawAllowedLogins, rawNodePatterns, RoleFlags{})
 }
 
-func AttachRole(name string, rawUsers string) (string, error) {
-	users := strings.Split(rawUsers, ",")
-	_, err := backend.AttachRole(name, users)
+// UpdateRoleWithFlags only changes the settings that are given, empty
+// logins or nodes keep their current value.
+func UpdateRoleWithFlags(operator, name, rawAllowedLogins, rawNodePatterns string, flags RoleFlags) (string, error) {
+	args := roleArgs(rawAllowedLogins, rawNodePatterns, flags)
+	return audited(operator, "role.update", name, nil, args, func() (string, error) {
+		return updateRole(name, rawAllowedLogins, rawNodePatterns, flags)
+	})
+}
 
+func updateRole(name, rawAllowedLogins, rawNodePatterns string, flags RoleFlags) (string, error) {
+	changes := role.Role{}
+	if rawNodePatterns != "" {
+		nodePatterns, err := backend.ParseNodePatterns(rawNodePatterns)
+		if err != nil {
+			return "", err
+		}
+		changes.NodePatterns = nodePatterns
+	}
+	if rawAllowedLogins != "" {
+		allowedLogins, err := backend.ParseAllowedLogins(rawAllowedLogins)
+		if err != nil {
+			return "", err
+		}
+		changes.AllowedLogins = allowedLogins
+	}
+	err := applyRoleFlags(&changes, flags)
 	if err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("Role `%s` successfully attached!", name), nil
+	return updateRoleSpec(name, changes)
 }
 
-func DetachRole(name string, rawUsers string) (string, error) {
-	users := strings.Split(rawUsers, ",")
-	_, err := backend.DettachRole(name, users)
+// CreateRoleSpec creates r as given, for callers that build the whole role
+// themselves like the REST API.
+func CreateRoleSpec(operator string, r role.Role) (string, error) {
+	return audited(operator, "role.create", r.Name, nil, specArgs(r), func() (string, error) {
+		created, err := backend.CreateRole(r)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Role `%s` successfully created!", created.Name), nil
+	})
+}
 
+// UpdateRoleSpec changes the settings of the role that are set in changes,
+// the others keep their current value.
+func UpdateRoleSpec(operator, name string, changes role.Role) (string, error) {
+	return audited(operator, "role.update", name, nil, specArgs(changes), func() (string, error) {
+		return updateRoleSpec(name, changes)
+	})
+}
+
+func updateRoleSpec(name string, changes role.Role) (string, error) {
+	_, err := backend.UpdateRole(name, func(r *role.Role) {
+		if changes.NodePatterns != nil {
+			r.NodePatterns = changes.NodePatterns
+		}
+		if changes.AllowedLogins != nil {
+			r.AllowedLogins = changes.AllowedLogins
+		}
+		if changes.AllowRules != nil {
+			r.AllowRules = changes.AllowRules
+		}
+		if changes.Deny.Logins != nil {
+			r.Deny.Logins = changes.Deny.Logins
+		}
+		if changes.Deny.NodeLabels != nil {
+			r.Deny.NodeLabels = changes.Deny.NodeLabels
+		}
+		if changes.Deny.Rules != nil {
+			r.Deny.Rules = changes.Deny.Rules
+		}
+		if changes.Options.MaxSessionTTL != "" {
+			r.Options.MaxSessionTTL = changes.Options.MaxSessionTTL
+		}
+		if changes.Options.CertFormat != "" {
+			r.Options.CertFormat = changes.Options.CertFormat
+		}
+		if changes.Options.ForwardAgent != nil {
+			r.Options.ForwardAgent = changes.Options.ForwardAgent
+		}
+		if changes.Options.PortForwarding != nil {
+			r.Options.PortForwarding = changes.Options.PortForwarding
+		}
+	})
 	if err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("Role `%s` successfully detached from [%s]!", name, rawUsers), nil
+	return fmt.Sprintf("Role `%s` successfully updated!", name), nil
 }
 
-func ShowRole(name string) (string, error) {
-	r, err := backend.GetRoleByName(name)
-	if r == nil {
-		return "", fmt.Errorf("Role `%s` does not exist", name)
+// roleArgs are the role settings given, for the audit log.
+func roleArgs(rawAllowedLogins, rawNodePatterns string, flags RoleFlags) map[string]string {
+	args := map[string]string{
+		"logins":          rawAllowedLogins,
+		"nodes":           rawNodePatterns,
+		"deny_logins":     flags.DenyLogins,
+		"deny_nodes":      flags.DenyNodes,
+		"allow_rules":     strings.Join(flags.AllowRules, " "),
+		"deny_rules":      strings.Join(flags.DenyRules, " "),
+		"max_session_ttl": flags.MaxSessionTTL,
+		"forward_agent":   flags.ForwardAgent,
+		"port_forwarding": flags.PortForwarding,
+		"cert_format":     flags.CertFormat,
+	}
+	for k, v := range args {
+		if v == "" {
+			delete(args, k)
+		}
 	}
-	if err != nil {
-		return "", err
+	return args
+}
+
+// specArgs are the settings of r that are set, for the audit log.
+func specArgs(r role.Role) map[string]string {
+	rules := func(rules []role.Rule) string {
+		s := make([]string, 0, len(rules))
+		for _, rule := range rules {
+			s = append(s, rule.String())
+		}
+		return strings.Join(s, " ")
+	}
+	args := map[string]string{
+		"logins":          strings.Join(r.AllowedLogins, ","),
+		"nodes":           r.StringNodePatterns(),
+		"deny_logins":     r.Deny.StringLogins(),
+		"deny_nodes":      r.Deny.StringNodeLabels(),
+		"allow_rules":     rules(r.AllowRules),
+		"deny_rules":      rules(r.Deny.Rules),
+		"max_session_ttl": r.Options.MaxSessionTTL,
+		"forward_agent":   stringBool(r.Options.ForwardAgent),
+		"port_forwarding": stringBool(r.Options.PortForwarding),
+		"cert_format":     r.Options.CertFormat,
+	}
+	for k, v := range args {
+		if v == "" {
+			delete(args, k)
+		}
 	}
+	return args
+}
 
-	users, err := backend.GetUsersByRole(r.Name)
+func applyRoleFlags(r *role.Role, flags RoleFlags) error {
+	var err error
+	if flags.DenyLogins != "" {
+		r.Deny.Logins, err = backend.ParseAllowedLogins(flags.DenyLogins)
+		if err != nil {
+			return err
+		}
+	}
+	if flags.DenyNodes != "" {
+		r.Deny.NodeLabels, err = backend.ParseNodePatterns(flags.DenyNodes)
+		if err != nil {
+			return err
+		}
+	}
+	if len(flags.AllowRules) != 0 {
+		r.AllowRules, err = backend.ParseRules(flags.AllowRules)
+		if err != nil {
+			return err
+		}
+	}
+	if len(flags.DenyRules) != 0 {
+		r.Deny.Rules, err = backend.ParseRules(flags.DenyRules)
+		if err != nil {
+			return err
+		}
+	}
+	if flags.MaxSessionTTL != "" {
+		ttl, err := time.ParseDuration(flags.MaxSessionTTL)
+		if err != nil {
+			return backend.Invalid("Invalid max session ttl `%s`", flags.MaxSessionTTL)
+		}
+		r.Options.MaxSessionTTL = ttl.String()
+	}
+	if flags.CertFormat != "" {
+		r.Options.CertFormat = flags.CertFormat
+	}
+	if flags.ForwardAgent != "" {
+		forwardAgent, err := strconv.ParseBool(flags.ForwardAgent)
+		if err != nil {
+			return backend.Invalid("Invalid forward agent value `%s`", flags.ForwardAgent)
+		}
+		r.Options.ForwardAgent = &forwardAgent
+	}
+	if flags.PortForwarding != "" {
+		portForwarding, err := strconv.ParseBool(flags.PortForwarding)
+		if err != nil {
+			return backend.Invalid("Invalid port forwarding value `%s`", flags.PortForwarding)
+		}
+		r.Options.PortForwarding = &portForwarding
+	}
+	return nil
+}
+
+func AttachRole(operator, name string, rawUsers string) (string, error) {
+	users := strings.Split(rawUsers, ",")
+	return audited(operator, "role.attach", name, users, nil, func() (string, error) {
+		_, err := backend.AttachRole(name, users)
+
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("Role `%s` successfully attached!", name), nil
+	})
+}
+
+// AttachRoleUntil attaches the role until expires, `tero reap` detaches
+// it afterwards.
+func AttachRoleUntil(operator, name string, rawUsers string, expires time.Time) (string, error) {
+	users := strings.Split(rawUsers, ",")
+	args := map[string]string{"until": expires.Format(time.RFC3339)}
+	return audited(operator, "role.attach", name, users, args, func() (string, error) {
+		_, err := backend.AttachRoleUntil(name, users, expires)
+
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("Role `%s` successfully attached until %s!", name, expires.Format(time.RFC3339)), nil
+	})
+}
+
+// ParseExpiry returns when a grant given --for duration or --until
+// timestamp (RFC3339) expires, zero time means the grant does not expire.
+func ParseExpiry(duration time.Duration, until string, now time.Time) (time.Time, error) {
+	if duration != 0 && until != "" {
+		return time.Time{}, backend.Invalid("Use either --for or --until, not both")
+	}
+	if duration < 0 {
+		return time.Time{}, backend.Invalid("Invalid duration `%s`", duration)
+	}
+	if duration != 0 {
+		return now.Add(duration), nil
+	}
+	if until == "" {
+		return time.Time{}, nil
+	}
+
+	expires, err := time.Parse(time.RFC3339, until)
 	if err != nil {
-		return "", err
+		return time.Time{}, backend.Invalid("Invalid timestamp `%s`, use RFC3339. Ex: 2020-01-02T15:04:05+07:00", until)
+	}
+	return expires, nil
+}
+
+// ReapGrants detaches the roles whose grant expired and logs each of them.
+func ReapGrants(operator string) (Grants, error) {
+	reaped, err := backend.ReapGrants(time.Now())
+	for _, g := range reaped {
+		log.Printf("Detached role `%s` from `%s`, grant expired at %s", g.Role, g.User, g.Expires.Format(time.RFC3339))
+		recordErr := record(audit.Event{
+			Time:     time.Now().UTC(),
+			Operator: operator,
+			Action:   "grant.expire",
+			Role:     g.Role,
+			Users:    []string{g.User},
+			Args:     map[string]string{"expires": g.Expires.Format(time.RFC3339)},
+			After:    snapshot(g.Role, []string{g.User}),
+			Result:   audit.ResultOK,
+		})
+		if recordErr != nil && err == nil {
+			err = recordErr
+		}
 	}
+	return reaped, err
+}
+
+func DetachRole(operator, name string, rawUsers string) (string, error) {
+	users := strings.Split(rawUsers, ",")
+	return audited(operator, "role.detach", name, users, nil, func() (string, error) {
+		_, err := backend.DettachRole(name, users)
 
-	bufferRoleInfo := new(bytes.Buffer)
-	table := tablewriter.NewWriter(bufferRoleInfo)
-	table.SetHeader([]string{"Role", "Allowed Logins", "Node"})
+		if err != nil {
+			return "", err
+		}
 
-	table.Append([]string{
-		r.Name,
-		r.StringAllowedLogins(),
-		r.StringNodePatterns(),
+		return fmt.Sprintf("Role `%s` successfully detached from [%s]!", name, rawUsers), nil
 	})
-	table.Render()
+}
 
-	bufferUsersInfo := new(bytes.Buffer)
-	tableUsers := tablewriter.NewWriter(bufferUsersInfo)
-	tableUsers.SetHeader([]string{"Name", "Roles"})
+func ShowRole(name string) (*RoleDetail, error) {
+	r, err := backend.GetRoleByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, backend.NotFound("Role `%s` does not exist", name)
+	}
 
+	users, err := backend.GetUsersByRole(r.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	detail := &RoleDetail{
+		RoleInfo:   newRoleInfo(*r),
+		DenyLogins: append([]string{}, r.Deny.Logins...),
+		DenyNodes:  r.Deny.NodeLabels,
+		AllowRules: newRuleInfos(r.AllowRules),
+		DenyRules:  newRuleInfos(r.Deny.Rules),
+		Options: OptionsInfo{
+			MaxSessionTTL:  r.Options.MaxSessionTTL,
+			ForwardAgent:   r.Options.ForwardAgent,
+			PortForwarding: r.Options.PortForwarding,
+			CertFormat:     r.Options.CertFormat,
+		},
+		Users: make([]RoleUser, 0, len(users)),
+	}
+	if detail.DenyNodes == nil {
+		detail.DenyNodes = make(map[string]string)
+	}
 	for _, u := range users {
-		tableUsers.Append([]string{
-			u.Name,
-			strings.Join(u.RoleNames(), ", "),
-		})
+		detail.Users = append(detail.Users, RoleUser{Name: u.Name, Roles: u.RoleNames()})
+	}
+	return detail, nil
+}
+
+func stringBool(b *bool) string {
+	if b == nil {
+		return ""
 	}
-	tableUsers.Render()
+	return strconv.FormatBool(*b)
+}
 
-	result := "Role Info\n" + bufferRoleInfo.String() + "\n\nUsers\n" + bufferUsersInfo.String() + "\n"
-	return result, nil
+func AddUser(operator, userName, stringRoles, sendEmailTo string) (string, error) {
+	args := map[string]string{"roles": stringRoles, "email": sendEmailTo}
+	return audited(operator, "user.create", "", []string{userName}, args, func() (string, error) {
+		return addUser(userName, stringRoles, sendEmailTo)
+	})
 }
 
-func AddUser(userName, stringRoles, sendEmailTo string) (string, error) {
+func addUser(userName, stringRoles, sendEmailTo string) (string, error) {
+	if err := backend.CheckName("user", userName); err != nil {
+		return "", err
+	}
+
 	// make sure user not exist
 	results, _ := backend.GetUsersByNames([]string{userName})
 	if len(results) != 0 {
 		return "", errors.New(fmt.Sprintf("User `%s` already exist", userName))
 	}
 
-	stdout, tokenString, err := tctl.CmdAddUser(userName, "")
+	stdout, tokenString, err := account.AddUser(userName)
 	if err != nil {
 		return "", err
 	}
@@ -166,7 +589,7 @@ func AddUser(userName, stringRoles, sendEmailTo string) (string, error) {
 	// send email
 	if config.Get().EnableEmailToken {
 		if sendEmailTo == "" {
-			sendEmailTo = userName + "@tokopedia.com"
+			sendEmailTo = notif.Address(userName)
 		}
 		err = notif.SentMailNewUser(userName, sendEmailTo, tokenString)
 		if err != nil {
@@ -179,139 +602,109 @@ func AddUser(userName, stringRoles, sendEmailTo string) (string, error) {
 	return stdout, nil
 }
 
-func ShowUser(name string) (string, error) {
+func ShowUser(name string) (*UserInfo, error) {
 	users, err := backend.GetUsersByNames([]string{name})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(users) == 0 {
-		return "", fmt.Errorf("User `%s` does not exist", name)
+		return nil, backend.NotFound("User `%s` does not exist", name)
 	}
 
-	bufferUsersInfo := new(bytes.Buffer)
-	tableUsers := tablewriter.NewWriter(bufferUsersInfo)
-	tableUsers.SetHeader([]string{"Name", "Roles"})
-	tableUsers.SetColMinWidth(1, 100)
-	tableUsers.SetAutoMergeCells(true)
-
-	user := users[0]
-	roleInfo := make([]string, 0)
-	for _, r := range user.Roles {
-		if len(r.Name) == 0 {
-			continue
-		}
-		info := r.Name + " = " + r.StringAllowedLogins() + "@" + r.StringNodePatterns()
-		roleInfo = append(roleInfo, info)
-	}
-
-	u := users[0]
-	for i, info := range roleInfo {
-		if i == 0 {
-			name = u.Name
-		} else {
-			name = ""
-		}
-		tableUsers.Append([]string{
-			name,
-			info,
-		})
+	grants, err := backend.GetGrantsByUser(name)
+	if err != nil {
+		return nil, err
 	}
-	tableUsers.Render()
 
-	result := bufferUsersInfo.String()
-	return result, nil
+	info := newUserInfo(users[0], grants)
+	return &info, nil
 }
 
-func ListUser() (string, error) {
+func ListUser() (UserList, error) {
 	users, err := backend.GetUsers()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	bufferUsersInfo := new(bytes.Buffer)
-	tableUsers := tablewriter.NewWriter(bufferUsersInfo)
-	tableUsers.SetHeader([]string{"Name", "Locked", "Roles"})
-	tableUsers.SetColMinWidth(2, 100)
-	tableUsers.SetAutoMergeCells(true)
-	tableUsers.SetRowLine(true)
-
-	for _, user := range users {
-		roleInfo := make([]string, 0)
-		for _, r := range user.Roles {
-			if len(r.Name) == 0 {
-				continue
-			}
-			info := r.Name + " = " + r.StringAllowedLogins() + "@" + r.StringNodePatterns()
-			roleInfo = append(roleInfo, info)
-		}
-		lockedStatus := "no"
-		if user.IsLocked {
-			lockedStatus = "yes"
-		}
-
-		for _, info := range roleInfo {
-			name := user.Name
-			tableUsers.Append([]string{
-				name,
-				lockedStatus,
-				info,
-			})
-		}
+	grants, err := backend.GetGrants()
+	if err != nil {
+		return nil, err
 	}
 
-	tableUsers.Render()
-
-	result := bufferUsersInfo.String()
+	result := make(UserList, 0, len(users))
+	for _, u := range users {
+		result = append(result, newUserInfo(u, grants))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
 	return result, nil
 }
 
-func LockUser(username string) (string, error) {
-	err := backend.LockUser(username)
+func LockUser(operator, username string) (string, error) {
+	return audited(operator, "user.lock", "", []string{username}, nil, func() (string, error) {
+		err := backend.LockUser(username)
 
-	if err != nil {
-		return "", err
-	}
+		if err != nil {
+			return "", err
+		}
 
-	return fmt.Sprintf("User `%s` is locked!", username), nil
+		return fmt.Sprintf("User `%s` is locked!", username), nil
+	})
 }
 
-func UnlockUser(username string) (string, error) {
-	err := backend.UnlockUser(username)
+func UnlockUser(operator, username string) (string, error) {
+	return audited(operator, "user.unlock", "", []string{username}, nil, func() (string, error) {
+		err := backend.UnlockUser(username)
 
-	if err != nil {
-		return "", err
-	}
+		if err != nil {
+			return "", err
+		}
 
-	return fmt.Sprintf("User `%s` is unlocked!", username), nil
+		return fmt.Sprintf("User `%s` is unlocked!", username), nil
+	})
+}
+
+func DeleteUser(operator, userName string) (string, error) {
+	return audited(operator, "user.delete", "", []string{userName}, nil, func() (string, error) {
+		return deleteUser(userName)
+	})
 }
 
-func DeleteUser(userName string) (string, error) {
+func deleteUser(userName string) (string, error) {
 	// make sure user not exist
 	results, _ := backend.GetUsersByNames([]string{userName})
 	if len(results) == 0 {
-		return "", errors.New(fmt.Sprintf("User `%s` not exist", userName))
+		return "", backend.NotFound("User `%s` not exist", userName)
 	}
 
-	_, err := tctl.CmdDeleteUser(userName)
+	err := account.DeleteUser(userName)
 	if err != nil {
 		return "", err
 	}
 	return fmt.Sprintf("User `%s` deleted!", userName), nil
 }
 
-func ResetUser(userName, sendEmailTo string) (string, error) {
+func ResetUser(operator, userName, sendEmailTo string) (string, error) {
+	args := map[string]string{"email": sendEmailTo}
+	return audited(operator, "user.reset", "", []string{userName}, args, func() (string, error) {
+		return resetUser(userName, sendEmailTo)
+	})
+}
+
+func resetUser(userName, sendEmailTo string) (string, error) {
 	results, _ := backend.GetUsersByNames([]string{userName})
 	if len(results) == 0 {
-		return "", fmt.Errorf("user `%s` not exist", userName)
+		return "", backend.NotFound("user `%s` not exist", userName)
 	}
 
-	_, err := DeleteUser(userName)
+	_, err := deleteUser(userName)
 	if err != nil {
 		return "", err
 	}
 
 	userObj := results[0]
 	roles := strings.Join(userObj.RoleNames(), ",")
-	return AddUser(userName, roles, sendEmailTo)
+	return addUser(userName, roles, sendEmailTo)
 }
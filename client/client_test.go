@@ -1,15 +1,22 @@
-package client
+package client_test
 
 import (
 	"fmt"
+	"log"
 	"math/rand"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/bentol/tero/account"
 	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/backend/memory"
 	"github.com/bentol/tero/client"
+	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/output"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func init() {
@@ -24,12 +31,40 @@ func init() {
 }
 
 func setup() {
-	backend.InitBackend("dynamodb")
+	err := backend.InitBackend("memory", config.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = backend.GetStorage().(*memory.MemoryStorage).LoadFixtures("../testdata")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// fakeAccounts stores a signup token as teleport does when a user is added.
+type fakeAccounts struct{}
+
+func (fakeAccounts) AddUser(name string) (string, string, error) {
+	token := "fresh-" + name
+	record := `{"token":"` + token + `","user":{"name":"` + name + `","roles":null}}`
+	return "Signup token created", token, backend.GetStorage().InsertItem("teleport/addusertokens/"+token, record, 0)
+}
+
+func (fakeAccounts) DeleteUser(name string) error {
+	return nil
+}
+
+func render(t *testing.T, v interface{}) string {
+	out, err := output.String("table", v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
 }
 
 func TestNewRole_shouldCreateNewRole(t *testing.T) {
-	_, _ = client.DeleteRole("brand_new_role")
-	out, err := client.NewRole("brand_new_role", "ubuntu,root,admin", "app:tome,env:production")
+	_, _ = client.DeleteRole("hulk", "brand_new_role")
+	out, err := client.NewRole("hulk", "brand_new_role", "ubuntu,root,admin", "app:tome,env:production")
 	if err != nil {
 		t.Error("add role failed with valid input")
 		t.Error(err)
@@ -48,39 +83,87 @@ func TestNewRole_shouldCreateNewRole(t *testing.T) {
 }
 
 func TestNewRole_cannotCreateNewRoleThatAlreadyExists(t *testing.T) {
-	_, _ = client.DeleteRole("second_role")
+	_, _ = client.DeleteRole("hulk", "second_role")
 
-	_, _ = client.NewRole("second_role", "ubuntu,root,admin", "app:tome,env:production")
+	_, _ = client.NewRole("hulk", "second_role", "ubuntu,root,admin", "app:tome,env:production")
 
-	_, err := client.NewRole("second_role", "ubuntu,root,admin", "app:tome,env:production")
+	_, err := client.NewRole("hulk", "second_role", "ubuntu,root,admin", "app:tome,env:production")
 	assert.Contains(t, err.Error(), "already exists")
 }
 
 func TestDeleteRole_shouldRemoveRole(t *testing.T) {
-	client.NewRole("existed_role", "ubuntu", "env:production")
-	client.DeleteRole("existed_role")
+	client.NewRole("hulk", "existed_role", "ubuntu", "env:production")
+	client.DeleteRole("hulk", "existed_role")
 	role, _ := backend.GetRoleByName("existed_role")
 	if role != nil {
 		t.Error("Role should not exist after deleted")
 	}
 }
 
+func TestDeleteRole_shouldRefuseWhileAttached(t *testing.T) {
+	setup()
+	client.NewRole("hulk", "held_role", "ubuntu", "env:production")
+	client.AttachRole("hulk", "held_role", "beni,hulk")
+
+	_, err := client.DeleteRole("hulk", "held_role")
+	assert.Equal(t, "Role `held_role` is still attached to beni,hulk, use --cascade to detach it or --reassign to move them to another role", err.Error())
+	role, _ := backend.GetRoleByName("held_role")
+	assert.NotNil(t, role)
+
+	_, err = client.DeleteRoleWithFlags("hulk", "held_role", client.DeleteRoleFlags{Cascade: true, Reassign: "admin"})
+	assert.NotNil(t, err)
+
+	out, err := client.DeleteRoleWithFlags("hulk", "held_role", client.DeleteRoleFlags{Cascade: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "Role `held_role` deleted and detached from [beni,hulk]!", out)
+	users, _ := backend.GetUsersByNames([]string{"beni", "hulk"})
+	for _, u := range users {
+		assert.Equal(t, []string{"admin"}, u.RoleNames())
+	}
+}
+
+func TestDeleteRole_shouldReassignHolders(t *testing.T) {
+	setup()
+	client.NewRole("hulk", "old_role", "ubuntu", "env:production")
+	client.NewRole("hulk", "new_role", "ubuntu", "env:production")
+	client.AttachRole("hulk", "old_role", "beni")
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	client.AttachRoleUntil("hulk", "old_role", "hulk", expires)
+
+	_, err := client.DeleteRoleWithFlags("hulk", "old_role", client.DeleteRoleFlags{Reassign: "missing_role"})
+	assert.Contains(t, err.Error(), "Role `missing_role` does not exist")
+
+	out, err := client.DeleteRoleWithFlags("hulk", "old_role", client.DeleteRoleFlags{Reassign: "new_role"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Role `old_role` deleted, [beni,hulk] moved to role `new_role`!", out)
+
+	holders, _ := client.RoleHolders("new_role")
+	assert.Equal(t, []string{"beni", "hulk"}, holders)
+	grants, _ := backend.GetGrantsByUser("hulk")
+	assert.Equal(t, 1, len(grants))
+	assert.Equal(t, "new_role", grants[0].Role)
+	assert.True(t, expires.Equal(grants[0].Expires))
+	grants, _ = backend.GetGrantsByUser("beni")
+	assert.Equal(t, 0, len(grants))
+}
+
 func TestListRole_shouldDisplayAllRoles(t *testing.T) {
-	client.NewRole("role_one", "ubuntu", "env:production")
-	client.NewRole("role_two", "dev", "env:staging")
+	client.NewRole("hulk", "role_one", "ubuntu", "env:production")
+	client.NewRole("hulk", "role_two", "dev", "env:staging")
 
-	result, err := client.ListRoles()
+	roles, err := client.ListRoles()
 	if err != nil {
 		t.Fatal(err)
 	}
+	result := render(t, roles)
 	assert.Contains(t, result, "role_one")
 	assert.Contains(t, result, "role_two")
 }
 
 func TestUpdateRole_shouldChangeItsAttribute(t *testing.T) {
-	_, _ = client.DeleteRole("to_be_updated")
-	_, _ = client.NewRole("to_be_updated", "ubuntu", "env:staging")
-	out, err := client.UpdateRole("to_be_updated", "root,dev", "app:tome,env:production")
+	_, _ = client.DeleteRole("hulk", "to_be_updated")
+	_, _ = client.NewRole("hulk", "to_be_updated", "ubuntu", "env:staging")
+	out, err := client.UpdateRole("hulk", "to_be_updated", "root,dev", "app:tome,env:production")
 	if err != nil {
 		t.Fatal("error: " + err.Error())
 	}
@@ -93,24 +176,63 @@ func TestUpdateRole_shouldChangeItsAttribute(t *testing.T) {
 	assert.Contains(t, "tome", role.NodePatterns["app"])
 }
 
+func TestUpdateRoleWithFlags_shouldOnlyChangeGivenSettings(t *testing.T) {
+	roleName := "test-role-" + strconv.Itoa(rand.Int())
+	_, err := client.NewRoleWithFlags("hulk", roleName, "ubuntu", "env:staging", client.RoleFlags{
+		DenyLogins:    "root",
+		AllowRules:    []string{"session:list,read"},
+		MaxSessionTTL: "8h",
+		ForwardAgent:  "true",
+	})
+	assert.Nil(t, err)
+
+	_, err = client.UpdateRoleWithFlags("hulk", roleName, "", "", client.RoleFlags{
+		PortForwarding: "false",
+		DenyRules:      []string{"role:create,update:contains(user.spec.traits[\"groups\"], \"intern\")"},
+	})
+	assert.Nil(t, err)
+
+	r, _ := backend.GetRoleByName(roleName)
+	assert.Equal(t, []string{"ubuntu"}, r.AllowedLogins)
+	assert.Equal(t, "staging", r.NodePatterns["env"])
+	assert.Equal(t, []string{"root"}, r.Deny.Logins)
+	assert.Equal(t, "session:list,read", r.AllowRules[0].String())
+	assert.Equal(t, []string{"create", "update"}, r.Deny.Rules[0].Verbs)
+	assert.Equal(t, `contains(user.spec.traits["groups"], "intern")`, r.Deny.Rules[0].Where)
+	assert.Equal(t, "8h0m0s", r.Options.MaxSessionTTL)
+	assert.True(t, *r.Options.ForwardAgent)
+	assert.False(t, *r.Options.PortForwarding)
+}
+
+func TestNewRoleWithFlags_shouldRejectInvalidRule(t *testing.T) {
+	roleName := "test-role-" + strconv.Itoa(rand.Int())
+	_, err := client.NewRoleWithFlags("hulk", roleName, "ubuntu", "env:staging", client.RoleFlags{
+		AllowRules: []string{"session"},
+	})
+	assert.NotNil(t, err)
+
+	r, _ := backend.GetRoleByName(roleName)
+	assert.Nil(t, r)
+}
+
 func TestAttachRole_shouldErrorIfRoleNotExist(t *testing.T) {
-	out, err := client.AttachRole("imaginary_role", "beni,budi")
+	out, err := client.AttachRole("hulk", "imaginary_role", "beni,budi")
 	assert.NotNil(t, err, "Attach non existant role should failed")
 	assert.Equal(t, err.Error(), fmt.Sprintf("Role `%s` does not exist", "imaginary_role"))
 	assert.Empty(t, out)
 }
 
 func TestAttachRole_shouldErrorIfUsersDoesNotExist(t *testing.T) {
-	out, err := client.AttachRole("admin", "imaginary_user")
+	out, err := client.AttachRole("hulk", "admin", "imaginary_user")
 	assert.NotNil(t, err, "Attach role to non existant user should failed")
 	assert.Empty(t, out)
 }
 
 func TestAttachRole_shouldAttachTheRoleToUser(t *testing.T) {
 	roleName := "test-role-" + strconv.Itoa(rand.Int())
-	_, _ = client.NewRole(roleName, "ubuntu", "env:production")
+	_, _ = client.NewRole("hulk", roleName, "ubuntu", "env:production")
 
-	out, err := client.AttachRole(roleName, "beni,hulk")
+	out, err := client.AttachRole("hulk", roleName, "beni,hulk")
 	assert.Nil(t, err, "Attach valid role should not error")
 	assert.Contains(t, out, fmt.Sprintf("Role `%s` successfully attached!", roleName))
 
@@ -121,7 +243,7 @@ func TestAttachRole_shouldAttachTheRoleToUser(t *testing.T) {
 }
 
 func TestDettachRole_shouldErrorIfRoleNotExist(t *testing.T) {
-	out, err := client.DetachRole("imaginary_role", "beni,budi")
+	out, err := client.DetachRole("hulk", "imaginary_role", "beni,budi")
 	assert.NotNil(t, err, "Detach non existant role should failed")
 	assert.Equal(t, err.Error(), fmt.Sprintf("Role `%s` does not exist", "imaginary_role"))
 	assert.Empty(t, out)
@@ -129,23 +251,23 @@ func TestDettachRole_shouldErrorIfRoleNotExist(t *testing.T) {
 
 func TestDetachRole_shouldErrorIfUsersDoesNotExist(t *testing.T) {
 	roleName := "test-role-" + strconv.Itoa(rand.Int())
-	_, _ = client.NewRole(roleName, "ubuntu", "env:production")
-	out, err := client.DetachRole(roleName, "imaginary_user")
+	_, _ = client.NewRole("hulk", roleName, "ubuntu", "env:production")
+	out, err := client.DetachRole("hulk", roleName, "imaginary_user")
 	assert.NotNil(t, err, "Detach role to non existant user should failed")
 	assert.Empty(t, out)
 }
 
 func TestDetachRole_shouldDetachTheRoleFromUser(t *testing.T) {
 	roleName := "test-role-" + strconv.Itoa(rand.Int())
-	_, _ = client.NewRole(roleName, "ubuntu", "env:production")
-	_, err := client.AttachRole(roleName, "beni,hulk")
+	_, _ = client.NewRole("hulk", roleName, "ubuntu", "env:production")
+	_, err := client.AttachRole("hulk", roleName, "beni,hulk")
 
 	users, _ := backend.GetUsersByNames([]string{"beni", "hulk"})
 	for _, u := range users {
 		assert.Contains(t, u.RoleNames(), roleName)
 	}
 
-	out, err := client.DetachRole(roleName, "beni,hulk")
+	out, err := client.DetachRole("hulk", roleName, "beni,hulk")
 	assert.Nil(t, err, "Detach role with valid input should not error")
 	assert.Contains(t,
 		out,
@@ -166,11 +288,12 @@ func TestShowRole_shouldErrorIfRoleDoesNotExist(t *testing.T) {
 
 func TestShowRole_shouldDisplayItsAllowedLoginsAndNodePatterns(t *testing.T) {
 	roleName := "test-role-" + strconv.Itoa(rand.Int())
-	_, _ = client.NewRole(roleName, "avengers,monster", "env:production,app:jet")
-	_, _ = client.AttachRole(roleName, "hulk")
+	_, _ = client.NewRole("hulk", roleName, "avengers,monster", "env:production,app:jet")
+	_, _ = client.AttachRole("hulk", roleName, "hulk")
 
-	out, err := client.ShowRole(roleName)
+	detail, err := client.ShowRole(roleName)
 	assert.Nil(t, err)
+	out := render(t, detail)
 	assert.Contains(t, out, "avengers")
 	assert.Contains(t, out, "monster")
 	assert.Contains(t, out, "env:production")
@@ -180,30 +303,27 @@ func TestShowRole_shouldDisplayItsAllowedLoginsAndNodePatterns(t *testing.T) {
 }
 
 func TestAddUser_shouldErrorIfUserAlreadyExist(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test")
-	}
 	roleName1 := "test-role-" + strconv.Itoa(rand.Int())
-	_, _ = client.NewRole(roleName1, "avengers,monster", "env:production,app:jet")
-	out, err := client.AddUser("beni", roleName1, "test@example.com")
+	_, _ = client.NewRole("hulk", roleName1, "avengers,monster", "env:production,app:jet")
+	out, err := client.AddUser("hulk", "beni", roleName1, "test@example.com")
 	assert.Equal(t, err.Error(), "User `beni` already exist")
 	assert.Equal(t, out, "")
 }
 
 func TestAddUser_shouldCreateAddUserSessionWithSelectedRole(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test")
-	}
+	account.Set(fakeAccounts{})
+	defer account.Set(account.Tctl{})
 	userName := "test-user-" + strconv.Itoa(rand.Int())
 	roleName1 := "test-role-" + strconv.Itoa(rand.Int())
-	_, _ = client.NewRole(roleName1, "avengers,monster", "env:production,app:jet")
+	_, _ = client.NewRole("hulk", roleName1, "avengers,monster", "env:production,app:jet")
 	roleName2 := "test-role-" + strconv.Itoa(rand.Int())
-	_, _ = client.NewRole(roleName2, "hydra", "env:staging,app:bus")
+	_, _ = client.NewRole("hulk", roleName2, "hydra", "env:staging,app:bus")
 
-	client.AddUser(userName, roleName1+","+roleName2, "test@example.com")
+	_, err := client.AddUser("hulk", userName, roleName1+","+roleName2, "test@example.com")
+	require.Nil(t, err)
 	addUserToken, err := backend.GetStorage().GetAddUserTokenByUserName(userName)
-	assert.NotNil(t, addUserToken)
-	assert.Nil(t, err)
+	require.Nil(t, err)
+	require.NotNil(t, addUserToken)
 	assert.EqualValues(t, addUserToken.GetStringRoles(), []string{roleName1, roleName2})
 }
 
@@ -216,13 +336,14 @@ func TestShowUser_shouldErrorIfUserDoesNotExist(t *testing.T) {
 func TestShowUser_shouldDisplayItsRoleAndAllowedLogins(t *testing.T) {
 	roleName1 := "test-role-" + strconv.Itoa(rand.Int())
 	roleName2 := "test-role-" + strconv.Itoa(rand.Int())
-	_, _ = client.NewRole(roleName1, "ubuntu", "env:production,app:plane")
-	_, _ = client.NewRole(roleName2, "root", "env:staging,app:ship")
-	_, _ = client.AttachRole(roleName1, "hulk")
-	_, _ = client.AttachRole(roleName2, "hulk")
+	_, _ = client.NewRole("hulk", roleName1, "ubuntu", "env:production,app:plane")
+	_, _ = client.NewRole("hulk", roleName2, "root", "env:staging,app:ship")
+	_, _ = client.AttachRole("hulk", roleName1, "hulk")
+	_, _ = client.AttachRole("hulk", roleName2, "hulk")
 
-	out, err := client.ShowUser("hulk")
+	info, err := client.ShowUser("hulk")
 	assert.Nil(t, err)
+	out := render(t, info)
 	assert.Contains(t, out, "ubuntu")
 	assert.Contains(t, out, "root")
 	assert.Contains(t, out, "env:production")
@@ -236,13 +357,14 @@ func TestShowUser_shouldDisplayItsRoleAndAllowedLogins(t *testing.T) {
 func TestListUser_shouldDisplayItsRoleAndAllowedLogins(t *testing.T) {
 	roleName1 := "test-role-" + strconv.Itoa(rand.Int())
 	roleName2 := "test-role-" + strconv.Itoa(rand.Int())
-	_, _ = client.NewRole(roleName1, "ubuntu", "env:production,app:plane")
-	_, _ = client.NewRole(roleName2, "root", "env:staging,app:ship")
-	_, _ = client.AttachRole(roleName1, "beni")
-	_, _ = client.AttachRole(roleName2, "hulk")
+	_, _ = client.NewRole("hulk", roleName1, "ubuntu", "env:production,app:plane")
+	_, _ = client.NewRole("hulk", roleName2, "root", "env:staging,app:ship")
+	_, _ = client.AttachRole("hulk", roleName1, "beni")
+	_, _ = client.AttachRole("hulk", roleName2, "hulk")
 
-	out, err := client.ListUser()
+	users, err := client.ListUser()
 	assert.Nil(t, err)
+	out := render(t, users)
 	assert.Contains(t, out, "ubuntu")
 	assert.Contains(t, out, "root")
 	assert.Contains(t, out, "env:production")
@@ -255,7 +377,7 @@ func TestListUser_shouldDisplayItsRoleAndAllowedLogins(t *testing.T) {
 }
 
 func TestLockUser_shouldMakeIsLockedTrue(t *testing.T) {
-	out, err := client.LockUser("beni")
+	out, err := client.LockUser("hulk", "beni")
 	assert.Nil(t, err)
 	assert.Contains(t, out, "User `beni` is locked!")
 
@@ -264,7 +386,7 @@ func TestLockUser_shouldMakeIsLockedTrue(t *testing.T) {
 }
 
 func TestUnlockUser_shouldMakeIsLockedFalse(t *testing.T) {
-	out, err := client.UnlockUser("beni")
+	out, err := client.UnlockUser("hulk", "beni")
 	assert.Nil(t, err)
 	assert.Contains(t, out, "User `beni` is unlocked!")
 
@@ -273,7 +395,50 @@ func TestUnlockUser_shouldMakeIsLockedFalse(t *testing.T) {
 }
 
 func TestResetUser_shouldErrorIfUserNotExist(t *testing.T) {
-	out, err := client.ResetUser("imaginary_user", "")
+	out, err := client.ResetUser("hulk", "imaginary_user", "")
 	assert.Equal(t, out, "")
 	assert.Contains(t, err.Error(), "user `imaginary_user` not exist")
 }
+
+func TestParseExpiry_shouldAcceptEitherForOrUntil(t *testing.T) {
+	now := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	expires, err := client.ParseExpiry(4*time.Hour, "", now)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(4*time.Hour), expires)
+
+	expires, err = client.ParseExpiry(0, "2020-01-02T15:04:05Z", now)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC), expires)
+
+	expires, err = client.ParseExpiry(0, "", now)
+	assert.Nil(t, err)
+	assert.True(t, expires.IsZero())
+
+	_, err = client.ParseExpiry(time.Hour, "2020-01-02T15:04:05Z", now)
+	assert.NotNil(t, err)
+	_, err = client.ParseExpiry(0, "tomorrow", now)
+	assert.NotNil(t, err)
+}
+
+func TestShowUser_shouldDisplayWhenRoleExpires(t *testing.T) {
+	roleName := "test-role-" + strconv.Itoa(rand.Int())
+	_, _ = client.NewRole("hulk", roleName, "ubuntu", "env:production")
+	expires := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	_, err := client.AttachRoleUntil("hulk", roleName, "hulk", expires)
+	assert.Nil(t, err)
+
+	info, err := client.ShowUser("hulk")
+	assert.Nil(t, err)
+	// the table wraps long lines, so look at the role as it is rendered
+	found := false
+	for _, r := range info.Roles {
+		if r.Name == roleName {
+			found = true
+			assert.Contains(t, r.String(), "(expires "+expires.Format(time.RFC3339)+")")
+		}
+	}
+	assert.True(t, found)
+
+	_, _ = client.DetachRole("hulk", roleName, "hulk")
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"sort"
+
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/role"
+	"github.com/bentol/tero/user"
+)
+
+// ExplainUser computes what the roles of a user add up to: the logins on
+// each node selector and the roles granting them, with the deny rules of
+// any role taken away as teleport does.
+func ExplainUser(name string) (*UserExplanation, error) {
+	users, err := backend.GetUsersByNames([]string{name})
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, backend.NotFound("User `%s` does not exist", name)
+	}
+	u := users[0]
+
+	grants, err := backend.GetGrantsByUser(name)
+	if err != nil {
+		return nil, err
+	}
+	info := newUserInfo(u, grants)
+
+	explanation := &UserExplanation{
+		Name:   u.Name,
+		Locked: u.IsLocked,
+		Roles:  info.Roles,
+		Logins: make([]string, 0),
+		Access: make([]NodeAccess, 0),
+		Deny:   make([]DenyInfo, 0),
+	}
+
+	deniedLogins := make(map[string][]string)
+	for _, r := range u.Roles {
+		logins := role.ExpandLogins(r.Deny.Logins, u.Traits)
+		if len(logins) == 0 && len(r.Deny.NodeLabels) == 0 {
+			continue
+		}
+		explanation.Deny = append(explanation.Deny, DenyInfo{Role: r.Name, Logins: logins, Nodes: r.Deny.NodeLabels})
+		for _, login := range logins {
+			deniedLogins[login] = append(deniedLogins[login], r.Name)
+		}
+	}
+
+	selectors := make(map[string]*NodeAccess)
+	for _, r := range u.Roles {
+		if len(r.NodePatterns) == 0 {
+			continue
+		}
+		key := stringNodes(r.NodePatterns)
+		access, ok := selectors[key]
+		if !ok {
+			access = &NodeAccess{Nodes: r.NodePatterns, Logins: make([]LoginGrant, 0), DeniedBy: deniedNodesBy(u, r.NodePatterns)}
+			selectors[key] = access
+		}
+		for _, login := range role.ExpandLogins(r.AllowedLogins, u.Traits) {
+			deniedBy := append(append([]string(nil), deniedLogins[login]...), deniedLogins[role.Wildcard]...)
+			access.addLogin(login, r.Name, deniedBy)
+		}
+	}
+
+	keys := make([]string, 0, len(selectors))
+	for key := range selectors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		access := selectors[key]
+		sort.Slice(access.Logins, func(i, j int) bool {
+			return access.Logins[i].Login < access.Logins[j].Login
+		})
+		explanation.Access = append(explanation.Access, *access)
+
+		for _, g := range access.Logins {
+			if len(access.DeniedBy) == 0 && len(g.DeniedBy) == 0 && !containsString(explanation.Logins, g.Login) {
+				explanation.Logins = append(explanation.Logins, g.Login)
+			}
+		}
+	}
+	sort.Strings(explanation.Logins)
+	return explanation, nil
+}
+
+func (access *NodeAccess) addLogin(login, roleName string, deniedBy []string) {
+	for i := range access.Logins {
+		if access.Logins[i].Login == login {
+			if !containsString(access.Logins[i].Roles, roleName) {
+				access.Logins[i].Roles = append(access.Logins[i].Roles, roleName)
+			}
+			return
+		}
+	}
+	access.Logins = append(access.Logins, LoginGrant{Login: login, Roles: []string{roleName}, DeniedBy: deniedBy})
+}
+
+// deniedNodesBy returns the roles of u denying every node the selector
+// allows. Selectors with wildcards or regexes are only denied by a deny
+// rule that selects the same nodes, a deny rule covering a part of them is
+// listed in UserExplanation.Deny.
+func deniedNodesBy(u user.User, selector map[string]string) []string {
+	result := make([]string, 0)
+	for _, r := range u.Roles {
+		if r.DeniesNode(selector) || (len(r.Deny.NodeLabels) != 0 && stringNodes(r.Deny.NodeLabels) == stringNodes(selector)) {
+			result = append(result, r.Name)
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
@@ -0,0 +1,37 @@
+package client_test
+
+import (
+	"testing"
+
+	"github.com/bentol/tero/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplainUser_shouldMergeLoginsAndApplyDenyRules(t *testing.T) {
+	setup()
+	_, err := client.NewRoleWithFlags("hulk", "dba", "postgres,{{internal.logins}}", "env:production", client.RoleFlags{})
+	assert.Nil(t, err)
+	_, err = client.NewRoleWithFlags("hulk", "dev", "ubuntu,postgres", "env:production", client.RoleFlags{DenyLogins: "root"})
+	assert.Nil(t, err)
+	_, err = client.AttachRole("hulk", "dba", "beni")
+	assert.Nil(t, err)
+	_, err = client.AttachRole("hulk", "dev", "beni")
+	assert.Nil(t, err)
+
+	e, err := client.ExplainUser("beni")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"postgres", "ubuntu"}, e.Logins)
+	assert.Equal(t, []client.DenyInfo{{Role: "dev", Logins: []string{"root"}}}, e.Deny)
+
+	assert.Equal(t, 2, len(e.Access))
+	assert.Equal(t, map[string]string{"*": "*"}, e.Access[0].Nodes)
+	assert.Equal(t, []client.LoginGrant{{Login: "root", Roles: []string{"admin"}, DeniedBy: []string{"dev"}}}, e.Access[0].Logins)
+	assert.Equal(t, map[string]string{"env": "production"}, e.Access[1].Nodes)
+	assert.Equal(t, []client.LoginGrant{
+		{Login: "postgres", Roles: []string{"dba", "dev"}},
+		{Login: "ubuntu", Roles: []string{"dba", "dev"}},
+	}, e.Access[1].Logins)
+
+	_, err = client.ExplainUser("thanos")
+	assert.EqualError(t, err, "User `thanos` does not exist")
+}
@@ -0,0 +1,360 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/bentol/tero/auth"
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/role"
+	"github.com/bentol/tero/user"
+)
+
+const (
+	rolesPrefix  = "teleport/roles/"
+	usersPrefix  = "teleport/web/users/"
+	tokensPrefix = "teleport/addusertokens/"
+)
+
+// Problem is something wrong with a record of the backend found by fsck.
+type Problem struct {
+	Kind    string `json:"kind" yaml:"kind"`
+	Name    string `json:"name" yaml:"name"`
+	Path    string `json:"path" yaml:"path"`
+	Problem string `json:"problem" yaml:"problem"`
+	// Fix is what RepairProblems does about it, empty when it has to be
+	// fixed by hand
+	Fix string `json:"fix,omitempty" yaml:"fix,omitempty"`
+	// Role is the role a user or token refers to, used to authorize the fix
+	Role   string `json:"-" yaml:"-"`
+	repair func() error
+}
+
+type Problems []Problem
+
+// Fixable returns how many problems RepairProblems can fix.
+func (problems Problems) Fixable() int {
+	n := 0
+	for _, p := range problems {
+		if p.repair != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Fsck reads every role, user and add user token record as stored and
+// reports the ones that do not parse, are stored twice, refer to roles
+// that do not exist or expired before now.
+func Fsck(now time.Time) (Problems, error) {
+	storage := backend.GetStorage()
+	roleItems, err := storage.GetItems(rolesPrefix)
+	if err != nil {
+		return nil, err
+	}
+	userItems, err := storage.GetItems(usersPrefix)
+	if err != nil {
+		return nil, err
+	}
+	tokenItems, err := storage.GetItems(tokensPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := make(Problems, 0)
+	roleRecords := checkRecords("role", rolesPrefix, roleItems, &problems, func(raw []byte) (string, error) {
+		r, err := role.FromJSON(raw)
+		return r.Name, err
+	})
+	userRecords := checkRecords("user", usersPrefix, userItems, &problems, func(raw []byte) (string, error) {
+		u, err := user.FromJSON(raw, nil)
+		return u.Name, err
+	})
+
+	known := make(map[string]bool, len(roleRecords))
+	for _, name := range roleRecords {
+		known[name] = true
+	}
+
+	for _, path := range sortedPaths(userRecords) {
+		name, path := userRecords[path], path
+		parsed, _ := gabs.ParseJSON([]byte(userItems[path]))
+		_, listProblems := checkRoleList(parsed.Path("spec.roles").Data(), known)
+		for _, lp := range listProblems {
+			problems = append(problems, Problem{
+				Kind:    "user",
+				Name:    name,
+				Path:    path,
+				Problem: lp.problem,
+				Fix:     lp.fix + " from the user",
+				Role:    lp.role,
+				repair:  func() error { return repairUserRoles(path) },
+			})
+		}
+	}
+
+	for _, path := range sortedPaths(tokenItems) {
+		problems = append(problems, checkToken(path, tokenItems[path], known, now)...)
+	}
+	return problems, nil
+}
+
+// checkRecords parses the <prefix><name>/params records with parse and
+// returns the name of every record that parsed by path. A record stored
+// at the path of another name is moved there, or deleted when that path
+// already has the record.
+func checkRecords(kind, prefix string, items map[string]string, problems *Problems, parse func(raw []byte) (string, error)) map[string]string {
+	parsed := make(map[string]string)
+	pathsByName := make(map[string][]string)
+	for _, path := range sortedPaths(items) {
+		if !strings.HasSuffix(path, "/params") {
+			continue
+		}
+		name, err := parse([]byte(items[path]))
+		if err != nil {
+			*problems = append(*problems, Problem{
+				Kind:    kind,
+				Name:    strings.TrimSuffix(strings.TrimPrefix(path, prefix), "/params"),
+				Path:    path,
+				Problem: fmt.Sprintf("Record does not parse: %s", err),
+			})
+			continue
+		}
+		parsed[path] = name
+		pathsByName[name] = append(pathsByName[name], path)
+	}
+
+	names := make([]string, 0, len(pathsByName))
+	for name := range pathsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		paths := pathsByName[name]
+		want := prefix + name + "/params"
+		_, taken := items[want]
+		for _, path := range paths {
+			if path == want {
+				continue
+			}
+			p := Problem{Kind: kind, Name: name, Path: path}
+			switch {
+			case containsString(paths, want):
+				p.Problem = fmt.Sprintf("Duplicate of %s", want)
+				p.Fix = "delete the record"
+				p.repair = deleteItem(path)
+			case len(paths) == 1 && !taken:
+				p.Problem = fmt.Sprintf("Record of %s `%s` is not stored at %s", kind, name, want)
+				p.Fix = "move it to " + want
+				p.repair = moveItem(path, want, items[path])
+			case len(paths) == 1:
+				p.Problem = fmt.Sprintf("Record of %s `%s` is not stored at %s, the record there does not parse", kind, name, want)
+			default:
+				p.Problem = fmt.Sprintf("Record of %s `%s` is stored %d times", kind, name, len(paths))
+			}
+			*problems = append(*problems, p)
+			delete(parsed, path)
+		}
+	}
+	return parsed
+}
+
+func checkToken(path, raw string, known map[string]bool, now time.Time) Problems {
+	p := Problem{Kind: "token", Path: path}
+	parsed, err := gabs.ParseJSON([]byte(raw))
+	if err != nil {
+		p.Problem = fmt.Sprintf("Record does not parse: %s", err)
+		p.Fix = "delete the token"
+		p.repair = deleteItem(path)
+		return Problems{p}
+	}
+	p.Name, _ = parsed.Path("user.name").Data().(string)
+
+	rawExpires, _ := parsed.Path("expires").Data().(string)
+	if expires, err := time.Parse(time.RFC3339Nano, rawExpires); err == nil && !expires.IsZero() && expires.Before(now) {
+		p.Problem = fmt.Sprintf("Expired at %s", expires.Format(time.RFC3339))
+		p.Fix = "delete the token"
+		p.repair = deleteItem(path)
+		return Problems{p}
+	}
+
+	problems := make(Problems, 0)
+	_, listProblems := checkRoleList(parsed.Path("user.roles").Data(), known)
+	for _, lp := range listProblems {
+		p.Problem = lp.problem
+		p.Fix = lp.fix + " from the token"
+		p.Role = lp.role
+		p.repair = func() error { return repairTokenRoles(path) }
+		problems = append(problems, p)
+	}
+	return problems
+}
+
+type listProblem struct {
+	problem string
+	fix     string
+	role    string
+}
+
+// checkRoleList returns the role names of a user or token record that
+// exist, once each, and what is wrong with the others.
+func checkRoleList(raw interface{}, known map[string]bool) ([]string, []listProblem) {
+	names := make([]string, 0)
+	problems := make([]listProblem, 0)
+	list, ok := raw.([]interface{})
+	if raw != nil && !ok {
+		return names, append(problems, listProblem{problem: "Roles are not a list", fix: "clear the roles"})
+	}
+
+	for _, entry := range list {
+		name, ok := entry.(string)
+		switch {
+		case !ok || name == "":
+			problems = append(problems, listProblem{problem: fmt.Sprintf("Invalid role `%v`", entry), fix: "remove it"})
+		case !known[name]:
+			problems = append(problems, listProblem{problem: fmt.Sprintf("Role `%s` does not exist", name), fix: "remove it", role: name})
+		case containsString(names, name):
+			problems = append(problems, listProblem{problem: fmt.Sprintf("Role `%s` is listed twice", name), fix: "remove the duplicate", role: name})
+		default:
+			names = append(names, name)
+		}
+	}
+	return names, problems
+}
+
+// repairUserRoles rewrites the roles of the user record at path with
+// checkRoleList, the other fields are kept. It does nothing once the
+// roles are fine, so every problem of the same user can call it.
+func repairUserRoles(path string) error {
+	return repairRoleList(path, "spec.roles")
+}
+
+func repairTokenRoles(path string) error {
+	return repairRoleList(path, "user.roles")
+}
+
+// repairRoleList writes with compare-and-swap, so a lock or attach made
+// at the same time is not overwritten.
+func repairRoleList(path, field string) error {
+	storage := backend.GetStorage()
+	items, err := storage.GetItems(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := items[path]; !ok {
+		return nil
+	}
+	known, err := knownRoles()
+	if err != nil {
+		return err
+	}
+
+	return storage.UpdateItem(path, func(old string) (string, error) {
+		parsed, err := gabs.ParseJSON([]byte(old))
+		if err != nil {
+			return "", err
+		}
+		names, problems := checkRoleList(parsed.Path(field).Data(), known)
+		if len(problems) == 0 {
+			return old, nil
+		}
+		parsed.SetP(names, field)
+		return parsed.String(), nil
+	})
+}
+
+func knownRoles() (map[string]bool, error) {
+	roles, err := backend.GetRoles()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(roles))
+	for _, r := range roles {
+		known[r.Name] = true
+	}
+	return known, nil
+}
+
+func deleteItem(path string) func() error {
+	return func() error {
+		return backend.GetStorage().DeleteItem(path)
+	}
+}
+
+func moveItem(from, to, value string) func() error {
+	return func() error {
+		if err := backend.GetStorage().InsertItem(to, value, 0); err != nil {
+			return err
+		}
+		return backend.GetStorage().DeleteItem(from)
+	}
+}
+
+func sortedPaths(items map[string]string) []string {
+	paths := make([]string, 0, len(items))
+	for path := range items {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// AuthorizeRepairs checks op may manage every role and user the fixes
+// touch, so nothing is repaired when one of them is denied.
+func AuthorizeRepairs(op *auth.Operator, problems Problems) error {
+	for _, p := range problems {
+		if p.repair == nil {
+			continue
+		}
+		var err error
+		switch p.Kind {
+		case "role":
+			err = op.CanManageRole(p.Name)
+		case "user", "token":
+			err = op.CanManageUser(p.Name)
+			if err == nil && p.Role != "" {
+				err = op.CanManageRole(p.Role)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RepairProblems fixes the problems that have a fix, in order, and stops
+// at the first failure.
+func RepairProblems(operator string, problems Problems) (string, error) {
+	repaired := 0
+	for _, p := range problems {
+		if p.repair == nil {
+			continue
+		}
+
+		roleName, userNames := "", []string(nil)
+		switch p.Kind {
+		case "role":
+			roleName = p.Name
+		case "user":
+			userNames = []string{p.Name}
+		}
+		args := map[string]string{"path": p.Path, "problem": p.Problem}
+		_, err := audited(operator, "fsck.repair", roleName, userNames, args, func() (string, error) {
+			return "", p.repair()
+		})
+		if err != nil {
+			return "", fmt.Errorf("Failed to repair %s (%d of %d problems repaired): %s", p.Path, repaired, problems.Fixable(), err)
+		}
+		repaired++
+	}
+
+	out := fmt.Sprintf("%d problems repaired!", repaired)
+	if left := len(problems) - repaired; left != 0 {
+		out += fmt.Sprintf(" %d have to be fixed by hand.", left)
+	}
+	return out, nil
+}
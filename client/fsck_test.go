@@ -0,0 +1,104 @@
+package client_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsck_shouldReportAndRepairBrokenRecords(t *testing.T) {
+	setup()
+	storage := backend.GetStorage()
+	now := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	problems, err := client.Fsck(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(problems))
+
+	storage.InsertItem("teleport/web/users/thor/params", `{"kind":"user","metadata":{"name":"thor"},"spec":{"roles":["admin","gone","admin"],"traits":{"logins":["thor"]}}}`, 0)
+	storage.InsertItem("teleport/web/users/loki/params", `{"kind":"user",`, 0)
+	storage.InsertItem("teleport/web/users/Beni/params", `{"kind":"user","metadata":{"name":"beni"},"spec":{"roles":["admin"]}}`, 0)
+	storage.InsertItem("teleport/addusertokens/expired", `{"token":"expired","user":{"name":"odin","roles":["admin"]},"expires":"2020-01-01T00:00:00Z"}`, 0)
+	storage.InsertItem("teleport/addusertokens/dangling", `{"token":"dangling","user":{"name":"frigg","roles":["gone","admin"]},"expires":"2020-01-03T00:00:00Z"}`, 0)
+
+	problems, err = client.Fsck(now)
+	assert.Nil(t, err)
+	found := make([]string, 0)
+	for _, p := range problems {
+		found = append(found, p.Path+": "+p.Problem)
+	}
+	assert.Equal(t, []string{
+		"teleport/web/users/loki/params: Record does not parse: unexpected end of JSON input",
+		"teleport/web/users/Beni/params: Duplicate of teleport/web/users/beni/params",
+		"teleport/web/users/thor/params: Role `gone` does not exist",
+		"teleport/web/users/thor/params: Role `admin` is listed twice",
+		"teleport/addusertokens/dangling: Role `gone` does not exist",
+		"teleport/addusertokens/expired: Expired at 2020-01-01T00:00:00Z",
+	}, found)
+	assert.Equal(t, 5, problems.Fixable())
+
+	out, err := client.RepairProblems("hulk", problems)
+	assert.Nil(t, err)
+	assert.Equal(t, "5 problems repaired! 1 have to be fixed by hand.", out)
+
+	problems, err = client.Fsck(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(problems))
+	assert.Equal(t, "loki", problems[0].Name)
+
+	users, err := backend.GetUsersByNames([]string{"thor", "beni"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(users))
+	for _, u := range users {
+		assert.Equal(t, []string{"admin"}, u.RoleNames())
+	}
+	thor, _ := storage.GetItems("teleport/web/users/thor/params")
+	assert.Contains(t, thor["teleport/web/users/thor/params"], `"logins":["thor"]`)
+
+	tok, err := storage.GetAddUserToken("dangling")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"admin"}, tok.GetStringRoles())
+	tok, err = storage.GetAddUserToken("expired")
+	assert.Nil(t, err)
+	assert.Nil(t, tok)
+}
+
+func TestFsck_shouldMoveMisplacedRecord(t *testing.T) {
+	setup()
+	storage := backend.GetStorage()
+	storage.InsertItem("teleport/roles/old-name/params", `{"kind":"role","metadata":{"name":"dev"},"spec":{"allow":{"logins":["ubuntu"],"node_labels":{"env":"dev"}}}}`, 0)
+
+	problems, err := client.Fsck(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(problems))
+	assert.Equal(t, "move it to teleport/roles/dev/params", problems[0].Fix)
+
+	_, err = client.RepairProblems("hulk", problems)
+	assert.Nil(t, err)
+	r, err := backend.GetRoleByName("dev")
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+	items, _ := storage.GetItems("teleport/roles/old-name/")
+	assert.Equal(t, 0, len(items))
+}
+
+func TestRepairProblems_shouldKeepChangesMadeSinceFsck(t *testing.T) {
+	setup()
+	storage := backend.GetStorage()
+	storage.InsertItem("teleport/web/users/thor/params", `{"kind":"user","metadata":{"name":"thor"},"spec":{"roles":["admin","gone"]}}`, 0)
+
+	problems, err := client.Fsck(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(problems))
+	assert.Nil(t, backend.LockUser("thor"))
+
+	_, err = client.RepairProblems("hulk", problems)
+	assert.Nil(t, err)
+	users, err := backend.GetUsersByNames([]string{"thor"})
+	assert.Nil(t, err)
+	assert.True(t, users[0].IsLocked)
+	assert.Equal(t, []string{"admin"}, users[0].RoleNames())
+}
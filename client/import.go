@@ -0,0 +1,258 @@
+package client
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bentol/tero/auth"
+	"github.com/bentol/tero/backend"
+	"gopkg.in/yaml.v2"
+)
+
+// ImportRow is a user to add, Row is its record in a CSV file or its place
+// in the users list of a YAML file.
+type ImportRow struct {
+	Row int
+	UserState
+}
+
+// ImportResult is what happened to a row of `users import`.
+type ImportResult struct {
+	Row    int      `json:"row" yaml:"row"`
+	Name   string   `json:"name" yaml:"name"`
+	Roles  []string `json:"roles" yaml:"roles"`
+	Status string   `json:"status" yaml:"status"`
+	Detail string   `json:"detail,omitempty" yaml:"detail,omitempty"`
+}
+
+type ImportResults []ImportResult
+
+const (
+	importInvalid = "invalid"
+	importValid   = "valid"
+	importAdded   = "added"
+	importFailed  = "failed"
+)
+
+// LoadImport reads the users of a CSV file with the columns name, roles
+// and email, or of a YAML file with a users list as in a state file. The
+// roles of a CSV row are separated by commas, spaces or semicolons, a
+// header row is skipped.
+func LoadImport(path string) ([]ImportRow, error) {
+	switch filepath.Ext(path) {
+	case ".csv":
+		return loadImportCSV(path)
+	case ".yaml", ".yml":
+		return loadImportYAML(path)
+	default:
+		return nil, fmt.Errorf("Unknown import file format `%s`, use .csv or .yaml", path)
+	}
+}
+
+func loadImportCSV(path string) ([]ImportRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	rows := make([]ImportRow, 0)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CSV file %s: %s", path, err)
+		}
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "name") {
+			continue
+		}
+		if len(record) < 2 || len(record) > 3 {
+			return nil, fmt.Errorf("Row %d of %s has %d columns, want name,roles,email", line, path, len(record))
+		}
+
+		row := ImportRow{Row: line, UserState: UserState{Name: strings.TrimSpace(record[0])}}
+		row.Roles = strings.FieldsFunc(record[1], func(c rune) bool {
+			return c == ',' || c == ';' || c == ' '
+		})
+		if len(record) == 3 {
+			row.Email = strings.TrimSpace(record[2])
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func loadImportYAML(path string) ([]ImportRow, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := State{}
+	if err := yaml.UnmarshalStrict(content, &state); err != nil {
+		return nil, err
+	}
+	if len(state.Roles) != 0 || state.Prune {
+		return nil, errors.New("An import file only has users, use `tero apply` for roles")
+	}
+
+	rows := make([]ImportRow, 0, len(state.Users))
+	for i, u := range state.Users {
+		rows = append(rows, ImportRow{Row: i + 1, UserState: u})
+	}
+	return rows, nil
+}
+
+// AuthorizeImport checks op may add every user with its roles, so nobody
+// is added when one of them is denied.
+func AuthorizeImport(op *auth.Operator, rows []ImportRow) error {
+	for _, row := range rows {
+		if err := op.CanManageUser(row.Name); err != nil {
+			return err
+		}
+		for _, r := range row.Roles {
+			if err := op.CanManageRole(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ImportUsers checks every row before adding anyone: the users must not
+// exist yet and their roles must. It then adds them, parallel at a time,
+// or only reports the rows when dryRun is set. The results are in the
+// order of the rows, an error is returned with them when a row is
+// invalid or failed.
+func ImportUsers(operator string, rows []ImportRow, parallel int, dryRun bool) (ImportResults, error) {
+	if len(rows) == 0 {
+		return nil, errors.New("The import file has no users")
+	}
+	if parallel < 1 {
+		return nil, fmt.Errorf("Invalid parallelism %d", parallel)
+	}
+
+	results, err := validateImport(rows)
+	if err != nil {
+		return nil, err
+	}
+	invalid := results.count(importInvalid)
+	if invalid != 0 {
+		return results, fmt.Errorf("%d of %d rows are invalid, no user was added", invalid, len(rows))
+	}
+	if dryRun {
+		return results, nil
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, parallel)
+	for i := range rows {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			row := rows[i]
+			out, err := AddUser(operator, row.Name, strings.Join(row.Roles, ","), row.Email)
+			if err != nil {
+				results[i].Status = importFailed
+				results[i].Detail = err.Error()
+				return
+			}
+			results[i].Status = importAdded
+			results[i].Detail = strings.TrimSpace(out)
+		}(i)
+	}
+	wg.Wait()
+
+	if failed := results.count(importFailed); failed != 0 {
+		return results, fmt.Errorf("%d of %d users failed to be added", failed, len(rows))
+	}
+	return results, nil
+}
+
+func validateImport(rows []ImportRow) (ImportResults, error) {
+	names := make([]string, 0, len(rows))
+	for _, row := range rows {
+		names = append(names, row.Name)
+	}
+	existing, err := backend.GetUsersByNames(names)
+	if err != nil {
+		return nil, err
+	}
+	existingNames := make(map[string]bool, len(existing))
+	for _, u := range existing {
+		existingNames[u.Name] = true
+	}
+
+	roleExists := make(map[string]bool)
+	results := make(ImportResults, 0, len(rows))
+	seen := make(map[string]int)
+	for _, row := range rows {
+		problems := make([]string, 0)
+		switch {
+		case row.Name == "":
+			problems = append(problems, "name is missing")
+		case existingNames[row.Name]:
+			problems = append(problems, fmt.Sprintf("user `%s` already exists", row.Name))
+		case seen[row.Name] != 0:
+			problems = append(problems, fmt.Sprintf("user `%s` is also on row %d", row.Name, seen[row.Name]))
+		}
+		if seen[row.Name] == 0 {
+			seen[row.Name] = row.Row
+		}
+
+		if len(row.Roles) == 0 {
+			problems = append(problems, "roles are missing")
+		}
+		for _, name := range row.Roles {
+			exists, checked := roleExists[name]
+			if !checked {
+				r, err := backend.GetRoleByName(name)
+				if err != nil {
+					return nil, err
+				}
+				exists = r != nil
+				roleExists[name] = exists
+			}
+			if !exists {
+				problems = append(problems, fmt.Sprintf("role `%s` does not exist", name))
+			}
+		}
+		if row.Email != "" && !strings.Contains(row.Email, "@") {
+			problems = append(problems, fmt.Sprintf("invalid email `%s`", row.Email))
+		}
+
+		result := ImportResult{Row: row.Row, Name: row.Name, Roles: row.Roles, Status: importValid}
+		if len(problems) != 0 {
+			result.Status = importInvalid
+			result.Detail = strings.Join(problems, ", ")
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (results ImportResults) count(status string) int {
+	n := 0
+	for _, r := range results {
+		if r.Status == status {
+			n++
+		}
+	}
+	return n
+}
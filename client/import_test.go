@@ -0,0 +1,70 @@
+package client_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bentol/tero/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeImportFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "tero-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadImport_shouldReadCSVAndYAML(t *testing.T) {
+	path := writeImportFile(t, "hires.csv", "name,roles,email\nthor,\"admin,dba\",thor@example.com\nloki,admin\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	rows, err := client.LoadImport(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, 2, rows[0].Row)
+	assert.Equal(t, "thor", rows[0].Name)
+	assert.Equal(t, []string{"admin", "dba"}, rows[0].Roles)
+	assert.Equal(t, "thor@example.com", rows[0].Email)
+	assert.Equal(t, "", rows[1].Email)
+
+	path = writeImportFile(t, "hires.yaml", "users:\n  - name: thor\n    roles: [admin]\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	rows, err = client.LoadImport(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "thor", rows[0].Name)
+	assert.Equal(t, []string{"admin"}, rows[0].Roles)
+
+	path = writeImportFile(t, "hires.csv", "thor,admin,thor@example.com,extra\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	_, err = client.LoadImport(path)
+	assert.Equal(t, "Row 1 of "+path+" has 4 columns, want name,roles,email", err.Error())
+}
+
+func TestImportUsers_shouldCheckEveryRowFirst(t *testing.T) {
+	setup()
+	rows := []client.ImportRow{
+		{Row: 1, UserState: client.UserState{Name: "thor", Roles: []string{"admin"}}},
+		{Row: 2, UserState: client.UserState{Name: "beni", Roles: []string{"admin"}}},
+		{Row: 3, UserState: client.UserState{Name: "thor", Roles: []string{"gone"}, Email: "thor"}},
+	}
+
+	results, err := client.ImportUsers("hulk", rows, 4, false)
+	assert.Equal(t, "2 of 3 rows are invalid, no user was added", err.Error())
+	assert.Equal(t, "valid", results[0].Status)
+	assert.Equal(t, "user `beni` already exists", results[1].Detail)
+	assert.Equal(t, "user `thor` is also on row 1, role `gone` does not exist, invalid email `thor`", results[2].Detail)
+
+	results, err = client.ImportUsers("hulk", rows[:1], 4, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "valid", results[0].Status)
+	users, _ := client.ListUser()
+	assert.Equal(t, 2, len(users))
+}
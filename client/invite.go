@@ -0,0 +1,114 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bentol/tero/auth"
+	"github.com/bentol/tero/backend"
+)
+
+const (
+	invitePending = "pending"
+	inviteExpired = "expired"
+)
+
+// Invite is a user that was added but did not sign up yet.
+type Invite struct {
+	User    string     `json:"user" yaml:"user"`
+	Roles   []string   `json:"roles" yaml:"roles"`
+	Expires *time.Time `json:"expires,omitempty" yaml:"expires,omitempty"`
+	State   string     `json:"state" yaml:"state"`
+}
+
+type Invites []Invite
+
+// ListInvites returns the invites of the users matching the userPattern
+// glob in the given state, every invite when they are empty.
+func ListInvites(userPattern, state string, now time.Time) (Invites, error) {
+	tokens, err := backend.GetAddUserTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(Invites, 0, len(tokens))
+	for _, t := range tokens {
+		invite := Invite{User: t.UserName(), Roles: t.GetStringRoles(), State: invitePending}
+		if expires := t.Expires(); !expires.IsZero() {
+			invite.Expires = &expires
+			if !now.Before(expires) {
+				invite.State = inviteExpired
+			}
+		}
+		if userPattern != "" && !matchAny([]string{userPattern}, invite.User) {
+			continue
+		}
+		if state != "" && invite.State != state {
+			continue
+		}
+		result = append(result, invite)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].User < result[j].User
+	})
+	return result, nil
+}
+
+// AuthorizeInvite checks op may manage the invited user and the roles it
+// is invited with.
+func AuthorizeInvite(op *auth.Operator, userName string) error {
+	if err := op.CanManageUser(userName); err != nil {
+		return err
+	}
+	t, err := backend.GetStorage().GetAddUserTokenByUserName(userName)
+	if err != nil || t == nil {
+		return err
+	}
+	for _, r := range t.GetStringRoles() {
+		if err := op.CanManageRole(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func RevokeInvite(operator, userName string) (string, error) {
+	return audited(operator, "invite.revoke", "", []string{userName}, nil, func() (string, error) {
+		revoked, err := backend.RevokeAddUserToken(userName)
+		if err != nil {
+			return "", err
+		}
+		if !revoked {
+			return "", backend.NotFound("User `%s` has no pending invite", userName)
+		}
+		return fmt.Sprintf("Invite of `%s` revoked!", userName), nil
+	})
+}
+
+// ResendInvite replaces the signup token of the user with a fresh one with
+// the same roles, and mails it as `users add` does. The old token is only
+// revoked once the new one exists, so a failure leaves the old invite usable.
+func ResendInvite(operator, userName, sendEmailTo string) (string, error) {
+	args := map[string]string{"email": sendEmailTo}
+	return audited(operator, "invite.resend", "", []string{userName}, args, func() (string, error) {
+		t, err := backend.GetStorage().GetAddUserTokenByUserName(userName)
+		if err != nil {
+			return "", err
+		}
+		if t == nil {
+			return "", backend.NotFound("User `%s` has no pending invite", userName)
+		}
+
+		roles := strings.Join(t.GetStringRoles(), ",")
+		out, err := addUser(userName, roles, sendEmailTo)
+		if err != nil {
+			return "", err
+		}
+		if err := backend.DeleteAddUserToken(t.Token); err != nil {
+			return "", fmt.Errorf("A new invite is created but the old token `%s` could not be revoked: %s", t.Token, err)
+		}
+		return out, nil
+	})
+}
@@ -0,0 +1,85 @@
+package client_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bentol/tero/account"
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvites_shouldListAndRevoke(t *testing.T) {
+	setup()
+	storage := backend.GetStorage()
+	storage.InsertItem("teleport/addusertokens/thor-token", `{"token":"thor-token","user":{"name":"thor","roles":["admin"]},"expires":"2020-01-02T16:00:00Z"}`, 0)
+	storage.InsertItem("teleport/addusertokens/loki-token", `{"token":"loki-token","user":{"name":"loki","roles":null},"expires":"2020-01-02T14:00:00Z"}`, 0)
+	now := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	invites, err := client.ListInvites("", "", now)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(invites))
+	assert.Equal(t, "loki", invites[0].User)
+	assert.Equal(t, "expired", invites[0].State)
+	assert.Equal(t, "thor", invites[1].User)
+	assert.Equal(t, []string{"admin"}, invites[1].Roles)
+	assert.Equal(t, "pending", invites[1].State)
+
+	invites, err = client.ListInvites("", "expired", now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(invites))
+	invites, err = client.ListInvites("th*", "", now)
+	assert.Nil(t, err)
+	assert.Equal(t, "thor", invites[0].User)
+
+	out, err := client.RevokeInvite("hulk", "thor")
+	assert.Nil(t, err)
+	assert.Equal(t, "Invite of `thor` revoked!", out)
+	_, err = client.RevokeInvite("hulk", "thor")
+	assert.Equal(t, "User `thor` has no pending invite", err.Error())
+	invites, _ = client.ListInvites("", "", now)
+	assert.Equal(t, 1, len(invites))
+}
+
+func TestResendInvite_shouldReplaceTheToken(t *testing.T) {
+	setup()
+	account.Set(fakeAccounts{})
+	defer account.Set(account.Tctl{})
+	backend.GetStorage().InsertItem("teleport/addusertokens/thor-token", `{"token":"thor-token","user":{"name":"thor","roles":["admin"]}}`, 0)
+
+	out, err := client.ResendInvite("hulk", "thor", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "Signup token created", out)
+
+	tokens, _ := backend.GetAddUserTokens()
+	assert.Equal(t, 1, len(tokens))
+	assert.Equal(t, "fresh-thor", tokens[0].Token)
+	assert.Equal(t, []string{"admin"}, tokens[0].GetStringRoles())
+}
+
+// failingAccounts fails like tctl does when the auth server is unreachable.
+type failingAccounts struct{}
+
+func (failingAccounts) AddUser(name string) (string, string, error) {
+	return "", "", errors.New("auth server unreachable")
+}
+
+func (failingAccounts) DeleteUser(name string) error {
+	return nil
+}
+
+func TestResendInvite_shouldKeepTheOldTokenWhenAddFails(t *testing.T) {
+	setup()
+	account.Set(failingAccounts{})
+	defer account.Set(account.Tctl{})
+	backend.GetStorage().InsertItem("teleport/addusertokens/thor-token", `{"token":"thor-token","user":{"name":"thor","roles":["admin"]}}`, 0)
+
+	_, err := client.ResendInvite("hulk", "thor", "")
+	assert.NotNil(t, err)
+
+	tokens, _ := backend.GetAddUserTokens()
+	assert.Equal(t, 1, len(tokens))
+	assert.Equal(t, "thor-token", tokens[0].Token)
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bentol/tero/auth"
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/notif"
+	"github.com/bentol/tero/offboard"
+)
+
+// LoadOffboardList reads a file with a user name per line, blank lines
+// and lines starting with # are skipped.
+func LoadOffboardList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !containsString(names, line) {
+			names = append(names, line)
+		}
+	}
+	return names, scanner.Err()
+}
+
+// AuthorizeOffboarding checks op may manage every user and detach every
+// role they have, so nobody is offboarded when one of them is denied.
+func AuthorizeOffboarding(op *auth.Operator, names []string) error {
+	users, err := backend.GetUsersByNames(names)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := op.CanManageUser(name); err != nil {
+			return err
+		}
+	}
+	for _, u := range users {
+		for _, r := range u.RoleNames() {
+			if err := op.CanManageRole(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// OffboardUsers locks every user, detaches its roles and revokes its
+// signup token. With a grace period `tero reap` deletes the account once
+// it is over. A user that fails does not stop the others, the summary is
+// mailed to requester when given.
+func OffboardUsers(operator string, names []string, reason, requester string, gracePeriod time.Duration) (OffboardResults, error) {
+	if len(names) == 0 {
+		return nil, backend.Invalid("No user to offboard")
+	}
+	if reason == "" {
+		return nil, backend.Invalid("Offboarding needs a reason")
+	}
+	if gracePeriod < 0 {
+		return nil, backend.Invalid("Invalid grace period `%s`", gracePeriod)
+	}
+
+	now := time.Now().UTC()
+	results := make(OffboardResults, 0, len(names))
+	done := make([]offboard.Offboarding, 0, len(names))
+	failed := make(map[string]string)
+	for _, name := range names {
+		o, err := offboardUser(operator, name, reason, requester, gracePeriod, now)
+		if err != nil {
+			failed[name] = err.Error()
+			results = append(results, OffboardResult{Offboarding: offboard.Offboarding{User: name}, Status: "failed", Detail: err.Error()})
+			continue
+		}
+		done = append(done, o)
+		results = append(results, OffboardResult{Offboarding: o, Status: "offboarded"})
+	}
+
+	if requester != "" {
+		if err := notif.SentMailOffboarding(requester, done, failed); err != nil {
+			log.Printf("Failed to mail the summary to `%s`: %s", requester, err)
+		}
+	}
+	if len(failed) != 0 {
+		return results, fmt.Errorf("%d of %d users could not be offboarded", len(failed), len(names))
+	}
+	return results, nil
+}
+
+func offboardUser(operator, name, reason, requester string, gracePeriod time.Duration, now time.Time) (offboard.Offboarding, error) {
+	o := offboard.Offboarding{User: name, Reason: reason, By: operator, Requester: requester, At: now, Roles: make([]string, 0)}
+	args := map[string]string{"reason": reason}
+	if gracePeriod > 0 {
+		deleteAfter := now.Add(gracePeriod)
+		o.DeleteAfter = &deleteAfter
+		args["delete_after"] = deleteAfter.Format(time.RFC3339)
+	}
+
+	_, err := audited(operator, "user.offboard", "", []string{name}, args, func() (string, error) {
+		users, err := backend.GetUsersByNames([]string{name})
+		if err != nil {
+			return "", err
+		}
+		previous, err := backend.GetOffboarding(name)
+		if err != nil {
+			return "", err
+		}
+		if previous != nil && previous.Deleted == nil && (len(users) == 0 || users[0].IsLocked) {
+			return "", fmt.Errorf("User `%s` was already offboarded at %s", name, previous.At.Format(time.RFC3339))
+		}
+
+		if len(users) != 0 {
+			if err := backend.LockUser(name); err != nil {
+				return "", fmt.Errorf("Failed to lock user: %s", err)
+			}
+			o.Roles, err = backend.DetachAllRoles(users[0])
+			if err != nil {
+				return "", fmt.Errorf("Failed to detach roles: %s", err)
+			}
+		}
+		o.TokenRevoked, err = backend.RevokeAddUserToken(name)
+		if err != nil {
+			return "", fmt.Errorf("Failed to revoke signup token: %s", err)
+		}
+		if len(users) == 0 && !o.TokenRevoked {
+			return "", backend.NotFound("User `%s` does not exist", name)
+		}
+		return "", backend.SaveOffboarding(o)
+	})
+	return o, err
+}
+
+// ReapOffboardings deletes the accounts of offboarded users whose grace
+// period is over and logs each of them. A user unlocked since it was
+// offboarded is kept for good.
+func ReapOffboardings(operator string) ([]offboard.Offboarding, error) {
+	offboardings, err := backend.GetOffboardings()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	reaped := make([]offboard.Offboarding, 0)
+	for _, o := range offboardings {
+		if !o.Due(now) {
+			continue
+		}
+		users, err := backend.GetUsersByNames([]string{o.User})
+		if err != nil {
+			return reaped, err
+		}
+		if len(users) != 0 && !users[0].IsLocked {
+			o.DeleteAfter = nil
+			if err := backend.SaveOffboarding(o); err != nil {
+				return reaped, err
+			}
+			log.Printf("Not deleting user `%s`, it was unlocked since it was offboarded", o.User)
+			continue
+		}
+
+		if len(users) != 0 {
+			args := map[string]string{"reason": o.Reason}
+			_, err := audited(operator, "user.delete", "", []string{o.User}, args, func() (string, error) {
+				return deleteUser(o.User)
+			})
+			if err != nil {
+				return reaped, err
+			}
+		}
+		o.Deleted = &now
+		if err := backend.SaveOffboarding(o); err != nil {
+			return reaped, err
+		}
+		log.Printf("Deleted user `%s`, offboarded at %s", o.User, o.At.Format(time.RFC3339))
+		reaped = append(reaped, o)
+	}
+	return reaped, nil
+}
@@ -0,0 +1,65 @@
+package client_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/client"
+	"github.com/bentol/tero/notif"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffboardUsers_shouldLockDetachAndMailTheRequester(t *testing.T) {
+	setup()
+	mails := make([]sentMail, 0)
+	deliver := notif.Deliver
+	notif.Deliver = func(recipients []string, subject, body string) error {
+		mails = append(mails, sentMail{recipients, subject, body})
+		return nil
+	}
+	defer func() { notif.Deliver = deliver }()
+
+	_, err := client.NewRole("hulk", "oncall", "ubuntu", "env:production")
+	assert.Nil(t, err)
+	_, err = client.AttachRoleUntil("hulk", "oncall", "beni", time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	backend.GetStorage().InsertItem("teleport/addusertokens/odin-token", `{"token":"odin-token","user":{"name":"odin","roles":["admin"]}}`, 0)
+
+	results, err := client.OffboardUsers("hulk", []string{"beni", "odin", "thanos"}, "left the company", "hulk", 720*time.Hour)
+	assert.Equal(t, "1 of 3 users could not be offboarded", err.Error())
+	assert.Equal(t, "offboarded", results[0].Status)
+	assert.Equal(t, []string{"admin", "oncall"}, results[0].Roles)
+	assert.NotNil(t, results[0].DeleteAfter)
+	assert.True(t, results[1].TokenRevoked)
+	assert.Equal(t, "User `thanos` does not exist", results[2].Detail)
+
+	users, _ := backend.GetUsersByNames([]string{"beni"})
+	assert.True(t, users[0].IsLocked)
+	assert.Equal(t, 0, len(users[0].Roles))
+	grants, _ := backend.GetGrantsByUser("beni")
+	assert.Equal(t, 0, len(grants))
+
+	assert.Equal(t, 1, len(mails))
+	assert.Equal(t, []string{"hulk@tokopedia.com"}, mails[0].recipients)
+	assert.Contains(t, mails[0].body, "beni: locked, roles detached: admin,oncall")
+	assert.Contains(t, mails[0].body, "thanos: User `thanos` does not exist")
+
+	_, err = client.OffboardUsers("hulk", []string{"beni"}, "left the company", "", 0)
+	assert.Contains(t, err.Error(), "1 of 1 users")
+}
+
+func TestReapOffboardings_shouldKeepUnlockedUsers(t *testing.T) {
+	setup()
+	_, err := client.OffboardUsers("beni", []string{"hulk"}, "left the company", "", time.Nanosecond)
+	assert.Nil(t, err)
+	_, err = client.UnlockUser("beni", "hulk")
+	assert.Nil(t, err)
+
+	reaped, err := client.ReapOffboardings("beni")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(reaped))
+	o, _ := backend.GetOffboarding("hulk")
+	assert.Nil(t, o.DeleteAfter)
+	assert.Nil(t, o.Deleted)
+}
@@ -0,0 +1,396 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bentol/tero/auth"
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/role"
+	"gopkg.in/yaml.v2"
+)
+
+// State is the desired set of roles, users and role assignments, read
+// from a yaml or toml file.
+type State struct {
+	// Prune deletes roles and users that are not in the file
+	Prune bool        `toml:"prune" yaml:"prune"`
+	Roles []RoleState `toml:"roles" yaml:"roles"`
+	Users []UserState `toml:"users" yaml:"users"`
+}
+
+type RoleState struct {
+	Name   string            `toml:"name" yaml:"name"`
+	Logins []string          `toml:"logins" yaml:"logins"`
+	Nodes  map[string]string `toml:"nodes" yaml:"nodes"`
+}
+
+type UserState struct {
+	Name  string   `toml:"name" yaml:"name"`
+	Roles []string `toml:"roles" yaml:"roles"`
+	// Email receives the registration link when the user is created
+	Email string `toml:"email" yaml:"email"`
+}
+
+// Change is a single operation needed to reach the desired state.
+type Change struct {
+	Action string `json:"action" yaml:"action"`
+	Kind   string `json:"kind" yaml:"kind"`
+	Name   string `json:"name" yaml:"name"`
+	Detail string `json:"detail,omitempty" yaml:"detail,omitempty"`
+	// what the change touches besides Name, used to authorize it
+	Users  []string          `json:"users,omitempty" yaml:"users,omitempty"`
+	Roles  []string          `json:"roles,omitempty" yaml:"roles,omitempty"`
+	Nodes  map[string]string `json:"nodes,omitempty" yaml:"nodes,omitempty"`
+	Logins []string          `json:"logins,omitempty" yaml:"logins,omitempty"`
+	apply  func(operator string) error
+}
+
+type Changes []Change
+
+func LoadState(path string) (State, error) {
+	state := State{}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(content, &state)
+	case ".toml":
+		_, err = toml.Decode(string(content), &state)
+	default:
+		return state, fmt.Errorf("Unknown state file format `%s`, use .yaml or .toml", path)
+	}
+	if err != nil {
+		return state, err
+	}
+
+	return state, validateState(state)
+}
+
+func validateState(state State) error {
+	roleNames := make(map[string]bool)
+	for _, r := range state.Roles {
+		if r.Name == "" {
+			return errors.New("Every role needs a name")
+		}
+		if roleNames[r.Name] {
+			return fmt.Errorf("Role `%s` is defined more than once", r.Name)
+		}
+		if len(r.Logins) == 0 || len(r.Nodes) == 0 {
+			return fmt.Errorf("Role `%s` needs logins and nodes", r.Name)
+		}
+		roleNames[r.Name] = true
+	}
+
+	userNames := make(map[string]bool)
+	for _, u := range state.Users {
+		if u.Name == "" {
+			return errors.New("Every user needs a name")
+		}
+		if userNames[u.Name] {
+			return fmt.Errorf("User `%s` is defined more than once", u.Name)
+		}
+		userNames[u.Name] = true
+	}
+	return nil
+}
+
+// PlanState compares the desired state with the backend and returns the
+// changes in the order they have to be applied.
+func PlanState(state State) (Changes, error) {
+	currentRoles, err := backend.GetRoles()
+	if err != nil {
+		return nil, err
+	}
+	currentUsers, err := backend.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	mappedRoles := make(map[string]role.Role)
+	for _, r := range currentRoles {
+		mappedRoles[r.Name] = r
+	}
+	desiredRoles := make(map[string]bool)
+	for _, r := range state.Roles {
+		desiredRoles[r.Name] = true
+	}
+
+	changes := make(Changes, 0)
+	for _, r := range state.Roles {
+		changes = append(changes, planRole(r, mappedRoles)...)
+	}
+
+	// attach and detach are grouped per role, like `tero attach` does
+	attach := make(map[string][]string)
+	detach := make(map[string][]string)
+	desiredUsers := make(map[string]bool)
+	for _, u := range state.Users {
+		desiredUsers[u.Name] = true
+		for _, roleName := range u.Roles {
+			if !desiredRoles[roleName] {
+				if _, ok := mappedRoles[roleName]; !ok {
+					return nil, fmt.Errorf("User `%s` uses role `%s` which does not exist", u.Name, roleName)
+				}
+			}
+		}
+
+		current, ok := currentUsers[u.Name]
+		if !ok {
+			changes = append(changes, planNewUser(u))
+			continue
+		}
+
+		currentRoleNames := current.RoleNames()
+		for _, roleName := range u.Roles {
+			if !containsString(currentRoleNames, roleName) {
+				attach[roleName] = append(attach[roleName], u.Name)
+			}
+		}
+		for _, roleName := range currentRoleNames {
+			if !containsString(u.Roles, roleName) {
+				detach[roleName] = append(detach[roleName], u.Name)
+			}
+		}
+	}
+
+	for _, roleName := range sortedKeys(attach) {
+		changes = append(changes, planAttach(roleName, attach[roleName]))
+	}
+	for _, roleName := range sortedKeys(detach) {
+		changes = append(changes, planDetach(roleName, detach[roleName]))
+	}
+
+	if state.Prune {
+		deletedUsers := make([]string, 0)
+		for name := range currentUsers {
+			if !desiredUsers[name] {
+				deletedUsers = append(deletedUsers, name)
+			}
+		}
+		sort.Strings(deletedUsers)
+		for _, name := range deletedUsers {
+			changes = append(changes, planDeleteUser(name))
+		}
+
+		for _, r := range currentRoles {
+			if !desiredRoles[r.Name] {
+				changes = append(changes, planDeleteRole(r.Name))
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+func planRole(desired RoleState, mappedRoles map[string]role.Role) []Change {
+	logins := strings.Join(desired.Logins, ",")
+	nodes := stringNodes(desired.Nodes)
+
+	current, ok := mappedRoles[desired.Name]
+	if !ok {
+		return []Change{{
+			Action: "create",
+			Kind:   "role",
+			Name:   desired.Name,
+			Detail: logins + "@" + nodes,
+			Nodes:  desired.Nodes,
+			Logins: desired.Logins,
+			apply: func(operator string) error {
+				args := map[string]string{"logins": logins, "nodes": nodes}
+				_, err := audited(operator, "role.create", desired.Name, nil, args, func() (string, error) {
+					_, err := backend.CreateRole(role.Role{
+						Name:          desired.Name,
+						AllowedLogins: desired.Logins,
+						NodePatterns:  desired.Nodes,
+					})
+					return "", err
+				})
+				return err
+			},
+		}}
+	}
+
+	currentLogins := append([]string(nil), current.AllowedLogins...)
+	desiredLogins := append([]string(nil), desired.Logins...)
+	sort.Strings(currentLogins)
+	sort.Strings(desiredLogins)
+	if reflect.DeepEqual(currentLogins, desiredLogins) && reflect.DeepEqual(current.NodePatterns, desired.Nodes) {
+		return nil
+	}
+
+	return []Change{{
+		Action: "update",
+		Kind:   "role",
+		Name:   desired.Name,
+		Detail: current.StringAllowedLogins() + "@" + current.StringNodePatterns() + " => " + logins + "@" + nodes,
+		Nodes:  desired.Nodes,
+		Logins: desired.Logins,
+		apply: func(operator string) error {
+			args := map[string]string{"logins": logins, "nodes": nodes}
+			_, err := audited(operator, "role.update", desired.Name, nil, args, func() (string, error) {
+				_, err := backend.UpdateRole(desired.Name, func(r *role.Role) {
+					r.AllowedLogins = desired.Logins
+					r.NodePatterns = desired.Nodes
+				})
+				return "", err
+			})
+			return err
+		},
+	}}
+}
+
+func planNewUser(desired UserState) Change {
+	return Change{
+		Action: "create",
+		Kind:   "user",
+		Name:   desired.Name,
+		Detail: "roles: " + strings.Join(desired.Roles, ","),
+		Roles:  desired.Roles,
+		apply: func(operator string) error {
+			_, err := AddUser(operator, desired.Name, strings.Join(desired.Roles, ","), desired.Email)
+			return err
+		},
+	}
+}
+
+func planAttach(roleName string, users []string) Change {
+	sort.Strings(users)
+	return Change{
+		Action: "attach",
+		Kind:   "role",
+		Name:   roleName,
+		Detail: "users: " + strings.Join(users, ","),
+		Users:  users,
+		apply: func(operator string) error {
+			_, err := audited(operator, "role.attach", roleName, users, nil, func() (string, error) {
+				_, err := backend.AttachRole(roleName, users)
+				return "", err
+			})
+			return err
+		},
+	}
+}
+
+func planDetach(roleName string, users []string) Change {
+	sort.Strings(users)
+	return Change{
+		Action: "detach",
+		Kind:   "role",
+		Name:   roleName,
+		Detail: "users: " + strings.Join(users, ","),
+		Users:  users,
+		apply: func(operator string) error {
+			_, err := audited(operator, "role.detach", roleName, users, nil, func() (string, error) {
+				// the role may be gone already, users still hold its name
+				_, err := backend.DetachRoleByName(roleName, users)
+				return "", err
+			})
+			return err
+		},
+	}
+}
+
+func planDeleteUser(name string) Change {
+	return Change{
+		Action: "delete",
+		Kind:   "user",
+		Name:   name,
+		apply: func(operator string) error {
+			_, err := DeleteUser(operator, name)
+			return err
+		},
+	}
+}
+
+func planDeleteRole(name string) Change {
+	return Change{
+		Action: "delete",
+		Kind:   "role",
+		Name:   name,
+		apply: func(operator string) error {
+			_, err := audited(operator, "role.delete", name, nil, nil, func() (string, error) {
+				return deleteRole(name, DeleteRoleFlags{})
+			})
+			return err
+		},
+	}
+}
+
+// AuthorizeChanges checks op may make every change, so nothing is applied
+// when one of them is denied.
+func AuthorizeChanges(op *auth.Operator, changes Changes) error {
+	for _, c := range changes {
+		var err error
+		switch c.Kind {
+		case "role":
+			err = op.CanManageRole(c.Name)
+			if err == nil {
+				err = op.CanUseLabels(c.Nodes)
+			}
+			if err == nil {
+				err = op.CanUseLogins(c.Logins)
+			}
+			for _, u := range c.Users {
+				if err == nil {
+					err = op.CanManageUser(u)
+				}
+			}
+		case "user":
+			err = op.CanManageUser(c.Name)
+			for _, r := range c.Roles {
+				if err == nil {
+					err = op.CanManageRole(r)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyChanges runs the changes in order and stops at the first failure.
+func ApplyChanges(operator string, changes Changes) (string, error) {
+	for i, c := range changes {
+		err := c.apply(operator)
+		if err != nil {
+			return "", fmt.Errorf("Failed to %s %s `%s` (%d of %d changes applied): %s", c.Action, c.Kind, c.Name, i, len(changes), err)
+		}
+	}
+
+	return fmt.Sprintf("%d changes applied!", len(changes)), nil
+}
+
+func stringNodes(nodes map[string]string) string {
+	r := role.Role{NodePatterns: nodes}
+	return r.StringNodePatterns()
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(slice []string, element string) bool {
+	for _, elem := range slice {
+		if elem == element {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package client_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bentol/tero/auth"
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeStateFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "tero-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const yamlState = `
+roles:
+  - name: admin
+    logins: [root, ubuntu]
+    nodes: {"*": "*"}
+  - name: dba
+    logins: [postgres]
+    nodes: {app: postgres}
+users:
+  - name: beni
+    roles: [admin, dba]
+  - name: hulk
+    roles: [dba]
+`
+
+const tomlState = `
+[[roles]]
+name = "admin"
+logins = ["root", "ubuntu"]
+nodes = { "*" = "*" }
+
+[[roles]]
+name = "dba"
+logins = ["postgres"]
+nodes = { app = "postgres" }
+
+[[users]]
+name = "beni"
+roles = ["admin", "dba"]
+
+[[users]]
+name = "hulk"
+roles = ["dba"]
+`
+
+func TestLoadState_shouldReadYamlAndToml(t *testing.T) {
+	fromYaml, err := client.LoadState(writeStateFile(t, "access.yaml", yamlState))
+	assert.Nil(t, err)
+	fromToml, err := client.LoadState(writeStateFile(t, "access.toml", tomlState))
+	assert.Nil(t, err)
+
+	assert.Equal(t, fromYaml, fromToml)
+	assert.Equal(t, 2, len(fromYaml.Roles))
+	assert.Equal(t, "postgres", fromYaml.Roles[1].Nodes["app"])
+	assert.Equal(t, []string{"admin", "dba"}, fromYaml.Users[0].Roles)
+}
+
+func TestLoadState_shouldRejectInvalidState(t *testing.T) {
+	_, err := client.LoadState(writeStateFile(t, "access.json", "{}"))
+	assert.NotNil(t, err)
+
+	_, err = client.LoadState(writeStateFile(t, "access.yaml", "roles:\n  - name: dba\n    logins: [postgres]\n"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "needs logins and nodes")
+
+	_, err = client.LoadState(writeStateFile(t, "access.yaml", "users:\n  - name: beni\n  - name: beni\n"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "more than once")
+}
+
+func TestPlanState_shouldApplyDifference(t *testing.T) {
+	setup()
+	state, err := client.LoadState(writeStateFile(t, "access.yaml", yamlState))
+	assert.Nil(t, err)
+
+	changes, err := client.PlanState(state)
+	assert.Nil(t, err)
+	out := render(t, changes)
+	assert.Equal(t, 4, len(changes))
+	assert.Contains(t, out, "update")
+	assert.Contains(t, out, "create")
+	assert.Contains(t, out, "attach")
+	assert.Contains(t, out, "detach")
+	assert.NotContains(t, out, "delete")
+
+	_, err = client.ApplyChanges("hulk", changes)
+	assert.Nil(t, err)
+
+	admin, _ := backend.GetRoleByName("admin")
+	assert.Equal(t, []string{"root", "ubuntu"}, admin.AllowedLogins)
+	users, _ := backend.GetUsersByNames([]string{"beni", "hulk"})
+	assert.Equal(t, []string{"admin", "dba"}, users[0].RoleNames())
+	assert.Equal(t, []string{"dba"}, users[1].RoleNames())
+
+	changes, err = client.PlanState(state)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(changes))
+}
+
+func TestPlanState_shouldDeleteOnlyWhenPruning(t *testing.T) {
+	setup()
+	changes, err := client.PlanState(client.State{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(changes))
+
+	changes, err = client.PlanState(client.State{Prune: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(changes))
+	for _, c := range changes {
+		assert.Equal(t, "delete", c.Action)
+	}
+	// users go before the roles they hold
+	assert.Equal(t, "user", changes[0].Kind)
+	assert.Equal(t, "role", changes[2].Kind)
+}
+
+func TestApplyChanges_shouldDetachRolesThatNoLongerExist(t *testing.T) {
+	setup()
+	_, err := client.NewRole("hulk", "ghost", "ubuntu", "env:staging")
+	assert.Nil(t, err)
+	_, err = client.AttachRole("hulk", "ghost", "beni")
+	assert.Nil(t, err)
+	assert.Nil(t, backend.DeleteRole("ghost"))
+
+	changes, err := client.PlanState(client.State{Users: []client.UserState{{Name: "beni", Roles: []string{"admin"}}}})
+	assert.Nil(t, err)
+	_, err = client.ApplyChanges("hulk", changes)
+	assert.Nil(t, err)
+
+	users, _ := backend.GetUsersByNames([]string{"beni"})
+	assert.Equal(t, []string{"admin"}, users[0].RoleNames())
+}
+
+func TestPlanState_shouldRejectUnknownRole(t *testing.T) {
+	setup()
+	_, err := client.PlanState(client.State{
+		Users: []client.UserState{{Name: "beni", Roles: []string{"ghost"}}},
+	})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "ghost")
+}
+
+func TestAuthorizeChanges_shouldCheckLogins(t *testing.T) {
+	setup()
+	state, err := client.LoadState(writeStateFile(t, "access.yaml", yamlState))
+	assert.Nil(t, err)
+	changes, err := client.PlanState(state)
+	assert.Nil(t, err)
+
+	op := &auth.Operator{Name: "dbops", Roles: []string{"*"}, Users: []string{"*"}, Labels: []string{"*:*"}, Logins: []string{"postgres"}}
+	assert.EqualError(t, client.AuthorizeChanges(op, changes), "Operator `dbops` is not allowed to manage login `root`")
+
+	op.Logins = append(op.Logins, "root", "ubuntu")
+	assert.Nil(t, client.AuthorizeChanges(op, changes))
+}
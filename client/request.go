@@ -0,0 +1,226 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/notif"
+	"github.com/bentol/tero/request"
+)
+
+// RequestAccess stores a pending request of requester for the role and
+// tells the approvers of that role about it.
+func RequestAccess(requester, roleName, reason string, duration time.Duration) (string, error) {
+	if reason == "" {
+		return "", backend.Invalid("Reason must not empty")
+	}
+	if duration <= 0 {
+		return "", backend.Invalid("Invalid duration `%s`", duration)
+	}
+
+	r, err := backend.GetRoleByName(roleName)
+	if err != nil {
+		return "", err
+	}
+	if r == nil {
+		return "", backend.NotFound("Role `%s` does not exist", roleName)
+	}
+	users, err := backend.GetUsersByNames([]string{requester})
+	if err != nil {
+		return "", err
+	}
+	if len(users) == 0 {
+		return "", backend.NotFound("User `%s` does not exist", requester)
+	}
+	if containsString(users[0].RoleNames(), roleName) {
+		return "", fmt.Errorf("User `%s` already has role `%s`", requester, roleName)
+	}
+
+	approvers := requestApprovers(roleName)
+	if len(approvers) == 0 {
+		return "", fmt.Errorf("Nobody can approve requests for role `%s`", roleName)
+	}
+
+	requests, err := backend.GetRequests()
+	if err != nil {
+		return "", err
+	}
+	for _, existing := range requests {
+		if existing.State == request.Pending && existing.User == requester && existing.Role == roleName {
+			return "", fmt.Errorf("Request %s for role `%s` is still pending", existing.ID, roleName)
+		}
+	}
+
+	newRequest := request.New(roleName, requester, reason, duration, time.Now())
+	err = backend.SaveRequest(&newRequest)
+	if err != nil {
+		return "", err
+	}
+
+	out := fmt.Sprintf("Request %s for role `%s` created, waiting for approval!", newRequest.ID, roleName)
+	if config.Get().AccessRequests.Notify {
+		err = notif.SentMailAccessRequest(approvers, newRequest)
+		if err != nil {
+			// the request is stored, approvers can still find it with
+			// `tero requests ls`
+			log.Printf("Failed to notify approvers: %s", err)
+		} else {
+			out += fmt.Sprintf("\nApprovers notified: %v", approvers)
+		}
+	}
+	return out, nil
+}
+
+// ListRequests returns the pending requests, or every request when all
+// is set.
+func ListRequests(all bool) (Requests, error) {
+	requests, err := backend.GetRequests()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(Requests, 0, len(requests))
+	for _, r := range requests {
+		if all || r.State == request.Pending {
+			result = append(result, r)
+		}
+	}
+	return result, nil
+}
+
+// ApproveRequest attaches the requested role until the requested duration
+// has passed, `tero reap` detaches it afterwards.
+func ApproveRequest(approver, id string) (string, error) {
+	r, err := decidableRequest(approver, id)
+	if err != nil {
+		return "", err
+	}
+
+	duration, err := time.ParseDuration(r.Duration)
+	if err != nil {
+		return "", fmt.Errorf("Request %s has invalid duration `%s`", r.ID, r.Duration)
+	}
+	now := time.Now()
+	expires := now.Add(duration)
+
+	// the request is marked approved before the role is attached, so a
+	// concurrent deny or approve of the same request fails instead
+	args := map[string]string{"request": r.ID, "until": expires.Format(time.RFC3339)}
+	_, err = audited(approver, "request.approve", r.Role, []string{r.User}, args, func() (string, error) {
+		r, err = decideRequest(id, func(pending *request.Request) {
+			pending.State = request.Approved
+			pending.DecidedBy = approver
+			pending.DecidedAt = &now
+			pending.Expires = &expires
+		})
+		if err != nil {
+			return "", err
+		}
+
+		_, err = backend.AttachRoleUntil(r.Role, []string{r.User}, expires)
+		if err != nil {
+			_, resetErr := backend.UpdateRequest(id, func(approved *request.Request) error {
+				approved.State = request.Pending
+				approved.DecidedBy = ""
+				approved.DecidedAt = nil
+				approved.Expires = nil
+				return nil
+			})
+			if resetErr != nil {
+				log.Printf("Failed to set request %s back to pending: %s", id, resetErr)
+			}
+		}
+		return "", err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	notifyDecision(*r)
+	return fmt.Sprintf("Request %s approved, role `%s` attached to `%s` until %s!", r.ID, r.Role, r.User, expires.Format(time.RFC3339)), nil
+}
+
+func DenyRequest(approver, id, reason string) (string, error) {
+	r, err := decidableRequest(approver, id)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	args := map[string]string{"request": r.ID, "reason": reason}
+	_, err = audited(approver, "request.deny", r.Role, []string{r.User}, args, func() (string, error) {
+		r, err = decideRequest(id, func(pending *request.Request) {
+			pending.State = request.Denied
+			pending.DecidedBy = approver
+			pending.DecidedAt = &now
+			pending.DenialReason = reason
+		})
+		return "", err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	notifyDecision(*r)
+	return fmt.Sprintf("Request %s denied!", r.ID), nil
+}
+
+// decideRequest applies decision to the request only if it is still
+// pending in the backend.
+func decideRequest(id string, decision func(r *request.Request)) (*request.Request, error) {
+	return backend.UpdateRequest(id, func(r *request.Request) error {
+		if r.State != request.Pending {
+			return fmt.Errorf("Request %s is already %s", id, r.State)
+		}
+		decision(r)
+		return nil
+	})
+}
+
+// decidableRequest returns the request if it is pending and approver may
+// decide on it.
+func decidableRequest(approver, id string) (*request.Request, error) {
+	r, err := backend.GetRequest(id)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, backend.NotFound("Request %s does not exist", id)
+	}
+	if r.State != request.Pending {
+		return nil, fmt.Errorf("Request %s is already %s", id, r.State)
+	}
+	if r.User == approver {
+		return nil, errors.New("You cannot decide on your own request")
+	}
+	if !containsString(requestApprovers(r.Role), approver) {
+		return nil, fmt.Errorf("`%s` is not an approver for role `%s`", approver, r.Role)
+	}
+	return r, nil
+}
+
+func requestApprovers(roleName string) []string {
+	approvers := config.Get().AccessRequests.Approvers
+	result := make([]string, 0)
+	for _, names := range [][]string{approvers[roleName], approvers["*"]} {
+		for _, name := range names {
+			if !containsString(result, name) {
+				result = append(result, name)
+			}
+		}
+	}
+	return result
+}
+
+func notifyDecision(r request.Request) {
+	if !config.Get().AccessRequests.Notify {
+		return
+	}
+	if err := notif.SentMailAccessDecision(r); err != nil {
+		log.Printf("Failed to notify `%s`: %s", r.User, err)
+	}
+}
@@ -0,0 +1,193 @@
+package client_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/client"
+	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/notif"
+	"github.com/bentol/tero/request"
+	"github.com/stretchr/testify/assert"
+)
+
+type sentMail struct {
+	recipients []string
+	subject    string
+	body       string
+}
+
+// setupRequests lets hulk approve requests for role oncall and catches
+// the mails that would be sent.
+func setupRequests(t *testing.T) *[]sentMail {
+	setup()
+	_, err := client.NewRole("hulk", "oncall", "ubuntu", "env:production")
+	assert.Nil(t, err)
+
+	conf := config.Get()
+	config.Set(config.Config{AccessRequests: config.AccessRequestsConfig{
+		Approvers: map[string][]string{"oncall": {"hulk", "beni"}},
+		Notify:    true,
+	}})
+
+	mails := make([]sentMail, 0)
+	deliver := notif.Deliver
+	notif.Deliver = func(recipients []string, subject, body string) error {
+		mails = append(mails, sentMail{recipients, subject, body})
+		return nil
+	}
+	t.Cleanup(func() {
+		config.Set(conf)
+		notif.Deliver = deliver
+	})
+	return &mails
+}
+
+func pendingRequestID(t *testing.T) string {
+	requests, err := client.ListRequests(false)
+	assert.Nil(t, err)
+	if len(requests) != 1 {
+		t.Fatalf("expected one pending request, got %d", len(requests))
+	}
+	return requests[0].ID
+}
+
+func TestApproveRequest_shouldAttachRoleUntilRequestExpires(t *testing.T) {
+	mails := setupRequests(t)
+
+	_, err := client.RequestAccess("beni", "oncall", "INC-123", 2*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(*mails))
+	assert.Equal(t, []string{"hulk@tokopedia.com", "beni@tokopedia.com"}, (*mails)[0].recipients)
+	assert.Contains(t, (*mails)[0].body, "INC-123")
+
+	id := pendingRequestID(t)
+	out, err := client.ApproveRequest("hulk", id)
+	assert.Nil(t, err)
+	assert.Contains(t, out, "approved")
+
+	grants, _ := backend.GetGrantsByUser("beni")
+	assert.Equal(t, 1, len(grants))
+	assert.Equal(t, "oncall", grants[0].Role)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), grants[0].Expires, time.Minute)
+
+	r, _ := backend.GetRequest(id)
+	assert.Equal(t, request.Approved, r.State)
+	assert.Equal(t, "hulk", r.DecidedBy)
+
+	assert.Equal(t, 2, len(*mails))
+	assert.Equal(t, []string{"beni@tokopedia.com"}, (*mails)[1].recipients)
+	assert.True(t, strings.HasSuffix((*mails)[1].subject, "approved"))
+
+	_, err = client.ApproveRequest("hulk", id)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "already approved")
+}
+
+func TestApproveRequest_shouldRejectSelfApproval(t *testing.T) {
+	setupRequests(t)
+
+	_, err := client.RequestAccess("beni", "oncall", "INC-123", time.Hour)
+	assert.Nil(t, err)
+
+	_, err = client.ApproveRequest("beni", pendingRequestID(t))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "your own request")
+
+	_, err = client.ApproveRequest("thanos", pendingRequestID(t))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "not an approver")
+
+	beni, _ := backend.GetStorage().GetUserByName("beni")
+	assert.NotContains(t, beni.RoleNames(), "oncall")
+}
+
+func TestDenyRequest_shouldNotAttachRole(t *testing.T) {
+	mails := setupRequests(t)
+
+	_, err := client.RequestAccess("beni", "oncall", "INC-123", time.Hour)
+	assert.Nil(t, err)
+	_, err = client.RequestAccess("beni", "oncall", "INC-124", time.Hour)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "still pending")
+
+	id := pendingRequestID(t)
+	_, err = client.DenyRequest("hulk", id, "not on call")
+	assert.Nil(t, err)
+
+	requests, _ := client.ListRequests(false)
+	assert.Equal(t, 0, len(requests))
+	requests, _ = client.ListRequests(true)
+	assert.Equal(t, request.Denied, requests[0].State)
+
+	beni, _ := backend.GetStorage().GetUserByName("beni")
+	assert.NotContains(t, beni.RoleNames(), "oncall")
+	assert.Contains(t, (*mails)[1].body, "not on call")
+}
+
+func TestApproveAndDenyRequest_shouldLetOnlyOneDecisionWin(t *testing.T) {
+	setupRequests(t)
+
+	_, err := client.RequestAccess("beni", "oncall", "INC-123", time.Hour)
+	assert.Nil(t, err)
+	id := pendingRequestID(t)
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := client.ApproveRequest("hulk", id)
+		errs <- err
+	}()
+	go func() {
+		_, err := client.DenyRequest("hulk", id, "not on call")
+		errs <- err
+	}()
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			assert.Contains(t, err.Error(), "already")
+			failed++
+		}
+	}
+	assert.Equal(t, 1, failed)
+
+	r, _ := backend.GetRequest(id)
+	beni, _ := backend.GetStorage().GetUserByName("beni")
+	if r.State == request.Approved {
+		assert.Contains(t, beni.RoleNames(), "oncall")
+	} else {
+		assert.Equal(t, request.Denied, r.State)
+		assert.NotContains(t, beni.RoleNames(), "oncall")
+	}
+}
+
+func TestApproveRequest_shouldStayPendingWhenAttachFails(t *testing.T) {
+	setupRequests(t)
+
+	_, err := client.RequestAccess("beni", "oncall", "INC-123", time.Hour)
+	assert.Nil(t, err)
+	id := pendingRequestID(t)
+	_, err = client.DeleteRole("hulk", "oncall")
+	assert.Nil(t, err)
+
+	_, err = client.ApproveRequest("hulk", id)
+	assert.NotNil(t, err)
+	r, _ := backend.GetRequest(id)
+	assert.Equal(t, request.Pending, r.State)
+	assert.Nil(t, r.DecidedAt)
+}
+
+func TestRequestAccess_shouldNeedAnApprover(t *testing.T) {
+	setupRequests(t)
+
+	_, err := client.RequestAccess("beni", "admin", "INC-123", time.Hour)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "already has role")
+
+	_, err = client.NewRole("hulk", "dba", "postgres", "app:postgres")
+	assert.Nil(t, err)
+	_, err = client.RequestAccess("beni", "dba", "INC-123", time.Hour)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Nobody can approve")
+}
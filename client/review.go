@@ -0,0 +1,432 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bentol/tero/auth"
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/notif"
+	"github.com/bentol/tero/review"
+)
+
+// StartReview snapshots the roles of owner every user has into a new
+// campaign, the items are shared out among the reviewers of the team.
+func StartReview(creator, owner string) (string, error) {
+	team, ok := config.Get().Reviews.Teams[owner]
+	if !ok {
+		return "", backend.NotFound("Team `%s` is not in the reviews config", owner)
+	}
+	if len(team.Reviewers) == 0 {
+		return "", fmt.Errorf("Team `%s` has no reviewers", owner)
+	}
+
+	items, err := reviewItems(team)
+	if err != nil {
+		return "", err
+	}
+	if len(items) == 0 {
+		return "", fmt.Errorf("No user has a role of team `%s`", owner)
+	}
+
+	c := review.New(owner, creator, items, time.Now().UTC())
+	args := map[string]string{"owner": owner}
+	_, err = audited(creator, "review.start", "", nil, args, func() (string, error) {
+		err := backend.SaveCampaign(&c)
+		args["review"] = c.ID
+		return "", err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	out := fmt.Sprintf("Review %s of team `%s` started with %d roles to review!", c.ID, owner, len(items))
+	if config.Get().Reviews.Notify {
+		for reviewer, pending := range c.PendingBy() {
+			if err := notif.SentMailReviewStarted(reviewer, c, pending); err != nil {
+				log.Printf("Failed to notify `%s`: %s", reviewer, err)
+			}
+		}
+	}
+	return out, nil
+}
+
+// AuthorizeStartReview checks op manages every role and user the review
+// of owner would cover.
+func AuthorizeStartReview(op *auth.Operator, owner string) error {
+	team, ok := config.Get().Reviews.Teams[owner]
+	if !ok {
+		return nil
+	}
+	items, err := reviewItems(team)
+	if err != nil {
+		return err
+	}
+	return authorizeItems(op, items)
+}
+
+// AuthorizeRemind checks op manages every item of the campaigns whose
+// reviewers would be reminded, the open ones when id is empty.
+func AuthorizeRemind(op *auth.Operator, id string) error {
+	campaigns := make([]review.Campaign, 0)
+	if id != "" {
+		c, err := getCampaign(id)
+		if err != nil {
+			return err
+		}
+		campaigns = append(campaigns, *c)
+	} else {
+		open, err := ListReviews(false)
+		if err != nil {
+			return err
+		}
+		campaigns = append(campaigns, open...)
+	}
+	for _, c := range campaigns {
+		if err := authorizeItems(op, c.Items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func authorizeItems(op *auth.Operator, items []review.Item) error {
+	for _, item := range items {
+		if err := op.CanManageRole(item.Role); err != nil {
+			return err
+		}
+		if err := op.CanManageUser(item.User); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reviewItems lists the roles of team every user has, shared out among
+// the reviewers of the team.
+func reviewItems(team config.ReviewTeam) ([]review.Item, error) {
+	users, err := backend.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	items := make([]review.Item, 0)
+	for _, name := range names {
+		u := users[name]
+		for _, roleName := range u.RoleNames() {
+			if roleName == "" || !matchAny(team.Roles, roleName) {
+				continue
+			}
+			reviewer, err := assignReviewer(team.Reviewers, u.Name, len(items))
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, review.Item{User: u.Name, Role: roleName, Reviewer: reviewer, Decision: review.Pending})
+		}
+	}
+
+	return items, nil
+}
+
+// assignReviewer takes the reviewers in turn, skipping the user whose
+// role is reviewed.
+func assignReviewer(reviewers []string, userName string, n int) (string, error) {
+	for i := 0; i < len(reviewers); i++ {
+		reviewer := reviewers[(n+i)%len(reviewers)]
+		if reviewer != userName {
+			return reviewer, nil
+		}
+	}
+	return "", fmt.Errorf("Nobody but `%s` can review the roles of `%s`", userName, userName)
+}
+
+// ListReviews returns the open campaigns, or every campaign when all is
+// set.
+func ListReviews(all bool) (Reviews, error) {
+	campaigns, err := backend.GetCampaigns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(Reviews, 0, len(campaigns))
+	for _, c := range campaigns {
+		if all || c.State == review.Open {
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+func ShowReview(id string) (*ReviewDetail, error) {
+	c, err := getCampaign(id)
+	if err != nil {
+		return nil, err
+	}
+	return &ReviewDetail{Campaign: *c}, nil
+}
+
+// DecideReview keeps or revokes the roles of userName in the campaign,
+// every role of the user when roleName is empty. Decisions can be changed
+// until the campaign is closed.
+func DecideReview(reviewer, id, userName, roleName, decision string) (string, error) {
+	if decision != review.Keep && decision != review.Revoke {
+		return "", backend.Invalid("Invalid decision `%s`", decision)
+	}
+	c, err := openCampaign(id)
+	if err != nil {
+		return "", err
+	}
+	if !containsString(config.Get().Reviews.Teams[c.Owner].Reviewers, reviewer) {
+		return "", fmt.Errorf("`%s` is not a reviewer of team `%s`", reviewer, c.Owner)
+	}
+	if reviewer == userName {
+		return "", errors.New("You cannot review your own roles")
+	}
+
+	now := time.Now().UTC()
+	if len(decide(c, reviewer, userName, roleName, decision, now)) == 0 {
+		return "", fmt.Errorf("Review %s has no role `%s` of `%s` to decide on", id, roleName, userName)
+	}
+
+	// decide again on a fresh copy, so decisions of other reviewers made
+	// in the meantime are kept and a closed campaign is left alone
+	var decided []string
+	args := map[string]string{"review": c.ID, "decision": decision}
+	_, err = audited(reviewer, "review.decide", roleName, []string{userName}, args, func() (string, error) {
+		var err error
+		c, err = backend.UpdateCampaign(id, func(fresh *review.Campaign) error {
+			if fresh.State != review.Open {
+				return fmt.Errorf("Review %s is already %s", id, fresh.State)
+			}
+			decided = decide(fresh, reviewer, userName, roleName, decision, now)
+			return nil
+		})
+		return "", err
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Marked %s of `%s` as %s, %d roles left to review!", strings.Join(decided, ","), userName, decision, c.Pending()), nil
+}
+
+// decide sets the decision on the items of userName in c and returns the
+// roles decided on.
+func decide(c *review.Campaign, reviewer, userName, roleName, decision string, now time.Time) []string {
+	decided := make([]string, 0)
+	for i := range c.Items {
+		item := &c.Items[i]
+		if item.User != userName || (roleName != "" && item.Role != roleName) {
+			continue
+		}
+		item.Decision = decision
+		item.DecidedBy = reviewer
+		item.DecidedAt = &now
+		decided = append(decided, item.Role)
+	}
+	return decided
+}
+
+// AuthorizeReview checks op may detach every role revoked in the
+// campaign, so nothing is detached when one of them is denied.
+func AuthorizeReview(op *auth.Operator, id string) error {
+	c, err := getCampaign(id)
+	if err != nil {
+		return err
+	}
+	revoked := make([]review.Item, 0)
+	for _, item := range c.Items {
+		if item.Decision == review.Revoke {
+			revoked = append(revoked, item)
+		}
+	}
+	return authorizeItems(op, revoked)
+}
+
+// CloseReview detaches the revoked roles, closes the campaign and writes
+// its report signed with the signing key of the config to reportFile.
+func CloseReview(closer, id, reportFile string) (string, error) {
+	keyFile := config.Get().Reviews.SigningKey
+	if keyFile == "" {
+		return "", errors.New("Closing a review needs signing_key in the reviews config to sign the report")
+	}
+	key, err := review.LoadPrivateKey(keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := openCampaign(id)
+	if err != nil {
+		return "", err
+	}
+	if pending := c.Pending(); pending != 0 {
+		return "", fmt.Errorf("Review %s still has %d roles to review", id, pending)
+	}
+
+	// a close that failed half way is run again, roles already detached
+	// are skipped
+	revoked := 0
+	for _, item := range c.Items {
+		if item.Decision != review.Revoke {
+			continue
+		}
+		users, err := backend.GetUsersByNames([]string{item.User})
+		if err != nil {
+			return "", err
+		}
+		if len(users) == 0 || !containsString(users[0].RoleNames(), item.Role) {
+			continue
+		}
+
+		args := map[string]string{"review": c.ID}
+		_, err = audited(closer, "review.revoke", item.Role, []string{item.User}, args, func() (string, error) {
+			_, err := backend.DettachRole(item.Role, []string{item.User})
+			return "", err
+		})
+		if err != nil {
+			return "", fmt.Errorf("Failed to revoke role `%s` of `%s`: %s", item.Role, item.User, err)
+		}
+		revoked++
+	}
+
+	now := time.Now().UTC()
+	c.State = review.Closed
+	c.ClosedBy = closer
+	c.ClosedAt = &now
+	report, err := review.Sign(*c, key, now)
+	if err != nil {
+		return "", err
+	}
+	raw, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(reportFile, raw, 0600); err != nil {
+		return "", fmt.Errorf("Failed to write report: %s", err)
+	}
+
+	_, err = audited(closer, "review.close", "", nil, map[string]string{"review": c.ID}, func() (string, error) {
+		_, err := backend.UpdateCampaign(id, func(fresh *review.Campaign) error {
+			if fresh.State != review.Open {
+				return fmt.Errorf("Review %s is already %s", id, fresh.State)
+			}
+			if !reflect.DeepEqual(fresh.Items, c.Items) {
+				return fmt.Errorf("Review %s was changed while it was closed, run close again", id)
+			}
+			*fresh = *c
+			return nil
+		})
+		return "", err
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Review %s closed, %d roles revoked, report written to %s!", c.ID, revoked, reportFile), nil
+}
+
+// VerifyReviewReport checks the signature of a report with the public key
+// of the signing key.
+func VerifyReviewReport(reportFile, publicKeyFile string) (*ReviewDetail, error) {
+	pub, err := review.LoadPublicKey(publicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadFile(reportFile)
+	if err != nil {
+		return nil, err
+	}
+	report := review.Report{}
+	if err := json.Unmarshal(raw, &report); err != nil {
+		return nil, fmt.Errorf("Invalid report %s: %s", reportFile, err)
+	}
+
+	c, err := review.Verify(report, pub)
+	if err != nil {
+		return nil, err
+	}
+	return &ReviewDetail{Campaign: *c}, nil
+}
+
+// RemindReviewers mails every reviewer with roles left to review in the
+// open campaigns, or only in the campaign id when given.
+func RemindReviewers(id string) (string, error) {
+	campaigns := make([]review.Campaign, 0)
+	if id != "" {
+		c, err := openCampaign(id)
+		if err != nil {
+			return "", err
+		}
+		campaigns = append(campaigns, *c)
+	} else {
+		open, err := ListReviews(false)
+		if err != nil {
+			return "", err
+		}
+		campaigns = append(campaigns, open...)
+	}
+
+	reminded := make([]string, 0)
+	for _, c := range campaigns {
+		pendingBy := c.PendingBy()
+		reviewers := make([]string, 0, len(pendingBy))
+		for reviewer := range pendingBy {
+			reviewers = append(reviewers, reviewer)
+		}
+		sort.Strings(reviewers)
+
+		for _, reviewer := range reviewers {
+			if err := notif.SentMailReviewReminder(reviewer, c, pendingBy[reviewer]); err != nil {
+				return "", fmt.Errorf("Failed to remind `%s`: %s", reviewer, err)
+			}
+			reminded = append(reminded, fmt.Sprintf("%s (%s)", reviewer, c.ID))
+		}
+	}
+	if len(reminded) == 0 {
+		return "Nobody to remind!", nil
+	}
+	return "Reminded: " + strings.Join(reminded, ", "), nil
+}
+
+func getCampaign(id string) (*review.Campaign, error) {
+	c, err := backend.GetCampaign(id)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, backend.NotFound("Review %s does not exist", id)
+	}
+	return c, nil
+}
+
+func openCampaign(id string) (*review.Campaign, error) {
+	c, err := getCampaign(id)
+	if err != nil {
+		return nil, err
+	}
+	if c.State != review.Open {
+		return nil, fmt.Errorf("Review %s is already %s", id, c.State)
+	}
+	return c, nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package client_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bentol/tero/auth"
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/client"
+	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/notif"
+	"github.com/bentol/tero/review"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupReviews lets hulk and thor review the roles of team sre, it
+// returns the directory of the signing keys and reports.
+func setupReviews(t *testing.T, mails *[]sentMail) string {
+	setup()
+	_, err := client.NewRole("hulk", "dba", "postgres", "app:postgres")
+	assert.Nil(t, err)
+	_, err = client.AttachRole("hulk", "dba", "beni,hulk")
+	assert.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "tero-review")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	rawKey, _ := x509.MarshalPKCS8PrivateKey(key)
+	rawPub, _ := x509.MarshalPKIXPublicKey(pub)
+	ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: rawKey}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "pub.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rawPub}), 0600)
+
+	conf := config.Get()
+	config.Set(config.Config{Reviews: config.ReviewsConfig{
+		Teams: map[string]config.ReviewTeam{
+			"sre": {Reviewers: []string{"hulk", "thor"}, Roles: []string{"admin", "db*"}},
+		},
+		SigningKey: filepath.Join(dir, "key.pem"),
+		Notify:     true,
+	}})
+
+	deliver := notif.Deliver
+	notif.Deliver = func(recipients []string, subject, body string) error {
+		*mails = append(*mails, sentMail{recipients, subject, body})
+		return nil
+	}
+	t.Cleanup(func() {
+		config.Set(conf)
+		notif.Deliver = deliver
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func reviewID(t *testing.T) string {
+	reviews, err := client.ListReviews(false)
+	assert.Nil(t, err)
+	if len(reviews) != 1 {
+		t.Fatalf("expected one open review, got %d", len(reviews))
+	}
+	return reviews[0].ID
+}
+
+func TestReview_shouldRevokeRolesAndSignReport(t *testing.T) {
+	mails := make([]sentMail, 0)
+	dir := setupReviews(t, &mails)
+
+	_, err := client.StartReview("hulk", "sre")
+	assert.Nil(t, err)
+	id := reviewID(t)
+
+	detail, err := client.ShowReview(id)
+	assert.Nil(t, err)
+	assert.Equal(t, []review.Item{
+		{User: "beni", Role: "admin", Reviewer: "hulk", Decision: review.Pending},
+		{User: "beni", Role: "dba", Reviewer: "thor", Decision: review.Pending},
+		{User: "hulk", Role: "admin", Reviewer: "thor", Decision: review.Pending},
+		{User: "hulk", Role: "dba", Reviewer: "thor", Decision: review.Pending},
+	}, detail.Items)
+	assert.Equal(t, 2, len(mails))
+
+	_, err = client.DecideReview("hulk", id, "hulk", "", review.Keep)
+	assert.EqualError(t, err, "You cannot review your own roles")
+	_, err = client.DecideReview("beni", id, "hulk", "", review.Keep)
+	assert.EqualError(t, err, "`beni` is not a reviewer of team `sre`")
+
+	_, err = client.DecideReview("hulk", id, "beni", "dba", review.Revoke)
+	assert.Nil(t, err)
+	_, err = client.CloseReview("hulk", id, filepath.Join(dir, "report.json"))
+	assert.EqualError(t, err, "Review "+id+" still has 3 roles to review")
+
+	mails = mails[:0]
+	out, err := client.RemindReviewers("")
+	assert.Nil(t, err)
+	assert.Equal(t, "Reminded: hulk ("+id+"), thor ("+id+")", out)
+	assert.Equal(t, 2, len(mails))
+
+	_, err = client.DecideReview("hulk", id, "beni", "admin", review.Keep)
+	assert.Nil(t, err)
+	_, err = client.DecideReview("thor", id, "hulk", "", review.Keep)
+	assert.Nil(t, err)
+
+	out, err = client.CloseReview("hulk", id, filepath.Join(dir, "report.json"))
+	assert.Nil(t, err)
+	assert.Contains(t, out, "1 roles revoked")
+
+	users, _ := backend.GetUsersByNames([]string{"beni"})
+	assert.Equal(t, []string{"admin"}, users[0].RoleNames())
+
+	verified, err := client.VerifyReviewReport(filepath.Join(dir, "report.json"), filepath.Join(dir, "pub.pem"))
+	assert.Nil(t, err)
+	assert.Equal(t, review.Closed, verified.State)
+	assert.Equal(t, "hulk", verified.ClosedBy)
+
+	_, err = client.DecideReview("hulk", id, "beni", "admin", review.Revoke)
+	assert.EqualError(t, err, "Review "+id+" is already closed")
+}
+
+func TestAuthorizeStartReview_shouldCheckEveryReviewedRoleAndUser(t *testing.T) {
+	mails := make([]sentMail, 0)
+	setupReviews(t, &mails)
+
+	dbaOnly := &auth.Operator{Name: "loki", Roles: []string{"db*"}, Users: []string{"*"}}
+	assert.EqualError(t, client.AuthorizeStartReview(dbaOnly, "sre"), "Operator `loki` is not allowed to manage role `admin`")
+	assert.Nil(t, client.AuthorizeStartReview(&auth.Operator{Name: "hulk", Roles: []string{"*"}, Users: []string{"*"}}, "sre"))
+
+	_, err := client.StartReview("hulk", "sre")
+	assert.Nil(t, err)
+	assert.EqualError(t, client.AuthorizeRemind(dbaOnly, reviewID(t)), "Operator `loki` is not allowed to manage role `admin`")
+	assert.EqualError(t, client.AuthorizeRemind(&auth.Operator{Name: "loki", Roles: []string{"*"}, Users: []string{"hulk"}}, ""), "Operator `loki` is not allowed to manage user `beni`")
+}
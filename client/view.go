@@ -0,0 +1,497 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bentol/tero/audit"
+	"github.com/bentol/tero/grant"
+	"github.com/bentol/tero/offboard"
+	"github.com/bentol/tero/output"
+	"github.com/bentol/tero/request"
+	"github.com/bentol/tero/review"
+	"github.com/bentol/tero/role"
+	"github.com/bentol/tero/user"
+)
+
+// RoleInfo is the summary of a role shown by `roles ls` and `users ls`.
+type RoleInfo struct {
+	Name   string            `json:"name" yaml:"name"`
+	Logins []string          `json:"logins" yaml:"logins"`
+	Nodes  map[string]string `json:"nodes" yaml:"nodes"`
+	// Expires is set when the role is attached to a user until some time
+	Expires *time.Time `json:"expires,omitempty" yaml:"expires,omitempty"`
+}
+
+type RoleList []RoleInfo
+
+type RuleInfo struct {
+	Resources []string `json:"resources" yaml:"resources"`
+	Verbs     []string `json:"verbs" yaml:"verbs"`
+	Where     string   `json:"where,omitempty" yaml:"where,omitempty"`
+}
+
+type OptionsInfo struct {
+	MaxSessionTTL  string `json:"max_session_ttl,omitempty" yaml:"max_session_ttl,omitempty"`
+	ForwardAgent   *bool  `json:"forward_agent,omitempty" yaml:"forward_agent,omitempty"`
+	PortForwarding *bool  `json:"port_forwarding,omitempty" yaml:"port_forwarding,omitempty"`
+	CertFormat     string `json:"cert_format,omitempty" yaml:"cert_format,omitempty"`
+}
+
+type RoleUser struct {
+	Name  string   `json:"name" yaml:"name"`
+	Roles []string `json:"roles" yaml:"roles"`
+}
+
+// RoleDetail is everything `roles show` knows about a role.
+type RoleDetail struct {
+	RoleInfo   `yaml:",inline"`
+	DenyLogins []string          `json:"deny_logins" yaml:"deny_logins"`
+	DenyNodes  map[string]string `json:"deny_nodes" yaml:"deny_nodes"`
+	AllowRules []RuleInfo        `json:"allow_rules" yaml:"allow_rules"`
+	DenyRules  []RuleInfo        `json:"deny_rules" yaml:"deny_rules"`
+	Options    OptionsInfo       `json:"options" yaml:"options"`
+	Users      []RoleUser        `json:"users" yaml:"users"`
+}
+
+type UserInfo struct {
+	Name   string     `json:"name" yaml:"name"`
+	Locked bool       `json:"locked" yaml:"locked"`
+	Roles  []RoleInfo `json:"roles" yaml:"roles"`
+}
+
+type UserList []UserInfo
+
+type Grants []grant.Grant
+
+type Requests []request.Request
+
+type AuditEvents []audit.Event
+
+type Reviews []review.Campaign
+
+// ReviewDetail is a campaign with every role under review.
+type ReviewDetail struct {
+	review.Campaign `yaml:",inline"`
+}
+
+// AccessGrant is a login a user gets on the checked nodes and the role
+// granting it.
+type AccessGrant struct {
+	User   string `json:"user" yaml:"user"`
+	Login  string `json:"login" yaml:"login"`
+	Role   string `json:"role" yaml:"role"`
+	Locked bool   `json:"locked" yaml:"locked"`
+}
+
+// UserExplanation is the effective access of a user, see ExplainUser.
+type UserExplanation struct {
+	Name   string     `json:"name" yaml:"name"`
+	Locked bool       `json:"locked" yaml:"locked"`
+	Roles  []RoleInfo `json:"roles" yaml:"roles"`
+	// Logins are the logins the user can use on some node
+	Logins []string     `json:"logins" yaml:"logins"`
+	Access []NodeAccess `json:"access" yaml:"access"`
+	Deny   []DenyInfo   `json:"deny" yaml:"deny"`
+}
+
+// NodeAccess is the logins granted on the nodes selected by Nodes.
+type NodeAccess struct {
+	Nodes  map[string]string `json:"nodes" yaml:"nodes"`
+	Logins []LoginGrant      `json:"logins" yaml:"logins"`
+	// DeniedBy are the roles denying all of these nodes
+	DeniedBy []string `json:"denied_by,omitempty" yaml:"denied_by,omitempty"`
+}
+
+type LoginGrant struct {
+	Login string   `json:"login" yaml:"login"`
+	Roles []string `json:"roles" yaml:"roles"`
+	// DeniedBy are the roles denying this login everywhere
+	DeniedBy []string `json:"denied_by,omitempty" yaml:"denied_by,omitempty"`
+}
+
+type DenyInfo struct {
+	Role   string            `json:"role" yaml:"role"`
+	Logins []string          `json:"logins" yaml:"logins"`
+	Nodes  map[string]string `json:"nodes" yaml:"nodes"`
+}
+
+// AccessReport is the answer of `access check`.
+type AccessReport struct {
+	Labels map[string]string `json:"labels" yaml:"labels"`
+	Login  string            `json:"login,omitempty" yaml:"login,omitempty"`
+	Roles  RoleList          `json:"roles" yaml:"roles"`
+	Users  []AccessGrant     `json:"users" yaml:"users"`
+}
+
+// OffboardResult is what happened to a user of `users offboard`.
+type OffboardResult struct {
+	offboard.Offboarding `yaml:",inline"`
+	Status               string `json:"status" yaml:"status"`
+	Detail               string `json:"detail,omitempty" yaml:"detail,omitempty"`
+}
+
+type OffboardResults []OffboardResult
+
+func newRoleInfo(r role.Role) RoleInfo {
+	logins := append([]string{}, r.AllowedLogins...)
+	sort.Strings(logins)
+	nodes := r.NodePatterns
+	if nodes == nil {
+		nodes = make(map[string]string)
+	}
+	return RoleInfo{Name: r.Name, Logins: logins, Nodes: nodes}
+}
+
+func newRuleInfos(rules []role.Rule) []RuleInfo {
+	result := make([]RuleInfo, 0, len(rules))
+	for _, rule := range rules {
+		result = append(result, RuleInfo{Resources: rule.Resources, Verbs: rule.Verbs, Where: rule.Where})
+	}
+	return result
+}
+
+// newUserInfo shows the expiry of the user roles found in grants.
+func newUserInfo(u user.User, grants []grant.Grant) UserInfo {
+	expires := make(map[string]time.Time)
+	for _, g := range grants {
+		if g.User == u.Name {
+			expires[g.Role] = g.Expires
+		}
+	}
+
+	info := UserInfo{Name: u.Name, Locked: u.IsLocked, Roles: make([]RoleInfo, 0)}
+	for _, r := range u.Roles {
+		if len(r.Name) == 0 {
+			continue
+		}
+		roleInfo := newRoleInfo(r)
+		if t, ok := expires[r.Name]; ok {
+			roleInfo.Expires = &t
+		}
+		info.Roles = append(info.Roles, roleInfo)
+	}
+	return info
+}
+
+func (r RoleInfo) String() string {
+	s := r.Name + " = " + strings.Join(r.Logins, ",") + "@" + stringNodes(r.Nodes)
+	if r.Expires != nil {
+		s += " (expires " + r.Expires.Format(time.RFC3339) + ")"
+	}
+	return s
+}
+
+func (list RoleList) Tables() []output.Table {
+	rows := make([][]string, 0, len(list))
+	for _, r := range list {
+		rows = append(rows, []string{r.Name, strings.Join(r.Logins, ","), stringNodes(r.Nodes)})
+	}
+	return []output.Table{{
+		Header: []string{"Role", "Allowed Logins", "Node"},
+		Rows:   rows,
+	}}
+}
+
+func (d RoleDetail) Tables() []output.Table {
+	rules := make([][]string, 0)
+	for _, rule := range d.AllowRules {
+		rules = append(rules, []string{"allow", strings.Join(rule.Resources, ","), strings.Join(rule.Verbs, ","), rule.Where})
+	}
+	for _, rule := range d.DenyRules {
+		rules = append(rules, []string{"deny", strings.Join(rule.Resources, ","), strings.Join(rule.Verbs, ","), rule.Where})
+	}
+
+	users := make([][]string, 0, len(d.Users))
+	for _, u := range d.Users {
+		users = append(users, []string{u.Name, strings.Join(u.Roles, ", ")})
+	}
+
+	return []output.Table{
+		{
+			Title:  "Role Info",
+			Header: []string{"Role", "Allowed Logins", "Node"},
+			Rows:   [][]string{{d.Name, strings.Join(d.Logins, ","), stringNodes(d.Nodes)}},
+		},
+		{
+			Title:  "Deny",
+			Header: []string{"Denied Logins", "Denied Node"},
+			Rows:   [][]string{{strings.Join(d.DenyLogins, ","), stringNodes(d.DenyNodes)}},
+		},
+		{
+			Title:  "Rules",
+			Header: []string{"Type", "Resources", "Verbs", "Where"},
+			Rows:   rules,
+		},
+		{
+			Title:  "Options",
+			Header: []string{"Max Session TTL", "Forward Agent", "Port Forwarding", "Cert Format"},
+			Rows: [][]string{{
+				d.Options.MaxSessionTTL,
+				stringBool(d.Options.ForwardAgent),
+				stringBool(d.Options.PortForwarding),
+				d.Options.CertFormat,
+			}},
+		},
+		{
+			Title:  "Users",
+			Header: []string{"Name", "Roles"},
+			Rows:   users,
+		},
+	}
+}
+
+func (u UserInfo) Tables() []output.Table {
+	return UserList{u}.Tables()
+}
+
+func (list UserList) Tables() []output.Table {
+	rows := make([][]string, 0)
+	for _, u := range list {
+		lockedStatus := "no"
+		if u.Locked {
+			lockedStatus = "yes"
+		}
+		if len(u.Roles) == 0 {
+			rows = append(rows, []string{u.Name, lockedStatus, ""})
+		}
+		for _, r := range u.Roles {
+			rows = append(rows, []string{u.Name, lockedStatus, r.String()})
+		}
+	}
+	return []output.Table{{
+		Header:     []string{"Name", "Locked", "Roles"},
+		Rows:       rows,
+		MergeCells: true,
+		RowLine:    true,
+	}}
+}
+
+func (grants Grants) Tables() []output.Table {
+	rows := make([][]string, 0, len(grants))
+	for _, g := range grants {
+		rows = append(rows, []string{g.Role, g.User, g.Expires.Format(time.RFC3339)})
+	}
+	return []output.Table{{
+		Header: []string{"Role", "User", "Expires"},
+		Rows:   rows,
+	}}
+}
+
+func (requests Requests) Tables() []output.Table {
+	rows := make([][]string, 0, len(requests))
+	for _, r := range requests {
+		expires := ""
+		if r.Expires != nil {
+			expires = r.Expires.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{r.ID, r.Role, r.User, r.Reason, r.Duration, r.State, r.DecidedBy, expires})
+	}
+	return []output.Table{{
+		Header: []string{"ID", "Role", "User", "Reason", "For", "State", "Decided By", "Expires"},
+		Rows:   rows,
+	}}
+}
+
+func (changes Changes) Tables() []output.Table {
+	rows := make([][]string, 0, len(changes))
+	for _, c := range changes {
+		rows = append(rows, []string{c.Action, c.Kind, c.Name, c.Detail})
+	}
+	return []output.Table{{
+		Header: []string{"Action", "Kind", "Name", "Detail"},
+		Rows:   rows,
+	}}
+}
+
+func (problems Problems) Tables() []output.Table {
+	rows := make([][]string, 0, len(problems))
+	for _, p := range problems {
+		fix := p.Fix
+		if fix == "" {
+			fix = "by hand"
+		}
+		rows = append(rows, []string{p.Kind, p.Name, p.Path, p.Problem, fix})
+	}
+	return []output.Table{{
+		Header: []string{"Kind", "Name", "Record", "Problem", "Fix"},
+		Rows:   rows,
+	}}
+}
+
+func (results ImportResults) Tables() []output.Table {
+	rows := make([][]string, 0, len(results))
+	for _, r := range results {
+		rows = append(rows, []string{fmt.Sprint(r.Row), r.Name, strings.Join(r.Roles, ","), r.Status, r.Detail})
+	}
+	return []output.Table{{
+		Header: []string{"Row", "Name", "Roles", "Status", "Detail"},
+		Rows:   rows,
+	}}
+}
+
+func (results OffboardResults) Tables() []output.Table {
+	rows := make([][]string, 0, len(results))
+	for _, r := range results {
+		token, deleteAfter := "", ""
+		if r.TokenRevoked {
+			token = "revoked"
+		}
+		if r.DeleteAfter != nil {
+			deleteAfter = r.DeleteAfter.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{r.User, r.Status, strings.Join(r.Roles, ","), token, deleteAfter, r.Detail})
+	}
+	return []output.Table{{
+		Header: []string{"User", "Status", "Detached Roles", "Signup Token", "Delete After", "Detail"},
+		Rows:   rows,
+	}}
+}
+
+func (invites Invites) Tables() []output.Table {
+	rows := make([][]string, 0, len(invites))
+	for _, i := range invites {
+		expires := ""
+		if i.Expires != nil {
+			expires = i.Expires.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{i.User, strings.Join(i.Roles, ","), expires, i.State})
+	}
+	return []output.Table{{
+		Header: []string{"User", "Roles", "Expires", "State"},
+		Rows:   rows,
+	}}
+}
+
+func (events AuditEvents) Tables() []output.Table {
+	rows := make([][]string, 0, len(events))
+	for _, e := range events {
+		args := make([]string, 0, len(e.Args))
+		for k, v := range e.Args {
+			args = append(args, k+"="+v)
+		}
+		sort.Strings(args)
+		result := e.Result
+		if e.Error != "" {
+			result += ": " + e.Error
+		}
+		rows = append(rows, []string{
+			e.Time.Local().Format(time.RFC3339),
+			e.Operator,
+			e.Action,
+			e.Role,
+			strings.Join(e.Users, ","),
+			strings.Join(args, " "),
+			result,
+		})
+	}
+	return []output.Table{{
+		Header: []string{"Time", "Operator", "Action", "Role", "Users", "Args", "Result"},
+		Rows:   rows,
+	}}
+}
+
+func (report AccessReport) Tables() []output.Table {
+	roles := report.Roles.Tables()[0]
+	roles.Title = "Roles"
+
+	users := make([][]string, 0, len(report.Users))
+	for _, g := range report.Users {
+		lockedStatus := "no"
+		if g.Locked {
+			lockedStatus = "yes"
+		}
+		users = append(users, []string{g.User, lockedStatus, g.Login, g.Role})
+	}
+	return []output.Table{roles, {
+		Title:  "Users",
+		Header: []string{"User", "Locked", "Login", "Granted By"},
+		Rows:   users,
+	}}
+}
+
+func (e UserExplanation) Tables() []output.Table {
+	lockedStatus := "no"
+	if e.Locked {
+		lockedStatus = "yes"
+	}
+	roles := make([]string, 0, len(e.Roles))
+	for _, r := range e.Roles {
+		roles = append(roles, r.Name)
+	}
+
+	access := make([][]string, 0)
+	for _, a := range e.Access {
+		for _, g := range a.Logins {
+			deniedBy := append(append([]string{}, a.DeniedBy...), g.DeniedBy...)
+			access = append(access, []string{stringNodes(a.Nodes), g.Login, strings.Join(g.Roles, ","), strings.Join(deniedBy, ",")})
+		}
+	}
+
+	deny := make([][]string, 0, len(e.Deny))
+	for _, d := range e.Deny {
+		deny = append(deny, []string{d.Role, strings.Join(d.Logins, ","), stringNodes(d.Nodes)})
+	}
+
+	return []output.Table{
+		{
+			Title:  "User",
+			Header: []string{"Name", "Locked", "Roles", "Effective Logins"},
+			Rows:   [][]string{{e.Name, lockedStatus, strings.Join(roles, ","), strings.Join(e.Logins, ",")}},
+		},
+		{
+			Title:  "Access",
+			Header: []string{"Node", "Login", "Granted By", "Denied By"},
+			Rows:   access,
+		},
+		{
+			Title:  "Deny",
+			Header: []string{"Role", "Denied Logins", "Denied Node"},
+			Rows:   deny,
+		},
+	}
+}
+
+func (reviews Reviews) Tables() []output.Table {
+	rows := make([][]string, 0, len(reviews))
+	for _, c := range reviews {
+		rows = append(rows, []string{
+			c.ID,
+			c.Owner,
+			c.State,
+			c.Created.Local().Format(time.RFC3339),
+			c.CreatedBy,
+			fmt.Sprintf("%d/%d", c.Pending(), len(c.Items)),
+		})
+	}
+	return []output.Table{{
+		Header: []string{"ID", "Owner", "State", "Created", "Created By", "Pending"},
+		Rows:   rows,
+	}}
+}
+
+func (d ReviewDetail) Tables() []output.Table {
+	closed := ""
+	if d.ClosedAt != nil {
+		closed = d.ClosedAt.Local().Format(time.RFC3339) + " by " + d.ClosedBy
+	}
+
+	items := make([][]string, 0, len(d.Items))
+	for _, item := range d.Items {
+		items = append(items, []string{item.User, item.Role, item.Reviewer, item.Decision, item.DecidedBy})
+	}
+	return []output.Table{
+		{
+			Title:  "Review",
+			Header: []string{"ID", "Owner", "State", "Created", "Created By", "Closed"},
+			Rows:   [][]string{{d.ID, d.Owner, d.State, d.Created.Local().Format(time.RFC3339), d.CreatedBy, closed}},
+		},
+		{
+			Title:  "Roles",
+			Header: []string{"User", "Role", "Reviewer", "Decision", "Decided By"},
+			Rows:   items,
+		},
+	}
+}
@@ -3,7 +3,78 @@ package config
 type Config struct {
 	ProxyHost        string `toml:"proxy_host"`
 	EnableEmailToken bool   `toml:"enable_email_token"`
-	SMTP             SMTPConfig
+	// PolicyFile lists the operators allowed to use tero.
+	// Default: /etc/tero-policy.toml
+	PolicyFile string `toml:"policy_file"`
+	// Storage is one of: dynamodb, etcd, dir, boltdb. Default: dynamodb
+	Storage  string
+	SMTP     SMTPConfig
+	DynamoDB DynamoDBConfig `toml:"dynamodb"`
+	Etcd     EtcdConfig
+	Dir      DirConfig
+	BoltDB   BoltDBConfig `toml:"boltdb"`
+
+	AccessRequests AccessRequestsConfig `toml:"access_requests"`
+	Audit          AuditConfig
+	Reviews        ReviewsConfig
+	Teleport       TeleportConfig
+}
+
+// TeleportConfig says how tero reaches the auth server to add and delete
+// users: through its API when AuthServer and Identity are both set, by
+// running tctl otherwise. tctl gets AuthServer and Identity as
+// --auth-server and --identity when set.
+type TeleportConfig struct {
+	// AuthServer is the host:port of the auth server
+	AuthServer string `toml:"auth_server"`
+	// Identity is a file made by `tctl auth sign --format=file`
+	Identity string
+	// Timeout of an API call or tctl run. Ex: 1m, default: 30s
+	Timeout string
+	// TctlPath is the tctl binary. Default: /usr/local/bin/tctl
+	TctlPath string `toml:"tctl_path"`
+	// TctlConfig is given to tctl as --config when set
+	TctlConfig string `toml:"tctl_config"`
+}
+
+type ReviewsConfig struct {
+	// Teams that review access, `tero review start --owner <team>`
+	Teams map[string]ReviewTeam
+	// SigningKey is the PKCS#8 PEM ed25519 key the report of a closed
+	// campaign is signed with
+	SigningKey string `toml:"signing_key"`
+	// Notify emails the reviewers when a campaign starts
+	Notify bool
+}
+
+type ReviewTeam struct {
+	// Reviewers may keep or revoke the roles of the campaign
+	Reviewers []string
+	// Roles the team owns, glob patterns. Ex: ["dba", "data-*"]
+	Roles []string
+}
+
+type AuditConfig struct {
+	// Sink is one of: backend, file, syslog. Default: backend
+	// The backend and file sinks chain their events by hash and keep the
+	// head of the chain apart, `tero audit ls` fails when an event was
+	// changed, added or removed. Syslog events are only as safe as the
+	// syslog server keeps them.
+	Sink string
+	// File is the JSON lines log of the file sink.
+	// Default: /var/log/tero/audit.jsonl
+	File string
+	// SyslogTag Default: tero
+	SyslogTag string `toml:"syslog_tag"`
+}
+
+type AccessRequestsConfig struct {
+	// Approvers lists who may approve requests for each role, the ones
+	// listed for "*" may approve requests for every role
+	Approvers map[string][]string
+	// Notify emails approvers about new requests and requesters about
+	// the decision
+	Notify bool
 }
 
 type SMTPConfig struct {
@@ -15,6 +86,48 @@ type SMTPConfig struct {
 	Port       int
 }
 
+type DynamoDBConfig struct {
+	Region    string
+	Endpoint  string
+	TableName string `toml:"table_name"`
+	// Credentials is one of: static, env, shared, instance.
+	// Leave it empty to use the default AWS credential chain.
+	Credentials string
+	AccessKey   string `toml:"access_key"`
+	SecretKey   string `toml:"secret_key"`
+	Profile     string
+	DisableSSL  bool `toml:"disable_ssl"`
+}
+
+type EtcdConfig struct {
+	Peers       []string
+	Prefix      string
+	TLSCertFile string `toml:"tls_cert_file"`
+	TLSKeyFile  string `toml:"tls_key_file"`
+	TLSCAFile   string `toml:"tls_ca_file"`
+	Username    string
+	Password    string
+	// DialTimeout in seconds
+	DialTimeout int `toml:"dial_timeout"`
+}
+
+type DirConfig struct {
+	Path string
+	// LockTimeout in seconds
+	LockTimeout int `toml:"lock_timeout"`
+	// PidFile of the auth server (teleport start --pid-file), tero refuses
+	// to write while the process in it runs
+	PidFile string `toml:"pid_file"`
+	// Force allows writes without a PidFile, it is set by --force
+	Force bool `toml:"-"`
+}
+
+type BoltDBConfig struct {
+	Path string
+	// LockTimeout in seconds
+	LockTimeout int `toml:"lock_timeout"`
+}
+
 var conf Config
 
 func Set(newConfig Config) {
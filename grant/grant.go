@@ -0,0 +1,41 @@
+package grant
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Prefix is where tero keeps time-boxed grants, next to the teleport
+// records: teleport/tero/grants/<role>/<user>
+const Prefix = "teleport/tero/grants/"
+
+// Grant records that Role was attached to User until Expires.
+type Grant struct {
+	Role      string    `json:"role" yaml:"role"`
+	User      string    `json:"user" yaml:"user"`
+	Expires   time.Time `json:"expires" yaml:"expires"`
+	GrantedAt time.Time `json:"granted_at" yaml:"granted_at"`
+}
+
+func Path(roleName, userName string) string {
+	return Prefix + roleName + "/" + userName
+}
+
+func (g *Grant) Path() string {
+	return Path(g.Role, g.User)
+}
+
+func (g *Grant) Expired(now time.Time) bool {
+	return !now.Before(g.Expires)
+}
+
+func (g *Grant) GetJSON() string {
+	out, _ := json.Marshal(g)
+	return string(out)
+}
+
+func FromJSON(rawJSON []byte) (Grant, error) {
+	g := Grant{}
+	err := json.Unmarshal(rawJSON, &g)
+	return g, err
+}
@@ -0,0 +1,28 @@
+package grant_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bentol/tero/grant"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromJSON_shouldReadWhatGetJSONWrites(t *testing.T) {
+	expires := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	g := grant.Grant{Role: "dba", User: "beni", Expires: expires, GrantedAt: expires.Add(-4 * time.Hour)}
+
+	parsed, err := grant.FromJSON([]byte(g.GetJSON()))
+	assert.Nil(t, err)
+	assert.Equal(t, g, parsed)
+	assert.Equal(t, "teleport/tero/grants/dba/beni", parsed.Path())
+}
+
+func TestExpired_shouldBeTrueFromExpiryOn(t *testing.T) {
+	expires := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	g := grant.Grant{Role: "dba", User: "beni", Expires: expires}
+
+	assert.False(t, g.Expired(expires.Add(-time.Second)))
+	assert.True(t, g.Expired(expires))
+	assert.True(t, g.Expired(expires.Add(time.Second)))
+}
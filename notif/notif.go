@@ -2,12 +2,20 @@ package notif
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/offboard"
+	"github.com/bentol/tero/request"
+	"github.com/bentol/tero/review"
 	"gopkg.in/gomail.v2"
 )
 
-func SentMailNewUser(username, recipient, stringToken string) error {
+// Deliver sends a plain text mail, tests replace it to catch what would
+// be sent.
+var Deliver = func(recipients []string, subject, body string) error {
 	smtpConf := config.Get().SMTP
 
 	SmtpUser := smtpConf.Username
@@ -16,10 +24,31 @@ func SentMailNewUser(username, recipient, stringToken string) error {
 	Port := smtpConf.Port
 	Sender := smtpConf.Sender
 	SenderName := smtpConf.SenderName
-	Subject := "Your teleport account"
 
 	m := gomail.NewMessage()
 
+	// Set the alternative part to plain text.
+	m.AddAlternative("text/plain", body)
+
+	// Construct the message headers, including a Configuration Set and a Tag.
+	m.SetHeaders(map[string][]string{
+		"From":    {m.FormatAddress(Sender, SenderName)},
+		"To":      recipients,
+		"Subject": {subject},
+	})
+
+	// Send the email.
+	d := gomail.NewPlainDialer(Host, Port, SmtpUser, SmtpPass)
+
+	return d.DialAndSend(m)
+}
+
+// Address is where mails for a teleport user go when no address is given.
+func Address(username string) string {
+	return username + "@tokopedia.com"
+}
+
+func SentMailNewUser(username, recipient, stringToken string) error {
 	body := fmt.Sprintf(
 		"Hi %s.\n\n"+
 			"You or your lead has requested teleport account for you.\n"+
@@ -31,22 +60,108 @@ func SentMailNewUser(username, recipient, stringToken string) error {
 		stringToken,
 	)
 
-	// Set the alternative part to plain text.
-	m.AddAlternative("text/plain", body)
+	return Deliver([]string{recipient}, "Your teleport account", body)
+}
 
-	// Construct the message headers, including a Configuration Set and a Tag.
-	m.SetHeaders(map[string][]string{
-		"From":    {m.FormatAddress(Sender, SenderName)},
-		"To":      {recipient},
-		"Subject": {Subject},
-	})
+func SentMailAccessRequest(approvers []string, r request.Request) error {
+	recipients := make([]string, 0, len(approvers))
+	for _, approver := range approvers {
+		recipients = append(recipients, Address(approver))
+	}
 
-	// Send the email.
-	d := gomail.NewPlainDialer(Host, Port, SmtpUser, SmtpPass)
+	body := fmt.Sprintf(
+		"Hi.\n\n"+
+			"%s requests role `%s` for %s.\n"+
+			"Reason: %s\n\n"+
+			"Approve it with: tero requests approve %s\n"+
+			"Deny it with: tero requests deny %s",
+		r.User,
+		r.Role,
+		r.Duration,
+		r.Reason,
+		r.ID,
+		r.ID,
+	)
+
+	return Deliver(recipients, fmt.Sprintf("Teleport access request from %s", r.User), body)
+}
+
+func SentMailAccessDecision(r request.Request) error {
+	body := fmt.Sprintf("Hi %s.\n\nYour request %s for role `%s` was %s by %s.", r.User, r.ID, r.Role, r.State, r.DecidedBy)
+	if r.Expires != nil {
+		body += fmt.Sprintf("\nThe role is detached again at %s.", r.Expires.Format(time.RFC3339))
+	}
+	if r.DenialReason != "" {
+		body += "\nReason: " + r.DenialReason
+	}
+
+	return Deliver([]string{Address(r.User)}, "Teleport access request "+r.State, body)
+}
+
+func SentMailReviewStarted(reviewer string, c review.Campaign, pending int) error {
+	body := fmt.Sprintf(
+		"Hi %s.\n\n"+
+			"Access review %s of team %s started, %d roles of users are waiting for your decision.\n\n"+
+			"See them with: tero review show %s\n"+
+			"Decide with: tero review keep %s <user> [<role>] or tero review revoke %s <user> [<role>]",
+		reviewer,
+		c.ID,
+		c.Owner,
+		pending,
+		c.ID,
+		c.ID,
+		c.ID,
+	)
 
-	if err := d.DialAndSend(m); err != nil {
-		return err
-	} else {
-		return nil
+	return Deliver([]string{Address(reviewer)}, fmt.Sprintf("Teleport access review %s of team %s", c.ID, c.Owner), body)
+}
+
+func SentMailReviewReminder(reviewer string, c review.Campaign, pending int) error {
+	body := fmt.Sprintf(
+		"Hi %s.\n\n"+
+			"Access review %s of team %s is still waiting for your decision on %d roles of users.\n\n"+
+			"See them with: tero review show %s",
+		reviewer,
+		c.ID,
+		c.Owner,
+		pending,
+		c.ID,
+	)
+
+	return Deliver([]string{Address(reviewer)}, fmt.Sprintf("Reminder: teleport access review %s", c.ID), body)
+}
+
+// SentMailOffboarding tells requester which users were offboarded, and
+// why the others failed.
+func SentMailOffboarding(requester string, done []offboard.Offboarding, failed map[string]string) error {
+	recipient := requester
+	if !strings.Contains(recipient, "@") {
+		recipient = Address(requester)
+	}
+
+	body := fmt.Sprintf("Hi %s.\n\n%d teleport users were offboarded as you requested.\n", requester, len(done))
+	for _, o := range done {
+		body += fmt.Sprintf("\n%s: locked, roles detached: %s", o.User, strings.Join(o.Roles, ","))
+		if o.TokenRevoked {
+			body += ", signup token revoked"
+		}
+		if o.DeleteAfter != nil {
+			body += fmt.Sprintf(", deleted after %s", o.DeleteAfter.Format(time.RFC3339))
+		}
+		body += "\nReason: " + o.Reason + "\n"
 	}
+
+	if len(failed) != 0 {
+		names := make([]string, 0, len(failed))
+		for name := range failed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		body += fmt.Sprintf("\n%d users could not be offboarded:\n", len(failed))
+		for _, name := range names {
+			body += fmt.Sprintf("%s: %s\n", name, failed[name])
+		}
+	}
+
+	return Deliver([]string{recipient}, fmt.Sprintf("Teleport offboarding of %d users", len(done)), body)
 }
@@ -0,0 +1,52 @@
+package offboard
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Prefix is where tero keeps the users that left:
+// teleport/tero/offboard/<user>
+const Prefix = "teleport/tero/offboard/"
+
+// Offboarding records that User was locked and lost Roles, and when `tero
+// reap` deletes the account.
+type Offboarding struct {
+	User      string    `json:"user" yaml:"user"`
+	Reason    string    `json:"reason" yaml:"reason"`
+	By        string    `json:"by" yaml:"by"`
+	Requester string    `json:"requester,omitempty" yaml:"requester,omitempty"`
+	At        time.Time `json:"at" yaml:"at"`
+	// Roles were detached from the user
+	Roles []string `json:"roles" yaml:"roles"`
+	// TokenRevoked is set when the user had not finished signing up
+	TokenRevoked bool `json:"token_revoked" yaml:"token_revoked"`
+	// DeleteAfter is the end of the grace period, the account stays
+	// locked for good when it is nil
+	DeleteAfter *time.Time `json:"delete_after,omitempty" yaml:"delete_after,omitempty"`
+	Deleted     *time.Time `json:"deleted,omitempty" yaml:"deleted,omitempty"`
+}
+
+func Path(userName string) string {
+	return Prefix + userName
+}
+
+func (o *Offboarding) Path() string {
+	return Path(o.User)
+}
+
+// Due reports whether the account has to be deleted by now.
+func (o *Offboarding) Due(now time.Time) bool {
+	return o.Deleted == nil && o.DeleteAfter != nil && !now.Before(*o.DeleteAfter)
+}
+
+func (o *Offboarding) GetJSON() string {
+	out, _ := json.Marshal(o)
+	return string(out)
+}
+
+func FromJSON(rawJSON []byte) (Offboarding, error) {
+	o := Offboarding{}
+	err := json.Unmarshal(rawJSON, &o)
+	return o, err
+}
@@ -0,0 +1,153 @@
+package output
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/olekukonko/tablewriter"
+	"gopkg.in/yaml.v2"
+)
+
+// Table is how a value looks in the table and csv formats.
+type Table struct {
+	Title  string
+	Header []string
+	Rows   [][]string
+	// MergeCells merges equal cells of a column, ex: the user name when a
+	// user has several roles
+	MergeCells bool
+	RowLine    bool
+}
+
+// Tabular is implemented by values that can be rendered as tables. The
+// json and yaml formats marshal the value itself.
+type Tabular interface {
+	Tables() []Table
+}
+
+// Message is the result of commands that only report what they did.
+type Message struct {
+	Message string `json:"message" yaml:"message"`
+}
+
+func (m Message) Tables() []Table {
+	return []Table{{
+		Header: []string{"Message"},
+		Rows:   [][]string{{m.Message}},
+	}}
+}
+
+type Formatter interface {
+	Format(w io.Writer, v interface{}) error
+}
+
+type FormatterFunc func(w io.Writer, v interface{}) error
+
+func (f FormatterFunc) Format(w io.Writer, v interface{}) error {
+	return f(w, v)
+}
+
+var formatters = map[string]Formatter{
+	"table": FormatterFunc(formatTable),
+	"json":  FormatterFunc(formatJSON),
+	"yaml":  FormatterFunc(formatYAML),
+	"csv":   FormatterFunc(formatCSV),
+}
+
+// Register adds a formatter, or replaces the one with the same name.
+func Register(name string, f Formatter) {
+	formatters[name] = f
+}
+
+func Names() []string {
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func Write(w io.Writer, format string, v interface{}) error {
+	f, ok := formatters[format]
+	if !ok {
+		return fmt.Errorf("Unknown output format `%s`", format)
+	}
+	return f.Format(w, v)
+}
+
+// String renders v in format, it is mostly useful in tests.
+func String(format string, v interface{}) (string, error) {
+	result := new(bytes.Buffer)
+	err := Write(result, format, v)
+	return result.String(), err
+}
+
+func formatTable(w io.Writer, v interface{}) error {
+	if m, ok := v.(Message); ok {
+		_, err := fmt.Fprintln(w, m.Message)
+		return err
+	}
+	t, ok := v.(Tabular)
+	if !ok {
+		return fmt.Errorf("Cannot render %T as a table", v)
+	}
+
+	for i, data := range t.Tables() {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		if data.Title != "" {
+			fmt.Fprintln(w, data.Title)
+		}
+
+		table := tablewriter.NewWriter(w)
+		table.SetHeader(data.Header)
+		table.SetAutoMergeCells(data.MergeCells)
+		table.SetRowLine(data.RowLine)
+		table.AppendBulk(data.Rows)
+		table.Render()
+	}
+	return nil
+}
+
+// formatCSV writes one csv block per table, blocks are separated by an
+// empty line.
+func formatCSV(w io.Writer, v interface{}) error {
+	t, ok := v.(Tabular)
+	if !ok {
+		return fmt.Errorf("Cannot render %T as csv", v)
+	}
+
+	for i, data := range t.Tables() {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		writer := csv.NewWriter(w)
+		writer.Write(data.Header)
+		writer.WriteAll(data.Rows)
+		if err := writer.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func formatYAML(w io.Writer, v interface{}) error {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
@@ -0,0 +1,79 @@
+package output_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/bentol/tero/output"
+	"github.com/stretchr/testify/assert"
+)
+
+type roles []struct {
+	Name   string   `json:"name" yaml:"name"`
+	Logins []string `json:"logins" yaml:"logins"`
+}
+
+func (r roles) Tables() []output.Table {
+	rows := make([][]string, 0)
+	for _, v := range r {
+		rows = append(rows, []string{v.Name, v.Logins[0]})
+	}
+	return []output.Table{{Header: []string{"Role", "Login"}, Rows: rows}}
+}
+
+var data = roles{
+	{Name: "admin", Logins: []string{"root"}},
+	{Name: "dba", Logins: []string{"postgres"}},
+}
+
+func TestWrite_shouldRenderEveryFormat(t *testing.T) {
+	out, err := output.String("table", data)
+	assert.Nil(t, err)
+	assert.Contains(t, out, "| ROLE  |  LOGIN   |")
+	assert.Contains(t, out, "| dba   | postgres |")
+
+	out, err = output.String("csv", data)
+	assert.Nil(t, err)
+	assert.Equal(t, "Role,Login\nadmin,root\ndba,postgres\n", out)
+
+	out, err = output.String("json", data)
+	assert.Nil(t, err)
+	assert.Contains(t, out, `"name": "admin"`)
+	assert.Contains(t, out, `"logins": [`)
+
+	out, err = output.String("yaml", data)
+	assert.Nil(t, err)
+	assert.Contains(t, out, "- name: dba\n  logins:\n  - postgres\n")
+}
+
+func TestWrite_shouldPrintMessageAsPlainText(t *testing.T) {
+	msg := output.Message{Message: "Role `dba` deleted!"}
+
+	out, err := output.String("table", msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "Role `dba` deleted!\n", out)
+
+	out, err = output.String("json", msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\n  \"message\": \"Role `dba` deleted!\"\n}\n", out)
+}
+
+func TestWrite_shouldErrorOnUnknownFormat(t *testing.T) {
+	_, err := output.String("xml", data)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Unknown output format `xml`")
+}
+
+func TestRegister_shouldAddFormatter(t *testing.T) {
+	output.Register("names", output.FormatterFunc(func(w io.Writer, v interface{}) error {
+		for _, r := range v.(roles) {
+			io.WriteString(w, r.Name+"\n")
+		}
+		return nil
+	}))
+	assert.Contains(t, output.Names(), "names")
+
+	out, err := output.String("names", data)
+	assert.Nil(t, err)
+	assert.Equal(t, "admin\ndba\n", out)
+}
@@ -0,0 +1,62 @@
+package request
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Prefix is where tero keeps access requests: teleport/tero/requests/<id>
+const Prefix = "teleport/tero/requests/"
+
+const (
+	Pending  = "pending"
+	Approved = "approved"
+	Denied   = "denied"
+)
+
+// Request is a user asking for Role during Duration, ex: for an incident.
+type Request struct {
+	ID       string    `json:"id" yaml:"id"`
+	Role     string    `json:"role" yaml:"role"`
+	User     string    `json:"user" yaml:"user"`
+	Reason   string    `json:"reason" yaml:"reason"`
+	Duration string    `json:"duration" yaml:"duration"`
+	State    string    `json:"state" yaml:"state"`
+	Created  time.Time `json:"created" yaml:"created"`
+	// set once the request is approved or denied
+	DecidedBy    string     `json:"decided_by,omitempty" yaml:"decided_by,omitempty"`
+	DecidedAt    *time.Time `json:"decided_at,omitempty" yaml:"decided_at,omitempty"`
+	DenialReason string     `json:"denial_reason,omitempty" yaml:"denial_reason,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty" yaml:"expires,omitempty"`
+}
+
+// New returns a pending request, it gets its ID from backend.SaveRequest.
+func New(roleName, userName, reason string, duration time.Duration, now time.Time) Request {
+	return Request{
+		Role:     roleName,
+		User:     userName,
+		Reason:   reason,
+		Duration: duration.String(),
+		State:    Pending,
+		Created:  now,
+	}
+}
+
+func Path(id string) string {
+	return Prefix + id
+}
+
+func (r *Request) Path() string {
+	return Path(r.ID)
+}
+
+func (r *Request) GetJSON() string {
+	out, _ := json.Marshal(r)
+	return string(out)
+}
+
+func FromJSON(rawJSON []byte) (Request, error) {
+	r := Request{}
+	err := json.Unmarshal(rawJSON, &r)
+	return r, err
+}
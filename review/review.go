@@ -0,0 +1,189 @@
+package review
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Prefix is where tero keeps review campaigns: teleport/tero/reviews/<id>
+const Prefix = "teleport/tero/reviews/"
+
+const (
+	Open   = "open"
+	Closed = "closed"
+)
+
+const (
+	Pending = "pending"
+	Keep    = "keep"
+	Revoke  = "revoke"
+)
+
+// Campaign is a snapshot of the user roles a team owns, every one of them
+// has to be kept or revoked before the campaign is closed.
+type Campaign struct {
+	ID        string     `json:"id" yaml:"id"`
+	Owner     string     `json:"owner" yaml:"owner"`
+	State     string     `json:"state" yaml:"state"`
+	Created   time.Time  `json:"created" yaml:"created"`
+	CreatedBy string     `json:"created_by" yaml:"created_by"`
+	ClosedAt  *time.Time `json:"closed_at,omitempty" yaml:"closed_at,omitempty"`
+	ClosedBy  string     `json:"closed_by,omitempty" yaml:"closed_by,omitempty"`
+	Items     []Item     `json:"items" yaml:"items"`
+}
+
+// Item is a role of a user, Reviewer is who is reminded to decide on it.
+type Item struct {
+	User      string     `json:"user" yaml:"user"`
+	Role      string     `json:"role" yaml:"role"`
+	Reviewer  string     `json:"reviewer" yaml:"reviewer"`
+	Decision  string     `json:"decision" yaml:"decision"`
+	DecidedBy string     `json:"decided_by,omitempty" yaml:"decided_by,omitempty"`
+	DecidedAt *time.Time `json:"decided_at,omitempty" yaml:"decided_at,omitempty"`
+}
+
+// New returns an open campaign, it gets its ID from backend.SaveCampaign.
+func New(owner, createdBy string, items []Item, now time.Time) Campaign {
+	return Campaign{
+		Owner:     owner,
+		State:     Open,
+		Created:   now,
+		CreatedBy: createdBy,
+		Items:     items,
+	}
+}
+
+// PendingBy returns how many items are waiting for each reviewer.
+func (c *Campaign) PendingBy() map[string]int {
+	result := make(map[string]int)
+	for _, item := range c.Items {
+		if item.Decision == Pending {
+			result[item.Reviewer]++
+		}
+	}
+	return result
+}
+
+func (c *Campaign) Pending() int {
+	count := 0
+	for _, n := range c.PendingBy() {
+		count += n
+	}
+	return count
+}
+
+func Path(id string) string {
+	return Prefix + id
+}
+
+func (c *Campaign) Path() string {
+	return Path(c.ID)
+}
+
+func (c *Campaign) GetJSON() string {
+	out, _ := json.Marshal(c)
+	return string(out)
+}
+
+func FromJSON(rawJSON []byte) (Campaign, error) {
+	c := Campaign{}
+	err := json.Unmarshal(rawJSON, &c)
+	return c, err
+}
+
+// Report is a closed campaign signed with ed25519, Signature is over the
+// compact JSON of Campaign so the report may be indented.
+type Report struct {
+	Campaign  json.RawMessage `json:"campaign"`
+	SignedAt  time.Time       `json:"signed_at"`
+	Signature string          `json:"signature"`
+}
+
+func Sign(c Campaign, key ed25519.PrivateKey, now time.Time) (Report, error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return Report{}, err
+	}
+	return Report{
+		Campaign:  raw,
+		SignedAt:  now,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, raw)),
+	}, nil
+}
+
+// Verify returns the campaign of the report if it was signed by the
+// private key of pub.
+func Verify(r Report, pub ed25519.PublicKey) (*Campaign, error) {
+	signature, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid signature: %s", err)
+	}
+	signed := bytes.Buffer{}
+	if err := json.Compact(&signed, r.Campaign); err != nil {
+		return nil, fmt.Errorf("Invalid campaign in report: %s", err)
+	}
+	if !ed25519.Verify(pub, signed.Bytes(), signature) {
+		return nil, errors.New("Signature does not match the report, it was changed or signed with another key")
+	}
+	c, err := FromJSON(r.Campaign)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// LoadPrivateKey reads a PKCS#8 PEM ed25519 key, ex: from
+// `openssl genpkey -algorithm ed25519`.
+func LoadPrivateKey(file string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid private key %s: %s", file, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Private key %s is not an ed25519 key", file)
+	}
+	return edKey, nil
+}
+
+// LoadPublicKey reads a PKIX PEM ed25519 key, ex: from
+// `openssl pkey -in key.pem -pubout`.
+func LoadPublicKey(file string) (ed25519.PublicKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid public key %s: %s", file, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Public key %s is not an ed25519 key", file)
+	}
+	return edKey, nil
+}
+
+func readPEM(file string) (*pem.Block, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", file)
+	}
+	return block, nil
+}
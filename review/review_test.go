@@ -0,0 +1,63 @@
+package review_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bentol/tero/review"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSign_shouldBeVerifiedWithPublicKey(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	c := review.New("sre", "hulk", []review.Item{{User: "beni", Role: "dba", Reviewer: "hulk", Decision: review.Revoke}}, time.Now().UTC())
+
+	report, err := review.Sign(c, key, time.Now().UTC())
+	assert.Nil(t, err)
+	verified, err := review.Verify(report, pub)
+	assert.Nil(t, err)
+	assert.Equal(t, c.Items, verified.Items)
+
+	report.Campaign = []byte(`{"id":"` + c.ID + `","owner":"sre","items":[]}`)
+	_, err = review.Verify(report, pub)
+	assert.NotNil(t, err)
+
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	report, _ = review.Sign(c, key, time.Now().UTC())
+	_, err = review.Verify(report, otherPub)
+	assert.NotNil(t, err)
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tero-review")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	rawKey, _ := x509.MarshalPKCS8PrivateKey(key)
+	rawPub, _ := x509.MarshalPKIXPublicKey(pub)
+	keyFile := filepath.Join(dir, "key.pem")
+	pubFile := filepath.Join(dir, "pub.pem")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: rawKey}), 0600)
+	ioutil.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rawPub}), 0600)
+
+	loadedKey, err := review.LoadPrivateKey(keyFile)
+	assert.Nil(t, err)
+	assert.Equal(t, key, loadedKey)
+	loadedPub, err := review.LoadPublicKey(pubFile)
+	assert.Nil(t, err)
+	assert.Equal(t, pub, loadedPub)
+
+	_, err = review.LoadPrivateKey(pubFile)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,102 @@
+package role
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Jeffail/gabs"
+)
+
+// Wildcard matches any label key, label value or login, as in teleport.
+const Wildcard = "*"
+
+var traitPattern = regexp.MustCompile(`^\{\{(internal|external)\.([\w-]+)\}\}$`)
+
+// AllowsNode reports whether the allowed node labels of the role select a
+// node with the given labels.
+func (r *Role) AllowsNode(labels map[string]string) bool {
+	return MatchLabels(r.nodeSelector("allow", r.NodePatterns), labels)
+}
+
+// DeniesNode reports whether the denied node labels of the role select a
+// node with the given labels, teleport then refuses every login to it.
+func (r *Role) DeniesNode(labels map[string]string) bool {
+	return MatchLabels(r.nodeSelector("deny", r.Deny.NodeLabels), labels)
+}
+
+// MatchLabels follows teleport: every key of selector must be a label of
+// the node with a matching value, `*: *` selects every node and an empty
+// selector none. A value is a glob, or a regex when wrapped in ^ and $.
+func MatchLabels(selector map[string][]string, labels map[string]string) bool {
+	if len(selector) == 0 {
+		return false
+	}
+	for key, values := range selector {
+		if key == Wildcard {
+			return len(values) == 1 && values[0] == Wildcard
+		}
+		value, ok := labels[key]
+		if !ok {
+			return false
+		}
+		if !matchAnyValue(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAnyValue(expressions []string, value string) bool {
+	for _, expr := range expressions {
+		if expr == Wildcard {
+			return true
+		}
+		if !strings.HasPrefix(expr, "^") || !strings.HasSuffix(expr, "$") {
+			expr = "^" + strings.Replace(regexp.QuoteMeta(expr), `\*`, "(.*)", -1) + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err == nil && re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpandLogins replaces the {{internal.<trait>}} and {{external.<trait>}}
+// logins with the values of that trait of the user.
+func ExpandLogins(logins []string, traits map[string][]string) []string {
+	result := make([]string, 0, len(logins))
+	for _, login := range logins {
+		m := traitPattern.FindStringSubmatch(login)
+		if m == nil {
+			result = append(result, login)
+			continue
+		}
+		result = append(result, traits[m[2]]...)
+	}
+	return result
+}
+
+// IsTrait reports whether login is filled from a user trait.
+func IsTrait(login string) bool {
+	return traitPattern.MatchString(login)
+}
+
+// nodeSelector returns labels with their list of values, teleport takes a
+// list where parseConditions keeps it printed as one string.
+func (r *Role) nodeSelector(condition string, labels map[string]string) map[string][]string {
+	var raw map[string]interface{}
+	if parsed, err := gabs.ParseJSON(r.Raw); err == nil {
+		raw, _ = parsed.Path("spec." + condition + ".node_labels").Data().(map[string]interface{})
+	}
+
+	selector := make(map[string][]string, len(labels))
+	for k, v := range labels {
+		selector[k] = []string{v}
+		if list, ok := raw[k].([]interface{}); ok && fmt.Sprint(list) == v {
+			selector[k] = toStrings(list)
+		}
+	}
+	return selector
+}
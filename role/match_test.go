@@ -0,0 +1,41 @@
+package role_test
+
+import (
+	"testing"
+
+	"github.com/bentol/tero/role"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchLabels(t *testing.T) {
+	node := map[string]string{"env": "production", "app": "postgres-main"}
+
+	assert.True(t, role.MatchLabels(map[string][]string{"*": {"*"}}, node))
+	assert.True(t, role.MatchLabels(map[string][]string{"env": {"production"}}, node))
+	assert.True(t, role.MatchLabels(map[string][]string{"env": {"*"}, "app": {"postgres-*"}}, node))
+	assert.True(t, role.MatchLabels(map[string][]string{"app": {`^postgres-(main|replica)$`}}, node))
+	assert.True(t, role.MatchLabels(map[string][]string{"env": {"staging", "production"}}, node))
+
+	assert.False(t, role.MatchLabels(map[string][]string{}, node))
+	assert.False(t, role.MatchLabels(map[string][]string{"env": {"staging"}}, node))
+	assert.False(t, role.MatchLabels(map[string][]string{"env": {"production"}, "team": {"*"}}, node))
+	assert.False(t, role.MatchLabels(map[string][]string{"app": {"postgres"}}, node))
+	assert.False(t, role.MatchLabels(map[string][]string{"app": {`^mysql-.*$`}}, node))
+}
+
+func TestAllowsNode_shouldReadListValuesFromRecord(t *testing.T) {
+	r, err := role.FromJSON([]byte(teleportRole))
+	assert.Nil(t, err)
+
+	assert.True(t, r.AllowsNode(map[string]string{"app": "postgres", "env": "staging"}))
+	assert.True(t, r.AllowsNode(map[string]string{"app": "postgres", "env": "production"}))
+	assert.False(t, r.AllowsNode(map[string]string{"app": "postgres", "env": "dev"}))
+	assert.False(t, r.DeniesNode(map[string]string{"app": "postgres", "env": "production"}))
+}
+
+func TestExpandLogins(t *testing.T) {
+	traits := map[string][]string{"logins": {"ubuntu", "beni"}}
+
+	assert.Equal(t, []string{"root", "ubuntu", "beni"}, role.ExpandLogins([]string{"root", "{{internal.logins}}"}, traits))
+	assert.Equal(t, []string{}, role.ExpandLogins([]string{"{{external.unknown}}"}, traits))
+}
@@ -1,7 +1,9 @@
 package role
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"sort"
 	"strings"
 
@@ -9,13 +11,43 @@ import (
 )
 
 var (
-	RoleJsonTemplate string = `{"kind":"role","version":"v3","metadata":{"name":"new_role"},"spec":{"options":{"max_session_ttl":"30h0m0s"},"allow":{"logins":["tmp"],"node_labels":{"tmp":"tmp"},"rules":[{"resources":["role"],"verbs":["list","create","read","update","delete"]},{"resources":["auth_connector"],"verbs":["list","create","read","update","delete"]},{"resources":["session"],"verbs":["list","read"]},{"resources":["trusted_cluster"],"verbs":["list","create","read","update","delete"]}]},"deny":{}}}`
+	// RoleJsonTemplate is the base of a new role, it grants no resource
+	// rules, those have to be given explicitly
+	RoleJsonTemplate string = `{"kind":"role","version":"v3","metadata":{"name":"new_role"},"spec":{"options":{"max_session_ttl":"30h0m0s"},"allow":{"logins":["tmp"],"node_labels":{"tmp":"tmp"},"rules":[]},"deny":{}}}`
 )
 
+// Role is the part of a teleport role tero manages. A nil slice, map or
+// pointer and an empty string mean "not set": GetJSON leaves that field
+// of the record as it is.
 type Role struct {
 	Name          string
 	NodePatterns  map[string]string
 	AllowedLogins []string
+	AllowRules    []Rule
+	Deny          Conditions
+	Options       Options
+	// Raw is the record this role was read from, fields tero does not
+	// know about are kept from it.
+	Raw []byte
+}
+
+type Conditions struct {
+	Logins     []string
+	NodeLabels map[string]string
+	Rules      []Rule
+}
+
+type Rule struct {
+	Resources []string
+	Verbs     []string
+	Where     string
+}
+
+type Options struct {
+	MaxSessionTTL  string
+	ForwardAgent   *bool
+	PortForwarding *bool
+	CertFormat     string
 }
 
 func (r *Role) StringAllowedLogins() string {
@@ -25,18 +57,166 @@ func (r *Role) StringAllowedLogins() string {
 }
 
 func (r *Role) StringNodePatterns() string {
+	return stringLabels(r.NodePatterns)
+}
+
+func (c *Conditions) StringLogins() string {
+	logins := append([]string(nil), c.Logins...)
+	sort.Strings(logins)
+	return strings.Join(logins, ",")
+}
+
+func (c *Conditions) StringNodeLabels() string {
+	return stringLabels(c.NodeLabels)
+}
+
+func (rule *Rule) String() string {
+	s := strings.Join(rule.Resources, ",") + ":" + strings.Join(rule.Verbs, ",")
+	if rule.Where != "" {
+		s += ":" + rule.Where
+	}
+	return s
+}
+
+func stringLabels(labels map[string]string) string {
 	listNodes := make([]string, 0)
-	for k, v := range r.NodePatterns {
+	for k, v := range labels {
 		listNodes = append(listNodes, fmt.Sprintf("%s:%s", k, v))
 	}
+	sort.Strings(listNodes)
 
 	return strings.Join(listNodes, ",")
 }
 
 func (r *Role) GetJSON() string {
-	jsonTemplate, _ := gabs.ParseJSON([]byte(RoleJsonTemplate))
+	base := r.Raw
+	if len(base) == 0 {
+		base = []byte(RoleJsonTemplate)
+	}
+	jsonTemplate, err := gabs.ParseJSON(base)
+	if err != nil {
+		base = []byte(RoleJsonTemplate)
+		jsonTemplate, _ = gabs.ParseJSON(base)
+	}
+
+	// only write what differs from the base record, so values tero can
+	// not represent (ex: a list of label values) survive untouched
+	orig, _ := FromJSON(base)
+	set := func(changed bool, value interface{}, path string) {
+		if changed {
+			jsonTemplate.SetP(value, path)
+		}
+	}
+
 	jsonTemplate.SetP(r.Name, "metadata.name")
-	jsonTemplate.SetP(r.AllowedLogins, "spec.allow.logins")
-	jsonTemplate.SetP(r.NodePatterns, "spec.allow.node_labels")
+	set(r.AllowedLogins != nil && !reflect.DeepEqual(r.AllowedLogins, orig.AllowedLogins), r.AllowedLogins, "spec.allow.logins")
+	set(r.NodePatterns != nil && !reflect.DeepEqual(r.NodePatterns, orig.NodePatterns), r.NodePatterns, "spec.allow.node_labels")
+	set(r.AllowRules != nil && !reflect.DeepEqual(r.AllowRules, orig.AllowRules), rulesToJSON(r.AllowRules), "spec.allow.rules")
+	set(r.Deny.Logins != nil && !reflect.DeepEqual(r.Deny.Logins, orig.Deny.Logins), r.Deny.Logins, "spec.deny.logins")
+	set(r.Deny.NodeLabels != nil && !reflect.DeepEqual(r.Deny.NodeLabels, orig.Deny.NodeLabels), r.Deny.NodeLabels, "spec.deny.node_labels")
+	set(r.Deny.Rules != nil && !reflect.DeepEqual(r.Deny.Rules, orig.Deny.Rules), rulesToJSON(r.Deny.Rules), "spec.deny.rules")
+	set(r.Options.MaxSessionTTL != "", r.Options.MaxSessionTTL, "spec.options.max_session_ttl")
+	set(r.Options.CertFormat != "", r.Options.CertFormat, "spec.options.cert_format")
+	if r.Options.ForwardAgent != nil {
+		jsonTemplate.SetP(*r.Options.ForwardAgent, "spec.options.forward_agent")
+	}
+	if r.Options.PortForwarding != nil {
+		jsonTemplate.SetP(*r.Options.PortForwarding, "spec.options.port_forwarding")
+	}
 	return jsonTemplate.String()
 }
+
+func rulesToJSON(rules []Rule) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, len(rules))
+	for _, rule := range rules {
+		raw := map[string]interface{}{
+			"resources": rule.Resources,
+			"verbs":     rule.Verbs,
+		}
+		if rule.Where != "" {
+			raw["where"] = rule.Where
+		}
+		result = append(result, raw)
+	}
+	return result
+}
+
+func FromJSON(rawJSON []byte) (Role, error) {
+	rawRole, err := gabs.ParseJSON(rawJSON)
+	if err != nil {
+		return Role{}, err
+	}
+
+	name, ok := rawRole.Path("metadata.name").Data().(string)
+	if !ok {
+		return Role{}, errors.New("Role record has no metadata.name")
+	}
+
+	allow := parseConditions(rawRole.Path("spec.allow"))
+	if allow.Logins == nil {
+		allow.Logins = make([]string, 0)
+	}
+	if allow.NodeLabels == nil {
+		allow.NodeLabels = make(map[string]string)
+	}
+
+	options := Options{}
+	options.MaxSessionTTL, _ = rawRole.Path("spec.options.max_session_ttl").Data().(string)
+	options.CertFormat, _ = rawRole.Path("spec.options.cert_format").Data().(string)
+	if forwardAgent, ok := rawRole.Path("spec.options.forward_agent").Data().(bool); ok {
+		options.ForwardAgent = &forwardAgent
+	}
+	if portForwarding, ok := rawRole.Path("spec.options.port_forwarding").Data().(bool); ok {
+		options.PortForwarding = &portForwarding
+	}
+
+	return Role{
+		Name:          name,
+		NodePatterns:  allow.NodeLabels,
+		AllowedLogins: allow.Logins,
+		AllowRules:    allow.Rules,
+		Deny:          parseConditions(rawRole.Path("spec.deny")),
+		Options:       options,
+		Raw:           rawJSON,
+	}, nil
+}
+
+func parseConditions(raw *gabs.Container) Conditions {
+	conditions := Conditions{}
+
+	if rawNodeLabels, ok := raw.Path("node_labels").Data().(map[string]interface{}); ok {
+		conditions.NodeLabels = make(map[string]string)
+		for k, v := range rawNodeLabels {
+			conditions.NodeLabels[k] = fmt.Sprint(v)
+		}
+	}
+
+	if rawLogins, ok := raw.Path("logins").Data().([]interface{}); ok {
+		conditions.Logins = toStrings(rawLogins)
+	}
+
+	if rawRules, ok := raw.Path("rules").Data().([]interface{}); ok {
+		conditions.Rules = make([]Rule, 0)
+		for _, rawRule := range rawRules {
+			ruleMap, _ := rawRule.(map[string]interface{})
+			resources, _ := ruleMap["resources"].([]interface{})
+			verbs, _ := ruleMap["verbs"].([]interface{})
+			where, _ := ruleMap["where"].(string)
+			conditions.Rules = append(conditions.Rules, Rule{
+				Resources: toStrings(resources),
+				Verbs:     toStrings(verbs),
+				Where:     where,
+			})
+		}
+	}
+
+	return conditions
+}
+
+func toStrings(raw []interface{}) []string {
+	result := make([]string, 0, len(raw))
+	for _, v := range raw {
+		result = append(result, fmt.Sprint(v))
+	}
+	return result
+}
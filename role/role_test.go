@@ -0,0 +1,61 @@
+package role_test
+
+import (
+	"testing"
+
+	"github.com/Jeffail/gabs"
+	"github.com/bentol/tero/role"
+	"github.com/stretchr/testify/assert"
+)
+
+const teleportRole = `{"kind":"role","version":"v3","metadata":{"name":"dba","labels":{"team":"data"}},"spec":{"options":{"max_session_ttl":"8h0m0s","forward_agent":true,"client_idle_timeout":"15m"},"allow":{"logins":["postgres"],"node_labels":{"app":"postgres","env":["staging","production"]},"rules":[{"resources":["session"],"verbs":["list","read"]}],"kubernetes_groups":["viewers"]},"deny":{"logins":["root"],"rules":[{"resources":["role"],"verbs":["create"],"where":"contains(user.spec.traits[\"groups\"], \"intern\")"}]}}}`
+
+func TestFromJSON_shouldParseAllowDenyAndOptions(t *testing.T) {
+	r, err := role.FromJSON([]byte(teleportRole))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "dba", r.Name)
+	assert.Equal(t, []string{"postgres"}, r.AllowedLogins)
+	assert.Equal(t, "postgres", r.NodePatterns["app"])
+	assert.Equal(t, []role.Rule{{Resources: []string{"session"}, Verbs: []string{"list", "read"}}}, r.AllowRules)
+	assert.Equal(t, []string{"root"}, r.Deny.Logins)
+	assert.Equal(t, `contains(user.spec.traits["groups"], "intern")`, r.Deny.Rules[0].Where)
+	assert.Equal(t, "8h0m0s", r.Options.MaxSessionTTL)
+	assert.True(t, *r.Options.ForwardAgent)
+	assert.Nil(t, r.Options.PortForwarding)
+}
+
+func TestGetJSON_shouldKeepFieldsThatWereNotChanged(t *testing.T) {
+	r, _ := role.FromJSON([]byte(teleportRole))
+	r.AllowedLogins = []string{"postgres", "ubuntu"}
+	portForwarding := false
+	r.Options.PortForwarding = &portForwarding
+
+	json, _ := gabs.ParseJSON([]byte(r.GetJSON()))
+	assert.Equal(t, []interface{}{"postgres", "ubuntu"}, json.Path("spec.allow.logins").Data())
+	assert.Equal(t, false, json.Path("spec.options.port_forwarding").Data())
+
+	assert.Equal(t, []interface{}{"staging", "production"}, json.Path("spec.allow.node_labels.env").Data())
+	assert.Equal(t, []interface{}{"viewers"}, json.Path("spec.allow.kubernetes_groups").Data())
+	assert.Equal(t, []interface{}{"root"}, json.Path("spec.deny.logins").Data())
+	assert.Equal(t, "create", json.Path("spec.deny.rules").Index(0).Path("verbs").Index(0).Data())
+	assert.Equal(t, "15m", json.Path("spec.options.client_idle_timeout").Data())
+	assert.Equal(t, "8h0m0s", json.Path("spec.options.max_session_ttl").Data())
+	assert.Equal(t, "data", json.Path("metadata.labels.team").Data())
+}
+
+func TestGetJSON_shouldUseTemplateForNewRole(t *testing.T) {
+	r := role.Role{
+		Name:          "intern",
+		AllowedLogins: []string{"ubuntu"},
+		NodePatterns:  map[string]string{"env": "staging"},
+		Deny:          role.Conditions{Logins: []string{"root"}},
+	}
+
+	json, _ := gabs.ParseJSON([]byte(r.GetJSON()))
+	assert.Equal(t, "intern", json.Path("metadata.name").Data())
+	assert.Equal(t, []interface{}{"ubuntu"}, json.Path("spec.allow.logins").Data())
+	assert.Equal(t, map[string]interface{}{"env": "staging"}, json.Path("spec.allow.node_labels").Data())
+	assert.Equal(t, []interface{}{"root"}, json.Path("spec.deny.logins").Data())
+	assert.Equal(t, "30h0m0s", json.Path("spec.options.max_session_ttl").Data())
+}
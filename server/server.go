@@ -0,0 +1,586 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Jeffail/gabs"
+	"github.com/bentol/tero/auth"
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/client"
+	"github.com/bentol/tero/output"
+	"github.com/bentol/tero/role"
+	"github.com/bentol/tero/token"
+)
+
+// RoleRequest is the body of POST /roles and PATCH /roles/<name>. On
+// update only the fields that are given are changed.
+type RoleRequest struct {
+	Name       string             `json:"name"`
+	Logins     []string           `json:"logins"`
+	Nodes      map[string]string  `json:"nodes"`
+	DenyLogins []string           `json:"deny_logins"`
+	DenyNodes  map[string]string  `json:"deny_nodes"`
+	AllowRules []client.RuleInfo  `json:"allow_rules"`
+	DenyRules  []client.RuleInfo  `json:"deny_rules"`
+	Options    client.OptionsInfo `json:"options"`
+}
+
+// UserRequest is the body of POST /users.
+type UserRequest struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+	Email string   `json:"email"`
+}
+
+// AttachRequest is the body of POST /roles/<name>/attach and detach. For
+// (ex: 4h) or Until (RFC3339) make the attach time-boxed.
+type AttachRequest struct {
+	Users []string `json:"users"`
+	For   string   `json:"for"`
+	Until string   `json:"until"`
+}
+
+// ResetRequest is the body of POST /users/<name>/reset.
+type ResetRequest struct {
+	Email string `json:"email"`
+}
+
+type TokenInfo struct {
+	Token string   `json:"token"`
+	User  string   `json:"user"`
+	Roles []string `json:"roles"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// apiError carries the status code an error is answered with, other
+// errors are answered with 500.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, a ...interface{}) error {
+	return &apiError{http.StatusBadRequest, fmt.Sprintf(format, a...)}
+}
+
+func notFound(format string, a ...interface{}) error {
+	return &apiError{http.StatusNotFound, fmt.Sprintf(format, a...)}
+}
+
+func conflict(format string, a ...interface{}) error {
+	return &apiError{http.StatusConflict, fmt.Sprintf(format, a...)}
+}
+
+var errMethodNotAllowed = &apiError{http.StatusMethodNotAllowed, "Method not allowed"}
+
+// handler returns the status and the value to answer with as json, op is
+// the operator that sent the request.
+type handler func(r *http.Request, op *auth.Operator, path []string) (int, interface{}, error)
+
+type route struct {
+	policy *auth.Policy
+	handle handler
+}
+
+func (rt route) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var status int
+	var body interface{}
+	op, err := identify(rt.policy, r)
+	if err == nil {
+		status, body, err = rt.handle(r, op, path)
+	}
+	if err != nil {
+		status = http.StatusInternalServerError
+		if e, ok := err.(*apiError); ok {
+			status = e.status
+		} else if e, ok := err.(*auth.DeniedError); ok {
+			status = http.StatusForbidden
+			if e.Unknown {
+				status = http.StatusUnauthorized
+			}
+		} else if _, ok := err.(*backend.InvalidError); ok {
+			status = http.StatusBadRequest
+		} else if _, ok := err.(*backend.NotFoundError); ok {
+			status = http.StatusNotFound
+		} else if err == backend.ErrConflict {
+			status = http.StatusConflict
+		}
+		body = ErrorResponse{Error: err.Error()}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// New returns the handler of the tero REST API:
+//
+//	GET    /roles                     list roles
+//	POST   /roles                     create role
+//	GET    /roles/<name>              show role
+//	PATCH  /roles/<name>              update role
+//	DELETE /roles/<name>              delete role
+//	POST   /roles/<name>/attach       attach role to users
+//	POST   /roles/<name>/detach       detach role from users
+//	GET    /users                     list users
+//	POST   /users                     add user and send the registration link
+//	GET    /users/<name>              show user
+//	DELETE /users/<name>              delete user
+//	POST   /users/<name>/lock         lock user
+//	POST   /users/<name>/unlock       unlock user
+//	POST   /users/<name>/reset        reset user
+//	GET    /users/<name>/token        pending add user token of user
+//	GET    /tokens/<token>            add user token
+//
+// Every request must come from an operator of policy, identified by an
+// `Authorization: Bearer <token>` header or by a verified client
+// certificate.
+func New(policy *auth.Policy) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/roles", route{policy, roles})
+	mux.Handle("/roles/", route{policy, roles})
+	mux.Handle("/users", route{policy, users})
+	mux.Handle("/users/", route{policy, users})
+	mux.Handle("/tokens/", route{policy, tokens})
+	mux.Handle("/", route{policy, func(r *http.Request, op *auth.Operator, path []string) (int, interface{}, error) {
+		return 0, nil, notFound("Unknown path `%s`", r.URL.Path)
+	}})
+	return mux
+}
+
+func identify(policy *auth.Policy, r *http.Request) (*auth.Operator, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return nil, &auth.DeniedError{Unknown: true, Message: "Authorization must be a bearer token"}
+		}
+		return policy.ByToken(strings.TrimPrefix(header, "Bearer "))
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		return policy.ByCert(r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}
+	return nil, &auth.DeniedError{Unknown: true, Message: "Missing api token or client certificate"}
+}
+
+func roles(r *http.Request, op *auth.Operator, path []string) (int, interface{}, error) {
+	switch {
+	case len(path) == 1 && r.Method == http.MethodGet:
+		list, err := client.ListRoles()
+		return http.StatusOK, list, err
+	case len(path) == 1 && r.Method == http.MethodPost:
+		return createRole(r, op)
+	case len(path) == 1:
+		return 0, nil, errMethodNotAllowed
+	}
+
+	name := path[1]
+	existing, err := backend.GetRoleByName(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	if existing == nil {
+		return 0, nil, notFound("Role `%s` does not exist", name)
+	}
+
+	switch {
+	case len(path) == 2 && r.Method == http.MethodGet:
+		detail, err := client.ShowRole(name)
+		return http.StatusOK, detail, err
+	case len(path) == 2 && r.Method == http.MethodPatch:
+		return updateRole(r, op, name)
+	case len(path) == 2 && r.Method == http.MethodDelete:
+		return deleteRole(r, op, name)
+	case len(path) == 3 && path[2] == "attach" && r.Method == http.MethodPost:
+		return attachRole(r, op, name)
+	case len(path) == 3 && path[2] == "detach" && r.Method == http.MethodPost:
+		body := AttachRequest{}
+		if err := decode(r, &body); err != nil {
+			return 0, nil, err
+		}
+		if err := canAttach(op, name, body.Users); err != nil {
+			return 0, nil, err
+		}
+		if err := checkUsers(body.Users); err != nil {
+			return 0, nil, err
+		}
+		return messageResponse(client.DetachRole(op.Name, name, strings.Join(body.Users, ",")))
+	case len(path) == 2 || (len(path) == 3 && (path[2] == "attach" || path[2] == "detach")):
+		return 0, nil, errMethodNotAllowed
+	}
+	return 0, nil, notFound("Unknown path `%s`", r.URL.Path)
+}
+
+func createRole(r *http.Request, op *auth.Operator) (int, interface{}, error) {
+	body := RoleRequest{}
+	if err := decode(r, &body); err != nil {
+		return 0, nil, err
+	}
+	if body.Name == "" {
+		return 0, nil, badRequest("Role name must not empty")
+	}
+	if len(body.Logins) == 0 || len(body.Nodes) == 0 {
+		return 0, nil, badRequest("Role needs logins and nodes")
+	}
+	if err := canUseRole(op, body.Name, body); err != nil {
+		return 0, nil, err
+	}
+
+	existing, err := backend.GetRoleByName(body.Name)
+	if err != nil {
+		return 0, nil, err
+	}
+	if existing != nil {
+		return 0, nil, conflict("Role `%s` already exists", body.Name)
+	}
+
+	newRole := role.Role{Name: body.Name}
+	applyRoleRequest(&newRole, body)
+	_, err = client.CreateRoleSpec(op.Name, newRole)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	detail, err := client.ShowRole(body.Name)
+	return http.StatusCreated, detail, err
+}
+
+// deleteRole takes ?cascade=true or ?reassign=<role> for a role that is
+// still attached, as `tero roles delete` does.
+func deleteRole(r *http.Request, op *auth.Operator, name string) (int, interface{}, error) {
+	query := r.URL.Query()
+	flags := client.DeleteRoleFlags{Cascade: query.Get("cascade") == "true", Reassign: query.Get("reassign")}
+	if err := op.CanManageRole(name); err != nil {
+		return 0, nil, err
+	}
+	if flags.Reassign != "" {
+		if err := op.CanManageRole(flags.Reassign); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	holders, err := client.RoleHolders(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(holders) != 0 && !flags.Cascade && flags.Reassign == "" {
+		return 0, nil, conflict("Role `%s` is still attached to %s, use ?cascade=true or ?reassign=<role>", name, strings.Join(holders, ","))
+	}
+	for _, u := range holders {
+		if err := op.CanManageUser(u); err != nil {
+			return 0, nil, err
+		}
+	}
+	return messageResponse(client.DeleteRoleWithFlags(op.Name, name, flags))
+}
+
+func updateRole(r *http.Request, op *auth.Operator, name string) (int, interface{}, error) {
+	body := RoleRequest{}
+	if err := decode(r, &body); err != nil {
+		return 0, nil, err
+	}
+	if body.Name != "" && body.Name != name {
+		return 0, nil, badRequest("Role cannot be renamed")
+	}
+	if err := canUseRole(op, name, body); err != nil {
+		return 0, nil, err
+	}
+
+	changes := role.Role{}
+	applyRoleRequest(&changes, body)
+	_, err := client.UpdateRoleSpec(op.Name, name, changes)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	detail, err := client.ShowRole(name)
+	return http.StatusOK, detail, err
+}
+
+// canUseRole checks op may manage the role and give it the nodes, logins
+// and rules of body.
+func canUseRole(op *auth.Operator, name string, body RoleRequest) error {
+	if err := op.CanManageRole(name); err != nil {
+		return err
+	}
+	if err := op.CanUseLabels(body.Nodes); err != nil {
+		return err
+	}
+	if err := op.CanUseLogins(body.Logins); err != nil {
+		return err
+	}
+	return op.CanUseRules(append(toRules(body.AllowRules), toRules(body.DenyRules)...))
+}
+
+// applyRoleRequest copies the fields given in body to r.
+func applyRoleRequest(r *role.Role, body RoleRequest) {
+	if body.Logins != nil {
+		r.AllowedLogins = body.Logins
+	}
+	if body.Nodes != nil {
+		r.NodePatterns = body.Nodes
+	}
+	if body.DenyLogins != nil {
+		r.Deny.Logins = body.DenyLogins
+	}
+	if body.DenyNodes != nil {
+		r.Deny.NodeLabels = body.DenyNodes
+	}
+	if body.AllowRules != nil {
+		r.AllowRules = toRules(body.AllowRules)
+	}
+	if body.DenyRules != nil {
+		r.Deny.Rules = toRules(body.DenyRules)
+	}
+	if body.Options.MaxSessionTTL != "" {
+		r.Options.MaxSessionTTL = body.Options.MaxSessionTTL
+	}
+	if body.Options.CertFormat != "" {
+		r.Options.CertFormat = body.Options.CertFormat
+	}
+	if body.Options.ForwardAgent != nil {
+		r.Options.ForwardAgent = body.Options.ForwardAgent
+	}
+	if body.Options.PortForwarding != nil {
+		r.Options.PortForwarding = body.Options.PortForwarding
+	}
+}
+
+func toRules(rules []client.RuleInfo) []role.Rule {
+	result := make([]role.Rule, 0, len(rules))
+	for _, rule := range rules {
+		result = append(result, role.Rule{Resources: rule.Resources, Verbs: rule.Verbs, Where: rule.Where})
+	}
+	return result
+}
+
+func attachRole(r *http.Request, op *auth.Operator, name string) (int, interface{}, error) {
+	body := AttachRequest{}
+	if err := decode(r, &body); err != nil {
+		return 0, nil, err
+	}
+	if err := canAttach(op, name, body.Users); err != nil {
+		return 0, nil, err
+	}
+	if err := checkUsers(body.Users); err != nil {
+		return 0, nil, err
+	}
+
+	var duration time.Duration
+	if body.For != "" {
+		var err error
+		duration, err = time.ParseDuration(body.For)
+		if err != nil {
+			return 0, nil, badRequest("Invalid duration `%s`", body.For)
+		}
+	}
+	expires, err := client.ParseExpiry(duration, body.Until, time.Now())
+	if err != nil {
+		return 0, nil, badRequest("%s", err)
+	}
+
+	rawUsers := strings.Join(body.Users, ",")
+	if expires.IsZero() {
+		return messageResponse(client.AttachRole(op.Name, name, rawUsers))
+	}
+	if !expires.After(time.Now()) {
+		return 0, nil, badRequest("Expiry must be in the future")
+	}
+	return messageResponse(client.AttachRoleUntil(op.Name, name, rawUsers, expires))
+}
+
+func canAttach(op *auth.Operator, roleName string, userNames []string) error {
+	if err := op.CanManageRole(roleName); err != nil {
+		return err
+	}
+	for _, name := range userNames {
+		if err := op.CanManageUser(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func users(r *http.Request, op *auth.Operator, path []string) (int, interface{}, error) {
+	switch {
+	case len(path) == 1 && r.Method == http.MethodGet:
+		list, err := client.ListUser()
+		return http.StatusOK, list, err
+	case len(path) == 1 && r.Method == http.MethodPost:
+		return addUser(r, op)
+	case len(path) == 1:
+		return 0, nil, errMethodNotAllowed
+	}
+
+	name := path[1]
+	action := ""
+	if len(path) == 3 {
+		action = path[2]
+	}
+
+	// the token belongs to a user that did not finish registration yet, it
+	// is as good as the user password so only its managers may see it
+	if action == "token" && r.Method == http.MethodGet {
+		if err := op.CanManageUser(name); err != nil {
+			return 0, nil, err
+		}
+		t, err := backend.GetStorage().GetAddUserTokenByUserName(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		if t == nil {
+			return 0, nil, notFound("User `%s` has no pending token", name)
+		}
+		return http.StatusOK, newTokenInfo(t), nil
+	}
+
+	if err := checkUsers([]string{name}); err != nil {
+		return 0, nil, err
+	}
+	if !(len(path) == 2 && r.Method == http.MethodGet) {
+		if err := op.CanManageUser(name); err != nil {
+			return 0, nil, err
+		}
+	}
+	switch {
+	case len(path) == 2 && r.Method == http.MethodGet:
+		info, err := client.ShowUser(name)
+		return http.StatusOK, info, err
+	case len(path) == 2 && r.Method == http.MethodDelete:
+		return messageResponse(client.DeleteUser(op.Name, name))
+	case action == "lock" && r.Method == http.MethodPost:
+		return messageResponse(client.LockUser(op.Name, name))
+	case action == "unlock" && r.Method == http.MethodPost:
+		return messageResponse(client.UnlockUser(op.Name, name))
+	case action == "reset" && r.Method == http.MethodPost:
+		body := ResetRequest{}
+		if err := decode(r, &body); err != nil {
+			return 0, nil, err
+		}
+		return messageResponse(client.ResetUser(op.Name, name, body.Email))
+	case len(path) == 2 || (len(path) == 3 && containsString([]string{"lock", "unlock", "reset", "token"}, action)):
+		return 0, nil, errMethodNotAllowed
+	}
+	return 0, nil, notFound("Unknown path `%s`", r.URL.Path)
+}
+
+func addUser(r *http.Request, op *auth.Operator) (int, interface{}, error) {
+	body := UserRequest{}
+	if err := decode(r, &body); err != nil {
+		return 0, nil, err
+	}
+	if body.Name == "" || len(body.Roles) == 0 {
+		return 0, nil, badRequest("User needs a name and roles")
+	}
+	if err := op.CanManageUser(body.Name); err != nil {
+		return 0, nil, err
+	}
+	for _, roleName := range body.Roles {
+		if err := op.CanManageRole(roleName); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	existing, err := backend.GetUsersByNames([]string{body.Name})
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(existing) != 0 {
+		return 0, nil, conflict("User `%s` already exist", body.Name)
+	}
+
+	out, err := client.AddUser(op.Name, body.Name, strings.Join(body.Roles, ","), body.Email)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, output.Message{Message: out}, nil
+}
+
+func tokens(r *http.Request, op *auth.Operator, path []string) (int, interface{}, error) {
+	if len(path) != 2 {
+		return 0, nil, notFound("Unknown path `%s`", r.URL.Path)
+	}
+	if r.Method != http.MethodGet {
+		return 0, nil, errMethodNotAllowed
+	}
+
+	t, err := backend.GetStorage().GetAddUserToken(path[1])
+	if err != nil {
+		return 0, nil, err
+	}
+	if t == nil {
+		return 0, nil, notFound("Token does not exist")
+	}
+	info := newTokenInfo(t)
+	if err := op.CanManageUser(info.User); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, info, nil
+}
+
+func newTokenInfo(t *token.AddUserToken) TokenInfo {
+	info := TokenInfo{Token: t.Token, Roles: t.GetStringRoles()}
+	if parsed, err := gabs.ParseJSON(t.JSON); err == nil {
+		info.User, _ = parsed.Path("user.name").Data().(string)
+	}
+	return info
+}
+
+// checkUsers answers 404 when one of users does not exist.
+func checkUsers(names []string) error {
+	if len(names) == 0 {
+		return badRequest("Users must not empty")
+	}
+
+	found, err := backend.GetUsersByNames(names)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		exists := false
+		for _, u := range found {
+			if u.Name == name {
+				exists = true
+			}
+		}
+		if !exists {
+			return notFound("User `%s` does not exist", name)
+		}
+	}
+	return nil
+}
+
+func decode(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return badRequest("Invalid request body: %s", err)
+	}
+	return nil
+}
+
+func messageResponse(out string, err error) (int, interface{}, error) {
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, output.Message{Message: out}, nil
+}
+
+func containsString(slice []string, element string) bool {
+	for _, elem := range slice {
+		if elem == element {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,346 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bentol/tero/audit"
+	"github.com/bentol/tero/auth"
+	"github.com/bentol/tero/backend"
+	"github.com/bentol/tero/backend/memory"
+	"github.com/bentol/tero/client"
+	"github.com/bentol/tero/config"
+	"github.com/bentol/tero/server"
+	"github.com/stretchr/testify/assert"
+)
+
+const adminToken = "admin-secret"
+
+var policy = &auth.Policy{Operators: map[string]*auth.Operator{
+	"admin": {
+		Name:        "admin",
+		TokenHashes: []string{auth.HashToken(adminToken)},
+		Roles:       []string{"*"},
+		Users:       []string{"*"},
+		Labels:      []string{"*:*"},
+		Logins:      []string{"*"},
+		Rules:       []string{"*:*"},
+	},
+	"staging": {
+		Name:        "staging",
+		TokenHashes: []string{auth.HashToken("staging-secret")},
+		Roles:       []string{"dev-*"},
+		Users:       []string{"*"},
+		Labels:      []string{"env:staging"},
+		Logins:      []string{"postgres"},
+		Rules:       []string{"session:list", "session:read"},
+	},
+}}
+
+func setup() *httptest.Server {
+	err := backend.InitBackend("memory", config.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = backend.GetStorage().(*memory.MemoryStorage).LoadFixtures("../testdata")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return httptest.NewServer(server.New(policy))
+}
+
+// call sends body as json and decodes the answer into out, it returns the
+// status code.
+func call(t *testing.T, ts *httptest.Server, method, path string, body interface{}, out interface{}) int {
+	return callAs(t, ts, adminToken, method, path, body, out)
+}
+
+func callAs(t *testing.T, ts *httptest.Server, apiToken, method, path string, body interface{}, out interface{}) int {
+	var reader *bytes.Reader
+	if s, ok := body.(string); ok {
+		reader = bytes.NewReader([]byte(s))
+	} else {
+		raw, _ := json.Marshal(body)
+		reader = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+apiToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestRoles_shouldSupportCRUD(t *testing.T) {
+	ts := setup()
+	defer ts.Close()
+
+	created := client.RoleDetail{}
+	status := call(t, ts, "POST", "/roles", server.RoleRequest{
+		Name:   "dba",
+		Logins: []string{"postgres"},
+		Nodes:  map[string]string{"app": "postgres"},
+	}, &created)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "dba", created.Name)
+	assert.Equal(t, []string{"postgres"}, created.Logins)
+
+	errResp := server.ErrorResponse{}
+	status = call(t, ts, "POST", "/roles", server.RoleRequest{
+		Name:   "dba",
+		Logins: []string{"postgres"},
+		Nodes:  map[string]string{"app": "postgres"},
+	}, &errResp)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Contains(t, errResp.Error, "already exists")
+
+	list := client.RoleList{}
+	status = call(t, ts, "GET", "/roles", nil, &list)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, len(list))
+
+	updated := client.RoleDetail{}
+	status = call(t, ts, "PATCH", "/roles/dba", server.RoleRequest{DenyLogins: []string{"root"}}, &updated)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"postgres"}, updated.Logins)
+	assert.Equal(t, []string{"root"}, updated.DenyLogins)
+
+	status = call(t, ts, "DELETE", "/roles/dba", nil, nil)
+	assert.Equal(t, http.StatusOK, status)
+
+	status = call(t, ts, "GET", "/roles/dba", nil, &errResp)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, "Role `dba` does not exist", errResp.Error)
+}
+
+func TestRoles_shouldNotDeleteAttachedRole(t *testing.T) {
+	ts := setup()
+	defer ts.Close()
+	_, _ = client.NewRole("hulk", "oncall", "ubuntu", "env:production")
+	_, _ = client.AttachRole("hulk", "oncall", "beni")
+
+	errResp := server.ErrorResponse{}
+	status := call(t, ts, "DELETE", "/roles/oncall", nil, &errResp)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Contains(t, errResp.Error, "still attached to beni")
+
+	status = call(t, ts, "DELETE", "/roles/oncall?cascade=true", nil, nil)
+	assert.Equal(t, http.StatusOK, status)
+	info := client.UserInfo{}
+	call(t, ts, "GET", "/users/beni", nil, &info)
+	assert.Equal(t, 1, len(info.Roles))
+}
+
+func TestRoles_shouldRejectInvalidRequests(t *testing.T) {
+	ts := setup()
+	defer ts.Close()
+
+	assert.Equal(t, http.StatusBadRequest, call(t, ts, "POST", "/roles", "{not json", nil))
+	assert.Equal(t, http.StatusBadRequest, call(t, ts, "POST", "/roles", `{"name":"dba","unknown":1}`, nil))
+	assert.Equal(t, http.StatusBadRequest, call(t, ts, "POST", "/roles", server.RoleRequest{Name: "dba"}, nil))
+	assert.Equal(t, http.StatusBadRequest, call(t, ts, "PATCH", "/roles/admin", server.RoleRequest{Name: "root"}, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, call(t, ts, "PUT", "/roles", nil, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, call(t, ts, "GET", "/roles/admin/attach", nil, nil))
+	assert.Equal(t, http.StatusNotFound, call(t, ts, "GET", "/roles/admin/unknown", nil, nil))
+	assert.Equal(t, http.StatusNotFound, call(t, ts, "GET", "/unknown", nil, nil))
+}
+
+func TestAttachAndDetach(t *testing.T) {
+	ts := setup()
+	defer ts.Close()
+	_, _ = client.NewRole("hulk", "oncall", "ubuntu", "env:production")
+
+	status := call(t, ts, "POST", "/roles/oncall/attach", server.AttachRequest{Users: []string{"beni"}, For: "4h"}, nil)
+	assert.Equal(t, http.StatusOK, status)
+
+	info := client.UserInfo{}
+	status = call(t, ts, "GET", "/users/beni", nil, &info)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, len(info.Roles))
+	assert.Equal(t, "oncall", info.Roles[1].Name)
+	assert.NotNil(t, info.Roles[1].Expires)
+
+	status = call(t, ts, "POST", "/roles/oncall/attach", server.AttachRequest{Users: []string{"thanos"}}, nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	status = call(t, ts, "POST", "/roles/oncall/attach", server.AttachRequest{Users: []string{"beni"}, For: "soon"}, nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status = call(t, ts, "POST", "/roles/oncall/detach", server.AttachRequest{Users: []string{"beni"}}, nil)
+	assert.Equal(t, http.StatusOK, status)
+	status = call(t, ts, "GET", "/users/beni", nil, &info)
+	assert.Equal(t, 1, len(info.Roles))
+}
+
+func TestErrors_shouldMapInvalidInputAndMissingRecords(t *testing.T) {
+	ts := setup()
+	defer ts.Close()
+	_, _ = client.NewRole("hulk", "oncall", "ubuntu", "env:production")
+
+	out := server.ErrorResponse{}
+	status := call(t, ts, "POST", "/roles/oncall/attach", server.AttachRequest{Users: []string{"beni"}, Until: "2000-01-02T15:04:05Z"}, &out)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "Expiry must be in the future", out.Error)
+
+	status = call(t, ts, "POST", "/roles", server.RoleRequest{Name: "a\\b", Logins: []string{"ubuntu"}, Nodes: map[string]string{"env": "staging"}}, nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status = call(t, ts, "DELETE", "/roles/admin?reassign=ghost", nil, &out)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, "Role `ghost` does not exist", out.Error)
+}
+
+func TestUsers(t *testing.T) {
+	ts := setup()
+	defer ts.Close()
+
+	list := client.UserList{}
+	status := call(t, ts, "GET", "/users", nil, &list)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, len(list))
+
+	status = call(t, ts, "POST", "/users/beni/lock", nil, nil)
+	assert.Equal(t, http.StatusOK, status)
+	info := client.UserInfo{}
+	call(t, ts, "GET", "/users/beni", nil, &info)
+	assert.True(t, info.Locked)
+
+	status = call(t, ts, "POST", "/users/beni/unlock", nil, nil)
+	assert.Equal(t, http.StatusOK, status)
+	call(t, ts, "GET", "/users/beni", nil, &info)
+	assert.False(t, info.Locked)
+
+	assert.Equal(t, http.StatusConflict, call(t, ts, "POST", "/users", server.UserRequest{Name: "beni", Roles: []string{"admin"}}, nil))
+	assert.Equal(t, http.StatusBadRequest, call(t, ts, "POST", "/users", server.UserRequest{Name: "thor"}, nil))
+	assert.Equal(t, http.StatusNotFound, call(t, ts, "GET", "/users/thanos", nil, nil))
+	assert.Equal(t, http.StatusNotFound, call(t, ts, "GET", "/users/beni/token", nil, nil))
+	assert.Equal(t, http.StatusNotFound, call(t, ts, "GET", "/tokens/unknown", nil, nil))
+}
+
+func TestTokens(t *testing.T) {
+	ts := setup()
+	defer ts.Close()
+	err := backend.GetStorage().InsertItem(
+		"teleport/addusertokens/abc",
+		`{"token":"abc","user":{"name":"thor","roles":["admin"]}}`,
+		3600,
+	)
+	assert.Nil(t, err)
+
+	info := server.TokenInfo{}
+	status := call(t, ts, "GET", "/tokens/abc", nil, &info)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, server.TokenInfo{Token: "abc", User: "thor", Roles: []string{"admin"}}, info)
+
+	info = server.TokenInfo{}
+	status = call(t, ts, "GET", "/users/thor/token", nil, &info)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "abc", info.Token)
+}
+
+func TestAuth_shouldRejectUnknownOperators(t *testing.T) {
+	ts := setup()
+	defer ts.Close()
+
+	errResp := server.ErrorResponse{}
+	assert.Equal(t, http.StatusUnauthorized, callAs(t, ts, "", "GET", "/roles", nil, &errResp))
+	assert.Equal(t, "Missing api token or client certificate", errResp.Error)
+	assert.Equal(t, http.StatusUnauthorized, callAs(t, ts, "guessed", "GET", "/roles", nil, nil))
+}
+
+func TestAuth_shouldLimitOperatorsToTheirScope(t *testing.T) {
+	ts := setup()
+	defer ts.Close()
+
+	assert.Equal(t, http.StatusOK, callAs(t, ts, "staging-secret", "GET", "/roles", nil, nil))
+
+	errResp := server.ErrorResponse{}
+	status := callAs(t, ts, "staging-secret", "POST", "/roles", server.RoleRequest{
+		Name:   "dev-db",
+		Logins: []string{"postgres"},
+		Nodes:  map[string]string{"env": "production"},
+	}, &errResp)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "Operator `staging` is not allowed to manage nodes `env:production`", errResp.Error)
+
+	status = callAs(t, ts, "staging-secret", "POST", "/roles", server.RoleRequest{
+		Name:   "dev-db",
+		Logins: []string{"root"},
+		Nodes:  map[string]string{"env": "staging"},
+	}, &errResp)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "Operator `staging` is not allowed to manage login `root`", errResp.Error)
+
+	status = callAs(t, ts, "staging-secret", "POST", "/roles", server.RoleRequest{
+		Name:       "dev-db",
+		Logins:     []string{"postgres"},
+		Nodes:      map[string]string{"env": "staging"},
+		AllowRules: []client.RuleInfo{{Resources: []string{"role"}, Verbs: []string{"create"}}},
+	}, &errResp)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "Operator `staging` is not allowed to manage rule `role:create`", errResp.Error)
+
+	created := client.RoleDetail{}
+	status = callAs(t, ts, "staging-secret", "POST", "/roles", server.RoleRequest{
+		Name:       "dev-db",
+		Logins:     []string{"postgres"},
+		Nodes:      map[string]string{"env": "staging"},
+		AllowRules: []client.RuleInfo{{Resources: []string{"session"}, Verbs: []string{"list", "read"}}},
+	}, &created)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, 1, len(created.AllowRules))
+
+	status = callAs(t, ts, "staging-secret", "PATCH", "/roles/dev-db", server.RoleRequest{
+		DenyRules: []client.RuleInfo{{Resources: []string{"trusted_cluster"}, Verbs: []string{"delete"}}},
+	}, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status = callAs(t, ts, "staging-secret", "POST", "/roles/admin/attach", server.AttachRequest{Users: []string{"beni"}}, &errResp)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "Operator `staging` is not allowed to manage role `admin`", errResp.Error)
+	assert.Equal(t, http.StatusForbidden, callAs(t, ts, "staging-secret", "DELETE", "/roles/admin", nil, nil))
+}
+
+func TestRoles_shouldRecordChangesInTheAuditLog(t *testing.T) {
+	ts := setup()
+	defer ts.Close()
+	audit.SetSink(&audit.BackendSink{})
+	defer audit.SetSink(nil)
+
+	status := call(t, ts, "POST", "/roles", server.RoleRequest{
+		Name:   "dba",
+		Logins: []string{"postgres"},
+		Nodes:  map[string]string{"app": "postgres"},
+	}, nil)
+	assert.Equal(t, http.StatusCreated, status)
+	status = call(t, ts, "PATCH", "/roles/dba", server.RoleRequest{DenyLogins: []string{"root"}}, nil)
+	assert.Equal(t, http.StatusOK, status)
+
+	events, err := client.ListAuditEvents("", "1h")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "role.create", events[0].Action)
+	assert.Equal(t, "admin", events[0].Operator)
+	assert.Equal(t, map[string]string{"logins": "postgres", "nodes": "app:postgres"}, events[0].Args)
+	assert.Equal(t, "role.update", events[1].Action)
+	assert.Equal(t, map[string]string{"deny_logins": "root"}, events[1].Args)
+	assert.NotEqual(t, events[1].Before.Role, events[1].After.Role)
+}
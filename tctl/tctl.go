@@ -1,31 +1,104 @@
 package tctl
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"os/exec"
 	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bentol/tero/config"
+)
+
+const (
+	DefaultPath    = "/usr/local/bin/tctl"
+	DefaultTimeout = 30 * time.Second
 )
 
-func CmdAddUser(name, allowedLogins string) (stdout, token string, err error) {
-	out, err := exec.Command("/usr/local/bin/tctl", "users", "add", name, "allowedLogins").CombinedOutput()
+var tokenPattern = regexp.MustCompile(`/web/newuser/(\w{28,64})`)
+
+// Options says how tctl is run, the zero value runs DefaultPath with the
+// tctl defaults and DefaultTimeout.
+type Options struct {
+	Path       string
+	Config     string
+	AuthServer string
+	Identity   string
+	Timeout    time.Duration
+}
+
+// NewOptions reads the teleport config, Timeout is DefaultTimeout when
+// the config has none.
+func NewOptions(conf config.TeleportConfig) (Options, error) {
+	opts := Options{Path: conf.TctlPath, Config: conf.TctlConfig, AuthServer: conf.AuthServer, Identity: conf.Identity, Timeout: DefaultTimeout}
+	if conf.Timeout != "" {
+		timeout, err := time.ParseDuration(conf.Timeout)
+		if err != nil || timeout <= 0 {
+			return opts, fmt.Errorf("Invalid teleport timeout `%s`, use a duration. Ex: 1m", conf.Timeout)
+		}
+		opts.Timeout = timeout
+	}
+	return opts, nil
+}
+
+// CmdAddUser runs `tctl users add` and returns what it printed with the
+// signup token taken from it. The user gets allowedLogins when given.
+func CmdAddUser(opts Options, name, allowedLogins string) (stdout, token string, err error) {
+	args := []string{"users", "add", name}
+	if allowedLogins != "" {
+		args = append(args, allowedLogins)
+	}
+	out, err := run(opts, args...)
 	if err != nil {
-		fmt.Printf("err = %+v\n", err)
 		return "", "", err
 	}
 
-	r, _ := regexp.Compile("/web/newuser/(\\w{28,35})")
+	m := tokenPattern.FindStringSubmatch(out)
+	if m == nil {
+		return "", "", fmt.Errorf("tctl users add printed no signup token: %s", strings.TrimSpace(out))
+	}
+	return out, m[1], nil
+}
 
-	token = string(r.FindAllSubmatch(out, 2)[0][1])
-	stdout = string(out)
-	return stdout, token, err
+func CmdDeleteUser(opts Options, userName string) (string, error) {
+	return run(opts, "users", "rm", userName)
 }
 
-func CmdDeleteUser(userName string) (string, error) {
-	out, err := exec.Command("/usr/local/bin/tctl", "users", "rm", userName).CombinedOutput()
-	if err != nil {
-		return "", errors.New(string(out))
+func run(opts Options, args ...string) (string, error) {
+	path := opts.Path
+	if path == "" {
+		path = DefaultPath
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	global := make([]string, 0)
+	if opts.Config != "" {
+		global = append(global, "--config", opts.Config)
+	}
+	if opts.AuthServer != "" {
+		global = append(global, "--auth-server", opts.AuthServer)
+	}
+	if opts.Identity != "" {
+		global = append(global, "--identity", opts.Identity)
 	}
 
-	return string(out), err
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, append(global, args...)...).CombinedOutput()
+	command := "tctl " + strings.Join(args[:2], " ")
+	if ctx.Err() == context.DeadlineExceeded {
+		server := "the auth server"
+		if opts.AuthServer != "" {
+			server += " " + opts.AuthServer
+		}
+		return "", fmt.Errorf("%s timed out after %s, check %s is reachable", command, timeout, server)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %s: %s", command, err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
 }
@@ -1,6 +1,8 @@
 package token
 
 import (
+	"time"
+
 	"github.com/Jeffail/gabs"
 )
 
@@ -10,15 +12,16 @@ type AddUserToken struct {
 }
 
 func (t *AddUserToken) GetStringRoles() []string {
-	json, _ := gabs.ParseJSON(t.JSON)
+	json, err := gabs.ParseJSON(t.JSON)
 	roles := make([]string, 0)
-	rawRoles := json.Path("user.roles").Data()
-	if rawRoles == nil {
-		return make([]string, 0)
+	if err != nil {
+		return roles
 	}
-
-	for _, raw := range rawRoles.([]interface{}) {
-		roles = append(roles, raw.(string))
+	rawRoles, _ := json.Path("user.roles").Data().([]interface{})
+	for _, raw := range rawRoles {
+		if r, ok := raw.(string); ok {
+			roles = append(roles, r)
+		}
 	}
 	return roles
 }
@@ -28,3 +31,25 @@ func (t *AddUserToken) SetRoles(roles []string) {
 	json.SetP(roles, "user.roles")
 	t.JSON = json.Bytes()
 }
+
+// UserName is the user the token signs up.
+func (t *AddUserToken) UserName() string {
+	json, err := gabs.ParseJSON(t.JSON)
+	if err != nil {
+		return ""
+	}
+	name, _ := json.Path("user.name").Data().(string)
+	return name
+}
+
+// Expires is when teleport stops accepting the token, zero when the
+// record has no expiry.
+func (t *AddUserToken) Expires() time.Time {
+	json, err := gabs.ParseJSON(t.JSON)
+	if err != nil {
+		return time.Time{}
+	}
+	raw, _ := json.Path("expires").Data().(string)
+	expires, _ := time.Parse(time.RFC3339Nano, raw)
+	return expires
+}
@@ -1,6 +1,10 @@
 package user
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
+
 	"github.com/Jeffail/gabs"
 	"github.com/bentol/tero/role"
 )
@@ -13,6 +17,10 @@ type User struct {
 	Name     string
 	Roles    []role.Role
 	IsLocked bool
+	Traits   map[string][]string
+	// Raw is the record this user was read from, GetJSON only overwrites
+	// the fields above so everything else teleport stored is kept.
+	Raw []byte
 }
 
 func (u *User) RoleNames() []string {
@@ -23,19 +31,87 @@ func (u *User) RoleNames() []string {
 	return names
 }
 
+// AllowedLogins returns the logins of every role of the user once, with
+// the logins taken from the user traits filled in.
 func (u *User) AllowedLogins() []string {
 	logins := make([]string, 0)
+	seen := make(map[string]bool)
 	for _, r := range u.Roles {
-		logins = append(logins, r.AllowedLogins...)
+		for _, login := range role.ExpandLogins(r.AllowedLogins, u.Traits) {
+			if !seen[login] {
+				seen[login] = true
+				logins = append(logins, login)
+			}
+		}
 	}
 	return logins
 }
 
 func (u *User) GetJSON() string {
-	jsonTemplate, _ := gabs.ParseJSON([]byte(UserJsonTemplate))
+	jsonTemplate, err := gabs.ParseJSON(u.Raw)
+	if len(u.Raw) == 0 || err != nil {
+		jsonTemplate, _ = gabs.ParseJSON([]byte(UserJsonTemplate))
+		// the traits of the template are only an example
+		traits := u.Traits
+		if traits == nil {
+			traits = map[string][]string{}
+		}
+		jsonTemplate.SetP(traits, "spec.traits")
+	} else if orig, _ := FromJSON(u.Raw, nil); u.Traits != nil && !reflect.DeepEqual(u.Traits, orig.Traits) {
+		// only write traits that changed, FromJSON cannot represent every
+		// value teleport accepts there
+		jsonTemplate.SetP(u.Traits, "spec.traits")
+	}
+
 	jsonTemplate.SetP(u.Name, "metadata.name")
 	jsonTemplate.SetP(u.RoleNames(), "spec.roles")
-	jsonTemplate.SetP([]string{"ubuntu"}, "spec.traits.logins")
 	jsonTemplate.SetP(u.IsLocked, "spec.status.is_locked")
 	return jsonTemplate.String()
 }
+
+func FromJSON(rawJSON []byte, mappedRoles map[string]role.Role) (User, error) {
+	rawUser, err := gabs.ParseJSON(rawJSON)
+	if err != nil {
+		return User{}, err
+	}
+
+	name, ok := rawUser.Path("metadata.name").Data().(string)
+	if !ok {
+		return User{}, errors.New("User record has no metadata.name")
+	}
+
+	roles := make([]role.Role, 0)
+	if rawRoles, ok := rawUser.Path("spec.roles").Data().([]interface{}); ok {
+		for _, r := range rawRoles {
+			roleName, _ := r.(string)
+			mappedRole, ok := mappedRoles[roleName]
+			if !ok {
+				// keep the name so writing the user back does not drop it
+				mappedRole = role.Role{Name: roleName}
+			}
+			roles = append(roles, mappedRole)
+		}
+	}
+
+	isLocked, _ := rawUser.Path("spec.status.is_locked").Data().(bool)
+
+	traits := make(map[string][]string)
+	if rawTraits, ok := rawUser.Path("spec.traits").Data().(map[string]interface{}); ok {
+		for k, v := range rawTraits {
+			values := make([]string, 0)
+			rawValues, _ := v.([]interface{})
+			for _, value := range rawValues {
+				values = append(values, fmt.Sprint(value))
+			}
+			traits[k] = values
+		}
+	}
+
+	return User{
+		Name:     name,
+		Roles:    roles,
+		IsLocked: isLocked,
+		Traits:   traits,
+		Raw:      rawJSON,
+	}, nil
+}
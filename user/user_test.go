@@ -0,0 +1,70 @@
+package user_test
+
+import (
+	"testing"
+
+	"github.com/Jeffail/gabs"
+	"github.com/bentol/tero/role"
+	"github.com/bentol/tero/user"
+	"github.com/stretchr/testify/assert"
+)
+
+const teleportUser = `{"kind":"user","version":"v2","metadata":{"name":"beni"},"spec":{"roles":["admin","deleted_role"],"traits":{"logins":["beni","root"],"kubernetes_groups":["dev"]},"oidc_identities":[{"connector_id":"google","username":"beni@example.com"}],"status":{"is_locked":false,"locked_time":"0001-01-01T00:00:00Z","lock_expires":"0001-01-01T00:00:00Z"},"expires":"2030-01-01T00:00:00Z","created_by":{"time":"2018-01-01T00:00:00Z","user":{"name":"admin"}}}}`
+
+func TestGetJSON_shouldKeepFieldsTeroDoesNotManage(t *testing.T) {
+	u, err := user.FromJSON([]byte(teleportUser), map[string]role.Role{"admin": {Name: "admin"}})
+	assert.Nil(t, err)
+
+	u.Roles = append(u.Roles, role.Role{Name: "dba"})
+	u.IsLocked = true
+
+	json, _ := gabs.ParseJSON([]byte(u.GetJSON()))
+	assert.Equal(t, []interface{}{"admin", "deleted_role", "dba"}, json.Path("spec.roles").Data())
+	assert.Equal(t, true, json.Path("spec.status.is_locked").Data())
+	assert.Equal(t, []interface{}{"beni", "root"}, json.Path("spec.traits.logins").Data())
+	assert.Equal(t, []interface{}{"dev"}, json.Path("spec.traits.kubernetes_groups").Data())
+	assert.Equal(t, "beni@example.com", json.Path("spec.oidc_identities").Index(0).Path("username").Data())
+	assert.Equal(t, "2030-01-01T00:00:00Z", json.Path("spec.expires").Data())
+	assert.Equal(t, "admin", json.Path("spec.created_by.user.name").Data())
+}
+
+func TestGetJSON_shouldOnlyWriteChangedTraits(t *testing.T) {
+	raw := `{"kind":"user","metadata":{"name":"thor"},"spec":{"roles":["admin"]}}`
+	u, err := user.FromJSON([]byte(raw), nil)
+	assert.Nil(t, err)
+	u.IsLocked = true
+	json, _ := gabs.ParseJSON([]byte(u.GetJSON()))
+	assert.False(t, json.Exists("spec", "traits"))
+
+	raw = `{"kind":"user","metadata":{"name":"thor"},"spec":{"roles":["admin"],"traits":{"logins":["thor"],"team":"sre"}}}`
+	u, err = user.FromJSON([]byte(raw), nil)
+	assert.Nil(t, err)
+	json, _ = gabs.ParseJSON([]byte(u.GetJSON()))
+	assert.Equal(t, "sre", json.Path("spec.traits.team").Data())
+
+	u.Traits["logins"] = append(u.Traits["logins"], "root")
+	json, _ = gabs.ParseJSON([]byte(u.GetJSON()))
+	assert.Equal(t, []interface{}{"thor", "root"}, json.Path("spec.traits.logins").Data())
+}
+
+func TestGetJSON_shouldUseTemplateWithoutRawRecord(t *testing.T) {
+	u := user.User{Name: "budi", Roles: []role.Role{{Name: "dev"}}}
+
+	json, _ := gabs.ParseJSON([]byte(u.GetJSON()))
+	assert.Equal(t, "budi", json.Path("metadata.name").Data())
+	assert.Equal(t, []interface{}{"dev"}, json.Path("spec.roles").Data())
+	assert.Equal(t, map[string]interface{}{}, json.Path("spec.traits").Data())
+}
+
+func TestAllowedLogins_shouldListEveryLoginOnce(t *testing.T) {
+	u := user.User{
+		Name: "beni",
+		Roles: []role.Role{
+			{Name: "dba", AllowedLogins: []string{"postgres", "{{internal.logins}}"}},
+			{Name: "dev", AllowedLogins: []string{"ubuntu", "postgres"}},
+		},
+		Traits: map[string][]string{"logins": {"ubuntu", "beni"}},
+	}
+
+	assert.Equal(t, []string{"postgres", "ubuntu", "beni"}, u.AllowedLogins())
+}